@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// overrideHostPattern matches the host names accepted in an address
+// override.
+var overrideHostPattern = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9.-]*[a-zA-Z0-9])?$`)
+
+var addressOverrideErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_address_override_errors_total",
+	Help: "Number of instances whose address_override_metadata_key value was invalid and ignored, by job name",
+}, []string{"job"})
+
+func init() {
+	prometheus.MustRegister(addressOverrideErrors)
+}
+
+// addressOverride returns the address set in the address_override_metadata_key
+// metadata of instance, split into its host and port, which is 0 if the
+// value has no port. Invalid values are logged and counted, and ignored.
+func addressOverride(instance *compute.Instance, config SearchConfig) (string, int, bool) {
+	if config.AddressOverride == "" {
+		return "", 0, false
+	}
+	value, ok := instanceMetadata(instance)[config.AddressOverride]
+	if !ok {
+		return "", 0, false
+	}
+
+	host, port, ok := parseAddressOverride(strings.TrimSpace(value))
+	if !ok {
+		log.Warningf("Ignoring %v metadata %q of %v for %v, it is not a host or host:port", config.AddressOverride, value, instance.Name, config.Job)
+		addressOverrideErrors.WithLabelValues(config.Job).Inc()
+		return "", 0, false
+	}
+	return host, port, true
+}
+
+// parseAddressOverride splits value, a host or host:port, into its host and
+// port. IPv6 hosts are returned in brackets, ready for a port to be added.
+func parseAddressOverride(value string) (string, int, bool) {
+	port := 0
+	host, portStr, err := net.SplitHostPort(value)
+	if err == nil {
+		port, err = strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			return "", 0, false
+		}
+	} else {
+		// Without a port an IPv6 address may or may not be bracketed.
+		host = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			return "[" + ip.String() + "]", port, true
+		}
+		return ip.String(), port, true
+	}
+	if !overrideHostPattern.MatchString(host) {
+		return "", 0, false
+	}
+	return host, port, true
+}
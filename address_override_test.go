@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestParseAddressOverride(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		value string
+		host  string
+		port  int
+		ok    bool
+	}{
+		{value: "nat.example.com", host: "nat.example.com", ok: true},
+		{value: "nat.example.com:9100", host: "nat.example.com", port: 9100, ok: true},
+		{value: "203.0.113.7", host: "203.0.113.7", ok: true},
+		{value: "203.0.113.7:8443", host: "203.0.113.7", port: 8443, ok: true},
+		{value: "2001:db8::1", host: "[2001:db8::1]", ok: true},
+		{value: "[2001:db8::1]", host: "[2001:db8::1]", ok: true},
+		{value: "[2001:db8::1]:9100", host: "[2001:db8::1]", port: 9100, ok: true},
+		{value: ""},
+		{value: "nat.example.com:"},
+		{value: "nat.example.com:http"},
+		{value: "nat.example.com:70000"},
+		{value: "http://nat.example.com/metrics"},
+		{value: "two words"},
+		{value: "-nat.example.com"},
+		{value: "🚀.example.com"},
+	}
+	for _, c := range cases {
+		host, port, ok := parseAddressOverride(c.value)
+		if host != c.host || port != c.port || ok != c.ok {
+			t.Fatalf("Unexpected result for %q: %q, %v, %v", c.value, host, port, ok)
+		}
+	}
+}
+
+func TestInstanceToTargetsAddressOverride(t *testing.T) {
+	t.Parallel()
+
+	withOverride := func(value string) *compute.Instance {
+		instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+		instance.Metadata = testMetadata("prometheus-address", value)
+		return instance
+	}
+	config := SearchConfig{Job: "address-override", Project: "test-project", Ports: []int{80, 9100}, AddressOverride: "prometheus-address"}
+
+	cases := []struct {
+		instance *compute.Instance
+		expected []string
+	}{
+		{ // Host only, the configured ports are appended
+			instance: withOverride("nat.example.com"),
+			expected: []string{"nat.example.com:80", "nat.example.com:9100"},
+		},
+		{ // host:port replaces every target
+			instance: withOverride("nat.example.com:8443"),
+			expected: []string{"nat.example.com:8443"},
+		},
+		{ // Garbage falls back to the instance's address
+			instance: withOverride("not a host!"),
+			expected: []string{"10.0.0.1:80", "10.0.0.1:9100"},
+		},
+		{ // Instances without the key are unaffected
+			instance: testInstance("web-2", "us-central1-b", "10.0.0.2", "web"),
+			expected: []string{"10.0.0.2:80", "10.0.0.2:9100"},
+		},
+	}
+
+	errs := counterValue(addressOverrideErrors.WithLabelValues(config.Job))
+	for i, c := range cases {
+		res, err := InstanceToTargets(c.instance, config)
+		if err != nil {
+			t.Fatalf("Unexpected error in case %v\nError: %v", i, err)
+		}
+		if got := targetAddresses(res); !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("Discrepancy in result of case %v\nResult: %v", i, prettyPrint(res))
+		}
+	}
+	if got := counterValue(addressOverrideErrors.WithLabelValues(config.Job)) - errs; got != 1 {
+		t.Fatalf("Expected 1 invalid override, got %v", got)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// modeAnnotations is the SearchConfig.Mode in which instances opt in to
+// discovery through their metadata, rather than being selected by the
+// config.
+const modeAnnotations = "annotations"
+
+// Metadata keys read in annotations mode.
+const (
+	annotationScrapeKey = "prometheus-scrape"
+	annotationPortKey   = "prometheus-port"
+	annotationJobKey    = "prometheus-job"
+)
+
+var annotationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_annotation_errors_total",
+	Help: "Number of instances not discovered in annotations mode as their prometheus-scrape metadata was not a boolean, by job name",
+}, []string{"job"})
+
+func init() {
+	prometheus.MustRegister(annotationErrors)
+}
+
+// parseAnnotationBool parses a boolean annotation, accepting true, 1 and yes,
+// or false, 0 and no, in any case.
+func parseAnnotationBool(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "1", "yes":
+		return true, true
+	case "false", "0", "no":
+		return false, true
+	}
+	return false, false
+}
+
+// annotationOptIn reports whether instance opted in to discovery with its
+// prometheus-scrape metadata. Values which are not booleans are logged and
+// counted, and do not opt in.
+func annotationOptIn(instance *compute.Instance, config SearchConfig) bool {
+	value, ok := instanceMetadata(instance)[annotationScrapeKey]
+	if !ok {
+		return false
+	}
+	scrape, ok := parseAnnotationBool(value)
+	if !ok {
+		job := reportedJob(instance, config)
+		log.Warningf("Not discovering %v for %v, its %v metadata %q is not a boolean", instance.Name, job, annotationScrapeKey, value)
+		annotationErrors.WithLabelValues(job).Inc()
+	}
+	return scrape
+}
+
+// annotationJob returns the job set in the prometheus-job metadata of
+// instance, or "" if there is none.
+func annotationJob(instance *compute.Instance) string {
+	return strings.TrimSpace(instanceMetadata(instance)[annotationJobKey])
+}
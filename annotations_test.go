@@ -0,0 +1,100 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestParseAnnotationBool(t *testing.T) {
+	t.Parallel()
+
+	for value, expected := range map[string][2]bool{
+		"true":  {true, true},
+		"TRUE":  {true, true},
+		"Yes":   {true, true},
+		"1":     {true, true},
+		" yes ": {true, true},
+		"false": {false, true},
+		"No":    {false, true},
+		"0":     {false, true},
+		"":      {false, false},
+		"y":     {false, false},
+		"on":    {false, false},
+		"2":     {false, false},
+	} {
+		if b, ok := parseAnnotationBool(value); b != expected[0] || ok != expected[1] {
+			t.Fatalf("Unexpected result for %q: %v, %v", value, b, ok)
+		}
+	}
+}
+
+func TestDiscoverTargetsAnnotations(t *testing.T) {
+	annotated := func(name, ip string, kv ...string) *compute.Instance {
+		instance := testInstance(name, "us-central1-b", ip)
+		instance.Metadata = testMetadata(kv...)
+		return instance
+	}
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			annotated("defaults-1", "10.0.0.1", "prometheus-scrape", "true"),
+			annotated("custom-1", "10.0.0.2", "prometheus-scrape", "Yes", "prometheus-port", "9200", "prometheus-job", "custom"),
+			annotated("ports-1", "10.0.0.3", "prometheus-scrape", "1", "prometheus-port", "9300,9301"),
+			annotated("opted-out-1", "10.0.0.4", "prometheus-scrape", "false", "prometheus-port", "9400"),
+			annotated("unannotated-1", "10.0.0.5"),
+			annotated("job-only-1", "10.0.0.6", "prometheus-job", "sneaky"),
+			annotated("malformed-scrape-1", "10.0.0.7", "prometheus-scrape", "sure"),
+			annotated("malformed-port-1", "10.0.0.8", "prometheus-scrape", "true", "prometheus-port", "http"),
+			annotated("blank-job-1", "10.0.0.9", "prometheus-scrape", "true", "prometheus-job", " "),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	config := SearchConfig{Job: "annotated", Mode: modeAnnotations, Project: "test-project", Ports: []int{9100}}
+	if err := ValidateConfig(config); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	malformed := counterValue(annotationErrors.WithLabelValues("annotated"))
+	invalidPorts := counterValue(instancesSkipped.WithLabelValues("annotated", "invalid_ports"))
+	res, err := DiscoverTargets(context.Background(), []SearchConfig{config})
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := map[string][]string{
+		"annotated": {"10.0.0.1:9100", "10.0.0.3:9300", "10.0.0.3:9301", "10.0.0.9:9100"},
+		"custom":    {"10.0.0.2:9200"},
+	}
+	if got := targetsByJob(res); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+	if got := counterValue(annotationErrors.WithLabelValues("annotated")) - malformed; got != 1 {
+		t.Fatalf("Expected 1 malformed prometheus-scrape value, got %v", got)
+	}
+	if got := counterValue(instancesSkipped.WithLabelValues("annotated", "invalid_ports")) - invalidPorts; got != 1 {
+		t.Fatalf("Expected 1 malformed prometheus-port value, got %v", got)
+	}
+}
+
+func TestValidateConfigAnnotations(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		config   SearchConfig
+		expected string
+	}{
+		{config: SearchConfig{Job: "annotated", Mode: "labels", Project: "test-project", Ports: []int{80}}, expected: `Unknown mode "labels"`},
+		{config: SearchConfig{Job: "annotated", Mode: modeAnnotations, Ports: []int{80}}, expected: "project"},
+		{config: SearchConfig{Job: "annotated", Mode: modeAnnotations, Project: "test-project", Ports: []int{80}, MinTargets: 1}, expected: "mode annotations cannot be combined with min_targets"},
+		{config: SearchConfig{Job: "annotated", Mode: modeAnnotations, Project: "test-project", Ports: []int{80}, MaxLabelValueLen: new(int)}, expected: "mode annotations cannot be combined with max_label_value_length"},
+	}
+	for i, c := range cases {
+		if err := ValidateConfig(c.config); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("Expected %q in case %v\nError: %v", c.expected, i, err)
+		}
+	}
+}
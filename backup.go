@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// backupFile returns the path targetFile is backed up to while it is
+// replaced.
+func backupFile(targetFile string) string {
+	return targetFile + ".bak"
+}
+
+// backupTargets copies targetFile to its backup, reporting whether there
+// was a file to back up.
+func backupTargets(targetFile string) (bool, error) {
+	d, err := ioutil.ReadFile(targetFile)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "Failed to read %v to back it up", targetFile)
+	}
+	if err := writeFileAtomic(backupFile(targetFile), d); err != nil {
+		return false, errors.Wrapf(err, "Failed to back up %v", targetFile)
+	}
+	return true, nil
+}
+
+// writeWithBackup replaces targetFile with d, first backing it up. If the
+// write fails the backup is restored. The backup is removed after a
+// successful write unless keep is set.
+func writeWithBackup(targetFile string, d []byte, keep bool) error {
+	backedUp, err := backupTargets(targetFile)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(targetFile, d); err != nil {
+		if !backedUp {
+			return err
+		}
+		if rerr := os.Rename(backupFile(targetFile), targetFile); rerr != nil {
+			return errors.Wrapf(err, "Failed to restore %v from %v (%v)", targetFile, backupFile(targetFile), rerr)
+		}
+		return errors.Wrapf(err, "Restored %v from %v after failing to replace it", targetFile, backupFile(targetFile))
+	}
+
+	if backedUp && !keep {
+		if err := os.Remove(backupFile(targetFile)); err != nil && !os.IsNotExist(err) {
+			log.Warningf("Failed to remove backup %v: %v", backupFile(targetFile), err)
+		}
+	}
+	return nil
+}
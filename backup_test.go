@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestWriteWithBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "targets.yaml")
+	tmp := filepath.Join(dir, fmt.Sprintf(".targets.yaml.%v.tmp", os.Getpid()))
+	origCreate, origRename := createOutputFile, renameOutputFile
+	restoreHooks := func() {
+		createOutputFile, renameOutputFile = origCreate, origRename
+	}
+	defer restoreHooks()
+
+	stages := map[string]func(){
+		"create": func() {
+			createOutputFile = func(name string) (*os.File, error) {
+				if name == tmp {
+					return nil, errors.New("disk quota exceeded")
+				}
+				return origCreate(name)
+			}
+		},
+		"write": func() {
+			// A read only file fails to be written to.
+			createOutputFile = func(name string) (*os.File, error) {
+				f, err := origCreate(name)
+				if err != nil || name != tmp {
+					return f, err
+				}
+				f.Close()
+				return os.Open(name)
+			}
+		},
+		"rename": func() {
+			renameOutputFile = func(from, to string) error {
+				if to == out {
+					return errors.New("read-only file system")
+				}
+				return origRename(from, to)
+			}
+		},
+	}
+
+	for stage, fail := range stages {
+		if err := ioutil.WriteFile(out, []byte("old\n"), 0644); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+
+		fail()
+		err := writeWithBackup(out, []byte("new\n"), false)
+		restoreHooks()
+
+		if err == nil || !strings.Contains(err.Error(), "Restored") {
+			t.Fatalf("Expected an error saying the backup was restored after failing to %v\nError: %v", stage, err)
+		}
+		if d, _ := ioutil.ReadFile(out); string(d) != "old\n" {
+			t.Fatalf("Expected the old targets after failing to %v, got %q", stage, d)
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, ".*"))
+		if len(files) != 0 {
+			t.Fatalf("Expected no temporary files after failing to %v, got %v", stage, files)
+		}
+	}
+
+	if err := writeWithBackup(out, []byte("new\n"), false); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if d, _ := ioutil.ReadFile(out); string(d) != "new\n" {
+		t.Fatalf("Expected the new targets, got %q", d)
+	}
+	if _, err := os.Stat(backupFile(out)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the backup to be removed\nError: %v", err)
+	}
+
+	if err := writeWithBackup(out, []byte("newer\n"), true); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if d, _ := ioutil.ReadFile(backupFile(out)); string(d) != "new\n" {
+		t.Fatalf("Expected the backup to be kept, got %q", d)
+	}
+
+	// With nothing to back up, a failure leaves no file.
+	fresh := filepath.Join(dir, "fresh.yaml")
+	renameOutputFile = func(from, to string) error { return errors.New("read-only file system") }
+	if err := writeWithBackup(fresh, []byte("new\n"), false); err == nil || strings.Contains(err.Error(), "Restored") {
+		t.Fatalf("Expected an error without a restore\nError: %v", err)
+	}
+	if _, err := os.Stat(fresh); !os.IsNotExist(err) {
+		t.Fatalf("Expected no file\nError: %v", err)
+	}
+}
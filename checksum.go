@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var targetFileInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "gcesd_target_file_info",
+	Help: "Always 1, labelled with the SHA-256 digest of the contents last written to each output file",
+}, []string{"file", "sha256"})
+
+func init() {
+	prometheus.MustRegister(targetFileInfo)
+}
+
+// targetDigests holds the digest targetFileInfo reports for each file, so
+// the series for the previous digest can be removed.
+var targetDigests = struct {
+	sync.Mutex
+	byFile map[string]string
+}{byFile: map[string]string{}}
+
+// checksumFile returns the path of the checksum written next to targetFile.
+func checksumFile(targetFile string) string {
+	return targetFile + ".sha256"
+}
+
+// writeChecksum writes the SHA-256 digest of d, the contents just written to
+// targetFile, to its checksum file in the format of sha256sum. The checksum
+// file is only replaced if the digest changed. If it cannot be written it is
+// removed rather than left describing different contents.
+func writeChecksum(targetFile string, d []byte) error {
+	sum := sha256.Sum256(d)
+	digest := hex.EncodeToString(sum[:])
+	line := []byte(fmt.Sprintf("%s  %s\n", digest, filepath.Base(targetFile)))
+
+	checksum := checksumFile(targetFile)
+	if old, err := ioutil.ReadFile(checksum); err != nil || string(old) != string(line) {
+		if err := writeFileAtomic(checksum, line); err != nil {
+			if rerr := os.Remove(checksum); rerr != nil && !os.IsNotExist(rerr) {
+				log.Errorf("Failed to remove stale checksum %v: %v", checksum, rerr)
+			}
+			return err
+		}
+	}
+
+	setTargetDigest(targetFile, digest)
+	return nil
+}
+
+// setTargetDigest reports digest as the contents of targetFile in
+// targetFileInfo.
+func setTargetDigest(targetFile, digest string) {
+	targetDigests.Lock()
+	defer targetDigests.Unlock()
+
+	if old, ok := targetDigests.byFile[targetFile]; ok && old != digest {
+		targetFileInfo.DeleteLabelValues(targetFile, old)
+	}
+	targetDigests.byFile[targetFile] = digest
+	targetFileInfo.WithLabelValues(targetFile, digest).Set(1)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestWriteTargetsChecksum(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "targets.yaml")
+	checkDigest := func() string {
+		d, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		sum := sha256.Sum256(d)
+		digest := hex.EncodeToString(sum[:])
+
+		line, err := ioutil.ReadFile(checksumFile(out))
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if string(line) != digest+"  targets.yaml\n" {
+			t.Fatalf("Expected checksum %v, got %s", digest, line)
+		}
+		if v := gaugeValue(targetFileInfo.WithLabelValues(out, digest)); v != 1 {
+			t.Fatalf("Expected the digest to be reported, got %v", v)
+		}
+		return digest
+	}
+
+	targets := []DiscoveryTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}}
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	first := checkDigest()
+
+	targets = append(targets, DiscoveryTarget{Targets: []string{"10.0.0.2:80"}, Labels: map[string]string{"job": "web"}})
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	second := checkDigest()
+	if first == second {
+		t.Fatalf("Expected the digest to change with the targets")
+	}
+	if targetFileInfo.DeleteLabelValues(out, first) {
+		t.Fatalf("Expected the previous digest not to be reported")
+	}
+
+	// A failed write leaves the old checksum, which still describes the
+	// file in place. A directory in the way of the temporary file stops it
+	// being created.
+	tmp := filepath.Join(dir, fmt.Sprintf(".targets.yaml.%v.tmp", os.Getpid()))
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := WriteTargets(context.Background(), targets[:1], out, syncInfo{}); err == nil || !strings.Contains(err.Error(), "output file") {
+		t.Fatalf("Expected an error writing the targets\nError: %v", err)
+	}
+	if checkDigest() != second {
+		t.Fatalf("Expected the checksum to be kept")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// gzipExt is the extension of output files which are written gzipped.
+const gzipExt = ".gz"
+
+// isCompressedOutput reports whether targets written to file are gzipped.
+func isCompressedOutput(file string) bool {
+	return strings.HasSuffix(strings.ToLower(file), gzipExt)
+}
+
+// compressedFile returns the path of the gzipped copy of targetFile written
+// with -output.compress.
+func compressedFile(targetFile string) string {
+	return targetFile + gzipExt
+}
+
+// gzipTargets compresses d. The header carries no name or modification
+// time, so identical targets always compress to identical files.
+func gzipTargets(d []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create gzip writer")
+	}
+	if _, err := zw.Write(d); err != nil {
+		return nil, errors.Wrap(err, "Failed to compress targets")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "Failed to compress targets")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+func gunzipFile(t *testing.T, file string) []byte {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%v is not gzipped\nError: %v", file, err)
+	}
+	d, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if !zr.ModTime.IsZero() || zr.Name != "" {
+		t.Fatalf("Expected an empty gzip header, got %v and %q", zr.ModTime, zr.Name)
+	}
+	return d
+}
+
+func TestWriteTargetsGzip(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	targets := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}},
+		{Targets: []string{"10.0.0.2:9100"}, Labels: map[string]string{"job": "node"}},
+	}
+
+	out := filepath.Join(dir, "targets.yaml.gz")
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	first, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	var written []DiscoveryTarget
+	if err := yaml.Unmarshal(gunzipFile(t, out), &written); err != nil {
+		t.Fatalf("Expected gzipped YAML\nError: %v", err)
+	}
+	if targetsDifferent(written, targets) {
+		t.Fatalf("Unexpected targets %v", prettyPrint(written))
+	}
+
+	// Rewriting the same targets produces the same file.
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	second, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("Expected identical targets to be gzipped identically")
+	}
+}
+
+func TestWriteTargetsCompressedCopy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*compressOutput = true
+	defer func() { *compressOutput = false }()
+
+	targets := []DiscoveryTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}}
+	out := filepath.Join(dir, "targets.json")
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	d, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if gz := gunzipFile(t, compressedFile(out)); !bytes.Equal(gz, d) {
+		t.Fatalf("Expected the gzipped copy to hold %s, got %s", d, gz)
+	}
+
+	if err := removeTargets(out); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if _, err := os.Stat(compressedFile(out)); !os.IsNotExist(err) {
+		t.Fatalf("Expected the gzipped copy to be removed, got %v", err)
+	}
+}
+
+func TestResolveOutputFormatGzip(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"targets.json.gz": outputFormatJSON,
+		"targets.JSON.GZ": outputFormatJSON,
+		"targets.yaml.gz": outputFormatYAML,
+		"targets.gz":      outputFormatYAML,
+	}
+	for filename, expected := range cases {
+		format, err := resolveOutputFormat(outputFormatAuto, filename)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if format != expected {
+			t.Fatalf("Expected %v for %v, got %v", expected, filename, format)
+		}
+	}
+}
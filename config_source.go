@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+// gcsScheme prefixes config paths which are objects in a GCS bucket, such as
+// gs://bucket/gcesd/config.yaml.
+const gcsScheme = "gs://"
+
+// gcsReadScope is the OAuth scope needed to read GCS objects.
+const gcsReadScope = "https://www.googleapis.com/auth/devstorage.read_only"
+
+// metadataScheme prefixes config paths which are project or instance
+// metadata keys, such as metadata://project/gcesd-config.
+const metadataScheme = "metadata://"
+
+// metadataValueLimit is the largest value GCE accepts for a metadata key.
+const metadataValueLimit = 256 * 1024
+
+// metadataBaseURL is the base URL of the GCE metadata server, it is replaced
+// in tests.
+var metadataBaseURL = "http://metadata.google.internal/computeMetadata/v1"
+
+// gcsBaseURL is the base URL of the GCS JSON API, it is replaced in tests.
+var gcsBaseURL = "https://storage.googleapis.com/storage/v1"
+
+// gcsClient returns the HTTP client used to fetch config objects from GCS,
+// using application default credentials as for the compute API. It is
+// replaced in tests.
+var gcsClient = func(ctx context.Context) (*http.Client, error) {
+	return google.DefaultClient(ctx, gcsReadScope)
+}
+
+// isRemoteConfig reports whether path refers to a config which is not on the
+// local filesystem.
+func isRemoteConfig(path string) bool {
+	return strings.HasPrefix(path, gcsScheme) || strings.HasPrefix(path, metadataScheme)
+}
+
+// readConfigSource reads the raw contents of the config at path, which may
+// be a local file, a gs:// URL or a metadata:// URL.
+func readConfigSource(path string) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(path, gcsScheme):
+		ctx, cancel := context.WithTimeout(context.Background(), *discoveryTimeout)
+		defer cancel()
+		return readGCSObject(ctx, path)
+	case strings.HasPrefix(path, metadataScheme):
+		ctx, cancel := context.WithTimeout(context.Background(), *discoveryTimeout)
+		defer cancel()
+		return readMetadataValue(ctx, path)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read config file %v", path)
+	}
+	return data, nil
+}
+
+// parseGCSURL splits a gs://bucket/object URL into its bucket and object.
+func parseGCSURL(uri string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, gcsScheme), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.Errorf("Invalid GCS URL %v, must be gs://bucket/object", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+// readGCSObject fetches the contents of the GCS object at uri, logging the
+// generation fetched so the live version of the config can be identified.
+func readGCSObject(ctx context.Context, uri string) ([]byte, error) {
+	bucket, object, err := parseGCSURL(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := gcsClient(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to get client")
+	}
+
+	objectURL := fmt.Sprintf("%s/b/%s/o/%s?alt=media", gcsBaseURL, url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequest("GET", objectURL, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to fetch %v", uri)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to fetch %v", uri)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Unable to fetch %v: %v", uri, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read %v", uri)
+	}
+
+	log.Infof("Fetched config %v generation %v", uri, resp.Header.Get("X-Goog-Generation"))
+
+	return data, nil
+}
+
+// parseMetadataURL splits a metadata://project/key or metadata://instance/key
+// URL into its level and key.
+func parseMetadataURL(uri string) (string, string, error) {
+	parts := strings.SplitN(strings.TrimPrefix(uri, metadataScheme), "/", 2)
+	if len(parts) != 2 || (parts[0] != "project" && parts[0] != "instance") || parts[1] == "" || strings.Contains(parts[1], "/") {
+		return "", "", errors.Errorf("Invalid metadata URL %v, must be metadata://project/key or metadata://instance/key", uri)
+	}
+	return parts[0], parts[1], nil
+}
+
+// readMetadataValue fetches the value of the project or instance metadata key
+// named by uri from the metadata server.
+func readMetadataValue(ctx context.Context, uri string) ([]byte, error) {
+	level, key, err := parseMetadataURL(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	valueURL := fmt.Sprintf("%s/%s/attributes/%s", metadataBaseURL, level, url.PathEscape(key))
+	req, err := http.NewRequest("GET", valueURL, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to fetch %v", uri)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to reach the metadata server to fetch %v, metadata configs are only available on GCE", uri)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errors.Errorf("Metadata key %v is not set in %v metadata", key, level)
+	default:
+		return nil, errors.Errorf("Unable to fetch %v: %v", uri, resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, metadataValueLimit+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read %v", uri)
+	}
+	if len(data) > metadataValueLimit {
+		return nil, errors.Errorf("Metadata value %v is larger than the %v byte limit", uri, metadataValueLimit)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, errors.Errorf("Metadata key %v in %v metadata is empty", key, level)
+	}
+
+	return data, nil
+}
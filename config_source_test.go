@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func fakeGCS(t *testing.T, objects map[string]string) func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("alt") != "media" {
+			t.Errorf("Expected a media download, got %v", r.URL)
+		}
+		switch r.URL.EscapedPath() {
+		case "/b/forbidden/o/gcesd%2Fconfig.yaml":
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		body, ok := objects[r.URL.EscapedPath()]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("X-Goog-Generation", "1500000000000000")
+		w.Write([]byte(body))
+	}))
+
+	origURL, origClient := gcsBaseURL, gcsClient
+	gcsBaseURL = server.URL
+	gcsClient = func(ctx context.Context) (*http.Client, error) {
+		return server.Client(), nil
+	}
+
+	return func() {
+		server.Close()
+		gcsBaseURL, gcsClient = origURL, origClient
+	}
+}
+
+func TestLoadConfigFileGCS(t *testing.T) {
+	valid, err := ioutil.ReadFile("./test/config_valid.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer fakeGCS(t, map[string]string{
+		"/b/bucket/o/gcesd%2Fconfig.yaml":  string(valid),
+		"/b/bucket/o/gcesd%2Finvalid.yaml": "- job: zk\n",
+		"/b/bucket/o/gcesd%2Finclude.yaml": "include:\n  - conf.d/*.yaml\n",
+		"/b/bucket/o/gcesd%2Fconfig.json":  `[{"job": "zk", "tags": ["zookeeper"], "project": "test", "ports": [2181]}]`,
+	})()
+
+	local, err := LoadConfigFile("./test/config_valid.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	res, err := LoadConfigFile("gs://bucket/gcesd/config.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if len(res) != len(local) || res[0].Job != local[0].Job {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+
+	res, err = LoadConfigFile("gs://bucket/gcesd/config.json")
+	if err != nil || len(res) != 1 || res[0].Job != "zk" {
+		t.Fatalf("Unexpected JSON result %v\nError: %v", prettyPrint(res), err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "gs://forbidden/gcesd/config.yaml", expected: "403"},
+		{path: "gs://bucket/gcesd/missing.yaml", expected: "404"},
+		{path: "gs://bucket/gcesd/invalid.yaml", expected: "entry #0"},
+		{path: "gs://bucket/gcesd/include.yaml", expected: "Includes are not supported"},
+		{path: "gs://bucket", expected: "Invalid GCS URL"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfigFile(tt.path)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Fatalf("Expected error containing %q for %v\nError: %v", tt.expected, tt.path, err)
+		}
+	}
+}
+
+func TestLoadConfigFileMetadata(t *testing.T) {
+	valid, err := ioutil.ReadFile("./test/config_valid.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	values := map[string]string{
+		"/project/attributes/gcesd-config":  string(valid),
+		"/instance/attributes/gcesd-config": `[{"job": "zk", "tags": ["zookeeper"], "project": "test", "ports": [2181]}]`,
+		"/project/attributes/empty":         "",
+		"/project/attributes/invalid":       "- job: zk\n",
+		"/project/attributes/huge":          strings.Repeat("#", metadataValueLimit+1),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "Missing Metadata-Flavor", http.StatusForbidden)
+			return
+		}
+		value, ok := values[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(value))
+	}))
+	defer server.Close()
+	origURL := metadataBaseURL
+	metadataBaseURL = server.URL
+	defer func() { metadataBaseURL = origURL }()
+
+	res, err := LoadConfigFile("metadata://project/gcesd-config")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if len(res) == 0 || res[0].Job != "gce_zookeeper" {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+
+	res, err = LoadConfigFile("metadata://instance/gcesd-config")
+	if err != nil || len(res) != 1 || res[0].Job != "zk" {
+		t.Fatalf("Unexpected instance result %v\nError: %v", prettyPrint(res), err)
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{path: "metadata://project/missing", expected: "not set in project metadata"},
+		{path: "metadata://project/empty", expected: "is empty"},
+		{path: "metadata://project/invalid", expected: "entry #0"},
+		{path: "metadata://project/huge", expected: "byte limit"},
+		{path: "metadata://zone/gcesd-config", expected: "Invalid metadata URL"},
+		{path: "metadata://project/", expected: "Invalid metadata URL"},
+	}
+	for _, tt := range tests {
+		_, err := LoadConfigFile(tt.path)
+		if err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Fatalf("Expected error containing %q for %v\nError: %v", tt.expected, tt.path, err)
+		}
+	}
+}
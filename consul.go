@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// consulServicePrefix prefixes the IDs of services registered in consul, so
+// that services registered by anything else are left alone.
+const consulServicePrefix = "gcesd:"
+
+// consulMetaKeyPattern matches the service meta keys consul accepts.
+var consulMetaKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// consulMetaValueLimit is the longest service meta value consul accepts.
+const consulMetaValueLimit = 512
+
+var consulOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_consul_operations_total",
+	Help: "Number of consul service listings, registrations and deregistrations, by operation and result",
+}, []string{"operation", "result"})
+
+func init() {
+	prometheus.MustRegister(consulOperations)
+}
+
+// consulService is a service as registered with the consul agent API.
+type consulService struct {
+	ID      string            `json:"ID"`
+	Service string            `json:"Service"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Tags    []string          `json:"Tags"`
+	Meta    map[string]string `json:"Meta"`
+}
+
+// same reports whether s and o are registered identically.
+func (s consulService) same(o consulService) bool {
+	return s.Service == o.Service && s.Address == o.Address && s.Port == o.Port &&
+		reflect.DeepEqual(s.Tags, o.Tags) && reflect.DeepEqual(s.Meta, o.Meta)
+}
+
+// consulServices returns a consul service for each address of targets,
+// named after the job, tagged with the instance's network tags and with
+// the __meta_gce_ labels as service meta.
+func consulServices(targets []DiscoveryTarget) map[string]consulService {
+	services := map[string]consulService{}
+	for _, t := range targets {
+		job := t.Labels["job"]
+
+		tags := []string{}
+		for _, tag := range strings.Split(t.Labels["__meta_gce_instance_tags"], ",") {
+			if tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+		sort.Strings(tags)
+
+		meta := map[string]string{}
+		for k, v := range t.Labels {
+			if !strings.HasPrefix(k, "__meta_gce_") || k == "__meta_gce_instance_tags" {
+				continue
+			}
+			k = strings.TrimPrefix(k, "__meta_gce_")
+			if !consulMetaKeyPattern.MatchString(k) || len(v) > consulMetaValueLimit {
+				continue
+			}
+			meta[k] = v
+		}
+
+		for _, address := range t.Targets {
+			host, portStr, err := net.SplitHostPort(address)
+			if err != nil {
+				log.Warningf("Not registering %v for %v in consul, it has no port", address, job)
+				continue
+			}
+			port, err := strconv.Atoi(portStr)
+			if err != nil {
+				log.Warningf("Not registering %v for %v in consul, its port is not numeric", address, job)
+				continue
+			}
+
+			id := consulServicePrefix + job + ":" + address
+			services[id] = consulService{
+				ID:      id,
+				Service: job,
+				Address: host,
+				Port:    port,
+				Tags:    tags,
+				Meta:    meta,
+			}
+		}
+	}
+	return services
+}
+
+// consulRegistrar keeps the services registered with a consul agent in
+// line with the discovered targets.
+type consulRegistrar struct {
+	addr   string
+	client *http.Client
+}
+
+func newConsulRegistrar(addr string, timeout time.Duration) *consulRegistrar {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return &consulRegistrar{addr: strings.TrimSuffix(addr, "/"), client: &http.Client{Timeout: timeout}}
+}
+
+// Reconcile registers a service for every address of targets, updating
+// those which changed, and deregisters services previously registered for
+// addresses no longer discovered. The agent's services are the record of
+// what is registered, so services left behind by a restart are cleaned up.
+func (c *consulRegistrar) Reconcile(ctx context.Context, targets []DiscoveryTarget) error {
+	registered, err := c.services(ctx)
+	if err != nil {
+		consulOperations.WithLabelValues("list", "failure").Inc()
+		return err
+	}
+	desired := consulServices(targets)
+
+	errs := []string{}
+	for _, id := range sortedServiceIDs(desired) {
+		s := desired[id]
+		if r, ok := registered[id]; ok && r.same(s) {
+			continue
+		}
+		if err := c.do(ctx, "register", "/v1/agent/service/register", s); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, id := range sortedServiceIDs(registered) {
+		if _, ok := desired[id]; ok {
+			continue
+		}
+		if err := c.do(ctx, "deregister", "/v1/agent/service/deregister/"+url.PathEscape(id), nil); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// services returns the services registered with the agent by gcesd.
+func (c *consulRegistrar) services(ctx context.Context) (map[string]consulService, error) {
+	req, err := http.NewRequest("GET", c.addr+"/v1/agent/services", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list consul services")
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to list consul services")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("Unable to list consul services: %v", resp.Status)
+	}
+
+	all := map[string]consulService{}
+	if err := json.NewDecoder(resp.Body).Decode(&all); err != nil {
+		return nil, errors.Wrap(err, "Unable to read consul services")
+	}
+	services := map[string]consulService{}
+	for id, s := range all {
+		if strings.HasPrefix(id, consulServicePrefix) {
+			sort.Strings(s.Tags)
+			services[id] = s
+		}
+	}
+	return services, nil
+}
+
+// do sends a request to the agent API, counting it as operation.
+func (c *consulRegistrar) do(ctx context.Context, operation, path string, body interface{}) error {
+	err := c.request(ctx, path, body)
+	if err != nil {
+		consulOperations.WithLabelValues(operation, "failure").Inc()
+		return errors.Wrapf(err, "Unable to %v consul service", operation)
+	}
+	consulOperations.WithLabelValues(operation, "success").Inc()
+	return nil
+}
+
+func (c *consulRegistrar) request(ctx context.Context, path string, body interface{}) error {
+	var d []byte
+	if body != nil {
+		var err error
+		if d, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("PUT", c.addr+path, bytes.NewReader(d))
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: %v", path, resp.Status)
+	}
+	return nil
+}
+
+func sortedServiceIDs(services map[string]consulService) []string {
+	ids := make([]string, 0, len(services))
+	for id := range services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeConsulAgent serves the consul agent service API.
+type fakeConsulAgent struct {
+	sync.Mutex
+	services map[string]consulService
+	requests []string
+}
+
+func (a *fakeConsulAgent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.Lock()
+	defer a.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.Path == "/v1/agent/services":
+		json.NewEncoder(w).Encode(a.services)
+	case r.Method == "PUT" && r.URL.Path == "/v1/agent/service/register":
+		var s consulService
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a.requests = append(a.requests, "register "+s.ID)
+		a.services[s.ID] = s
+	case r.Method == "PUT" && strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		a.requests = append(a.requests, "deregister "+id)
+		delete(a.services, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *fakeConsulAgent) takeRequests() []string {
+	a.Lock()
+	defer a.Unlock()
+
+	requests := a.requests
+	a.requests = nil
+	return requests
+}
+
+func TestConsulRegistrarReconcile(t *testing.T) {
+	agent := &fakeConsulAgent{services: map[string]consulService{
+		"web-sidecar":           {ID: "web-sidecar", Service: "web-sidecar", Port: 15000},
+		"gcesd:web:10.0.0.9:80": {ID: "gcesd:web:10.0.0.9:80", Service: "web", Address: "10.0.0.9", Port: 80},
+	}}
+	server := httptest.NewServer(agent)
+	defer server.Close()
+	registrar := newConsulRegistrar(strings.TrimPrefix(server.URL, "http://"), time.Second)
+
+	web := DiscoveryTarget{
+		Targets: []string{"10.0.0.1:80", "10.0.0.1:8080"},
+		Labels: map[string]string{
+			"job":                          "web",
+			"__meta_gce_instance_name":     "web-1",
+			"__meta_gce_instance_tags":     ",web,http,",
+			"__meta_gce_label_team":        "frontend",
+			"__meta_gce_metadata_some.key": "dropped",
+		},
+	}
+	targets := []DiscoveryTarget{web}
+
+	// Services left behind from before are deregistered, other services are
+	// left alone.
+	if err := registrar.Reconcile(context.Background(), targets); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	expected := []string{
+		"register gcesd:web:10.0.0.1:80",
+		"register gcesd:web:10.0.0.1:8080",
+		"deregister gcesd:web:10.0.0.9:80",
+	}
+	if got := agent.takeRequests(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in requests\nResult: %v", prettyPrint(got))
+	}
+	service := agent.services["gcesd:web:10.0.0.1:8080"]
+	expectedService := consulService{
+		ID:      "gcesd:web:10.0.0.1:8080",
+		Service: "web",
+		Address: "10.0.0.1",
+		Port:    8080,
+		Tags:    []string{"http", "web"},
+		Meta:    map[string]string{"instance_name": "web-1", "label_team": "frontend"},
+	}
+	if !reflect.DeepEqual(service, expectedService) {
+		t.Fatalf("Discrepancy in service\nResult: %v", prettyPrint(service))
+	}
+	if _, ok := agent.services["web-sidecar"]; !ok {
+		t.Fatalf("Expected services not registered by gcesd to be kept")
+	}
+
+	// Nothing changed, nothing is sent.
+	if err := registrar.Reconcile(context.Background(), targets); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if got := agent.takeRequests(); len(got) != 0 {
+		t.Fatalf("Expected no requests\nResult: %v", prettyPrint(got))
+	}
+
+	// Changed services are registered again, vanished ones deregistered.
+	web.Targets = []string{"10.0.0.1:80"}
+	web.Labels["__meta_gce_label_team"] = "platform"
+	if err := registrar.Reconcile(context.Background(), []DiscoveryTarget{web}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	expected = []string{
+		"register gcesd:web:10.0.0.1:80",
+		"deregister gcesd:web:10.0.0.1:8080",
+	}
+	if got := agent.takeRequests(); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in requests\nResult: %v", prettyPrint(got))
+	}
+
+	// An unreachable agent is an error, counted as a failure.
+	failuresBefore := counterValue(consulOperations.WithLabelValues("list", "failure"))
+	server.Close()
+	if err := registrar.Reconcile(context.Background(), targets); err == nil {
+		t.Fatalf("Expected an error with consul down")
+	}
+	if got := counterValue(consulOperations.WithLabelValues("list", "failure")) - failuresBefore; got != 1 {
+		t.Fatalf("Expected 1 failure, got %v", got)
+	}
+}
+
+func TestConsulRegistrarTimeout(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	// A hung agent fails the reconcile even without a deadline on ctx.
+	registrar := newConsulRegistrar(server.URL, 50*time.Millisecond)
+	done := make(chan error, 1)
+	go func() {
+		done <- registrar.Reconcile(context.Background(), nil)
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatalf("Expected an error from a hung agent")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the reconcile to time out")
+	}
+}
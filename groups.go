@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// instanceGroupRef identifies an instance group by name, along with the zone
+// or region it is in if known.
+type instanceGroupRef struct {
+	zone, region, name string
+}
+
+var (
+	// instanceGroupLinkPattern matches instance group self links, or the
+	// zones/ZONE/instanceGroups/NAME and regions/REGION/instanceGroups/NAME
+	// suffixes of them.
+	instanceGroupLinkPattern = regexp.MustCompile(`(?:^|/)(zones|regions)/([a-z0-9-]+)/instanceGroups/([a-z0-9-]+)$`)
+	// instanceGroupNamePattern matches bare instance group names.
+	instanceGroupNamePattern = regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+	// instanceLinkPattern extracts the zone and name of an instance from
+	// its URL.
+	instanceLinkPattern = regexp.MustCompile(`zones/([^/]+)/instances/([^/]+)$`)
+)
+
+var instanceGroupErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_instance_group_errors_total",
+	Help: "Number of failures listing the members of an instance group, by job name and group",
+}, []string{"job", "group"})
+
+func init() {
+	prometheus.MustRegister(instanceGroupErrors)
+}
+
+// listInstanceGroupMembers is the function used to list the URLs of the
+// instances in an instance group, it is replaced in tests.
+var listInstanceGroupMembers = listAllInstanceGroupMembers
+
+// parseInstanceGroup parses an instance group given as a name or self link.
+func parseInstanceGroup(group string) (instanceGroupRef, error) {
+	if m := instanceGroupLinkPattern.FindStringSubmatch(group); m != nil {
+		if m[1] == "zones" {
+			return instanceGroupRef{zone: m[2], name: m[3]}, nil
+		}
+		return instanceGroupRef{region: m[2], name: m[3]}, nil
+	}
+	if instanceGroupNamePattern.MatchString(group) {
+		return instanceGroupRef{name: group}, nil
+	}
+	return instanceGroupRef{}, errors.Errorf("Invalid instance group %q, must be a name or self link", group)
+}
+
+// listAllInstanceGroupMembers returns the URLs of the instances in group. A
+// group given only by name is looked for in every zone of project.
+func listAllInstanceGroupMembers(ctx context.Context, project, group, credentialsFile string) ([]string, error) {
+	ref, err := parseInstanceGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := computeServiceFor(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []instanceGroupRef{ref}
+	if ref.zone == "" && ref.region == "" {
+		refs = []instanceGroupRef{}
+		err := service.InstanceGroups.AggregatedList(project).Filter(fmt.Sprintf("name = %q", ref.name)).Pages(ctx, func(list *compute.InstanceGroupAggregatedList) error {
+			for _, scoped := range list.Items {
+				for _, ig := range scoped.InstanceGroups {
+					if ig == nil {
+						continue
+					}
+					refs = append(refs, instanceGroupRef{zone: parseResource(ig.Zone), region: parseResource(ig.Region), name: ig.Name})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to find instance group %v", group)
+		}
+		if len(refs) == 0 {
+			return nil, errors.Errorf("No instance group named %v in %v", group, project)
+		}
+	}
+
+	members := []string{}
+	for _, r := range refs {
+		var err error
+		if r.zone != "" {
+			err = service.InstanceGroups.ListInstances(project, r.zone, r.name, &compute.InstanceGroupsListInstancesRequest{InstanceState: "ALL"}).Pages(ctx, func(list *compute.InstanceGroupsListInstances) error {
+				for _, i := range list.Items {
+					members = append(members, i.Instance)
+				}
+				return nil
+			})
+		} else {
+			err = service.RegionInstanceGroups.ListInstances(project, r.region, r.name, &compute.RegionInstanceGroupsListInstancesRequest{InstanceState: "ALL"}).Pages(ctx, func(list *compute.RegionInstanceGroupsListInstances) error {
+				for _, i := range list.Items {
+					members = append(members, i.Instance)
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list instances in group %v", group)
+		}
+	}
+
+	return members, nil
+}
+
+// groupMembers is the result of listing the members of an instance group.
+type groupMembers struct {
+	urls []string
+	err  error
+}
+
+// filterInstanceGroups returns the instances of allInstances in any of the
+// instance groups of config. Groups are listed at most once per sync, using
+// cache. A group which cannot be listed is logged and treated as empty.
+func filterInstanceGroups(ctx context.Context, allInstances []*compute.Instance, config SearchConfig, cache map[string]groupMembers) []*compute.Instance {
+	members := map[string]bool{}
+	for _, group := range config.InstanceGroups {
+		key := config.Project + "\x00" + group + "\x00" + config.CredentialsFile
+		gm, ok := cache[key]
+		if !ok {
+			urls, err := listInstanceGroupMembers(ctx, config.Project, group, config.CredentialsFile)
+			gm = groupMembers{urls: urls, err: err}
+			cache[key] = gm
+		}
+		if gm.err != nil {
+			log.Warningf("Unable to list instance group %v in %v for %v: %v", group, config.Project, entryJob(config), gm.err)
+			instanceGroupErrors.WithLabelValues(entryJob(config), group).Inc()
+			continue
+		}
+
+		for _, u := range gm.urls {
+			if m := instanceLinkPattern.FindStringSubmatch(u); m != nil {
+				members[m[1]+"/"+m[2]] = true
+			}
+		}
+	}
+
+	instances := []*compute.Instance{}
+	for _, instance := range allInstances {
+		if instance != nil && members[parseResource(instance.Zone)+"/"+instance.Name] {
+			instances = append(instances, instance)
+		}
+	}
+	return instances
+}
+
+// listProjectInstanceGroups is the function used to list the URLs of the
+// instances in every instance group of a project, by group name, it is
+// replaced in tests.
+var listProjectInstanceGroups = listAllProjectInstanceGroups
+
+var instanceGroupLabelErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_instance_group_label_errors_total",
+	Help: "Number of failures listing the instance groups of a project for resolve_instance_groups, by project",
+}, []string{"project"})
+
+func init() {
+	prometheus.MustRegister(instanceGroupLabelErrors)
+}
+
+// listAllProjectInstanceGroups returns the URLs of the instances in each
+// zonal and regional instance group of project, by group name.
+func listAllProjectInstanceGroups(ctx context.Context, project, credentialsFile string) (map[string][]string, error) {
+	service, err := computeServiceFor(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	refs := []instanceGroupRef{}
+	err = service.InstanceGroups.AggregatedList(project).Pages(ctx, func(list *compute.InstanceGroupAggregatedList) error {
+		for _, scoped := range list.Items {
+			for _, ig := range scoped.InstanceGroups {
+				if ig == nil {
+					continue
+				}
+				refs = append(refs, instanceGroupRef{zone: parseResource(ig.Zone), region: parseResource(ig.Region), name: ig.Name})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to list instance groups in %v", project)
+	}
+
+	groups := map[string][]string{}
+	for _, r := range refs {
+		link := fmt.Sprintf("zones/%v/instanceGroups/%v", r.zone, r.name)
+		if r.zone == "" {
+			link = fmt.Sprintf("regions/%v/instanceGroups/%v", r.region, r.name)
+		}
+		members, err := listInstanceGroupMembers(ctx, project, link, credentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		groups[r.name] = append(groups[r.name], members...)
+	}
+	return groups, nil
+}
+
+// instanceGroupIndex maps the zone/name of each instance in a project to
+// the names of the instance groups containing it.
+type instanceGroupIndex struct {
+	groups map[string][]string
+	err    error
+}
+
+// instanceGroupLabeler labels targets with the instance groups of their
+// instance, listing the groups of each project at most once per sync.
+type instanceGroupLabeler struct {
+	byProject map[string]instanceGroupIndex
+}
+
+func newInstanceGroupLabeler() *instanceGroupLabeler {
+	return &instanceGroupLabeler{byProject: map[string]instanceGroupIndex{}}
+}
+
+// index returns the instance groups of config's project. A project whose
+// groups cannot be listed is logged and counted once.
+func (l *instanceGroupLabeler) index(ctx context.Context, config SearchConfig) instanceGroupIndex {
+	key := config.Project + "\x00" + config.CredentialsFile
+	if idx, ok := l.byProject[key]; ok {
+		return idx
+	}
+
+	idx := instanceGroupIndex{groups: map[string][]string{}}
+	groups, err := listProjectInstanceGroups(ctx, config.Project, config.CredentialsFile)
+	if err != nil {
+		log.Warningf("Not labelling targets in %v with their instance groups: %v", config.Project, err)
+		instanceGroupLabelErrors.WithLabelValues(config.Project).Inc()
+		idx.err = err
+	}
+
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		seen := map[string]bool{}
+		for _, u := range groups[name] {
+			m := instanceLinkPattern.FindStringSubmatch(u)
+			if m == nil {
+				continue
+			}
+			instance := m[1] + "/" + m[2]
+			if !seen[instance] {
+				seen[instance] = true
+				idx.groups[instance] = append(idx.groups[instance], name)
+			}
+		}
+	}
+
+	l.byProject[key] = idx
+	return idx
+}
+
+// Label adds __meta_gce_instance_groups, the comma wrapped names of the
+// instance groups containing instance, to targets, or "" if it is in none.
+// If the groups of the instance's project cannot be listed the label is left
+// out.
+func (l *instanceGroupLabeler) Label(ctx context.Context, instance *compute.Instance, config SearchConfig, targets []DiscoveryTarget) {
+	idx := l.index(ctx, config)
+	if idx.err != nil {
+		return
+	}
+	groups := ""
+	if names := idx.groups[parseResource(instance.Zone)+"/"+instance.Name]; len(names) != 0 {
+		groups = fmt.Sprintf(",%v,", strings.Join(names, ","))
+	}
+	for _, t := range targets {
+		t.Labels["__meta_gce_instance_groups"] = groups
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestParseInstanceGroup(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		group    string
+		expected instanceGroupRef
+		err      bool
+	}{
+		{group: "api", expected: instanceGroupRef{name: "api"}},
+		{group: "zones/us-central1-b/instanceGroups/api", expected: instanceGroupRef{zone: "us-central1-b", name: "api"}},
+		{group: "https://www.googleapis.com/compute/v1/projects/test/regions/us-central1/instanceGroups/api", expected: instanceGroupRef{region: "us-central1", name: "api"}},
+		{group: "Api", err: true},
+		{group: "zones/us-central1-b/instances/api", err: true},
+	}
+
+	for _, c := range cases {
+		ref, err := parseInstanceGroup(c.group)
+		if c.err {
+			if err == nil {
+				t.Fatalf("Expected an error for %v", c.group)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %v\nError: %v", c.group, err)
+		}
+		if ref != c.expected {
+			t.Fatalf("Discrepancy in result for %v\nResult: %+v", c.group, ref)
+		}
+	}
+}
+
+func TestDiscoverTargetsInstanceGroups(t *testing.T) {
+	instanceURL := func(zone, name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + zone + "/instances/" + name
+	}
+	groups := map[string][]string{
+		"api": {
+			instanceURL("us-central1-b", "api-1"),
+			instanceURL("us-central1-b", "shared-1"),
+		},
+		"zones/us-central1-c/instanceGroups/worker": {
+			instanceURL("us-central1-c", "worker-1"),
+			instanceURL("us-central1-b", "shared-1"),
+		},
+	}
+	calls := map[string]int{}
+	listInstanceGroupMembers = func(ctx context.Context, project, group, credentialsFile string) ([]string, error) {
+		calls[group]++
+		if group == "broken" {
+			return nil, errors.New("permission denied")
+		}
+		return groups[group], nil
+	}
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("api-1", "us-central1-b", "10.0.0.1", "node"),
+			testInstance("shared-1", "us-central1-b", "10.0.0.2", "node"),
+			testInstance("worker-1", "us-central1-c", "10.0.0.3", "node"),
+			testInstance("worker-1", "us-central1-b", "10.0.0.4", "node"),
+			testInstance("other-1", "us-central1-b", "10.0.0.5", "node"),
+		},
+	})
+	defer func() {
+		listInstanceGroupMembers = listAllInstanceGroupMembers
+		listInstances = listAllInstances
+	}()
+
+	configs := []SearchConfig{
+		{Job: "api", InstanceGroups: []string{"api"}, Project: "test-project", Ports: []int{80}},
+		{Job: "both", InstanceGroups: []string{"api", "zones/us-central1-c/instanceGroups/worker"}, Project: "test-project", Ports: []int{80}},
+		{Job: "tagged", InstanceGroups: []string{"api"}, Tags: []string{"node"}, Project: "test-project", Ports: []int{80}},
+		{Job: "broken", InstanceGroups: []string{"broken"}, Project: "test-project", Ports: []int{80}},
+		{Job: "partly_broken", InstanceGroups: []string{"broken", "api"}, Project: "test-project", Ports: []int{80}},
+	}
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := map[string][]string{
+		"api":           {"10.0.0.1:80", "10.0.0.2:80"},
+		"both":          {"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
+		"tagged":        {"10.0.0.1:80", "10.0.0.2:80"},
+		"partly_broken": {"10.0.0.1:80", "10.0.0.2:80"},
+	}
+	if got := targetsByJob(res); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+
+	if !reflect.DeepEqual(calls, map[string]int{"api": 1, "zones/us-central1-c/instanceGroups/worker": 1, "broken": 1}) {
+		t.Fatalf("Expected each group to be listed once, got %v", calls)
+	}
+}
+
+func TestDiscoverTargetsResolveInstanceGroups(t *testing.T) {
+	instanceURL := func(zone, name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + zone + "/instances/" + name
+	}
+	calls := map[string]int{}
+	listProjectInstanceGroups = func(ctx context.Context, project, credentialsFile string) (map[string][]string, error) {
+		calls[project]++
+		if project == "broken-project" {
+			return nil, errors.New("permission denied")
+		}
+		return map[string][]string{
+			"web": {
+				instanceURL("us-central1-b", "web-1"),
+				instanceURL("us-central1-b", "shared-1"),
+			},
+			"canary": {
+				instanceURL("us-central1-b", "shared-1"),
+			},
+		}, nil
+	}
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "node"),
+			testInstance("shared-1", "us-central1-b", "10.0.0.2", "node"),
+			testInstance("shared-1", "us-central1-c", "10.0.0.3", "node"),
+		},
+		"broken-project": {
+			testInstance("web-1", "us-central1-b", "10.0.1.1", "node"),
+		},
+	})
+	defer func() {
+		listProjectInstanceGroups = listAllProjectInstanceGroups
+		listInstances = listAllInstances
+	}()
+
+	before := counterValue(instanceGroupLabelErrors.WithLabelValues("broken-project"))
+	configs := []SearchConfig{
+		{Job: "web", Tags: []string{"node"}, Project: "test-project", Ports: []int{80}, ResolveGroups: true},
+		{Job: "admin", Tags: []string{"node"}, Project: "test-project", Ports: []int{9090}, ResolveGroups: true},
+		{Job: "plain", Tags: []string{"node"}, Project: "test-project", Ports: []int{80}},
+		{Job: "broken", Tags: []string{"node"}, Project: "broken-project", Ports: []int{80}, ResolveGroups: true},
+	}
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	got := map[string]map[string]string{}
+	for _, target := range res {
+		groups, ok := target.Labels["__meta_gce_instance_groups"]
+		if !ok {
+			groups = "<none>"
+		}
+		if got[target.Labels["job"]] == nil {
+			got[target.Labels["job"]] = map[string]string{}
+		}
+		for _, addr := range target.Targets {
+			got[target.Labels["job"]][addr] = groups
+		}
+	}
+	// The shared-1 in us-central1-c is in no group, so its label is empty.
+	expected := map[string]map[string]string{
+		"web": {
+			"10.0.0.1:80": ",web,",
+			"10.0.0.2:80": ",canary,web,",
+			"10.0.0.3:80": "",
+		},
+		"admin": {
+			"10.0.0.1:9090": ",web,",
+			"10.0.0.2:9090": ",canary,web,",
+			"10.0.0.3:9090": "",
+		},
+		"plain": {
+			"10.0.0.1:80": "<none>",
+			"10.0.0.2:80": "<none>",
+			"10.0.0.3:80": "<none>",
+		},
+		"broken": {
+			"10.0.1.1:80": "<none>",
+		},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+
+	if !reflect.DeepEqual(calls, map[string]int{"test-project": 1, "broken-project": 1}) {
+		t.Fatalf("Expected each project's groups to be listed once, got %v", calls)
+	}
+	if n := counterValue(instanceGroupLabelErrors.WithLabelValues("broken-project")) - before; n != 1 {
+		t.Fatalf("Expected one instance group label error, got %v", n)
+	}
+}
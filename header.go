@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// hostname returns the name of the host, it is replaced in tests.
+var hostname = os.Hostname
+
+// targetsHeader returns a block of YAML comments describing the sync which
+// discovered targets and how many targets each job has, to prepend to a
+// YAML targets file.
+func targetsHeader(targets []DiscoveryTarget, info syncInfo) []byte {
+	m := newTargetsManifest(targets, info)
+	host, err := hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by prometheus_gce_sd %v on %v at %v\n", m.Version, host, m.SyncTime.Format(time.RFC3339))
+	fmt.Fprintf(&buf, "# Config hash: %v\n", m.ConfigHash)
+	fmt.Fprintf(&buf, "# Targets: %v\n", m.Targets)
+
+	jobs := make([]string, 0, len(m.Jobs))
+	for job := range m.Jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+	for _, job := range jobs {
+		fmt.Fprintf(&buf, "#   %q: %v\n", job, m.Jobs[job])
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+func TestWriteTargetsHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hostname = func() (string, error) { return "gcesd-1", nil }
+	defer func() { hostname = os.Hostname }()
+
+	targets := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.1:80", "10.0.0.2:80"}, Labels: map[string]string{"job": "web"}},
+		{Targets: []string{"10.0.0.3:9100"}, Labels: map[string]string{"job": "node"}},
+	}
+	info := syncInfo{time: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC), configHash: "abc123"}
+
+	out := filepath.Join(dir, "targets.yaml")
+	if err := WriteTargets(context.Background(), targets, out, info); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	d, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := strings.Join([]string{
+		"# Generated by prometheus_gce_sd " + version + " on gcesd-1 at 2017-01-01T00:00:00Z",
+		"# Config hash: abc123",
+		"# Targets: 3",
+		`#   "node": 1`,
+		`#   "web": 2`,
+		"",
+	}, "\n")
+	if !bytes.HasPrefix(d, []byte(expected)) {
+		t.Fatalf("Expected header\n%v\nOutput:\n%s", expected, d)
+	}
+
+	var written []DiscoveryTarget
+	if err := yaml.Unmarshal(d, &written); err != nil {
+		t.Fatalf("Output is not valid YAML\nError: %v\nOutput:\n%s", err, d)
+	}
+	if targetsDifferent(written, targets) {
+		t.Fatalf("Expected the header not to affect the targets, got %v", prettyPrint(written))
+	}
+
+	// A later sync of the same targets has a different header, but the
+	// targets are unchanged so the file is not rewritten.
+	writer := newTargetWriter(out, false)
+	writes := counterValue(resultWrite.WithLabelValues(out))
+	for _, offset := range []time.Duration{0, time.Minute} {
+		later := syncInfo{time: info.time.Add(offset), configHash: info.configHash}
+		if err := writer.Write(context.Background(), map[string][]DiscoveryTarget{out: targets}, false, later); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	if got := counterValue(resultWrite.WithLabelValues(out)) - writes; got != 1 {
+		t.Fatalf("Expected a single write, got %v", got)
+	}
+
+	*writeHeader = false
+	defer func() { *writeHeader = true }()
+	if err := WriteTargets(context.Background(), targets, out, info); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	d, err = ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if bytes.HasPrefix(d, []byte("#")) {
+		t.Fatalf("Expected no header\nOutput:\n%s", d)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// httpSD serves the most recently discovered targets in the format read by
+// prometheus' http_sd_config. The snapshot is only replaced after a
+// successful sync, so a failing or in flight discovery leaves the last good
+// targets being served.
+type httpSD struct {
+	sync.Mutex
+	body     []byte
+	etag     string
+	modified time.Time
+}
+
+// Update replaces the served targets with those discovered by the sync at
+// synced. The Last-Modified time only changes if the targets did.
+func (h *httpSD) Update(targets []DiscoveryTarget, synced time.Time) error {
+	sortedTargets := make(discoveryTargets, len(targets))
+	copy(sortedTargets, targets)
+	sort.Sort(sortedTargets)
+
+	body, err := marshalTargets([]DiscoveryTarget(sortedTargets), outputFormatJSON)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal targets")
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	h.Lock()
+	defer h.Unlock()
+
+	if etag == h.etag {
+		return nil
+	}
+	h.body = body
+	h.etag = etag
+	h.modified = synced.UTC().Truncate(time.Second)
+	return nil
+}
+
+func (h *httpSD) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.Lock()
+	body, etag, modified := h.body, h.etag, h.modified
+	h.Unlock()
+
+	if body == nil {
+		http.Error(w, "No targets discovered yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+
+	if notModified(r, etag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+// notModified reports whether the conditional headers of r show the client
+// already has the targets with etag, last modified at modified. If-None-Match
+// takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range splitETags(inm) {
+			if tag == "*" || tag == etag || tag == "W/"+etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.After(t)
+	}
+	return false
+}
+
+// splitETags splits an If-None-Match header into its entity tags.
+func splitETags(header string) []string {
+	tags := []string{}
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
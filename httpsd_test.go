@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHTTPSD(t *testing.T) {
+	t.Parallel()
+
+	sd := &httpSD{}
+	server := httptest.NewServer(sd)
+	defer server.Close()
+
+	get := func(header http.Header) *http.Response {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		req.Header = header
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		return resp
+	}
+
+	resp := get(http.Header{})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 before the first sync, got %v", resp.StatusCode)
+	}
+
+	targets := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.2:80"}, Labels: map[string]string{"job": "web"}},
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node"}},
+	}
+	synced := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := sd.Update(targets, synced); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	resp = get(http.Header{})
+	var res []DiscoveryTarget
+	err := json.NewDecoder(resp.Body).Decode(&res)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Unexpected response %v with content type %v", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if !reflect.DeepEqual(res, []DiscoveryTarget{targets[1], targets[0]}) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") != "Sun, 01 Jan 2017 12:00:00 GMT" {
+		t.Fatalf("Expected ETag and Last-Modified headers, got %v", resp.Header)
+	}
+
+	// A sync which finds the same targets changes neither header.
+	if err := sd.Update(targets, synced.Add(time.Minute)); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	cases := []struct {
+		header   http.Header
+		expected int
+	}{
+		{header: http.Header{"If-None-Match": {etag}}, expected: http.StatusNotModified},
+		{header: http.Header{"If-None-Match": {`"other", ` + etag}}, expected: http.StatusNotModified},
+		{header: http.Header{"If-None-Match": {`"other"`}}, expected: http.StatusOK},
+		{header: http.Header{"If-Modified-Since": {"Sun, 01 Jan 2017 12:00:00 GMT"}}, expected: http.StatusNotModified},
+		{header: http.Header{"If-Modified-Since": {"Sun, 01 Jan 2017 11:59:59 GMT"}}, expected: http.StatusOK},
+		{header: http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {"Sun, 01 Jan 2017 12:00:00 GMT"}}, expected: http.StatusOK},
+	}
+	for _, c := range cases {
+		resp := get(c.header)
+		resp.Body.Close()
+		if resp.StatusCode != c.expected {
+			t.Fatalf("Expected %v for %v, got %v", c.expected, c.header, resp.StatusCode)
+		}
+	}
+
+	// Changed targets give a new ETag, so the old one no longer matches.
+	if err := sd.Update(targets[:1], synced.Add(2*time.Minute)); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	resp = get(http.Header{"If-None-Match": {etag}})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("ETag") == etag {
+		t.Fatalf("Expected changed targets to be served, got %v", resp.StatusCode)
+	}
+	if resp.Header.Get("Last-Modified") != "Sun, 01 Jan 2017 12:02:00 GMT" {
+		t.Fatalf("Unexpected Last-Modified %v", resp.Header.Get("Last-Modified"))
+	}
+}
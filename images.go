@@ -0,0 +1,264 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+var imageLookupErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_image_lookup_errors_total",
+	Help: "Number of instances included despite failing to find their boot image, by job name",
+}, []string{"job"})
+
+func init() {
+	prometheus.MustRegister(imageLookupErrors)
+}
+
+var (
+	// diskLinkPattern extracts the project, zone and name of a disk from its
+	// URL.
+	diskLinkPattern = regexp.MustCompile(`projects/([^/]+)/zones/([^/]+)/disks/([^/]+)$`)
+	// imageLinkPattern extracts the project and name of an image from its
+	// URL, or the family for URLs referring to the latest image of a family.
+	imageLinkPattern = regexp.MustCompile(`projects/([^/]+)/global/images/(family/)?([^/]+)$`)
+)
+
+// getDiskSourceImage and getImageFamily are the functions used to look up
+// the image a disk was created from and the family of an image, they are
+// replaced in tests.
+var (
+	getDiskSourceImage = fetchDiskSourceImage
+	getImageFamily     = fetchImageFamily
+)
+
+func fetchDiskSourceImage(ctx context.Context, diskURL, credentialsFile string) (string, error) {
+	m := diskLinkPattern.FindStringSubmatch(diskURL)
+	if m == nil {
+		return "", errors.Errorf("Unable to parse disk %v", diskURL)
+	}
+
+	service, err := computeServiceFor(credentialsFile)
+	if err != nil {
+		return "", err
+	}
+
+	disk, err := service.Disks.Get(m[1], m[2], m[3]).Context(ctx).Do()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get disk %v", diskURL)
+	}
+	return disk.SourceImage, nil
+}
+
+func fetchImageFamily(ctx context.Context, imageURL, credentialsFile string) (string, error) {
+	m := imageLinkPattern.FindStringSubmatch(imageURL)
+	if m == nil {
+		return "", errors.Errorf("Unable to parse image %v", imageURL)
+	}
+
+	service, err := computeServiceFor(credentialsFile)
+	if err != nil {
+		return "", err
+	}
+
+	image, err := service.Images.Get(m[1], m[3]).Context(ctx).Do()
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to get image %v", imageURL)
+	}
+	return image.Family, nil
+}
+
+// imageResolver finds the boot images of instances, caching lookups for the
+// duration of a sync.
+type imageResolver struct {
+	sourceImages map[string]string
+	families     map[string]string
+	errs         map[string]error
+}
+
+func newImageResolver() *imageResolver {
+	return &imageResolver{
+		sourceImages: map[string]string{},
+		families:     map[string]string{},
+		errs:         map[string]error{},
+	}
+}
+
+// bootDisk returns the boot disk of instance, or nil if it has none.
+func bootDisk(instance *compute.Instance) *compute.AttachedDisk {
+	for _, d := range instance.Disks {
+		if d != nil && d.Boot {
+			return d
+		}
+	}
+	return nil
+}
+
+// bootDiskLabels returns the device name of the boot disk of instance and,
+// if the instance payload carries it, the name of the image the disk was
+// created from.
+func bootDiskLabels(instance *compute.Instance) map[string]string {
+	labels := map[string]string{}
+	boot := bootDisk(instance)
+	if boot == nil {
+		return labels
+	}
+	if boot.DeviceName != "" {
+		labels["__meta_gce_boot_disk"] = boot.DeviceName
+	}
+	if boot.InitializeParams != nil && boot.InitializeParams.SourceImage != "" {
+		labels["__meta_gce_source_image"] = parseResource(boot.InitializeParams.SourceImage)
+	}
+	return labels
+}
+
+// sourceImage returns the URL of the image the boot disk of instance was
+// created from, looking up the disk if the instance does not say.
+func (r *imageResolver) sourceImage(ctx context.Context, instance *compute.Instance, credentialsFile string) (string, error) {
+	boot := bootDisk(instance)
+	if boot == nil {
+		return "", errors.Errorf("No boot disk on %v", instance.Name)
+	}
+	if boot.InitializeParams != nil && boot.InitializeParams.SourceImage != "" {
+		return boot.InitializeParams.SourceImage, nil
+	}
+
+	if err, ok := r.errs[boot.Source]; ok {
+		return "", err
+	}
+	if image, ok := r.sourceImages[boot.Source]; ok {
+		return image, nil
+	}
+
+	image, err := getDiskSourceImage(ctx, boot.Source, credentialsFile)
+	if err == nil && image == "" {
+		err = errors.Errorf("Disk %v has no source image", boot.Source)
+	}
+	if err != nil {
+		r.errs[boot.Source] = err
+		return "", err
+	}
+	r.sourceImages[boot.Source] = image
+	return image, nil
+}
+
+// labelSourceImage adds __meta_gce_source_image to the targets of instance
+// if InstanceToTargets could not, looking up its boot disk. The label is left
+// out if the lookup fails.
+func (r *imageResolver) labelSourceImage(ctx context.Context, instance *compute.Instance, config SearchConfig, targets []DiscoveryTarget) {
+	if len(targets) == 0 {
+		return
+	}
+	if _, ok := targets[0].Labels["__meta_gce_source_image"]; ok {
+		return
+	}
+	image, err := r.sourceImage(ctx, instance, config.CredentialsFile)
+	if err != nil {
+		log.Warningf("Not labelling %v for %v with its source image: %v", instance.Name, targets[0].Labels["job"], err)
+		return
+	}
+	for _, t := range targets {
+		t.Labels["__meta_gce_source_image"] = parseResource(image)
+	}
+}
+
+// family returns the family of the image at imageURL.
+func (r *imageResolver) family(ctx context.Context, imageURL, credentialsFile string) (string, error) {
+	m := imageLinkPattern.FindStringSubmatch(imageURL)
+	if m != nil && m[2] != "" {
+		return m[3], nil
+	}
+
+	if err, ok := r.errs[imageURL]; ok {
+		return "", err
+	}
+	if family, ok := r.families[imageURL]; ok {
+		return family, nil
+	}
+
+	family, err := getImageFamily(ctx, imageURL, credentialsFile)
+	if err != nil {
+		r.errs[imageURL] = err
+		return "", err
+	}
+	r.families[imageURL] = family
+	return family, nil
+}
+
+// imageMatch reports whether instance was booted from one of the images or
+// image families of config. Instances whose image cannot be found are
+// included.
+func (r *imageResolver) imageMatch(ctx context.Context, instance *compute.Instance, config SearchConfig) bool {
+	if len(config.Images) == 0 && len(config.ImageFamilies) == 0 {
+		return true
+	}
+
+	image, err := r.sourceImage(ctx, instance, config.CredentialsFile)
+	if err != nil {
+		return imageLookupFailed(instance, config, err)
+	}
+
+	if len(config.Images) != 0 && !globsMatch(config.Images, parseResource(image)) {
+		return false
+	}
+
+	if len(config.ImageFamilies) != 0 {
+		family, err := r.family(ctx, image, config.CredentialsFile)
+		if err != nil {
+			return imageLookupFailed(instance, config, err)
+		}
+		if !globsMatch(config.ImageFamilies, family) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func imageLookupFailed(instance *compute.Instance, config SearchConfig, err error) bool {
+	job := reportedJob(instance, config)
+	log.Warningf("Including %v for %v, unable to find its boot image: %v", instance.Name, job, err)
+	imageLookupErrors.WithLabelValues(job).Inc()
+	return true
+}
+
+// filterImages returns the instances booted from the images or image
+// families of config.
+func filterImages(ctx context.Context, instances []*compute.Instance, config SearchConfig, resolver *imageResolver) []*compute.Instance {
+	res := []*compute.Instance{}
+	for _, instance := range instances {
+		if resolver.imageMatch(ctx, instance, config) {
+			res = append(res, instance)
+		}
+	}
+	return res
+}
+
+// globsMatch reports whether s matches any of globs.
+func globsMatch(globs []string, s string) bool {
+	for _, g := range globs {
+		if ok, _ := path.Match(g, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// validateImageGlobs checks the globs of an images or image_families setting.
+func validateImageGlobs(setting string, globs []string) error {
+	for _, g := range globs {
+		if strings.TrimSpace(g) == "" {
+			return errors.Errorf("Empty pattern in %v", setting)
+		}
+		if _, err := path.Match(g, ""); err != nil {
+			return errors.Wrapf(err, "Malformed %v pattern %q", setting, g)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestDiscoverTargetsImages(t *testing.T) {
+	const images = "https://www.googleapis.com/compute/v1/projects/images-project/global/images/"
+	const disks = "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-b/disks/"
+	withBootDisk := func(instance *compute.Instance, disk, image string) *compute.Instance {
+		d := &compute.AttachedDisk{Boot: true, Source: disks + disk}
+		if image != "" {
+			d.InitializeParams = &compute.AttachedDiskInitializeParams{SourceImage: image}
+		}
+		instance.Disks = []*compute.AttachedDisk{{Source: disks + "data"}, d}
+		return instance
+	}
+
+	diskCalls := map[string]int{}
+	getDiskSourceImage = func(ctx context.Context, diskURL, credentialsFile string) (string, error) {
+		diskCalls[diskURL]++
+		switch diskURL {
+		case disks + "golden-2":
+			return images + "golden-v20250301", nil
+		case disks + "ubuntu-1":
+			return images + "family/ubuntu-2204", nil
+		}
+		return "", errors.New("permission denied")
+	}
+	familyCalls := map[string]int{}
+	getImageFamily = func(ctx context.Context, imageURL, credentialsFile string) (string, error) {
+		familyCalls[imageURL]++
+		return map[string]string{
+			images + "golden-v20250101": "golden",
+			images + "golden-v20250301": "golden",
+			images + "debian-12-v1":     "debian-12",
+		}[imageURL], nil
+	}
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			withBootDisk(testInstance("golden-1", "us-central1-b", "10.0.0.1", "node"), "golden-1", images+"golden-v20250101"),
+			withBootDisk(testInstance("golden-2", "us-central1-b", "10.0.0.2", "node"), "golden-2", ""),
+			withBootDisk(testInstance("debian-1", "us-central1-b", "10.0.0.3", "node"), "debian-1", images+"debian-12-v1"),
+			withBootDisk(testInstance("ubuntu-1", "us-central1-b", "10.0.0.4", "node"), "ubuntu-1", ""),
+			withBootDisk(testInstance("broken-1", "us-central1-b", "10.0.0.5", "node"), "broken-1", ""),
+		},
+	})
+	defer func() {
+		getDiskSourceImage = fetchDiskSourceImage
+		getImageFamily = fetchImageFamily
+		listInstances = listAllInstances
+	}()
+
+	configs := []SearchConfig{
+		{Job: "images", Images: []string{"golden-v2025*"}, Project: "test-project", Ports: []int{80}},
+		{Job: "families", ImageFamilies: []string{"golden", "ubuntu-*"}, Project: "test-project", Ports: []int{80}},
+		{Job: "both", Images: []string{"golden-v202503*"}, ImageFamilies: []string{"golden"}, Project: "test-project", Ports: []int{80}},
+	}
+
+	errorsBefore := counterValue(imageLookupErrors.WithLabelValues("families"))
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := map[string][]string{
+		"images":   {"10.0.0.1:80", "10.0.0.2:80", "10.0.0.5:80"},
+		"families": {"10.0.0.1:80", "10.0.0.2:80", "10.0.0.4:80", "10.0.0.5:80"},
+		"both":     {"10.0.0.2:80", "10.0.0.5:80"},
+	}
+	if got := targetsByJob(res); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+
+	for disk, n := range diskCalls {
+		if n != 1 {
+			t.Fatalf("Expected %v to be looked up once, got %v", disk, n)
+		}
+	}
+	if _, ok := diskCalls[disks+"golden-1"]; ok {
+		t.Fatalf("Expected the source image in the instance to be used")
+	}
+	for image, n := range familyCalls {
+		if n != 1 {
+			t.Fatalf("Expected %v to be looked up once, got %v", image, n)
+		}
+	}
+	if _, ok := familyCalls[images+"family/ubuntu-2204"]; ok {
+		t.Fatalf("Expected the family in the image URL to be used")
+	}
+
+	if got := counterValue(imageLookupErrors.WithLabelValues("families")) - errorsBefore; got != 1 {
+		t.Fatalf("Expected 1 image lookup error, got %v", got)
+	}
+}
+
+func TestDiscoverTargetsBootImageLabels(t *testing.T) {
+	const images = "https://www.googleapis.com/compute/v1/projects/images-project/global/images/"
+	const disks = "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-b/disks/"
+	withBootDisk := func(instance *compute.Instance, disk, image string) *compute.Instance {
+		d := &compute.AttachedDisk{Boot: true, DeviceName: "persistent-disk-0", Source: disks + disk}
+		if image != "" {
+			d.InitializeParams = &compute.AttachedDiskInitializeParams{SourceImage: image}
+		}
+		instance.Disks = []*compute.AttachedDisk{{DeviceName: "data", Source: disks + "data"}, d}
+		return instance
+	}
+
+	diskCalls := map[string]int{}
+	getDiskSourceImage = func(ctx context.Context, diskURL, credentialsFile string) (string, error) {
+		diskCalls[diskURL]++
+		if diskURL == disks+"listed-2" {
+			return images + "golden-v20250301", nil
+		}
+		return "", errors.New("permission denied")
+	}
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			withBootDisk(testInstance("payload-1", "us-central1-b", "10.0.0.1", "node"), "payload-1", images+"golden-v20250101"),
+			withBootDisk(testInstance("listed-2", "us-central1-b", "10.0.0.2", "node"), "listed-2", ""),
+			withBootDisk(testInstance("broken-3", "us-central1-b", "10.0.0.3", "node"), "broken-3", ""),
+			testInstance("diskless-4", "us-central1-b", "10.0.0.4", "node"),
+		},
+	})
+	defer func() {
+		getDiskSourceImage = fetchDiskSourceImage
+		listInstances = listAllInstances
+	}()
+
+	configs := []SearchConfig{
+		{Job: "cheap", Tags: []string{"node"}, Project: "test-project", Ports: []int{80}},
+		{Job: "resolving", Tags: []string{"node"}, Project: "test-project", Ports: []int{80}, ResolveBootImage: true},
+		{Job: "resolving_again", Tags: []string{"node"}, Project: "test-project", Ports: []int{9100}, ResolveBootImage: true},
+	}
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	type diskLabels struct{ disk, image string }
+	got := map[string]map[string]diskLabels{}
+	for _, target := range res {
+		job := target.Labels["job"]
+		if got[job] == nil {
+			got[job] = map[string]diskLabels{}
+		}
+		got[job][target.Labels["__meta_gce_instance_name"]] = diskLabels{
+			disk:  target.Labels["__meta_gce_boot_disk"],
+			image: target.Labels["__meta_gce_source_image"],
+		}
+	}
+	cheap := map[string]diskLabels{
+		"payload-1":  {disk: "persistent-disk-0", image: "golden-v20250101"},
+		"listed-2":   {disk: "persistent-disk-0"},
+		"broken-3":   {disk: "persistent-disk-0"},
+		"diskless-4": {},
+	}
+	resolved := map[string]diskLabels{
+		"payload-1":  {disk: "persistent-disk-0", image: "golden-v20250101"},
+		"listed-2":   {disk: "persistent-disk-0", image: "golden-v20250301"},
+		"broken-3":   {disk: "persistent-disk-0"},
+		"diskless-4": {},
+	}
+	expected := map[string]map[string]diskLabels{
+		"cheap":           cheap,
+		"resolving":       resolved,
+		"resolving_again": resolved,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %+v", got)
+	}
+
+	if !reflect.DeepEqual(diskCalls, map[string]int{disks + "listed-2": 1, disks + "broken-3": 1}) {
+		t.Fatalf("Expected only disks missing from the payload to be looked up once, got %v", diskCalls)
+	}
+}
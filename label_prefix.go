@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+)
+
+// metaLabelPrefix is the prefix of the labels gcesd sets from instances,
+// which Prometheus drops after relabelling.
+const metaLabelPrefix = "__meta_gce_"
+
+// stripMetaPrefix is the prefix meta labels are renamed to by strip_meta.
+const stripMetaPrefix = "gce_"
+
+// labelPrefix returns the prefix the meta labels of conf's targets are
+// renamed to on output, or "" if they keep their names.
+func labelPrefix(conf SearchConfig) string {
+	if conf.StripMeta {
+		return stripMetaPrefix
+	}
+	return conf.LabelPrefix
+}
+
+// renameLabels returns targets with their __meta_gce_ labels renamed to the
+// prefix of their job in prefixes. The job label is never renamed, and a
+// label which already exists under the new name keeps its value. targets is
+// not modified.
+func renameLabels(targets []DiscoveryTarget, prefixes map[string]string) []DiscoveryTarget {
+	if len(prefixes) == 0 {
+		return targets
+	}
+
+	res := make([]DiscoveryTarget, 0, len(targets))
+	for _, t := range targets {
+		prefix, ok := prefixes[t.Labels["job"]]
+		if !ok {
+			res = append(res, t)
+			continue
+		}
+
+		labels := make(map[string]string, len(t.Labels))
+		for k, v := range t.Labels {
+			if !strings.HasPrefix(k, metaLabelPrefix) {
+				labels[k] = v
+			}
+		}
+		for k, v := range t.Labels {
+			if !strings.HasPrefix(k, metaLabelPrefix) {
+				continue
+			}
+			renamed := prefix + strings.TrimPrefix(k, metaLabelPrefix)
+			if _, ok := labels[renamed]; !ok {
+				labels[renamed] = v
+			}
+		}
+		res = append(res, DiscoveryTarget{Targets: t.Targets, Labels: labels})
+	}
+	return res
+}
+
+// emitJobLabel reports whether the targets of conf are written with their
+// job label, which they are unless emit_job_label is false.
+func emitJobLabel(conf SearchConfig) bool {
+	return conf.EmitJobLabel == nil || *conf.EmitJobLabel
+}
+
+// outputLabels returns targets with the labels they are written with: their
+// values truncated to the max_label_value_length of their job in
+// info.maxValueLength, their meta labels renamed to the prefix of their job
+// in info.labelPrefixes, and without the job label if their job is in
+// info.omitJobLabel. Targets keep their job label until then as metrics,
+// min_targets and outputs are by job.
+func outputLabels(targets []DiscoveryTarget, info syncInfo) []DiscoveryTarget {
+	targets = truncateTargets(targets, info.maxValueLength)
+	targets = renameLabels(targets, info.labelPrefixes)
+	if len(info.omitJobLabel) == 0 {
+		return targets
+	}
+
+	res := make([]DiscoveryTarget, 0, len(targets))
+	for _, t := range targets {
+		if !info.omitJobLabel[t.Labels["job"]] {
+			res = append(res, t)
+			continue
+		}
+		labels := copyLabels(t.Labels)
+		delete(labels, "job")
+		res = append(res, DiscoveryTarget{Targets: t.Targets, Labels: labels})
+	}
+	return res
+}
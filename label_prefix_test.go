@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRenameLabels(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+	targets, err := InstanceToTargets(instance, SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}})
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	expectedLabels := func(prefix string) map[string]string {
+		return map[string]string{
+			"job":                           "web",
+			prefix + "instance_tags":        ",web,",
+			prefix + "instance_zone":        "us-central1-b",
+			prefix + "instance_region":      "us-central1",
+			prefix + "instance_preemptible": "false",
+			prefix + "provisioning_model":   "STANDARD",
+			prefix + "automatic_restart":    "true",
+			prefix + "instance_type":        "g1-small",
+			prefix + "instance_project":     "test-project",
+			prefix + "instance_name":        "web-1",
+			prefix + "instance_hostname":    "web-1.c.test-project.internal",
+			prefix + "instance_status":      "RUNNING",
+			prefix + "private_ip":           "10.0.0.1",
+		}
+	}
+
+	cases := []struct {
+		prefixes map[string]string
+		expected map[string]string
+	}{
+		{prefixes: nil, expected: expectedLabels("__meta_gce_")},
+		{prefixes: map[string]string{"other": "gce_"}, expected: expectedLabels("__meta_gce_")},
+		{prefixes: map[string]string{"web": stripMetaPrefix}, expected: expectedLabels("gce_")},
+		{prefixes: map[string]string{"web": "vm_"}, expected: expectedLabels("vm_")},
+	}
+	for i, c := range cases {
+		res := renameLabels(targets, c.prefixes)
+		if len(res) != 1 || !reflect.DeepEqual(res[0].Labels, c.expected) || !reflect.DeepEqual(res[0].Targets, []string{"10.0.0.1:80"}) {
+			t.Fatalf("Discrepancy in result of case %v\nResult: %v", i, prettyPrint(res))
+		}
+	}
+	if _, ok := targets[0].Labels["__meta_gce_instance_name"]; !ok {
+		t.Fatalf("Expected the discovered targets to be left unchanged")
+	}
+
+	// Existing labels are not overwritten by renamed ones.
+	clash := []DiscoveryTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web", "gce_instance_name": "static", "__meta_gce_instance_name": "web-1"}}}
+	if res := renameLabels(clash, map[string]string{"web": "gce_"}); res[0].Labels["gce_instance_name"] != "static" {
+		t.Fatalf("Expected the existing label to be kept, got %v", prettyPrint(res))
+	}
+}
+
+func TestWriteTargetsLabelPrefixes(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	targets := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.2:80"}, Labels: map[string]string{"job": "web", "__meta_gce_instance_project": "prod"}},
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node", "__meta_gce_instance_project": "prod"}},
+	}
+	out := filepath.Join(dir, "targets.yaml")
+	info := syncInfo{labelPrefixes: map[string]string{"web": "gce_"}}
+	if err := WriteTargets(context.Background(), targets, out, info); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	d, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	var written []DiscoveryTarget
+	if err := yaml.Unmarshal(d, &written); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	expected := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node", "__meta_gce_instance_project": "prod"}},
+		{Targets: []string{"10.0.0.2:80"}, Labels: map[string]string{"job": "web", "gce_instance_project": "prod"}},
+	}
+	if !reflect.DeepEqual(written, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %s", d)
+	}
+
+	m, err := ioutil.ReadFile(manifestFile(out))
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if !strings.Contains(string(m), `"prod": 2`) {
+		t.Fatalf("Expected the manifest to count renamed targets' projects\nOutput: %s", m)
+	}
+}
+
+func TestValidateConfigLabelPrefix(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		config   SearchConfig
+		expected string
+	}{
+		{config: SearchConfig{LabelPrefix: "gce_"}},
+		{config: SearchConfig{StripMeta: true}},
+		{config: SearchConfig{LabelPrefix: "gce_", StripMeta: true}, expected: "Only one of label_prefix and strip_meta may be specified"},
+		{config: SearchConfig{LabelPrefix: "gce-"}, expected: `Invalid label_prefix "gce-"`},
+		{config: SearchConfig{LabelPrefix: "__meta_"}, expected: `Invalid label_prefix "__meta_"`},
+	}
+	for i, c := range cases {
+		c.config.Job, c.config.Tags, c.config.Project, c.config.Ports = "web", []string{"web"}, "test-project", []int{80}
+		err := ValidateConfig(c.config)
+		if c.expected == "" && err != nil {
+			t.Fatalf("Unexpected error in case %v\nError: %v", i, err)
+		}
+		if c.expected != "" && (err == nil || !strings.Contains(err.Error(), c.expected)) {
+			t.Fatalf("Expected %q in case %v\nError: %v", c.expected, i, err)
+		}
+	}
+}
+
+func TestEmitJobLabel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+			testInstance("web-2", "us-central1-b", "10.0.0.2", "web"),
+			testInstance("db-1", "us-central1-b", "10.0.0.3", "db"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	emit := false
+	webFile := filepath.Join(dir, "web.yaml")
+	defaultFile := filepath.Join(dir, "targets.yaml")
+	configs := []SearchConfig{
+		{Job: "jobless-web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}, Output: webFile, EmitJobLabel: &emit, MinTargets: 2},
+		{Job: "db", Tags: []string{"db"}, Project: "test-project", Ports: []int{5432}},
+	}
+	scheduler := newDiscoveryScheduler(configs, time.Minute)
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := scheduler.Sync(context.Background(), now, true); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	writer := newTargetWriter(defaultFile, false)
+	writer.minTargets = scheduler.MinTargetsByFile(defaultFile)
+	info := syncInfo{time: now, omitJobLabel: scheduler.OmittedJobLabels()}
+	if err := writer.Write(context.Background(), scheduler.TargetsByFile(defaultFile), false, info); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	read := func(file string) []DiscoveryTarget {
+		d, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		var targets []DiscoveryTarget
+		if err := yaml.Unmarshal(d, &targets); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		return targets
+	}
+	web := read(webFile)
+	if len(web) != 2 {
+		t.Fatalf("Expected the web targets to be routed to %v, got %v", webFile, prettyPrint(web))
+	}
+	for _, target := range web {
+		if _, ok := target.Labels["job"]; ok {
+			t.Fatalf("Expected no job label, got %v", prettyPrint(target))
+		}
+	}
+	if db := read(defaultFile); len(db) != 1 || db[0].Labels["job"] != "db" {
+		t.Fatalf("Expected the db target to keep its job label, got %v", prettyPrint(db))
+	}
+
+	// Accounting is by the entry's job.
+	if got := gaugeValue(targetCount.WithLabelValues("jobless-web")); got != 2 {
+		t.Fatalf("Expected 2 targets counted for jobless-web, got %v", got)
+	}
+	m, err := ioutil.ReadFile(manifestFile(webFile))
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if !strings.Contains(string(m), `"jobless-web": 2`) {
+		t.Fatalf("Expected the manifest to count jobless-web\nOutput: %s", m)
+	}
+}
+
+func TestConfigWarningsEmitJobLabel(t *testing.T) {
+	t.Parallel()
+
+	emit, omit := true, false
+	cases := []struct {
+		config   SearchConfig
+		warnings int
+	}{
+		{config: SearchConfig{}},
+		{config: SearchConfig{EmitJobLabel: &emit}},
+		{config: SearchConfig{EmitJobLabel: &omit}, warnings: 1},
+		{config: SearchConfig{EmitJobLabel: &omit, TargetLabels: map[string]string{"service": "web"}}},
+		{config: SearchConfig{EmitJobLabel: &omit, RelabelConfigs: []RelabelConfig{{Action: "labeldrop"}}}},
+	}
+	for i, c := range cases {
+		if got := configWarnings(c.config); len(got) != c.warnings {
+			t.Fatalf("Expected %v warnings in case %v, got %v", c.warnings, i, got)
+		}
+	}
+}
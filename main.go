@@ -3,13 +3,22 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/golang/glog"
@@ -19,17 +28,48 @@ import (
 	"gopkg.in/yaml.v2"
 
 	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jwt"
 	compute "google.golang.org/api/compute/v1"
 	"os/signal"
 	"syscall"
+	"text/template"
 )
 
 var (
-	configFilename    = flag.String("config", "", "Path to config file")
-	outputFilename    = flag.String("output", "", "Path to results file")
+	configFilename    = flag.String("config", "", "Path to config file, or a gs://bucket/object or metadata://{project,instance}/key URL")
+	kubernetesAPIURL  = flag.String("kubernetes.api-url", "", "URL of the Kubernetes API for configmap:// outputs, such as a kubectl proxy, rather than the in-cluster API")
+	stdoutChanges     = flag.Bool("output.stdout-changes-only", false, "When printing results to stdout, only print them when they change, rather than on every sync")
+	once              = flag.Bool("once", false, "Discover and write targets once, then exit")
+	outputMode        = flag.String("output.mode", "", "Octal file mode of the results file, such as 0640, rather than one set by the umask")
+	outputUID         = flag.Int("output.uid", -1, "User id to give ownership of the results file to")
+	outputGID         = flag.Int("output.gid", -1, "Group id to give ownership of the results file to")
+	maxShrinkPercent  = flag.Float64("write.max-shrink-percent", 100, "Skip writing results with more than this percentage fewer targets than last written, unless the write is forced")
+	verifyWrites      = flag.Bool("write.verify", false, "Read back each written results file and fail the write if it differs from the intended content")
+	writeHeader       = flag.Bool("write.header", true, "Start YAML results files with comments describing the sync which discovered them")
+	compressOutput    = flag.Bool("output.compress", false, "Also write a gzipped copy of each results file as <output>.gz; results files named *.gz are always gzipped")
+	refreshInterval   = flag.Duration("write.refresh-interval", 0, "Rewrite results files with unchanged targets once they were last written this long ago, 0 to only write them when targets change")
+	keepBackup        = flag.Bool("output.keep-backup", false, "Keep the previous results file as <output>.bak after writing a new one")
+	groupOutput       = flag.Bool("output.group", true, "Merge targets with identical labels into a single target group, rather than writing one group per target")
+	removeStale       = flag.Bool("output.remove-stale", false, "Remove output files no longer written to by any job, rather than emptying them")
+	outputFormat      = flag.String("output.format", outputFormatAuto, "Format of the results file, yaml, json, or auto to choose by the file's extension")
 	discoveryInterval = flag.Duration("discovery.interval", 30*time.Second, "Period of discovery update")
 	discoveryTimeout  = flag.Duration("discovery.timeout", 25*time.Second, "Timeout of discovery update")
+	listConcurrency   = flag.Int("discovery.concurrency", 4, "Maximum number of projects listed at once")
+	validateOnly      = flag.Bool("validate-config", false, "Validate the config file, print a summary of its jobs and exit")
 	metricsAddr       = flag.String("metrics.addr", ":8080", "Address to serve metrics on")
+	consulAddr        = flag.String("consul.addr", "", "Address of a consul agent to register the targets of jobs setting consul as services with")
+	consulTimeout     = flag.Duration("consul.timeout", 10*time.Second, "Timeout of registering targets with consul, after they are written")
+	serveHTTPSD       = flag.Bool("http-sd", false, "Serve targets for prometheus' http_sd_config at /sd on the metrics address, making -output optional")
+	strictIncludes    = flag.Bool("config.strict-includes", false, "Fail to load the config when an include matches no files, rather than logging a warning")
+	watchConfigFile   = flag.Bool("config.watch", false, "Reload the config file when it changes")
+	watchDebounce     = flag.Duration("config.watch-debounce", time.Second, "How long the config file must be unchanged before it is reloaded")
+	expandEnv         = flag.Bool("config.expand-env", true, "Expand ${VAR} references to environment variables in config values")
+	maxPortRange      = flag.Int("config.max-port-range", 256, "Maximum number of ports a single port range in the config may expand to")
+	instanceAgeLabel  = flag.Bool("labels.instance-age", false, "Label targets with __meta_gce_instance_age_seconds, which changes on every sync so results files are rewritten on every sync")
+	metadataLabelMax  = flag.Int("metadata-labels.max-length", 512, "Truncate metadata_labels values to this many bytes, 0 for no limit")
+	labelValueMax     = flag.Int("labels.max-value-length", 1024, "Truncate label values to this many bytes in jobs which do not set max_label_value_length, 0 for no limit")
+	tagsLabelFormat   = flag.String("tags.label-format", tagsLabelJoined, "How network tags are labelled in jobs which do not set tags_label_format: joined, boolean or both")
+	ignoreTagCase     = flag.Bool("tags.case-insensitive", false, "Match network tags case-insensitively in every job, as if each set case_insensitive_tags")
 
 	targetCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Name: "gcesd_targets",
@@ -43,31 +83,451 @@ var (
 		Name: "gcesd_sync_count",
 		Help: "Count of the GCE api to prometheus target sync operation, labeled by result",
 	}, []string{"result"})
-	resultWrite = prometheus.NewCounter(prometheus.CounterOpts{
+	resultWrite = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "gcesd_target_write_count",
-		Help: "Number of times that the output file is updated",
+		Help: "Number of times that an output file is updated, by file",
+	}, []string{"file"})
+	resultWriteFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_target_write_failures_total",
+		Help: "Number of times that updating an output file failed, by file",
+	}, []string{"file"})
+	resultVerifyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_target_verify_failures_total",
+		Help: "Number of times that an output file read back after a write differed from what was written, by file",
+	}, []string{"file"})
+	instancesSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_instances_skipped_count",
+		Help: "Number of instances skipped during discovery, by job name and reason",
+	}, []string{"job", "reason"})
+	configReload = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_config_reload_total",
+		Help: "Number of config reloads, by result",
+	}, []string{"result"})
+	configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcesd_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful config load",
 	})
+	instancesWarmingUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gcesd_instances_warming_up",
+		Help: "Number of matching instances younger than min_age, by job name and project",
+	}, []string{"job", "project"})
+	instanceTimestampErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_instance_timestamp_errors_total",
+		Help: "Number of instances included despite an unparseable creation timestamp, by job name",
+	}, []string{"job"})
+	jobTemplateSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_job_template_skipped_total",
+		Help: "Number of instances skipped as their job_template failed to render or rendered an empty job, by config entry index",
+	}, []string{"entry"})
+	createdLabelErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_instance_created_label_errors_total",
+		Help: "Number of instances labelled without their creation time as it could not be parsed, by job name",
+	}, []string{"job"})
+	regionParseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_region_parse_errors_total",
+		Help: "Number of instances labelled without a region as their zone was not of the form <region>-<letter>, by job name",
+	}, []string{"job"})
+)
+
+// zonePattern matches zone names such as europe-west1-b, optionally
+// containing glob characters.
+var zonePattern = regexp.MustCompile(`^[a-z0-9*?\[\]-]+$`)
+
+// regionPattern matches region names such as europe-west1, and
+// regionLikeZonePattern catches zone names given where a region is expected.
+var (
+	regionPattern         = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+$`)
+	regionLikeZonePattern = regexp.MustCompile(`^[a-z]+-[a-z]+[0-9]+-[a-z]$`)
 )
 
+// emptyEnvRefPattern matches environment variable references without a
+// name, such as ${} or ${:-default}, which expansion leaves as written.
+var emptyEnvRefPattern = regexp.MustCompile(`\$\{(:-[^}]*)?\}`)
+
+// labelNamePattern matches valid Prometheus label names.
+var labelNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabelName reports whether name may not be set from the config, as
+// it is the job label or a label reserved for Prometheus or the built in
+// __meta_gce_ labels.
+func reservedLabelName(name string) bool {
+	return name == "job" || strings.HasPrefix(name, "__")
+}
+
+// timeNow returns the current time, it is replaced in tests.
+var timeNow = time.Now
+
+// listInstances is the function used by DiscoverTargets to fetch every
+// instance in a project matching an API filter, it is replaced in tests.
+var listInstances = listAllInstances
+
+// outputFilenames are the files results are written to, set by -output.
+var outputFilenames outputList
+
+func init() {
+	flag.Var(&outputFilenames, "output", "Path to results file, a gs://bucket/object or configmap://namespace/name/key URL to upload results to, or - to print results to stdout. "+
+		"May be repeated, or a comma separated list, to write the same results to several files")
+}
+
+// newComputeService is used by computeServiceFor to build a compute client
+// from a credentials file, or application default credentials when the path
+// is empty. It is replaced in tests.
+var newComputeService = NewComputeServiceFromFile
+
+// computeServices caches one compute client per credentials file.
+var computeServices = struct {
+	sync.Mutex
+	byFile map[string]*compute.Service
+}{byFile: map[string]*compute.Service{}}
+
 func init() {
 	prometheus.MustRegister(targetCount)
 	prometheus.MustRegister(syncDuration)
 	prometheus.MustRegister(syncResult)
 	prometheus.MustRegister(resultWrite)
+	prometheus.MustRegister(resultWriteFailures)
+	prometheus.MustRegister(resultVerifyFailures)
+	prometheus.MustRegister(instancesSkipped)
+	prometheus.MustRegister(regionParseErrors)
+	prometheus.MustRegister(createdLabelErrors)
+	prometheus.MustRegister(jobTemplateSkipped)
+	prometheus.MustRegister(configReload)
+	prometheus.MustRegister(instancesWarmingUp)
+	prometheus.MustRegister(instanceTimestampErrors)
+	prometheus.MustRegister(configLastReload)
 }
 
 type SearchConfig struct {
-	Job     string   `yaml:"job"`
-	Tags    []string `yaml:"tags"`
-	Project string   `yaml:"project"`
-	Ports   []int    `yaml:"ports"`
+	Job         string            `yaml:"job"`
+	JobTemplate string            `yaml:"job_template"`
+	Tags        []string          `yaml:"tags"`
+	ExcludeTags []string          `yaml:"exclude_tags"`
+	TagMatch    string            `yaml:"tag_match"`
+	Labels      map[string]string `yaml:"labels"`
+	Metadata    map[string]string `yaml:"metadata"`
+	Project     string            `yaml:"project"`
+	Projects    []string          `yaml:"projects"`
+	Ports       PortList          `yaml:"-"`
+	Zones       []string          `yaml:"zones"`
+	Regions     []string          `yaml:"regions"`
+	Networks    []string          `yaml:"networks"`
+	Subnetworks []string          `yaml:"subnetworks"`
+	NameRegex   string            `yaml:"name_regex"`
+	TagRegex    []string          `yaml:"tag_regex"`
+	Statuses    []string          `yaml:"statuses"`
+
+	TagGroupRefs      []string          `yaml:"tag_group_refs"`
+	MachineTypes      []string          `yaml:"machine_types"`
+	Preemptible       string            `yaml:"preemptible"`
+	MinAge            time.Duration     `yaml:"min_age"`
+	InstanceGroups    []string          `yaml:"instance_groups"`
+	Accelerators      string            `yaml:"accelerators"`
+	AcceleratorType   string            `yaml:"accelerator_type"`
+	ExternalIP        string            `yaml:"external_ip"`
+	ExcludeGKENodes   bool              `yaml:"exclude_gke_nodes"`
+	LabelSelectors    []string          `yaml:"label_selectors"`
+	Images            []string          `yaml:"images"`
+	ImageFamilies     []string          `yaml:"image_families"`
+	RequireMetadata   []string          `yaml:"require_metadata"`
+	APIFilter         string            `yaml:"api_filter"`
+	IgnoreTagCase     bool              `yaml:"case_insensitive_tags"`
+	TagsLabelFormat   string            `yaml:"tags_label_format"`
+	TargetLabels      map[string]string `yaml:"target_labels"`
+	PortsFromMetadata string            `yaml:"ports_from_metadata"`
+	PortLabel         string            `yaml:"port_label"`
+	AllowNoPorts      bool              `yaml:"allow_no_ports"`
+	AddressType       string            `yaml:"address_type"`
+	DNSForm           string            `yaml:"dns_form"`
+	InterfaceIndex    *int              `yaml:"interface_index"`
+	InterfaceNetwork  string            `yaml:"interface_network"`
+	AllInterfaces     bool              `yaml:"all_interfaces"`
+	IncludeAliasIPs   bool              `yaml:"include_alias_ips"`
+	AddressTemplate   string            `yaml:"address_template"`
+	Interval          time.Duration     `yaml:"interval"`
+	CredentialsFile   string            `yaml:"credentials_file"`
+	Output            string            `yaml:"output"`
+	Consul            bool              `yaml:"consul"`
+	MinTargets        int               `yaml:"min_targets"`
+	RemovedTargetTTL  time.Duration     `yaml:"removed_target_ttl"`
+	MetadataLabels    []string          `yaml:"metadata_labels"`
+	ResolveGroups     bool              `yaml:"resolve_instance_groups"`
+	ResolveBootImage  bool              `yaml:"resolve_boot_image"`
+	LabelPrefix       string            `yaml:"label_prefix"`
+	StripMeta         bool              `yaml:"strip_meta"`
+	RelabelConfigs    []RelabelConfig   `yaml:"relabel_configs"`
+	EmitJobLabel      *bool             `yaml:"emit_job_label"`
+	Scheme            string            `yaml:"scheme"`
+	MetricsPath       string            `yaml:"metrics_path"`
+	AddressOverride   string            `yaml:"address_override_metadata_key"`
+	Mode              string            `yaml:"mode"`
+	MaxLabelValueLen  *int              `yaml:"max_label_value_length"`
+
+	ProjectDiscovery *ProjectDiscoveryConfig `yaml:"project_discovery"`
+	ExcludeProjects  []string                `yaml:"exclude_projects"`
+
+	AllowDuplicateJobs bool `yaml:"allow_duplicate_jobs"`
 
 	XXX map[string]interface{} `yaml:",inline"`
+
+	// Fields derived from the above by compileConfig.
+	nameRegex       *regexp.Regexp
+	tagRegexes      []*regexp.Regexp
+	labelSelectors  []labelRequirement
+	addressTemplate *template.Template
+	jobTemplate     *template.Template
+	relabelRules    []relabelRule
+	// portSpecs are the structured entries of Ports, read by UnmarshalYAML.
+	portSpecs []PortSpec
+	// entry is the index of the config among those discovered, set during
+	// discovery to tell apart entries without a fixed job in metrics.
+	entry int
+}
+
+// Values accepted for SearchConfig.Preemptible, an empty value behaves as
+// preemptibleInclude.
+const (
+	preemptibleInclude = "include"
+	preemptibleExclude = "exclude"
+	preemptibleOnly    = "only"
+)
+
+// Values accepted for SearchConfig.Accelerators, an empty value matches
+// instances regardless of their accelerators.
+const (
+	acceleratorsRequire = "require"
+	acceleratorsExclude = "exclude"
+)
+
+// Values accepted for SearchConfig.ExternalIP, an empty value behaves as
+// externalIPAny.
+const (
+	externalIPRequire = "require"
+	externalIPExclude = "exclude"
+	externalIPAny     = "any"
+)
+
+// Values accepted for SearchConfig.TagsLabelFormat, an empty value behaves
+// as tagsLabelJoined. Joined tags are labelled as a single comma wrapped
+// __meta_gce_instance_tags label, boolean tags as one
+// __meta_gce_instance_tag_<tag>="true" label per tag.
+const (
+	tagsLabelJoined  = "joined"
+	tagsLabelBoolean = "boolean"
+	tagsLabelBoth    = "both"
+)
+
+// Values accepted for SearchConfig.TagMatch, an empty value behaves as
+// tagMatchAll.
+const (
+	tagMatchAll = "all"
+	tagMatchAny = "any"
+)
+
+// instanceStatuses are the statuses a compute instance may be in.
+var instanceStatuses = []string{
+	"PROVISIONING",
+	"STAGING",
+	"RUNNING",
+	"STOPPING",
+	"STOPPED",
+	"SUSPENDING",
+	"SUSPENDED",
+	"REPAIRING",
+	"TERMINATED",
+}
+
+// defaultStatuses are matched when SearchConfig.Statuses is empty, the
+// anyStatus wildcard matches every status.
+var defaultStatuses = []string{"RUNNING"}
+
+const anyStatus = "*"
+
+// unknownStatus is the __meta_gce_instance_status of instances the API
+// reports no status for.
+const unknownStatus = "UNKNOWN"
+
+// Values accepted for SearchConfig.AddressType, an empty value behaves as
+// addressInternal.
+const (
+	addressInternal = "internal"
+	addressExternal = "external"
+	addressDNS      = "dns"
+)
+
+// Values accepted for SearchConfig.DNSForm, an empty value behaves as
+// dnsFormGlobal.
+const (
+	dnsFormGlobal = "global"
+	dnsFormZonal  = "zonal"
+)
+
+// PortList is a list of ports which may be given in config as port numbers,
+// as ranges of the form "7070-7079", or as structured entries naming the port,
+// see PortSpec.
+type PortList []int
+
+func (pl *PortList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw []interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	ports, _, err := parsePortEntries(raw)
+	if err != nil {
+		return err
+	}
+	*pl = ports
+	return nil
+}
+
+// parsePortEntries parses the entries of a ports list, returning the ports
+// they list and the structured entries among them.
+func parsePortEntries(raw []interface{}) (PortList, []PortSpec, error) {
+	ports := PortList{}
+	var specs []PortSpec
+	for i, r := range raw {
+		switch v := r.(type) {
+		case int:
+			if v < 1 || v > 65535 {
+				return nil, nil, errors.Errorf("Invalid ports entry #%d: %v is out of range", i, v)
+			}
+			ports = append(ports, v)
+		case string:
+			expanded, err := parsePortRange(v)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Invalid ports entry #%d", i)
+			}
+			ports = append(ports, expanded...)
+		case map[interface{}]interface{}:
+			spec, err := parsePortSpec(v)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Invalid ports entry #%d", i)
+			}
+			ports = append(ports, spec.Port)
+			specs = append(specs, spec)
+		default:
+			return nil, nil, errors.Errorf("Invalid ports entry #%d: %v must be a number, range or ports entry", i, r)
+		}
+	}
+	return ports, specs, nil
+}
+
+// parsePortRange expands a port range such as "7070-7079", or a single port
+// given as a string, into the ports it contains.
+func parsePortRange(s string) ([]int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	start, err := parsePort(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid port range %q", s)
+	}
+	end := start
+	if len(parts) == 2 {
+		end, err = parsePort(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid port range %q", s)
+		}
+	}
+
+	if end < start {
+		return nil, errors.Errorf("Invalid port range %q, end is before start", s)
+	}
+	if end-start+1 > *maxPortRange {
+		return nil, errors.Errorf("Invalid port range %q, expands to more than %v ports", s, *maxPortRange)
+	}
+
+	ports := []int{}
+	for p := start; p <= end; p++ {
+		ports = append(ports, p)
+	}
+	return ports, nil
 }
 
 type DiscoveryTarget struct {
-	Targets []string          `yaml:"targets"`
-	Labels  map[string]string `yaml:"labels"`
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+const (
+	outputFormatAuto = "auto"
+	outputFormatYAML = "yaml"
+	outputFormatJSON = "json"
+)
+
+// resolveOutputFormat returns the format targets are written to filename
+// in, choosing by extension in auto mode and falling back to YAML. A .gz
+// extension is ignored, so targets.json.gz holds JSON.
+func resolveOutputFormat(format, filename string) (string, error) {
+	switch format {
+	case outputFormatYAML, outputFormatJSON:
+		return format, nil
+	case outputFormatAuto:
+		if isCompressedOutput(filename) {
+			filename = filename[:len(filename)-len(gzipExt)]
+		}
+		if strings.ToLower(filepath.Ext(filename)) == ".json" {
+			return outputFormatJSON, nil
+		}
+		return outputFormatYAML, nil
+	default:
+		return "", errors.Errorf("Unknown output format %q, must be one of yaml, json or auto", format)
+	}
+}
+
+// parseFileMode parses an octal file mode such as 0640.
+func parseFileMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m&^uint64(os.ModePerm) != 0 {
+		return 0, errors.Errorf("Invalid file mode %q, must be octal permission bits such as 0640", s)
+	}
+	return os.FileMode(m), nil
+}
+
+// setFilePermissions sets the mode of f, if mode is not empty, and its owner
+// and group, if uid or gid are not -1.
+func setFilePermissions(f *os.File, mode string, uid, gid int) error {
+	if mode != "" {
+		m, err := parseFileMode(mode)
+		if err != nil {
+			return err
+		}
+		if err := f.Chmod(m); err != nil {
+			return errors.Wrapf(err, "Failed to set mode of %v to %v", f.Name(), mode)
+		}
+	}
+
+	if uid != -1 || gid != -1 {
+		err := f.Chown(uid, gid)
+		if os.IsPermission(err) {
+			return errors.Wrapf(err, "Not permitted to change ownership of %v to %v:%v, chown requires root or CAP_CHOWN", f.Name(), uid, gid)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "Failed to change ownership of %v to %v:%v", f.Name(), uid, gid)
+		}
+	}
+	return nil
+}
+
+// outputContentType returns the MIME type of targets in format.
+func outputContentType(format string) string {
+	if format == outputFormatJSON {
+		return "application/json"
+	}
+	return "application/x-yaml"
+}
+
+// marshalTargets encodes targets as a file_sd file in the given format.
+func marshalTargets(targets []DiscoveryTarget, format string) ([]byte, error) {
+	if format == outputFormatJSON {
+		if targets == nil {
+			targets = []DiscoveryTarget{}
+		}
+		d, err := json.MarshalIndent(targets, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(d, '\n'), nil
+	}
+	return yaml.Marshal(targets)
 }
 
 func NewComputeService(ctx context.Context) (*compute.Service, error) {
@@ -84,216 +544,2585 @@ func NewComputeService(ctx context.Context) (*compute.Service, error) {
 	return service, nil
 }
 
+// NewComputeServiceFromFile creates a compute service authenticated with the
+// service account key in credentialsFile, falling back to application
+// default credentials if it is empty.
+func NewComputeServiceFromFile(ctx context.Context, credentialsFile string) (*compute.Service, error) {
+	if credentialsFile == "" {
+		return NewComputeService(ctx)
+	}
+
+	jwtConfig, err := readCredentialsFile(credentialsFile, compute.ComputeScope)
+	if err != nil {
+		return nil, err
+	}
+
+	service, err := compute.New(jwtConfig.Client(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create compute service")
+	}
+
+	return service, nil
+}
+
+// readCredentialsFile reads a service account key file, for use with the
+// given OAuth scopes.
+func readCredentialsFile(credentialsFile string, scopes ...string) (*jwt.Config, error) {
+	data, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read credentials file %v", credentialsFile)
+	}
+
+	jwtConfig, err := google.JWTConfigFromJSON(data, scopes...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to parse credentials file %v", credentialsFile)
+	}
+
+	return jwtConfig, nil
+}
+
+// computeServiceFor returns the cached compute client for credentialsFile,
+// creating it on first use. The client is kept for the life of the process,
+// so it is created with a background context rather than that of the sync
+// which first uses it, as its oauth2 transport refreshes tokens with it.
+func computeServiceFor(credentialsFile string) (*compute.Service, error) {
+	computeServices.Lock()
+	defer computeServices.Unlock()
+
+	if service, ok := computeServices.byFile[credentialsFile]; ok {
+		return service, nil
+	}
+
+	service, err := newComputeService(context.Background(), credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	computeServices.byFile[credentialsFile] = service
+
+	return service, nil
+}
+
 func LoadConfigFile(path string) ([]SearchConfig, error) {
-	data, err := ioutil.ReadFile(path)
+	entries, err := loadConfigEntries(path, []string{})
+	if err != nil {
+		return []SearchConfig{}, err
+	}
+
+	config := []SearchConfig{}
+	errs := configErrors{}
+	for _, e := range entries {
+		var err error
+		if *expandEnv {
+			err = expandConfigEnv(&e.SearchConfig)
+		}
+		if err == nil {
+			applyConfigFlags(&e.SearchConfig)
+			err = validateConfig(&e.SearchConfig)
+		}
+		if err != nil {
+			errs = append(errs, errors.Wrapf(err, "Failed to validate config entry #%v in %v (job %q)", e.index, e.file, e.Job))
+			continue
+		}
+		for _, w := range configWarnings(e.SearchConfig) {
+			log.Warningf("Config entry #%v in %v (job %q): %v", e.index, e.file, e.Job, w)
+		}
+		config = append(config, e.SearchConfig)
+	}
+
+	if err := checkDuplicateJobs(entries); err != nil {
+		errs = append(errs, err)
+	}
+
+	if len(errs) != 0 {
+		return []SearchConfig{}, errs
+	}
+	return config, nil
+}
+
+// configWarnings returns the problems with conf which do not make it invalid
+// but are likely mistakes.
+func configWarnings(conf SearchConfig) []string {
+	warnings := []string{}
+	if !emitJobLabel(conf) && len(conf.TargetLabels) == 0 && len(conf.RelabelConfigs) == 0 {
+		warnings = append(warnings, "emit_job_label is false and no target_labels or relabel_configs are set, so its targets cannot be told apart from other jobs'")
+	}
+	return warnings
+}
+
+// checkDuplicateJobs rejects entries sharing a job name, unless all of them
+// set allow_duplicate_jobs, in which case their targets are merged. Entries
+// which are identical are logged, as they are most likely a mistake.
+func checkDuplicateJobs(entries []configEntry) error {
+	byJob := map[string][]int{}
+	jobs := []string{}
+	for i, e := range entries {
+		// Entries with the same job_template produce the same jobs.
+		job := e.Job
+		if job == "" {
+			job = e.JobTemplate
+		}
+		if _, ok := byJob[job]; !ok {
+			jobs = append(jobs, job)
+		}
+		byJob[job] = append(byJob[job], i)
+	}
+
+	errs := configErrors{}
+	for _, job := range jobs {
+		indexes := byJob[job]
+		if len(indexes) < 2 {
+			continue
+		}
+
+		names := []string{}
+		allowed := true
+		for _, i := range indexes {
+			names = append(names, entries[i].String())
+			allowed = allowed && entries[i].AllowDuplicateJobs
+		}
+
+		if !allowed {
+			errs = append(errs, errors.Errorf("Job %q is defined by multiple entries: %v, set allow_duplicate_jobs on each to merge them", job, strings.Join(names, ", ")))
+			continue
+		}
+		log.Infof("Merging targets of job %q from %v", job, strings.Join(names, ", "))
+	}
+
+	for _, group := range identicalEntries(entries) {
+		names := []string{}
+		for _, i := range group {
+			names = append(names, entries[i].String())
+		}
+		log.Warningf("Config entries %v are identical", strings.Join(names, ", "))
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// identicalEntries returns the indexes of groups of entries which have
+// identical settings.
+func identicalEntries(entries []configEntry) [][]int {
+	groups := map[string][]int{}
+	keys := []string{}
+	for i, e := range entries {
+		data, err := yaml.Marshal(e.SearchConfig)
+		if err != nil {
+			continue
+		}
+		key := string(data)
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	identical := [][]int{}
+	for _, k := range keys {
+		if len(groups[k]) > 1 {
+			identical = append(identical, groups[k])
+		}
+	}
+	return identical
+}
+
+// maxIncludeDepth bounds how deeply config files may include each other.
+const maxIncludeDepth = 8
+
+// configEntry is a search entry along with where in the config it was found.
+type configEntry struct {
+	SearchConfig
+	file  string
+	index int
+}
+
+func (e configEntry) String() string {
+	return fmt.Sprintf("entry #%v in %v", e.index, e.file)
+}
+
+// loadConfigEntries reads the search entries in the config file at path,
+// followed by those of the files it includes. stack holds the files
+// including path.
+func loadConfigEntries(path string, stack []string) ([]configEntry, error) {
+	for _, p := range stack {
+		if p == path {
+			return nil, errors.Errorf("Include loop detected at %v", path)
+		}
+	}
+	if len(stack) > maxIncludeDepth {
+		return nil, errors.Errorf("Includes nested more than %v deep at %v", maxIncludeDepth, path)
+	}
+
+	data, err := readConfigSource(path)
 	if err != nil {
-		return []SearchConfig{}, errors.Wrap(err, "Unable to read config file")
+		return nil, err
+	}
+
+	format := configFormat(path, data)
+	if format == configFormatJSON {
+		data, err = jsonToYAML(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to parse config file %v as %v", path, format)
+		}
 	}
 
-	var config []SearchConfig
-	err = yaml.Unmarshal(data, &config)
+	config, includes, err := parseConfig(data)
 	if err != nil {
-		return []SearchConfig{}, errors.Wrap(err, "Unable to parse config file")
+		return nil, errors.Wrapf(err, "Unable to parse config file %v as %v", path, format)
+	}
+
+	entries := []configEntry{}
+	for i, c := range config {
+		entries = append(entries, configEntry{SearchConfig: c, file: path, index: i})
+	}
+
+	if len(includes) != 0 && isRemoteConfig(path) {
+		return nil, errors.Errorf("Includes are not supported in remote config %v", path)
+	}
+
+	for _, pattern := range includes {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid include %v in %v", pattern, path)
+		}
+		if len(matches) == 0 {
+			if *strictIncludes {
+				return nil, errors.Errorf("Include %v in %v matched no files", pattern, path)
+			}
+			log.Warningf("Include %v in %v matched no files", pattern, path)
+			continue
+		}
+
+		sort.Strings(matches)
+		for _, m := range matches {
+			included, err := loadConfigEntries(m, append(stack, path))
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, included...)
+		}
+	}
+
+	return entries, nil
+}
+
+const (
+	configFormatYAML = "YAML"
+	configFormatJSON = "JSON"
+)
+
+// configFormat determines the format of a config file from its extension,
+// falling back to looking for a JSON object or array in data.
+func configFormat(path string, data []byte) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return configFormatJSON
+	case ".yaml", ".yml":
+		return configFormatYAML
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) != 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return configFormatJSON
+	}
+	return configFormatYAML
+}
+
+// jsonToYAML converts a JSON document to YAML, so JSON configs share the
+// YAML parsing and unknown key detection.
+func jsonToYAML(data []byte) ([]byte, error) {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	return yaml.Marshal(raw)
+}
+
+// configFile is the structured form of the config file, allowing defaults to
+// be given for every job, named groups of tags to be shared between jobs, and
+// other config files to be included. A bare list of jobs is also accepted.
+type configFile struct {
+	Defaults  SearchConfig        `yaml:"defaults"`
+	TagGroups map[string][]string `yaml:"tag_groups"`
+	Jobs      []SearchConfig      `yaml:"jobs"`
+	Include   []string            `yaml:"include"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// parseConfig parses the search entries in a config file, in either the bare
+// list or the structured form, applying any defaults. The include patterns
+// of the file are also returned.
+func parseConfig(data []byte) ([]SearchConfig, []string, error) {
+	var raw interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, nil, err
+	}
+
+	if _, ok := raw.(map[interface{}]interface{}); !ok {
+		var config []SearchConfig
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, nil, err
+		}
+		if err := expandTagGroups(config, nil); err != nil {
+			return nil, nil, err
+		}
+		return config, nil, nil
+	}
+
+	var cf configFile
+	if err := yaml.Unmarshal(data, &cf); err != nil {
+		return nil, nil, err
+	}
+	if len(cf.XXX) != 0 {
+		return nil, nil, errors.Errorf("Unknown keys in config: %v", strings.Join(mapKeys(cf.XXX), ","))
+	}
+	if len(cf.Defaults.XXX) != 0 {
+		return nil, nil, errors.Errorf("Unknown keys in defaults: %v", strings.Join(mapKeys(cf.Defaults.XXX), ","))
+	}
+
+	// Defaults apply to the keys a job leaves out, so the raw jobs are read
+	// too, to tell a key set to false, 0 or "" from one left out.
+	var rawJobs struct {
+		Jobs []map[string]interface{} `yaml:"jobs"`
+	}
+	if err := yaml.Unmarshal(data, &rawJobs); err != nil {
+		return nil, nil, err
+	}
+	for i := range cf.Jobs {
+		cf.Jobs[i] = mergeDefaults(cf.Jobs[i], cf.Defaults, rawJobs.Jobs[i])
+	}
+	if err := expandTagGroups(cf.Jobs, cf.TagGroups); err != nil {
+		return nil, nil, err
+	}
+	return cf.Jobs, cf.Include, nil
+}
+
+// expandTagGroups appends the tags of the groups referenced by each of
+// configs to its tags, in the order referenced, dropping any tag already
+// present.
+func expandTagGroups(configs []SearchConfig, groups map[string][]string) error {
+	errs := configErrors{}
+	for i := range configs {
+		conf := &configs[i]
+		if len(conf.TagGroupRefs) == 0 {
+			continue
+		}
+
+		tags := []string{}
+		seen := map[string]bool{}
+		add := func(ts []string) {
+			for _, t := range ts {
+				if !seen[t] {
+					seen[t] = true
+					tags = append(tags, t)
+				}
+			}
+		}
+
+		add(conf.Tags)
+		for _, ref := range conf.TagGroupRefs {
+			group, ok := groups[ref]
+			if !ok {
+				errs = append(errs, errors.Errorf("Unknown tag group %q in entry #%v (job %q)", ref, i, conf.Job))
+				continue
+			}
+			add(group)
+		}
+		conf.Tags = tags
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// mergeDefaults returns conf with every exported field whose key is not in
+// raw, the job as written in the config file, taken from defaults. A job can
+// therefore override a default with false, 0 or "".
+func mergeDefaults(conf, defaults SearchConfig, raw map[string]interface{}) SearchConfig {
+	// Ports are read by SearchConfig.UnmarshalYAML rather than through their
+	// field, and the structured entries of the default ports go with them.
+	if _, ok := raw["ports"]; !ok {
+		conf.Ports = defaults.Ports
+		conf.portSpecs = defaults.portSpecs
+	}
+
+	cv := reflect.ValueOf(&conf).Elem()
+	dv := reflect.ValueOf(defaults)
+	for i := 0; i < cv.NumField(); i++ {
+		f := cv.Field(i)
+		field := cv.Type().Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if !f.CanSet() || field.Name == "XXX" || key == "-" {
+			continue
+		}
+		if _, ok := raw[key]; !ok {
+			f.Set(dv.Field(i))
+		}
+	}
+	return conf
+}
+
+func mapKeys(m map[string]interface{}) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// expandConfigEnv expands environment variable references in the string
+// values of conf, see expandEnvString.
+func expandConfigEnv(conf *SearchConfig) error {
+	unresolved := []string{}
+	expand := func(s string) string {
+		res, missing := expandEnvString(s)
+		unresolved = append(unresolved, missing...)
+		return res
+	}
+
+	cv := reflect.ValueOf(conf).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		f := cv.Field(i)
+		if !f.CanSet() || cv.Type().Field(i).Name == "XXX" {
+			continue
+		}
+
+		// Slices and maps may be shared with other entries through
+		// defaults, so they are replaced rather than modified.
+		switch v := f.Interface().(type) {
+		case string:
+			f.SetString(expand(v))
+		case []string:
+			if v == nil {
+				continue
+			}
+			res := make([]string, len(v))
+			for j := range v {
+				res[j] = expand(v[j])
+			}
+			f.Set(reflect.ValueOf(res))
+		case map[string]string:
+			if v == nil {
+				continue
+			}
+			res := make(map[string]string, len(v))
+			for k := range v {
+				res[k] = expand(v[k])
+			}
+			f.Set(reflect.ValueOf(res))
+		}
+	}
+
+	if len(unresolved) != 0 {
+		sort.Strings(unresolved)
+		return errors.Errorf("Unresolved environment variables: %v", strings.Join(unresolved, ","))
+	}
+	return nil
+}
+
+// expandEnvString replaces ${VAR} and ${VAR:-default} references in s with
+// the value of the environment variable, or the default when it is unset or
+// empty. $$ produces a literal $. References without a variable name are
+// left as written, for ValidateConfig to reject. The names of any variables
+// which are unset and have no default are returned.
+func expandEnvString(s string) (string, []string) {
+	unresolved := []string{}
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case '$':
+			buf.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				buf.WriteByte(s[i])
+				continue
+			}
+			ref := s[i+2 : i+end]
+			name, def, hasDefault := ref, "", false
+			if j := strings.Index(ref, ":-"); j >= 0 {
+				name, def, hasDefault = ref[:j], ref[j+2:], true
+			}
+			if name == "" {
+				buf.WriteString(s[i : i+end+1])
+				i += end
+				continue
+			}
+
+			value, ok := os.LookupEnv(name)
+			switch {
+			case ok && value != "":
+				buf.WriteString(value)
+			case hasDefault:
+				buf.WriteString(def)
+			case ok:
+			default:
+				unresolved = append(unresolved, name)
+			}
+			i += end
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	return buf.String(), unresolved
+}
+
+// ValidateConfig reports every problem with conf, without modifying it.
+func ValidateConfig(conf SearchConfig) error {
+	return validateConfig(&conf)
+}
+
+// validateConfig reports every problem with conf, compiling it as
+// compileConfig does along the way.
+func validateConfig(conf *SearchConfig) error {
+	errs := validationErrors{}
+
+	if len(conf.XXX) != 0 {
+		errs = append(errs, errors.Errorf("Unknown keys in config: %v", strings.Join(mapKeys(conf.XXX), ",")))
+	}
+
+	if conf.Job == "" && conf.JobTemplate == "" {
+		errs = append(errs, errors.New("No job specified"))
+	}
+
+	if conf.Job != "" && conf.JobTemplate != "" {
+		errs = append(errs, errors.New("Only one of job and job_template may be specified"))
+	}
+
+	// An empty placeholder would otherwise end up in, or render, the job.
+	for _, s := range []struct{ setting, value string }{
+		{"job", conf.Job},
+		{"job_template", conf.JobTemplate},
+	} {
+		if ref := emptyEnvRefPattern.FindString(s.value); ref != "" {
+			errs = append(errs, errors.Errorf("Empty environment variable reference %v in %v %q", ref, s.setting, s.value))
+		}
+	}
+
+	switch conf.Mode {
+	case "", modeAnnotations:
+	default:
+		errs = append(errs, errors.Errorf("Unknown mode %q, must be %q", conf.Mode, modeAnnotations))
+	}
+
+	// These settings apply to a job by name, which one set by instances'
+	// annotations does not have until its instances are discovered. Those
+	// of an entry with a job_template apply to each job it renders.
+	if conf.Mode == modeAnnotations {
+		option := "mode " + modeAnnotations
+		for _, s := range []struct {
+			setting string
+			set     bool
+		}{
+			{"min_targets", conf.MinTargets != 0},
+			{"label_prefix", conf.LabelPrefix != ""},
+			{"strip_meta", conf.StripMeta},
+			{"emit_job_label", conf.EmitJobLabel != nil},
+			{"max_label_value_length", conf.MaxLabelValueLen != nil},
+		} {
+			if s.set {
+				errs = append(errs, errors.Errorf("%v cannot be combined with %v", option, s.setting))
+			}
+		}
+	}
+
+	if !hasSelector(*conf) {
+		errs = append(errs, errors.New("No tags or other selectors specified"))
+	}
+
+	if err := compileConfig(conf); err != nil {
+		errs = append(errs, err)
+	}
+
+	switch conf.TagMatch {
+	case "", tagMatchAll, tagMatchAny:
+	default:
+		errs = append(errs, errors.Errorf("Unknown tag_match %q, must be %q or %q", conf.TagMatch, tagMatchAll, tagMatchAny))
+	}
+
+	if conf.TagsLabelFormat != "" && !validTagsLabelFormat(conf.TagsLabelFormat) {
+		errs = append(errs, errors.Errorf("Unknown tags_label_format %q, must be %q, %q or %q", conf.TagsLabelFormat, tagsLabelJoined, tagsLabelBoolean, tagsLabelBoth))
+	}
+
+	for _, et := range conf.ExcludeTags {
+		for _, t := range conf.Tags {
+			if et == t {
+				errs = append(errs, errors.Errorf("Tag %q is both required and excluded", t))
+			}
+		}
+	}
+
+	for _, st := range conf.Statuses {
+		if !validStatus(st) {
+			errs = append(errs, errors.Errorf("Unknown status %q, must be %q or one of %v", st, anyStatus, strings.Join(instanceStatuses, ",")))
+		}
+	}
+
+	if conf.Project != "" && len(conf.Projects) != 0 {
+		errs = append(errs, errors.New("Only one of project and projects may be specified"))
+	}
+
+	if conf.ProjectDiscovery != nil {
+		if err := validateProjectDiscovery(*conf); err != nil {
+			errs = append(errs, err)
+		}
+	} else if len(configProjects(*conf)) == 0 {
+		errs = append(errs, errors.New("No project specified"))
+	}
+
+	if len(conf.ExcludeProjects) != 0 && conf.ProjectDiscovery == nil {
+		errs = append(errs, errors.New("exclude_projects requires project_discovery"))
+	}
+
+	for _, p := range conf.Projects {
+		if p == "" {
+			errs = append(errs, errors.New("Empty project in projects"))
+		}
+	}
+
+	if len(conf.Ports) == 0 && conf.PortsFromMetadata == "" && conf.PortLabel == "" && !conf.AllowNoPorts {
+		errs = append(errs, errors.New("No ports, ports_from_metadata or port_label specified, set allow_no_ports to produce targets without ports"))
+	}
+
+	switch conf.Accelerators {
+	case "", acceleratorsRequire, acceleratorsExclude:
+	default:
+		errs = append(errs, errors.Errorf("Unknown accelerators %q, must be %q or %q", conf.Accelerators, acceleratorsRequire, acceleratorsExclude))
+	}
+
+	if conf.AcceleratorType != "" {
+		if conf.Accelerators == "" {
+			errs = append(errs, errors.New("accelerator_type requires accelerators to be set"))
+		}
+		if _, err := path.Match(conf.AcceleratorType, ""); err != nil {
+			errs = append(errs, errors.Wrapf(err, "Malformed accelerator_type %q", conf.AcceleratorType))
+		}
+	}
+
+	switch conf.ExternalIP {
+	case "", externalIPRequire, externalIPExclude, externalIPAny:
+	default:
+		errs = append(errs, errors.Errorf("Unknown external_ip %q, must be %q, %q or %q", conf.ExternalIP, externalIPRequire, externalIPExclude, externalIPAny))
+	}
+
+	switch conf.Preemptible {
+	case "", preemptibleInclude, preemptibleExclude, preemptibleOnly:
+	default:
+		errs = append(errs, errors.Errorf("Unknown preemptible %q, must be %q, %q or %q", conf.Preemptible, preemptibleInclude, preemptibleExclude, preemptibleOnly))
+	}
+
+	switch conf.AddressType {
+	case "", addressInternal, addressExternal, addressDNS:
+	default:
+		errs = append(errs, errors.Errorf("Unknown address_type %q, must be %q, %q or %q", conf.AddressType, addressInternal, addressExternal, addressDNS))
+	}
+
+	switch conf.DNSForm {
+	case "", dnsFormGlobal, dnsFormZonal:
+	default:
+		errs = append(errs, errors.Errorf("Unknown dns_form %q, must be %q or %q", conf.DNSForm, dnsFormGlobal, dnsFormZonal))
+	}
+
+	if conf.CredentialsFile != "" {
+		if _, err := readCredentialsFile(conf.CredentialsFile, compute.ComputeScope); err != nil {
+			errs = append(errs, errors.Wrapf(err, "Invalid credentials_file for project %v", strings.Join(configProjects(*conf), ", ")))
+		}
+	}
+
+	if conf.MinAge < 0 {
+		errs = append(errs, errors.Errorf("Invalid min_age %v", conf.MinAge))
+	}
+
+	if conf.Interval < 0 {
+		errs = append(errs, errors.Errorf("Invalid interval %v", conf.Interval))
+	}
+
+	if conf.MinTargets < 0 {
+		errs = append(errs, errors.Errorf("Invalid min_targets %v", conf.MinTargets))
+	}
+
+	if conf.RemovedTargetTTL < 0 {
+		errs = append(errs, errors.Errorf("Invalid removed_target_ttl %v", conf.RemovedTargetTTL))
+	}
+
+	if conf.AllInterfaces && conf.AddressType == addressDNS {
+		errs = append(errs, errors.Errorf("all_interfaces may not be used with address_type %q", addressDNS))
+	}
+
+	if conf.InterfaceIndex != nil && conf.InterfaceNetwork != "" {
+		errs = append(errs, errors.New("Only one of interface_index and interface_network may be specified"))
+	}
+
+	if conf.InterfaceIndex != nil && *conf.InterfaceIndex < 0 {
+		errs = append(errs, errors.Errorf("Invalid interface_index %v", *conf.InterfaceIndex))
+	}
+
+	for k := range conf.TargetLabels {
+		if !labelNamePattern.MatchString(k) {
+			errs = append(errs, errors.Errorf("Invalid target label name %q", k))
+		}
+		if reservedLabelName(k) {
+			errs = append(errs, errors.Errorf("Target label %q conflicts with a built in label", k))
+		}
+	}
+
+	switch conf.Scheme {
+	case "", "http", "https":
+	default:
+		errs = append(errs, errors.Errorf("Unknown scheme %q, must be %q or %q", conf.Scheme, "http", "https"))
+	}
+
+	errs = append(errs, validatePorts(*conf)...)
+
+	if conf.AddressOverride != "" && !metadataKeyPattern.MatchString(conf.AddressOverride) {
+		errs = append(errs, errors.Errorf("Invalid address_override_metadata_key %q", conf.AddressOverride))
+	}
+
+	if conf.MetricsPath != "" && !strings.HasPrefix(conf.MetricsPath, "/") {
+		errs = append(errs, errors.Errorf("Invalid metrics_path %q, must start with /", conf.MetricsPath))
+	}
+
+	if conf.MaxLabelValueLen != nil && *conf.MaxLabelValueLen < 0 {
+		errs = append(errs, errors.Errorf("Invalid max_label_value_length %v", *conf.MaxLabelValueLen))
+	}
+
+	if conf.StripMeta && conf.LabelPrefix != "" {
+		errs = append(errs, errors.New("Only one of label_prefix and strip_meta may be specified"))
+	}
+
+	if conf.LabelPrefix != "" && (!labelNamePattern.MatchString(conf.LabelPrefix) || conf.LabelPrefix == "job" || strings.HasPrefix(conf.LabelPrefix, "__")) {
+		errs = append(errs, errors.Errorf("Invalid label_prefix %q", conf.LabelPrefix))
+	}
+
+	for _, k := range conf.MetadataLabels {
+		if !metadataKeyPattern.MatchString(k) {
+			errs = append(errs, errors.Errorf("Invalid metadata_labels key %q", k))
+		}
+	}
+
+	for _, z := range conf.Zones {
+		if !zonePattern.MatchString(z) {
+			errs = append(errs, errors.Errorf("Malformed zone %q", z))
+		}
+		if _, err := path.Match(z, ""); err != nil {
+			errs = append(errs, errors.Wrapf(err, "Malformed zone %q", z))
+		}
+	}
+
+	for _, ig := range conf.InstanceGroups {
+		if _, err := parseInstanceGroup(ig); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := validateImageGlobs("images", conf.Images); err != nil {
+		errs = append(errs, err)
+	}
+	if err := validateImageGlobs("image_families", conf.ImageFamilies); err != nil {
+		errs = append(errs, err)
+	}
+
+	for _, mt := range conf.MachineTypes {
+		if mt == "" {
+			errs = append(errs, errors.New("Empty machine type in machine_types"))
+			continue
+		}
+		if _, err := path.Match(mt, ""); err != nil {
+			errs = append(errs, errors.Wrapf(err, "Malformed machine type %q", mt))
+		}
+	}
+
+	for _, r := range conf.Regions {
+		if region, ok := zoneRegion(r); ok && regionLikeZonePattern.MatchString(r) {
+			errs = append(errs, errors.Errorf("Region %q looks like a zone, did you mean %q?", r, region))
+			continue
+		}
+		if !regionPattern.MatchString(r) {
+			errs = append(errs, errors.Errorf("Malformed region %q", r))
+		}
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+	return nil
+}
+
+// validationErrors collects every problem found by ValidateConfig.
+type validationErrors []error
+
+func (errs validationErrors) Error() string {
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// configErrors collects the problems found in each invalid config entry.
+type configErrors []error
+
+func (errs configErrors) Error() string {
+	msgs := []string{}
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// applyConfigFlags sets the settings of conf which default to a flag, such as
+// case_insensitive_tags, from their flag.
+func applyConfigFlags(conf *SearchConfig) {
+	if *ignoreTagCase {
+		conf.IgnoreTagCase = true
+	}
+
+	if conf.TagsLabelFormat == "" && *tagsLabelFormat != tagsLabelJoined {
+		conf.TagsLabelFormat = *tagsLabelFormat
+	}
+}
+
+// compileConfig populates the fields of conf derived from its settings, such
+// as compiled regular expressions, which are used during discovery.
+func compileConfig(conf *SearchConfig) error {
+	if conf.NameRegex != "" {
+		re, err := regexp.Compile("^(?:" + conf.NameRegex + ")$")
+		if err != nil {
+			return errors.Wrapf(err, "Invalid name_regex %q", conf.NameRegex)
+		}
+		conf.nameRegex = re
+	}
+
+	conf.tagRegexes = nil
+	for _, tr := range conf.TagRegex {
+		expr := "^(?:" + tr + ")$"
+		if conf.IgnoreTagCase {
+			expr = "(?i)" + expr
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid tag_regex %q", tr)
+		}
+		conf.tagRegexes = append(conf.tagRegexes, re)
+	}
+
+	conf.labelSelectors = nil
+	for _, ls := range conf.LabelSelectors {
+		req, err := parseLabelSelector(ls)
+		if err != nil {
+			return err
+		}
+		conf.labelSelectors = append(conf.labelSelectors, req)
+	}
+
+	if conf.AddressTemplate != "" {
+		tmpl, err := template.New("address").Parse(conf.AddressTemplate)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid address_template %q", conf.AddressTemplate)
+		}
+		conf.addressTemplate = tmpl
+	}
+
+	if conf.JobTemplate != "" {
+		tmpl, err := template.New("job").Option("missingkey=zero").Parse(conf.JobTemplate)
+		if err != nil {
+			return errors.Wrapf(err, "Invalid job_template %q", conf.JobTemplate)
+		}
+		conf.jobTemplate = tmpl
+	}
+
+	conf.relabelRules = nil
+	for _, rc := range conf.RelabelConfigs {
+		rule, err := compileRelabelConfig(rc)
+		if err != nil {
+			return err
+		}
+		conf.relabelRules = append(conf.relabelRules, rule)
+	}
+
+	return nil
+}
+
+// configProjects returns the projects searched by conf.
+func configProjects(conf SearchConfig) []string {
+	if conf.Project != "" {
+		return []string{conf.Project}
+	}
+	return conf.Projects
+}
+
+// hasSelector reports whether conf narrows down the instances it matches,
+// rather than matching every instance in the project.
+func hasSelector(conf SearchConfig) bool {
+	return len(conf.Tags) != 0 || len(conf.Labels) != 0 || len(conf.Metadata) != 0 ||
+		conf.NameRegex != "" || len(conf.TagRegex) != 0 || len(conf.InstanceGroups) != 0 ||
+		len(conf.LabelSelectors) != 0 || len(conf.RequireMetadata) != 0 ||
+		conf.Mode == modeAnnotations
+}
+
+func DiscoverTargets(ctx context.Context, searchConfigs []SearchConfig) ([]DiscoveryTarget, error) {
+	indexes := make([]int, len(searchConfigs))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	targetsByConfig, errs := discoverTargetsByConfig(ctx, searchConfigs, indexes)
+	if err := combineDiscoveryErrors(errs); err != nil {
+		return []DiscoveryTarget{}, err
+	}
+
+	targets := []DiscoveryTarget{}
+	for _, ts := range targetsByConfig {
+		targets = append(targets, ts...)
+	}
+	updateTargetCounts(targets, configJobs(searchConfigs))
+
+	return targets, nil
+}
+
+// discoverTargetsByConfig discovers the targets of each of searchConfigs,
+// listing each project at most once, and returns the error of each entry
+// which failed, nil for those which did not, alongside its targets. Projects
+// found through project_discovery which cannot be listed are skipped, rather
+// than failing the entry, and the error of any other project names every
+// project of the entry which failed. Projects are listed concurrently, see
+// listProjectInstances. indexes are the positions of searchConfigs in the
+// config, which their targets, and metrics of entries without a fixed job,
+// are labelled with.
+func discoverTargetsByConfig(ctx context.Context, searchConfigs []SearchConfig, indexes []int) ([][]DiscoveryTarget, []error) {
+	targetsByConfig := make([][]DiscoveryTarget, len(searchConfigs))
+	errs := make([]error, len(searchConfigs))
+
+	projectsByParent := map[string][]string{}
+	membersByGroup := map[string]groupMembers{}
+	images := newImageResolver()
+	groupLabels := newInstanceGroupLabeler()
+
+	projectsByConfig := make([][]string, len(searchConfigs))
+	keys := []listKey{}
+	seen := map[listKey]bool{}
+	for i, searchConfig := range searchConfigs {
+		searchConfig.entry = indexes[i]
+		projects, err := searchProjects(ctx, searchConfig, projectsByParent)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		projectsByConfig[i] = projects
+		for _, project := range projects {
+			key := listKey{project, searchConfig.APIFilter, searchConfig.CredentialsFile}
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	instancesByProject, listErrors := listProjectInstances(ctx, keys)
+
+	for i, searchConfig := range searchConfigs {
+		if errs[i] != nil {
+			continue
+		}
+		failed := discoveryErrors{}
+		targets := []DiscoveryTarget{}
+		entryLabels := provenanceLabels(indexes[i], searchConfig)
+		for _, project := range projectsByConfig[i] {
+			config := searchConfig
+			config.Project = project
+			config.Projects = nil
+			config.ProjectDiscovery = nil
+			config.entry = indexes[i]
+
+			key := listKey{config.Project, config.APIFilter, config.CredentialsFile}
+			if err, ok := listErrors[key]; ok {
+				if searchConfig.ProjectDiscovery != nil && skipProjectError(err) {
+					log.Warningf("Skipping project %v discovered under %v for %v: %v", project, searchConfig.ProjectDiscovery.Parent, entryJob(config), err)
+					projectErrors.WithLabelValues(entryJob(config), project).Inc()
+					continue
+				}
+				if config.APIFilter != "" {
+					err = errors.Wrapf(err, "Failed to list instances in %v with api_filter %q of job %q", config.Project, config.APIFilter, entryJob(config))
+				} else {
+					err = errors.Wrapf(err, "Failed to list instances in %v", config.Project)
+				}
+				failed = append(failed, err.Error())
+				continue
+			}
+			allInstances := instancesByProject[key]
+
+			if len(config.InstanceGroups) != 0 {
+				allInstances = filterInstanceGroups(ctx, allInstances, config, membersByGroup)
+			}
+
+			instances, err := DiscoverComputeByTags(ctx, allInstances, config)
+			if err != nil {
+				failed = append(failed, errors.Wrapf(err, "Failed to discover instances %v in %v", config.Tags, config.Project).Error())
+				continue
+			}
+			instances = filterImages(ctx, instances, config, images)
+			log.V(2).Infof("Found %v targets for %v in %v", len(instances), config.Tags, config.Project)
+
+			for _, instance := range instances {
+				instTargets, err := InstanceToTargets(instance, config)
+				if err != nil {
+					failed = append(failed, errors.Wrapf(err, "Failed to convert %v to a discovery target", instance.Name).Error())
+					continue
+				}
+				if config.ResolveGroups {
+					groupLabels.Label(ctx, instance, config, instTargets)
+				}
+				if config.ResolveBootImage {
+					images.labelSourceImage(ctx, instance, config, instTargets)
+				}
+				labelProvenance(instTargets, entryLabels)
+				instTargets = relabelTargets(instTargets, config)
+				targets = append(targets, instTargets...)
+			}
+		}
+		if len(failed) != 0 {
+			errs[i] = failed
+			continue
+		}
+		targetsByConfig[i] = targets
+	}
+
+	return targetsByConfig, errs
+}
+
+// discoveryErrors are the failures of discovering an entry, such as each
+// project which could not be listed.
+type discoveryErrors []string
+
+func (e discoveryErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// combineDiscoveryErrors returns an error naming each failure of the entries
+// in errs once, as entries searching the same project fail alike, or nil if
+// none failed.
+func combineDiscoveryErrors(errs []error) error {
+	combined := discoveryErrors{}
+	seen := map[string]bool{}
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		failures, ok := err.(discoveryErrors)
+		if !ok {
+			failures = discoveryErrors{err.Error()}
+		}
+		for _, f := range failures {
+			if !seen[f] {
+				seen[f] = true
+				combined = append(combined, f)
+			}
+		}
+	}
+	if len(combined) == 0 {
+		return nil
+	}
+	return combined
+}
+
+// reportedJobs holds the series last set in the per-job gauges, so that the
+// series of jobs which are no longer configured or discovered can be removed.
+// warmedUp holds the jobs whose instancesWarmingUp series were set since the
+// target counts were last updated, such as jobs rendered from a job_template
+// whose instances are all warming up.
+var reportedJobs = struct {
+	sync.Mutex
+	targets   map[string]bool
+	warmingUp map[string]map[string]bool
+	warmedUp  map[string]bool
+}{targets: map[string]bool{}, warmingUp: map[string]map[string]bool{}, warmedUp: map[string]bool{}}
+
+// setWarmingUp sets the instancesWarmingUp gauge of job and project,
+// recording the series for removal with the job.
+func setWarmingUp(job, project string, n int) {
+	reportedJobs.Lock()
+	defer reportedJobs.Unlock()
+
+	if reportedJobs.warmingUp[job] == nil {
+		reportedJobs.warmingUp[job] = map[string]bool{}
+	}
+	reportedJobs.warmingUp[job][project] = true
+	reportedJobs.warmedUp[job] = true
+	instancesWarmingUp.WithLabelValues(job, project).Set(float64(n))
+}
+
+// updateTargetCounts sets the targetCount gauge from targets, reporting jobs
+// without any targets as 0. Identical targets are counted once. The per-job
+// gauge series of jobs neither in jobs nor targets, nor warming up since the
+// last update, are deleted.
+func updateTargetCounts(targets []DiscoveryTarget, jobs []string) {
+	targets, _ = dedupTargets(targets)
+	counts := map[string]int{}
+	for _, j := range jobs {
+		counts[j] = 0
+	}
+	for _, t := range targets {
+		job := t.Labels["job"]
+		counts[job] = counts[job] + 1
+	}
+	reportedJobs.Lock()
+	defer reportedJobs.Unlock()
+
+	for j, c := range counts {
+		targetCount.WithLabelValues(j).Set(float64(c))
+	}
+	for j := range reportedJobs.targets {
+		if _, ok := counts[j]; !ok {
+			log.V(1).Infof("Removing target count of job %v, it is no longer configured", j)
+			targetCount.DeleteLabelValues(j)
+		}
+	}
+	for j, projects := range reportedJobs.warmingUp {
+		if _, ok := counts[j]; ok || reportedJobs.warmedUp[j] {
+			continue
+		}
+		for p := range projects {
+			instancesWarmingUp.DeleteLabelValues(j, p)
+		}
+		delete(reportedJobs.warmingUp, j)
+	}
+
+	reportedJobs.warmedUp = map[string]bool{}
+	reportedJobs.targets = map[string]bool{}
+	for j := range counts {
+		reportedJobs.targets[j] = true
+	}
+}
+
+// configJobs returns the job of every entry in configs, other than those
+// with a job_template.
+func configJobs(configs []SearchConfig) []string {
+	jobs := []string{}
+	for _, c := range configs {
+		if c.Job != "" {
+			jobs = append(jobs, c.Job)
+		}
+	}
+	return jobs
+}
+
+func InstanceToTargets(instance *compute.Instance, config SearchConfig) ([]DiscoveryTarget, error) {
+	job, err := instanceJob(instance, config)
+	if err != nil {
+		log.Warningf("Skipping %v for job_template %q of entry #%v: %v", instance.Name, config.JobTemplate, config.entry, err)
+		jobTemplateSkipped.WithLabelValues(strconv.Itoa(config.entry)).Inc()
+		return []DiscoveryTarget{}, nil
+	}
+	// Logs and metrics below report the instance under the job of its
+	// targets.
+	config.Job = job
+
+	ifaces, err := selectInterfaces(instance, config)
+	if err != nil {
+		skipInstance(instance, config, "no_matching_interface", "%v", err)
+		return []DiscoveryTarget{}, nil
+	}
+
+	labels := map[string]string{
+		"job":                          job,
+		"__meta_gce_instance_zone":     parseResource(instance.Zone),
+		"__meta_gce_instance_type":     parseResource(instance.MachineType),
+		"__meta_gce_instance_project":  config.Project,
+		"__meta_gce_instance_name":     instance.Name,
+		"__meta_gce_instance_status":   instanceStatus(instance),
+		"__meta_gce_instance_hostname": instanceHostname(instance, config.Project),
+	}
+	for k, v := range tagLabels(instanceTags(instance), config.TagsLabelFormat) {
+		labels[k] = v
+	}
+	// Names are reused when instances are recreated, IDs are not.
+	if instance.Id != 0 {
+		labels["__meta_gce_instance_id"] = strconv.FormatUint(instance.Id, 10)
+	}
+
+	// Both IPs are labelled whichever is targeted, an instance without an
+	// external IP has no __meta_gce_public_ip.
+	if privateIP, err := findInstanceIP(ifaces); err == nil && privateIP != "" {
+		labels["__meta_gce_private_ip"] = privateIP
+	}
+	if publicIP, err := findInstanceExternalIP(ifaces); err == nil {
+		labels["__meta_gce_public_ip"] = publicIP
+	}
+	if instance.CpuPlatform != "" {
+		labels["__meta_gce_cpu_platform"] = instance.CpuPlatform
+	}
+	if instance.MinCpuPlatform != "" {
+		labels["__meta_gce_min_cpu_platform"] = instance.MinCpuPlatform
+	}
+	for k, v := range bootDiskLabels(instance) {
+		labels[k] = v
+	}
+	for k, v := range serviceAccountLabels(instance) {
+		labels[k] = v
+	}
+	for k, v := range schedulingLabels(instance) {
+		labels[k] = v
+	}
+	for k, v := range creationLabels(instance, config, *instanceAgeLabel) {
+		labels[k] = v
+	}
+	for k, v := range lifecycleLabels(instance, config) {
+		labels[k] = v
+	}
+	if region, ok := zoneRegion(labels["__meta_gce_instance_zone"]); ok {
+		labels["__meta_gce_instance_region"] = region
+	} else {
+		regionParseErrors.WithLabelValues(config.Job).Inc()
+	}
+	for _, iface := range ifaces {
+		if iface != nil {
+			for k, v := range networkLabels(iface) {
+				labels[k] = v
+			}
+			break
+		}
+	}
+
+	// Instances created by a managed instance group record it, and the
+	// template they were created from, in their metadata.
+	md := instanceMetadata(instance)
+	if createdBy := md["created-by"]; createdBy != "" {
+		labels["__meta_gce_created_by"] = parseResource(createdBy)
+	}
+	if template := md["instance-template"]; template != "" {
+		labels["__meta_gce_instance_template"] = parseResource(template)
+	}
+	for k, v := range metadataLabels(instance, config, *metadataLabelMax) {
+		labels[k] = v
+	}
+
+	if config.Accelerators == acceleratorsRequire {
+		labels["__meta_gce_accelerator_type"], labels["__meta_gce_accelerator_count"] = acceleratorLabels(instanceAccelerators(instance, config.AcceleratorType))
+	}
+
+	addresses := []targetAddress{}
+	if config.AllInterfaces {
+		addresses, err = interfaceAddresses(ifaces, config)
+		if err != nil {
+			skipInstance(instance, config, "no_address", "%v", err)
+			return []DiscoveryTarget{}, nil
+		}
+	} else {
+		var ip string
+		switch config.AddressType {
+		case addressExternal:
+			ip, err = findInstanceExternalIP(ifaces)
+			if err != nil {
+				skipInstance(instance, config, "no_external_ip", "%v", err)
+				return []DiscoveryTarget{}, nil
+			}
+		case addressDNS:
+			if _, err := findInstanceIP(ifaces); err != nil {
+				return []DiscoveryTarget{}, errors.Wrap(err, "Could not find ip for instance")
+			}
+			ip = instanceDNSName(instance, config)
+		default:
+			ip, err = findInstanceIP(ifaces)
+			if err != nil {
+				return []DiscoveryTarget{}, errors.Wrap(err, "Could not find ip for instance")
+			}
+		}
+		addresses = append(addresses, targetAddress{address: ip})
+	}
+
+	// Prometheus scrapes targets with these labels using them in place of
+	// the scheme and metrics_path of its scrape config.
+	if config.Scheme != "" {
+		labels["__scheme__"] = config.Scheme
+	}
+	if config.MetricsPath != "" {
+		labels["__metrics_path__"] = config.MetricsPath
+	}
+
+	// Conflicting target labels are rejected by ValidateConfig, built in
+	// labels still take precedence over any which get this far.
+	for k, v := range config.TargetLabels {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	labels = sanitizeLabels(labels, config.Job)
+
+	ports, err := instancePorts(instance, config)
+	if err != nil {
+		skipInstance(instance, config, "invalid_ports", "%v", err)
+		return []DiscoveryTarget{}, nil
+	}
+
+	if config.IncludeAliasIPs {
+		addresses = append(addresses, aliasAddresses(instance, ifaces)...)
+	}
+
+	// Instances which cannot be reached at their own addresses may name
+	// another in their metadata, replacing them.
+	if host, port, ok := addressOverride(instance, config); ok {
+		addresses = []targetAddress{{address: host}}
+		if port != 0 {
+			ports = []int{port}
+		}
+	}
+
+	if len(ports) == 0 && !config.AllowNoPorts {
+		skipInstance(instance, config, "no_ports", "it sets no ports and the job has none")
+		return []DiscoveryTarget{}, nil
+	}
+	if len(ports) == 0 && config.AllowNoPorts {
+		ports = []int{noPort}
+	}
+
+	targets := []DiscoveryTarget{}
+	for _, addr := range addresses {
+		for _, port := range ports {
+			target := targetString(addr.address, port)
+			if config.addressTemplate != nil {
+				target, err = renderAddress(config.addressTemplate, instance, ifaces, config, addr.address, port)
+				if err != nil {
+					skipInstance(instance, config, "address_template", "%v", err)
+					return []DiscoveryTarget{}, nil
+				}
+			}
+
+			targetLabels := copyLabels(labels)
+			for k, v := range addr.labels {
+				targetLabels[k] = v
+			}
+			if spec, ok := portSpec(config, port); ok {
+				if spec.Name != "" {
+					targetLabels[portNameLabel] = spec.Name
+				}
+				for k, v := range spec.Labels {
+					targetLabels[k] = v
+				}
+			}
+			targets = append(targets, DiscoveryTarget{
+				Targets: []string{target},
+				Labels:  targetLabels,
+			})
+		}
+	}
+	return targets, nil
+}
+
+// addressTemplateData is the data available to address_template.
+type addressTemplateData struct {
+	Name       string
+	Address    string
+	InternalIP string
+	ExternalIP string
+	Zone       string
+	Project    string
+	Port       int
+}
+
+// renderAddress executes tmpl to produce the target string for address and
+// port of instance.
+func renderAddress(tmpl *template.Template, instance *compute.Instance, ifaces []*compute.NetworkInterface, config SearchConfig, address string, port int) (string, error) {
+	data := addressTemplateData{
+		Name:    instance.Name,
+		Address: address,
+		Zone:    parseResource(instance.Zone),
+		Project: config.Project,
+		Port:    port,
+	}
+	data.InternalIP, _ = findInstanceIP(ifaces)
+	data.ExternalIP, _ = findInstanceExternalIP(ifaces)
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", errors.Wrap(err, "Failed to render address_template")
+	}
+	target := strings.TrimSpace(buf.String())
+	if target == "" {
+		return "", errors.New("address_template rendered an empty address")
+	}
+	return target, nil
+}
+
+// jobTemplateData is the data available to job_template.
+type jobTemplateData struct {
+	Name    string
+	Labels  map[string]string
+	Tags    []string
+	Zone    string
+	Project string
+}
+
+// instanceJob returns the job of the targets of instance for config: the
+// job of config, rendered from its job_template, or set by the instance's
+// annotations.
+func instanceJob(instance *compute.Instance, config SearchConfig) (string, error) {
+	job := config.Job
+	if config.jobTemplate != nil {
+		var err error
+		job, err = renderJob(config.jobTemplate, instance, config)
+		if err == nil && job == "" {
+			err = errors.New("job_template rendered an empty job")
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	if config.Mode == modeAnnotations {
+		if annotated := annotationJob(instance); annotated != "" {
+			job = annotated
+		}
+	}
+	return job, nil
+}
+
+// reportedJob returns the job instance is reported under for config in logs
+// and metrics before it is turned into targets: the job of its targets, or
+// if its job_template fails to render, that of the entry, see entryJob.
+func reportedJob(instance *compute.Instance, config SearchConfig) string {
+	job, err := instanceJob(instance, config)
+	if err != nil {
+		return entryJob(config)
+	}
+	return job
+}
+
+// entryJob returns the job config is reported under in logs and metrics not
+// about a single instance: its job, or for an entry without a fixed job, "#"
+// and its index, as counted in gcesd_job_template_skipped_total.
+func entryJob(config SearchConfig) string {
+	if config.Job == "" {
+		return "#" + strconv.Itoa(config.entry)
+	}
+	return config.Job
+}
+
+// renderJob executes tmpl to produce the job of the targets of instance.
+func renderJob(tmpl *template.Template, instance *compute.Instance, config SearchConfig) (string, error) {
+	labels := instance.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	data := jobTemplateData{
+		Name:    instance.Name,
+		Labels:  labels,
+		Tags:    instanceTags(instance),
+		Zone:    parseResource(instance.Zone),
+		Project: config.Project,
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", errors.Wrap(err, "Failed to render job_template")
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// aliasAddresses returns an address for each single address alias IP range
+// of ifaces, larger ranges are skipped.
+func aliasAddresses(instance *compute.Instance, ifaces []*compute.NetworkInterface) []targetAddress {
+	addresses := []targetAddress{}
+	for _, iface := range ifaces {
+		if iface == nil {
+			continue
+		}
+
+		for _, alias := range iface.AliasIpRanges {
+			if alias == nil {
+				continue
+			}
+
+			ip, ok := singleAddressRange(alias.IpCidrRange)
+			if !ok {
+				log.Warningf("Skipping alias ip range %v of %v, only /32 ranges are supported", alias.IpCidrRange, instance.Name)
+				continue
+			}
+
+			addresses = append(addresses, targetAddress{
+				address: ip,
+				labels: map[string]string{
+					"__meta_gce_alias_range_name": alias.SubnetworkRangeName,
+				},
+			})
+		}
+	}
+	return addresses
+}
+
+// singleAddressRange returns the address in cidr if it contains exactly one
+// address.
+func singleAddressRange(cidr string) (string, bool) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		return cidr, ip != nil && ip.To4() != nil
+	}
+
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return "", false
+	}
+	if ones, bits := ipNet.Mask.Size(); ones != bits {
+		return "", false
+	}
+	return ip.String(), true
+}
+
+// noPort is used in place of a port for targets without one.
+const noPort = 0
+
+func targetString(address string, port int) string {
+	if port == noPort {
+		return address
+	}
+	return fmt.Sprintf("%v:%v", address, port)
+}
+
+// targetAddress is an address targets are produced for, along with labels
+// specific to that address.
+type targetAddress struct {
+	address string
+	labels  map[string]string
+}
+
+// interfaceAddresses returns an address for each of ifaces, of the kind
+// chosen by config.AddressType. Interfaces sharing an address produce it once.
+func interfaceAddresses(ifaces []*compute.NetworkInterface, config SearchConfig) ([]targetAddress, error) {
+	addresses := []targetAddress{}
+	seen := map[string]bool{}
+	for _, iface := range ifaces {
+		if iface == nil {
+			continue
+		}
+
+		ip := iface.NetworkIP
+		if config.AddressType == addressExternal {
+			var err error
+			ip, err = findInstanceExternalIP([]*compute.NetworkInterface{iface})
+			if err != nil {
+				continue
+			}
+		}
+		if ip == "" || seen[ip] {
+			continue
+		}
+		seen[ip] = true
+
+		labels := map[string]string{
+			"__meta_gce_interface_name":    iface.Name,
+			"__meta_gce_interface_network": parseResource(iface.Network),
+			"__meta_gce_private_ip":        iface.NetworkIP,
+		}
+		if publicIP, err := findInstanceExternalIP([]*compute.NetworkInterface{iface}); err == nil {
+			labels["__meta_gce_public_ip"] = publicIP
+		}
+		for k, v := range networkLabels(iface) {
+			labels[k] = v
+		}
+		addresses = append(addresses, targetAddress{address: ip, labels: labels})
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("No addresses found on any interface")
+	}
+	return addresses, nil
+}
+
+// instanceDNSName returns the internal DNS name of instance, in the zonal
+// form when config.DNSForm is dnsFormZonal.
+func instanceDNSName(instance *compute.Instance, config SearchConfig) string {
+	if config.DNSForm == dnsFormZonal {
+		return fmt.Sprintf("%v.%v.c.%v.internal", instance.Name, parseResource(instance.Zone), config.Project)
+	}
+	return fmt.Sprintf("%v.c.%v.internal", instance.Name, config.Project)
+}
+
+// instancePorts returns the ports to scrape on instance, read from the
+// port_label label or ports_from_metadata key when configured and present,
+// or the static ports otherwise.
+func instancePorts(instance *compute.Instance, config SearchConfig) ([]int, error) {
+	if config.PortLabel != "" {
+		if value, ok := instance.Labels[config.PortLabel]; ok {
+			port, err := parsePort(value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Invalid port in label %v", config.PortLabel)
+			}
+			return []int{port}, nil
+		}
+	}
+
+	key := config.PortsFromMetadata
+	if key == "" && config.Mode == modeAnnotations {
+		key = annotationPortKey
+	}
+	if key == "" {
+		return config.Ports, nil
+	}
+
+	value, ok := instanceMetadata(instance)[key]
+	if !ok {
+		return config.Ports, nil
+	}
+
+	ports := []int{}
+	seen := map[int]bool{}
+	for _, p := range strings.Split(value, ",") {
+		port, err := parsePort(strings.TrimSpace(p))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid port in metadata %v", key)
+		}
+		if !seen[port] {
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, errors.Errorf("%q is not a number", s)
+	}
+	if port < 1 || port > 65535 {
+		return 0, errors.Errorf("%v is out of range", port)
+	}
+	return port, nil
+}
+
+// skipInstance records that instance produced no targets for config, without
+// failing the whole discovery.
+func skipInstance(instance *compute.Instance, config SearchConfig, reason, format string, args ...interface{}) {
+	log.Warningf("Skipping %v for %v: %v", instance.Name, config.Job, fmt.Sprintf(format, args...))
+	instancesSkipped.WithLabelValues(config.Job, reason).Inc()
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	res := make(map[string]string, len(labels))
+	for k, v := range labels {
+		res[k] = v
+	}
+	return res
+}
+
+func DiscoverComputeByTags(ctx context.Context, allInstances []*compute.Instance, config SearchConfig) ([]*compute.Instance, error) {
+	searchTags, excludeTags := config.Tags, config.ExcludeTags
+	if config.IgnoreTagCase {
+		searchTags, excludeTags = lowerStrings(searchTags), lowerStrings(excludeTags)
+	}
+
+	instances := []*compute.Instance{}
+	warmingUp := map[string]int{}
+	if config.Job != "" {
+		warmingUp[config.Job] = 0
+	}
+	for _, instance := range allInstances {
+		if instance == nil {
+			continue
+		}
+
+		if config.nameRegex != nil && !config.nameRegex.MatchString(instance.Name) {
+			continue
+		}
+
+		zone := parseResource(instance.Zone)
+		if !zonesMatch(config.Zones, zone) {
+			continue
+		}
+
+		if region, _ := zoneRegion(zone); !regionsMatch(config.Regions, region) {
+			continue
+		}
+
+		if !networksMatch(config.Networks, config.Subnetworks, instance.NetworkInterfaces) {
+			continue
+		}
+
+		if !machineTypesMatch(config.MachineTypes, parseResource(instance.MachineType)) {
+			continue
+		}
+
+		if !preemptibleMatch(config.Preemptible, instancePreemptible(instance)) {
+			continue
+		}
+
+		if !acceleratorsMatch(config.Accelerators, instanceAccelerators(instance, config.AcceleratorType)) {
+			continue
+		}
+
+		if !externalIPMatch(config.ExternalIP, hasExternalIP(instance)) {
+			continue
+		}
+
+		if config.ExcludeGKENodes && isGKENode(instance) {
+			job := reportedJob(instance, config)
+			log.V(2).Infof("Skipping %v for %v, it is a GKE node", instance.Name, job)
+			instancesSkipped.WithLabelValues(job, "gke_node").Inc()
+			continue
+		}
+
+		tags := instanceTags(instance)
+		if config.IgnoreTagCase {
+			tags = lowerStrings(tags)
+		}
+		if !tagsMatchMode(config.TagMatch, searchTags, tags) {
+			continue
+		}
+
+		if !tagRegexesMatch(config.tagRegexes, tags) {
+			continue
+		}
+
+		if !labelsMatch(config.Labels, instance.Labels) {
+			continue
+		}
+
+		if !labelRequirementsMatch(config.labelSelectors, instance.Labels) {
+			continue
+		}
+
+		metadata := instanceMetadata(instance)
+		if !metadataMatch(config.Metadata, metadata) {
+			continue
+		}
+
+		if config.Mode == modeAnnotations && !annotationOptIn(instance, config) {
+			continue
+		}
+
+		if missing := missingMetadata(config.RequireMetadata, metadata); missing != "" {
+			job := reportedJob(instance, config)
+			log.V(2).Infof("Skipping %v for %v, it has no %v metadata", instance.Name, job, missing)
+			instancesSkipped.WithLabelValues(job, "missing_metadata").Inc()
+			continue
+		}
+
+		if excluded := anyTagsMatch(excludeTags, tags); excluded != "" {
+			job := reportedJob(instance, config)
+			log.V(2).Infof("Skipping %v for %v, it carries excluded tag %v", instance.Name, job, excluded)
+			instancesSkipped.WithLabelValues(job, "excluded_tag").Inc()
+			continue
+		}
+
+		if !statusesMatch(config.Statuses, instance.Status) {
+			job := reportedJob(instance, config)
+			log.V(2).Infof("Skipping %v for %v, its status is %v", instance.Name, job, instance.Status)
+			instancesSkipped.WithLabelValues(job, "status").Inc()
+			continue
+		}
+
+		if config.MinAge > 0 {
+			job := reportedJob(instance, config)
+			if !oldEnough(instance, config, job) {
+				warmingUp[job]++
+				continue
+			}
+			// Jobs whose instances have all warmed up are reported as 0.
+			if _, ok := warmingUp[job]; !ok {
+				warmingUp[job] = 0
+			}
+		}
+
+		instances = append(instances, instance)
+	}
+
+	if config.MinAge > 0 {
+		for job, n := range warmingUp {
+			setWarmingUp(job, config.Project, n)
+		}
+	}
+
+	return instances, nil
+}
+
+func listAllInstances(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+	service, err := computeServiceFor(credentialsFile)
+	if err != nil {
+		return []*compute.Instance{}, err
+	}
+
+	call := service.Instances.AggregatedList(project)
+	if filter != "" {
+		call = call.Filter(filter)
+	}
+
+	instances := []*compute.Instance{}
+	err = call.Pages(ctx, func(ilist *compute.InstanceAggregatedList) error {
+		for _, innerIList := range ilist.Items {
+			for _, instance := range innerIList.Instances {
+				if instance == nil {
+					log.Infof("Skipping nil instance in %v", project)
+					continue
+				}
+
+				instances = append(instances, instance)
+			}
+		}
+		return nil
+	})
+
+	return instances, errors.Wrap(err, "Failed to list instances")
+}
+
+func tagsMatch(searchTags, instanceTags []string) bool {
+	for _, st := range searchTags {
+		found := false
+		for _, it := range instanceTags {
+			if st == it {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// lowerStrings returns a copy of ss with every string in lower case.
+func lowerStrings(ss []string) []string {
+	res := make([]string, len(ss))
+	for i, s := range ss {
+		res[i] = strings.ToLower(s)
+	}
+	return res
+}
+
+// tagsMatchMode matches instanceTags against searchTags using the given
+// tag_match mode.
+func tagsMatchMode(mode string, searchTags, instanceTags []string) bool {
+	if mode == tagMatchAny && len(searchTags) != 0 {
+		return anyTagsMatch(searchTags, instanceTags) != ""
+	}
+	return tagsMatch(searchTags, instanceTags)
+}
+
+// tagRegexesMatch reports whether every one of regexes matches at least one
+// of instanceTags.
+func tagRegexesMatch(regexes []*regexp.Regexp, instanceTags []string) bool {
+	for _, re := range regexes {
+		found := false
+		for _, it := range instanceTags {
+			if re.MatchString(it) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// anyTagsMatch returns the first of searchTags present in instanceTags, or
+// the empty string if there is none.
+func anyTagsMatch(searchTags, instanceTags []string) string {
+	for _, st := range searchTags {
+		for _, it := range instanceTags {
+			if st == it {
+				return st
+			}
+		}
+	}
+	return ""
+}
+
+func instanceTags(instance *compute.Instance) []string {
+	if instance.Tags == nil {
+		return nil
+	}
+	return instance.Tags.Items
+}
+
+// labelsMatch reports whether every key/value pair in searchLabels is present
+// in instanceLabels.
+func labelsMatch(searchLabels, instanceLabels map[string]string) bool {
+	for k, v := range searchLabels {
+		if iv, ok := instanceLabels[k]; !ok || iv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// metadataMatch reports whether every key in searchMetadata is present in
+// instanceMetadata with the given value, an empty value matches any value.
+func metadataMatch(searchMetadata, instanceMetadata map[string]string) bool {
+	for k, v := range searchMetadata {
+		iv, ok := instanceMetadata[k]
+		if !ok || (v != "" && iv != v) {
+			return false
+		}
+	}
+	return true
+}
+
+// instanceMetadata returns the metadata items of an instance as a map,
+// items with no value are present with an empty value.
+func instanceMetadata(instance *compute.Instance) map[string]string {
+	md := map[string]string{}
+	if instance.Metadata == nil {
+		return md
+	}
+	for _, item := range instance.Metadata.Items {
+		if item == nil {
+			continue
+		}
+		v := ""
+		if item.Value != nil {
+			v = *item.Value
+		}
+		md[item.Key] = v
+	}
+	return md
+}
+
+// missingMetadata returns the first of keys not set in instanceMetadata, or
+// the empty string if all are set. Keys with empty values count as set.
+func missingMetadata(keys []string, instanceMetadata map[string]string) string {
+	for _, k := range keys {
+		if _, ok := instanceMetadata[k]; !ok {
+			return k
+		}
+	}
+	return ""
+}
+
+// instanceStatus returns the status of instance, or unknownStatus if the API
+// did not report one.
+func instanceStatus(instance *compute.Instance) string {
+	if instance.Status == "" {
+		return unknownStatus
+	}
+	return instance.Status
+}
+
+// instanceHostname returns the custom hostname of instance, or the internal
+// DNS name GCE gives instances without one.
+func instanceHostname(instance *compute.Instance, project string) string {
+	if instance.Hostname != "" {
+		return instance.Hostname
+	}
+	return fmt.Sprintf("%v.c.%v.internal", instance.Name, project)
+}
+
+// statusesMatch reports whether status is one of searchStatuses, or of
+// defaultStatuses if searchStatuses is empty.
+func statusesMatch(searchStatuses []string, status string) bool {
+	if len(searchStatuses) == 0 {
+		searchStatuses = defaultStatuses
+	}
+	for _, ss := range searchStatuses {
+		if ss == anyStatus || ss == status {
+			return true
+		}
+	}
+	return false
+}
+
+func validTagsLabelFormat(format string) bool {
+	switch format {
+	case tagsLabelJoined, tagsLabelBoolean, tagsLabelBoth:
+		return true
+	}
+	return false
+}
+
+func validStatus(status string) bool {
+	if status == anyStatus {
+		return true
+	}
+	for _, st := range instanceStatuses {
+		if st == status {
+			return true
+		}
+	}
+	return false
+}
+
+// zonesMatch reports whether zone matches any of the glob patterns in
+// searchZones. An empty searchZones matches every zone.
+func zonesMatch(searchZones []string, zone string) bool {
+	if len(searchZones) == 0 {
+		return true
+	}
+	for _, sz := range searchZones {
+		if ok, _ := path.Match(sz, zone); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// machineTypesMatch reports whether machineType matches any of the names or
+// globs in searchTypes, ignoring case. An empty searchTypes matches every
+// machine type.
+func machineTypesMatch(searchTypes []string, machineType string) bool {
+	if len(searchTypes) == 0 {
+		return true
+	}
+	machineType = strings.ToLower(machineType)
+	for _, st := range searchTypes {
+		if ok, _ := path.Match(strings.ToLower(st), machineType); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// oldEnough reports whether instance was created at least the min_age of
+// config ago, reporting it under job. Instances with an unparseable creation
+// time are included.
+func oldEnough(instance *compute.Instance, config SearchConfig, job string) bool {
+	created, err := time.Parse(time.RFC3339, instance.CreationTimestamp)
+	if err != nil {
+		log.Warningf("Including %v for %v, unable to parse its creation time: %v", instance.Name, job, err)
+		instanceTimestampErrors.WithLabelValues(job).Inc()
+		return true
+	}
+
+	if age := timeNow().Sub(created); age < config.MinAge {
+		log.V(2).Infof("Deferring %v for %v, it is only %v old", instance.Name, job, age)
+		return false
+	}
+	return true
+}
+
+// creationLabels returns the __meta_gce_instance_created label of instance,
+// holding its creation time in UTC, and if withAge is set the
+// __meta_gce_instance_age_seconds label, its age at timeNow. Neither is
+// returned if the creation time cannot be parsed.
+func creationLabels(instance *compute.Instance, config SearchConfig, withAge bool) map[string]string {
+	labels := map[string]string{}
+	if instance.CreationTimestamp == "" {
+		return labels
+	}
+	created, err := time.Parse(time.RFC3339, instance.CreationTimestamp)
+	if err != nil {
+		log.Warningf("Not labelling %v for %v with its creation time, unable to parse it: %v", instance.Name, config.Job, err)
+		createdLabelErrors.WithLabelValues(config.Job).Inc()
+		return labels
+	}
+
+	labels["__meta_gce_instance_created"] = created.UTC().Format(time.RFC3339)
+	if withAge {
+		age := timeNow().Sub(created)
+		if age < 0 {
+			age = 0
+		}
+		labels["__meta_gce_instance_age_seconds"] = strconv.FormatInt(int64(age/time.Second), 10)
+	}
+	return labels
+}
+
+// lifecycleLabels returns the __meta_gce_last_start_timestamp and
+// __meta_gce_last_stop_timestamp labels of instance, in UTC, leaving out
+// those which are empty or cannot be parsed.
+func lifecycleLabels(instance *compute.Instance, config SearchConfig) map[string]string {
+	labels := map[string]string{}
+	for label, timestamp := range map[string]string{
+		"__meta_gce_last_start_timestamp": instance.LastStartTimestamp,
+		"__meta_gce_last_stop_timestamp":  instance.LastStopTimestamp,
+	} {
+		if timestamp == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, timestamp)
+		if err != nil {
+			log.Warningf("Not labelling %v for %v with %v, unable to parse it: %v", instance.Name, config.Job, label, err)
+			continue
+		}
+		labels[label] = t.UTC().Format(time.RFC3339)
+	}
+	return labels
+}
+
+// instanceAccelerators returns the accelerators attached to instance whose
+// type matches the glob typePattern, or every accelerator if it is empty.
+func instanceAccelerators(instance *compute.Instance, typePattern string) []*compute.AcceleratorConfig {
+	accelerators := []*compute.AcceleratorConfig{}
+	for _, ac := range instance.GuestAccelerators {
+		if ac == nil || ac.AcceleratorCount <= 0 {
+			continue
+		}
+		if typePattern != "" {
+			if ok, _ := path.Match(typePattern, parseResource(ac.AcceleratorType)); !ok {
+				continue
+			}
+		}
+		accelerators = append(accelerators, ac)
+	}
+	return accelerators
+}
+
+// acceleratorsMatch reports whether an instance with the given accelerators
+// is matched under mode.
+func acceleratorsMatch(mode string, accelerators []*compute.AcceleratorConfig) bool {
+	switch mode {
+	case acceleratorsRequire:
+		return len(accelerators) != 0
+	case acceleratorsExclude:
+		return len(accelerators) == 0
+	default:
+		return true
+	}
+}
+
+// acceleratorLabels returns the sorted, distinct types and total count of
+// accelerators.
+func acceleratorLabels(accelerators []*compute.AcceleratorConfig) (string, string) {
+	types := []string{}
+	seen := map[string]bool{}
+	count := int64(0)
+	for _, ac := range accelerators {
+		t := parseResource(ac.AcceleratorType)
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+		count += ac.AcceleratorCount
+	}
+	sort.Strings(types)
+	return strings.Join(types, ","), strconv.FormatInt(count, 10)
+}
+
+// isGKENode reports whether instance appears to be a node managed by GKE,
+// which carries the goog-gke-node label or a kube-env metadata key.
+func isGKENode(instance *compute.Instance) bool {
+	if _, ok := instance.Labels["goog-gke-node"]; ok {
+		return true
+	}
+	if _, ok := instanceMetadata(instance)["kube-env"]; ok {
+		return true
+	}
+	return false
+}
+
+// hasExternalIP reports whether any network interface of instance has a NAT
+// IP, regardless of which interface supplies the target address.
+func hasExternalIP(instance *compute.Instance) bool {
+	_, err := findInstanceExternalIP(instance.NetworkInterfaces)
+	return err == nil
+}
+
+// externalIPMatch reports whether an instance which has an external IP or not
+// is matched under mode.
+func externalIPMatch(mode string, external bool) bool {
+	switch mode {
+	case externalIPRequire:
+		return external
+	case externalIPExclude:
+		return !external
+	default:
+		return true
+	}
+}
+
+// preemptibleMatch reports whether an instance which is preemptible or not
+// is matched under mode.
+func preemptibleMatch(mode string, preemptible bool) bool {
+	switch mode {
+	case preemptibleExclude:
+		return !preemptible
+	case preemptibleOnly:
+		return preemptible
+	default:
+		return true
+	}
+}
+
+// instancePreemptible reports whether instance is a preemptible or Spot VM.
+func instancePreemptible(instance *compute.Instance) bool {
+	if instance.Scheduling == nil {
+		return false
+	}
+	return instance.Scheduling.Preemptible || instance.Scheduling.ProvisioningModel == "SPOT"
+}
+
+// serviceAccountLabels returns the emails of the service accounts instance
+// runs as, comma separated, and the scopes granted to them, comma wrapped
+// like __meta_gce_instance_tags and shortened to their last path component.
+// Instances without service accounts get neither label.
+func serviceAccountLabels(instance *compute.Instance) map[string]string {
+	labels := map[string]string{}
+	emails, scopes := []string{}, []string{}
+	seen := map[string]bool{}
+	for _, sa := range instance.ServiceAccounts {
+		if sa == nil {
+			continue
+		}
+		emails = append(emails, sa.Email)
+		for _, scope := range sa.Scopes {
+			scope = parseResource(scope)
+			if !seen[scope] {
+				seen[scope] = true
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	if len(emails) == 0 {
+		return labels
 	}
+	labels["__meta_gce_service_account"] = strings.Join(emails, ",")
+	labels["__meta_gce_service_account_scopes"] = fmt.Sprintf(",%v,", strings.Join(scopes, ","))
+	return labels
+}
 
-	for i, c := range config {
-		err := ValidateConfig(c)
-		if err != nil {
-			return []SearchConfig{}, errors.Wrapf(err, "Failed to validate config entry #%v", i)
+// schedulingLabels returns the labels describing how instance is scheduled.
+// Instances without scheduling options get the defaults GCE applies.
+func schedulingLabels(instance *compute.Instance) map[string]string {
+	labels := map[string]string{
+		"__meta_gce_instance_preemptible": strconv.FormatBool(instancePreemptible(instance)),
+		"__meta_gce_provisioning_model":   "STANDARD",
+		"__meta_gce_automatic_restart":    "true",
+	}
+	if s := instance.Scheduling; s != nil {
+		if s.ProvisioningModel != "" {
+			labels["__meta_gce_provisioning_model"] = s.ProvisioningModel
+		}
+		if s.AutomaticRestart != nil {
+			labels["__meta_gce_automatic_restart"] = strconv.FormatBool(*s.AutomaticRestart)
 		}
 	}
-
-	return config, nil
+	return labels
 }
 
-func ValidateConfig(conf SearchConfig) error {
-	if len(conf.XXX) != 0 {
-		unknownKeys := []string{}
-		for k := range conf.XXX {
-			unknownKeys = append(unknownKeys, k)
+// regionsMatch reports whether region is one of searchRegions. An empty
+// searchRegions matches every region.
+func regionsMatch(searchRegions []string, region string) bool {
+	if len(searchRegions) == 0 {
+		return true
+	}
+	for _, sr := range searchRegions {
+		if sr == region {
+			return true
 		}
-
-		return errors.Errorf("Unknown keys in config: %v", strings.Join(unknownKeys, ","))
 	}
+	return false
+}
 
-	if conf.Job == "" {
-		return errors.New("No job specified")
+// zoneRegion returns the region a zone belongs to, e.g. us-central1 for
+// us-central1-b, reporting whether zone was of the form <region>-<letter>.
+func zoneRegion(zone string) (string, bool) {
+	i := strings.LastIndex(zone, "-")
+	if i <= 0 || len(zone)-i != 2 {
+		return "", false
 	}
-
-	if len(conf.Tags) == 0 {
-		return errors.New("No tags specified")
+	if c := zone[i+1]; c < 'a' || c > 'z' {
+		return "", false
 	}
+	return zone[:i], true
+}
 
-	if conf.Project == "" {
-		return errors.New("No project specified")
-	}
+func parseResource(resource string) string {
+	parts := strings.Split(resource, "/")
+	return parts[len(parts)-1]
+}
 
-	if len(conf.Ports) == 0 {
-		return errors.New("No ports specified")
+// networkLabels returns the __meta_gce_network and __meta_gce_subnetwork
+// labels of iface, leaving out those it has no value for, such as the
+// subnetwork of an interface on a legacy network.
+func networkLabels(iface *compute.NetworkInterface) map[string]string {
+	labels := map[string]string{}
+	if iface.Network != "" {
+		labels["__meta_gce_network"] = parseResource(iface.Network)
 	}
-
-	return nil
+	if iface.Subnetwork != "" {
+		labels["__meta_gce_subnetwork"] = parseResource(iface.Subnetwork)
+	}
+	return labels
 }
 
-func DiscoverTargets(ctx context.Context, searchConfigs []SearchConfig) ([]DiscoveryTarget, error) {
-	targets := []DiscoveryTarget{}
+func formatTag(tag string) string {
+	return invalidLabelChars.ReplaceAllString(strings.ToLower(strings.Replace(tag, "-", "_", -1)), "")
+}
 
-	instancesByProject := map[string][]*compute.Instance{}
+// invalidLabelChars matches the characters formatTag strips from label
+// names.
+var invalidLabelChars = regexp.MustCompile(`[^a-z0-9_]`)
 
-	for _, config := range searchConfigs {
-		allInstances, ok := instancesByProject[config.Project]
-		if !ok {
-			var err error
-			allInstances, err = listAllInstances(ctx, config.Project)
-			if err != nil {
-				return []DiscoveryTarget{}, errors.Wrapf(err, "Failed to list instances in %v", config.Project)
+// tagLabels returns the labels for an instance's network tags in the given
+// tags_label_format.
+func tagLabels(tags []string, format string) map[string]string {
+	labels := map[string]string{}
+	if format != tagsLabelBoolean {
+		labels["__meta_gce_instance_tags"] = fmt.Sprintf(",%v,", strings.Join(tags, ","))
+	}
+	if format == tagsLabelBoolean || format == tagsLabelBoth {
+		for _, tag := range tags {
+			if name := formatTag(tag); name != "" {
+				labels["__meta_gce_instance_tag_"+name] = "true"
 			}
-			instancesByProject[config.Project] = allInstances
 		}
+	}
+	return labels
+}
 
-		instances, err := DiscoverComputeByTags(ctx, allInstances, config.Tags)
-		if err != nil {
-			return []DiscoveryTarget{}, errors.Wrapf(err, "Failed to discover instances %v in %v", config.Tags, config.Project)
+// selectInterfaces returns the network interfaces of instance which may
+// supply its address, as chosen by the interface_index or interface_network
+// settings of config. Without either setting every interface is returned.
+// Interfaces outside of the networks or subnetworks of config are dropped.
+func selectInterfaces(instance *compute.Instance, config SearchConfig) ([]*compute.NetworkInterface, error) {
+	var ifaces []*compute.NetworkInterface
+	switch {
+	case config.InterfaceIndex != nil:
+		i := *config.InterfaceIndex
+		if i >= len(instance.NetworkInterfaces) || instance.NetworkInterfaces[i] == nil {
+			return nil, errors.Errorf("No network interface with index %v", i)
 		}
-		log.V(2).Infof("Found %v targets for %v in %v", len(instances), config.Tags, config.Project)
-
-		for _, instance := range instances {
-			instTargets, err := InstanceToTargets(instance, config)
-			if err != nil {
-				return []DiscoveryTarget{}, errors.Wrapf(err, "Failed to convert %v to a discovery target", instance)
+		ifaces = []*compute.NetworkInterface{instance.NetworkInterfaces[i]}
+	case config.InterfaceNetwork != "":
+		for _, iface := range instance.NetworkInterfaces {
+			if iface == nil {
+				continue
+			}
+			if parseResource(iface.Network) == config.InterfaceNetwork || parseResource(iface.Subnetwork) == config.InterfaceNetwork {
+				ifaces = append(ifaces, iface)
 			}
-			targets = append(targets, instTargets...)
 		}
+		if len(ifaces) == 0 {
+			return nil, errors.Errorf("No network interface on network %v", config.InterfaceNetwork)
+		}
+	default:
+		ifaces = instance.NetworkInterfaces
 	}
 
-	counts := map[string]int{}
-	for _, t := range targets {
-		job := t.Labels["job"]
-		counts[job] = counts[job] + 1
+	if len(config.Networks) == 0 && len(config.Subnetworks) == 0 {
+		return ifaces, nil
 	}
-	for j, c := range counts {
-		targetCount.WithLabelValues(j).Set(float64(c))
+
+	allowed := []*compute.NetworkInterface{}
+	for _, iface := range ifaces {
+		if interfaceNetworksMatch(config.Networks, config.Subnetworks, iface) {
+			allowed = append(allowed, iface)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, errors.Errorf("No network interface on networks %v and subnetworks %v", config.Networks, config.Subnetworks)
 	}
+	return allowed, nil
+}
 
-	return targets, nil
+// networksMatch reports whether any of ifaces is attached to one of networks
+// and one of subnetworks, either of which match any interface when empty.
+func networksMatch(networks, subnetworks []string, ifaces []*compute.NetworkInterface) bool {
+	if len(networks) == 0 && len(subnetworks) == 0 {
+		return true
+	}
+	for _, iface := range ifaces {
+		if interfaceNetworksMatch(networks, subnetworks, iface) {
+			return true
+		}
+	}
+	return false
 }
 
-func InstanceToTargets(instance *compute.Instance, config SearchConfig) ([]DiscoveryTarget, error) {
-	ip, err := findInstanceIP(instance)
-	if err != nil {
-		return []DiscoveryTarget{}, errors.Wrap(err, "Could not find ip for instance")
+func interfaceNetworksMatch(networks, subnetworks []string, iface *compute.NetworkInterface) bool {
+	if iface == nil {
+		return false
 	}
+	return (len(networks) == 0 || stringInSlice(parseResource(iface.Network), networks)) &&
+		(len(subnetworks) == 0 || stringInSlice(parseResource(iface.Subnetwork), subnetworks))
+}
 
-	targets := []DiscoveryTarget{}
-	for _, port := range config.Ports {
-		targets = append(targets, DiscoveryTarget{
-			Targets: []string{fmt.Sprintf("%v:%v", ip, port)},
-			Labels: map[string]string{
-				"job": config.Job,
-				"__meta_gce_instance_tags":    fmt.Sprintf(",%v,", strings.Join(instance.Tags.Items, ",")),
-				"__meta_gce_instance_zone":    parseResource(instance.Zone),
-				"__meta_gce_instance_type":    parseResource(instance.MachineType),
-				"__meta_gce_instance_project": config.Project,
-				"__meta_gce_instance_name":    instance.Name,
-			},
-		})
+func stringInSlice(s string, list []string) bool {
+	for _, l := range list {
+		if s == l {
+			return true
+		}
 	}
-	return targets, nil
+	return false
 }
 
-func DiscoverComputeByTags(ctx context.Context, allInstances []*compute.Instance, searchTags []string) ([]*compute.Instance, error) {
-	instances := []*compute.Instance{}
-	for _, instance := range allInstances {
-		if instance == nil {
+func findInstanceIP(ifaces []*compute.NetworkInterface) (string, error) {
+	for _, iface := range ifaces {
+		if iface == nil {
 			continue
 		}
 
-		if tagsMatch(searchTags, instance.Tags.Items) {
-			instances = append(instances, instance)
-		}
+		return iface.NetworkIP, nil
 	}
+	return "", errors.Errorf("No non nil interfaces found")
+}
 
-	return instances, nil
+// findInstanceExternalIP returns the first NAT IP found in the access
+// configs of the given network interfaces.
+func findInstanceExternalIP(ifaces []*compute.NetworkInterface) (string, error) {
+	for _, iface := range ifaces {
+		if iface == nil {
+			continue
+		}
+
+		for _, ac := range iface.AccessConfigs {
+			if ac == nil || ac.NatIP == "" {
+				continue
+			}
+
+			return ac.NatIP, nil
+		}
+	}
+	return "", errors.Errorf("No external ip found")
 }
 
-func listAllInstances(ctx context.Context, project string) ([]*compute.Instance, error) {
-	service, err := NewComputeService(ctx)
+// WriteTargets writes targets to targetFile, backing up the previous file
+// while it is replaced, followed by its checksum and a manifest summarising
+// them. Both are replaced atomically. With -write.verify the targets file is
+// read back and the write fails if it does not hold the targets. YAML
+// targets are preceded by a comment header unless -write.header=false. The
+// meta labels of jobs in info.labelPrefixes are renamed, and the job label of
+// jobs in info.omitJobLabel removed, as they are written.
+// Targets written to a file or gs:// URL ending in .gz are gzipped, and with
+// -output.compress a gzipped copy of other files is also written. If
+// targetFile is stdoutOutput the targets are only printed, and if it is a
+// gs:// or configmap:// URL they are only uploaded. If the targets cannot be
+// written the previous manifest is kept, as it still describes the previous
+// targets, and if the manifest cannot be written it is removed rather than
+// left describing different targets.
+func WriteTargets(ctx context.Context, targets []DiscoveryTarget, targetFile string, info syncInfo) error {
+	sortedTargets := discoveryTargets(targets)
+	sort.Sort(sortedTargets)
+	targets = []DiscoveryTarget(sortedTargets)
+
+	format, err := resolveOutputFormat(*outputFormat, targetFile)
 	if err != nil {
-		return []*compute.Instance{}, err
+		return err
 	}
 
-	instances := []*compute.Instance{}
-	err = service.Instances.AggregatedList(project).Pages(ctx, func(ilist *compute.InstanceAggregatedList) error {
-		for _, innerIList := range ilist.Items {
-			for _, instance := range innerIList.Instances {
-				if instance == nil {
-					log.Infof("Skipping nil instance in %v", project)
-					continue
-				}
-
-				instances = append(instances, instance)
-			}
+	// Targets are sorted and summarised by their original labels, so
+	// renaming them does not change their order.
+	d, err := marshalTargets(outputLabels(targets, info), format)
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal targets")
+	}
+	if *writeHeader && format == outputFormatYAML {
+		d = append(targetsHeader(targets, info), d...)
+	}
+	if targetFile == stdoutOutput {
+		_, err := stdout.Write(d)
+		return errors.Wrap(err, "Failed to write targets to stdout")
+	}
+	if strings.HasPrefix(targetFile, configMapScheme) {
+		if isCompressedOutput(targetFile) {
+			return errors.Errorf("ConfigMap key %v cannot hold gzipped targets", targetFile)
 		}
-		return nil
-	})
+		return updateConfigMap(ctx, targetFile, d)
+	}
+	if isCompressedOutput(targetFile) {
+		if d, err = gzipTargets(d); err != nil {
+			return err
+		}
+	}
+	if strings.HasPrefix(targetFile, gcsScheme) {
+		contentType := outputContentType(format)
+		if isCompressedOutput(targetFile) {
+			contentType = "application/gzip"
+		}
+		return uploadGCSObject(ctx, targetFile, d, contentType)
+	}
 
-	return instances, errors.Wrap(err, "Failed to list instances")
-}
+	md, err := marshalManifest(newTargetsManifest(targets, info))
+	if err != nil {
+		return err
+	}
 
-func tagsMatch(searchTags, instanceTags []string) bool {
-	for _, st := range searchTags {
-		found := false
-		for _, it := range instanceTags {
-			if st == it {
-				found = true
-				break
-			}
+	if err := writeWithBackup(targetFile, d, *keepBackup); err != nil {
+		return err
+	}
+	if *verifyWrites {
+		if err := verifyFile(targetFile, d); err != nil {
+			resultVerifyFailures.WithLabelValues(targetFile).Inc()
+			return err
 		}
-		if !found {
-			return false
+	}
+	if err := writeChecksum(targetFile, d); err != nil {
+		return err
+	}
+	if *compressOutput && !isCompressedOutput(targetFile) {
+		gz, err := gzipTargets(d)
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(compressedFile(targetFile), gz); err != nil {
+			return errors.Wrapf(err, "Failed to write gzipped copy of %v", targetFile)
 		}
 	}
-	return true
-}
-
-func parseResource(resource string) string {
-	parts := strings.Split(resource, "/")
-	return parts[len(parts)-1]
-}
 
-func formatTag(tag string) string {
-	return strings.ToLower(strings.Replace(tag, "-", "_", -1))
+	manifest := manifestFile(targetFile)
+	if err := writeFileAtomic(manifest, md); err != nil {
+		if rerr := os.Remove(manifest); rerr != nil && !os.IsNotExist(rerr) {
+			log.Errorf("Failed to remove stale manifest %v: %v", manifest, rerr)
+		}
+		return err
+	}
+	return nil
 }
 
-func findInstanceIP(instance *compute.Instance) (string, error) {
-	for _, iface := range instance.NetworkInterfaces {
-		if iface == nil {
-			continue
-		}
+// createOutputFile, renameOutputFile, syncOutputDir and readOutputFile are
+// used to create, replace and read back output files, they are replaced in
+// tests.
+var (
+	createOutputFile = func(name string) (*os.File, error) {
+		return os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	}
+	renameOutputFile = os.Rename
+	syncOutputDir    = syncDir
+	readOutputFile   = ioutil.ReadFile
+)
 
-		return iface.NetworkIP, nil
+// syncDir fsyncs the directory dir, so that files renamed into it survive a
+// crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open %v", dir)
 	}
-	return "", errors.Errorf("No non nil interfaces found")
+	defer f.Close()
+	return errors.Wrapf(f.Sync(), "Failed to sync %v", dir)
 }
 
-func WriteTargets(ctx context.Context, targets []DiscoveryTarget, targetFile string) error {
-	sortedTargets := discoveryTargets(targets)
-	sort.Sort(sortedTargets)
-	targets = []DiscoveryTarget(sortedTargets)
-
-	d, err := yaml.Marshal(targets)
+// verifyFile reads file back and checks it holds exactly d.
+func verifyFile(file string, d []byte) error {
+	written, err := readOutputFile(file)
 	if err != nil {
-		return errors.Wrap(err, "Failed to marshal targets")
+		return errors.Wrapf(err, "Failed to read back %v", file)
 	}
+	if !bytes.Equal(written, d) {
+		return errors.Errorf("Read back %v bytes from %v which differ from the %v bytes written", len(written), file, len(d))
+	}
+	return nil
+}
 
-	f, err := os.Create(targetFile)
+// writeFileAtomic replaces file with d by writing a temporary file in the
+// same directory and renaming it over file. The file, and then the directory,
+// are fsynced so the new contents survive a crash. Like os.Create, the file's
+// mode is set by the umask unless -output.mode is set.
+func writeFileAtomic(file string, d []byte) error {
+	tmp := filepath.Join(filepath.Dir(file), fmt.Sprintf(".%v.%v.tmp", filepath.Base(file), os.Getpid()))
+	f, err := createOutputFile(tmp)
 	if err != nil {
 		return errors.Wrap(err, "Failed to open output file")
 	}
+	defer os.Remove(f.Name())
 	defer f.Close()
 
+	if err := setFilePermissions(f, *outputMode, *outputUID, *outputGID); err != nil {
+		return err
+	}
+
 	w := bufio.NewWriter(f)
-	_, err = w.WriteString(string(d))
+	_, err = w.Write(d)
 	if err != nil {
 		return errors.Wrap(err, "Failed to write to output buffer")
 	}
@@ -301,16 +3130,25 @@ func WriteTargets(ctx context.Context, targets []DiscoveryTarget, targetFile str
 	if err != nil {
 		return errors.Wrap(err, "Failed to flush to output file")
 	}
-	return nil
+	if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "Failed to sync output file")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "Failed to close output file")
+	}
+	if err := renameOutputFile(f.Name(), file); err != nil {
+		return errors.Wrapf(err, "Failed to replace %v", file)
+	}
+	return syncOutputDir(filepath.Dir(file))
 }
 
+// targetsDifferent reports whether old and new differ in any address or label.
+// Labels which change without the set of targets changing, such as
+// __meta_gce_last_start_timestamp when an instance restarts, deliberately
+// count as changes so that Prometheus sees their new values.
 func targetsDifferent(old, new []DiscoveryTarget) bool {
-	oldSorted := discoveryTargets(old)
-	sort.Sort(oldSorted)
-	old = []DiscoveryTarget(oldSorted)
-	newSorted := discoveryTargets(new)
-	sort.Sort(newSorted)
-	new = []DiscoveryTarget(newSorted)
+	old = normalizeTargets(old)
+	new = normalizeTargets(new)
 
 	newEncoded, _ := yaml.Marshal(new)
 	oldEncoded, _ := yaml.Marshal(old)
@@ -320,32 +3158,224 @@ func targetsDifferent(old, new []DiscoveryTarget) bool {
 
 type discoveryTargets []DiscoveryTarget
 
-func (dt discoveryTargets) Len() int           { return len(dt) }
-func (dt discoveryTargets) Less(i, j int) bool { return dt[i].Targets[0] < dt[j].Targets[0] }
-func (dt discoveryTargets) Swap(i, j int)      { dt[i], dt[j] = dt[j], dt[i] }
+func (dt discoveryTargets) Len() int      { return len(dt) }
+func (dt discoveryTargets) Swap(i, j int) { dt[i], dt[j] = dt[j], dt[i] }
+
+// Less orders targets by their addresses, then by their labels, so entries
+// with several addresses, or sharing addresses, sort deterministically.
+func (dt discoveryTargets) Less(i, j int) bool {
+	a, b := dt[i].Targets, dt[j].Targets
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return labelsKey(dt[i].Labels) < labelsKey(dt[j].Labels)
+}
+
+// labelsKey returns a string identifying a set of labels.
+func labelsKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte(0)
+		b.WriteString(labels[k])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// normalizeTargets returns a sorted copy of targets, with the addresses of
+// each entry sorted.
+func normalizeTargets(targets []DiscoveryTarget) []DiscoveryTarget {
+	res := make(discoveryTargets, len(targets))
+	for i, t := range targets {
+		addrs := append([]string{}, t.Targets...)
+		sort.Strings(addrs)
+		res[i] = DiscoveryTarget{Targets: addrs, Labels: t.Labels}
+	}
+	sort.Sort(res)
+	return []DiscoveryTarget(res)
+}
+
+// groupTargets merges the entries of targets sharing the same labels into
+// one entry holding all of their addresses, sorted and deduplicated.
+func groupTargets(targets []DiscoveryTarget) []DiscoveryTarget {
+	byLabels := map[string]*DiscoveryTarget{}
+	keys := []string{}
+	for _, t := range targets {
+		key := labelsKey(t.Labels)
+		g, ok := byLabels[key]
+		if !ok {
+			g = &DiscoveryTarget{Labels: t.Labels}
+			byLabels[key] = g
+			keys = append(keys, key)
+		}
+		g.Targets = append(g.Targets, t.Targets...)
+	}
+
+	res := make([]DiscoveryTarget, 0, len(keys))
+	for _, key := range keys {
+		g := byLabels[key]
+		sort.Strings(g.Targets)
+		addrs := g.Targets[:0]
+		for i, a := range g.Targets {
+			if i == 0 || a != g.Targets[i-1] {
+				addrs = append(addrs, a)
+			}
+		}
+		g.Targets = addrs
+		res = append(res, *g)
+	}
+	return normalizeTargets(res)
+}
+
+// dedupTargets returns targets without the entries identical to an earlier
+// one, with the same addresses and labels, and the number left out. Entries
+// differing in any label, such as job, are all kept, other than in the labels
+// recording the config entry which produced them, where the first is kept.
+func dedupTargets(targets []DiscoveryTarget) ([]DiscoveryTarget, int) {
+	seen := map[string]bool{}
+	res := make([]DiscoveryTarget, 0, len(targets))
+	for _, t := range targets {
+		key := strings.Join(t.Targets, ",") + "\x00" + labelsKey(withoutProvenance(t.Labels))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		res = append(res, t)
+	}
+	return res, len(targets) - len(res)
+}
+
+// Events sent by tickAndListen to the sync loop.
+type syncEvent int
+
+const (
+	// syncTick is sent every interval.
+	syncTick syncEvent = iota
+	// syncForce is sent on SIGUSR1, forcing discovery and a write.
+	syncForce
+	// syncReload is sent on SIGHUP, or when reloads receives, requesting the
+	// config be reloaded.
+	syncReload
+)
+
+// forcesDiscovery reports whether every job is discovered on e, rather than
+// only those which are due.
+func (e syncEvent) forcesDiscovery() bool {
+	return e != syncTick
+}
+
+// forcesWrite reports whether every file is written on e, overriding
+// -write.max-shrink-percent and min_targets. Only SIGUSR1 does, so that a
+// reloaded config which drops targets is still guarded against.
+func (e syncEvent) forcesWrite() bool {
+	return e == syncForce
+}
 
-func tickAndListen(ctx context.Context, interval time.Duration) chan bool {
-	tChan := make(chan bool, 2)
+func tickAndListen(ctx context.Context, interval func() time.Duration, reloads <-chan struct{}) chan syncEvent {
+	tChan := make(chan syncEvent, 2)
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGUSR1)
+	signal.Notify(sigChan, syscall.SIGUSR1, syscall.SIGHUP)
 
 	go func() {
 		for ctx.Err() == nil {
 			select {
-			case <-time.After(interval):
-				tChan <- false
-			case <-sigChan:
-				tChan <- true
+			case <-time.After(interval()):
+				tChan <- syncTick
+			case sig := <-sigChan:
+				if sig == syscall.SIGHUP {
+					tChan <- syncReload
+				} else {
+					tChan <- syncForce
+				}
+			case <-reloads:
+				tChan <- syncReload
 			case <-ctx.Done():
 			}
 		}
 	}()
 	// Let's kick things off with a bang!
-	tChan <- false
+	tChan <- syncTick
 
 	return tChan
 }
 
+// reloadConfig loads the config at path and swaps it into scheduler,
+// reporting whether it succeeded. On failure the scheduler keeps its current
+// config.
+func reloadConfig(path string, scheduler *discoveryScheduler) bool {
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		log.Errorf("Failed to reload config file %v, keeping the current config: %v", path, err)
+		configReload.WithLabelValues("failure").Inc()
+		return false
+	}
+
+	log.Infof("Reloaded config file %v", path)
+	log.V(2).Infof("Loaded config: %v", config)
+	scheduler.SetConfigs(config)
+	configReload.WithLabelValues("success").Inc()
+	configLastReload.SetToCurrentTime()
+	return true
+}
+
+// validateConfigFile loads and validates the config at path, printing a
+// summary of each job to out, sorted by job name, or the errors found to
+// errOut. It returns the exit status for -validate-config.
+func validateConfigFile(path string, out, errOut io.Writer) int {
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		fmt.Fprintf(errOut, "Invalid config %v:\n%v\n", path, err)
+		return 1
+	}
+
+	sorted := append([]SearchConfig{}, config...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Job < sorted[j].Job })
+
+	for _, c := range sorted {
+		projects := append([]string{}, configProjects(c)...)
+		if c.ProjectDiscovery != nil {
+			projects = append(projects, c.ProjectDiscovery.Parent)
+		}
+		sort.Strings(projects)
+		tags := append([]string{}, c.Tags...)
+		sort.Strings(tags)
+
+		portNums := append([]int{}, c.Ports...)
+		sort.Ints(portNums)
+		ports := []string{}
+		for _, p := range portNums {
+			ports = append(ports, strconv.Itoa(p))
+		}
+		if c.PortLabel != "" {
+			ports = append(ports, "label:"+c.PortLabel)
+		}
+		if c.PortsFromMetadata != "" {
+			ports = append(ports, "metadata:"+c.PortsFromMetadata)
+		}
+
+		fmt.Fprintf(out, "%v project=%v tags=%v ports=%v\n",
+			c.Job,
+			strings.Join(projects, ","),
+			strings.Join(tags, ","),
+			strings.Join(ports, ","))
+	}
+	fmt.Fprintf(out, "%v jobs OK\n", len(sorted))
+
+	return 0
+}
+
 func main() {
 	flag.Parse()
 	ctx := context.Background()
@@ -354,10 +3384,33 @@ func main() {
 		log.Error("Config filename not specified")
 		os.Exit(1)
 	}
-	if *outputFilename == "" {
+	if !validTagsLabelFormat(*tagsLabelFormat) {
+		log.Errorf("Unknown -tags.label-format %q, must be %q, %q or %q", *tagsLabelFormat, tagsLabelJoined, tagsLabelBoolean, tagsLabelBoth)
+		os.Exit(1)
+	}
+	if *listConcurrency < 1 {
+		log.Errorf("Invalid -discovery.concurrency %v, must be at least 1", *listConcurrency)
+		os.Exit(1)
+	}
+	if *validateOnly {
+		os.Exit(validateConfigFile(*configFilename, os.Stdout, os.Stderr))
+	}
+	if len(outputFilenames) == 0 && !*serveHTTPSD {
 		log.Error("Output filename not specified")
 		os.Exit(1)
 	}
+	for _, f := range outputFilenames {
+		if _, err := resolveOutputFormat(*outputFormat, f); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	if *outputMode != "" {
+		if _, err := parseFileMode(*outputMode); err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
 
 	config, err := LoadConfigFile(*configFilename)
 	if err != nil {
@@ -365,9 +3418,23 @@ func main() {
 		os.Exit(1)
 	}
 	log.V(2).Infof("Loaded config: %v", config)
+	configLastReload.SetToCurrentTime()
+
+	var reloads <-chan struct{}
+	if *watchConfigFile {
+		reloads, err = watchConfig(ctx, *configFilename, *watchDebounce)
+		if err != nil {
+			log.Errorf("Failed to watch config file %v: %v", *configFilename, err)
+			os.Exit(1)
+		}
+	}
 
+	sd := &httpSD{}
 	go func() {
 		http.Handle("/metrics", prometheus.Handler())
+		if *serveHTTPSD {
+			http.Handle("/sd", sd)
+		}
 		err := http.ListenAndServe(*metricsAddr, nil)
 		if err != nil {
 			log.Errorf("Could not start metrics server on %v: %v", *metricsAddr, err)
@@ -375,9 +3442,34 @@ func main() {
 		}
 	}()
 
-	var currentTargets []DiscoveryTarget
+	var registrar *consulRegistrar
+	if *consulAddr != "" {
+		registrar = newConsulRegistrar(*consulAddr, *consulTimeout)
+	}
+	writer := newTargetWriter(outputFilenames.first(), *removeStale)
+	if len(outputFilenames) > 1 {
+		writer.mirrors = outputFilenames[1:]
+	}
+	writer.stdoutChangesOnly = *stdoutChanges
+	writer.groupTargets = *groupOutput
+	writer.maxShrinkPercent = *maxShrinkPercent
+	writer.refreshInterval = *refreshInterval
+	scheduler := newDiscoveryScheduler(config, *discoveryInterval)
+
+	// A consul outage is logged rather than failing the sync. Services are
+	// registered after targets are written, with their own timeout, so that
+	// a slow agent delays neither writes nor discovery.
+	reconcile := func() {
+		ctx, cancel := context.WithTimeout(ctx, *consulTimeout)
+		defer cancel()
+
+		consulTargets := scheduler.TargetsMatching(func(c SearchConfig) bool { return c.Consul })
+		if err := registrar.Reconcile(ctx, consulTargets); err != nil {
+			log.Errorf("Failed to register targets in consul: %v", err)
+		}
+	}
 
-	loop := func(force bool) error {
+	loop := func(event syncEvent) error {
 		ctx, cancel := context.WithTimeout(ctx, *discoveryTimeout)
 		defer cancel()
 
@@ -385,30 +3477,74 @@ func main() {
 		defer syncDuration.Observe(float64(started.Sub(time.Now())) / float64(time.Second))
 
 		log.V(2).Info("Discovering targets")
-		newTargets, err := DiscoverTargets(ctx, config)
-		if err != nil {
-			return errors.Wrap(err, "Could not discover targets")
+		discovered, discoverErr := scheduler.Sync(ctx, started, event.forcesDiscovery())
+		if discoverErr != nil {
+			discoverErr = errors.Wrap(discoverErr, "Could not discover targets")
+			// The targets of the entries which did not fail are still
+			// written, and the error returned afterwards.
+			if !discovered {
+				return discoverErr
+			}
+		}
+		// Files which failed to be written are retried, and those due to be
+		// refreshed rewritten, even when no jobs are due.
+		if !discovered && !writer.Pending(started) {
+			log.V(2).Info("No jobs due for discovery")
+			return nil
+		}
+
+		info := syncInfo{
+			time:           started,
+			configHash:     scheduler.ConfigHash(),
+			labelPrefixes:  scheduler.LabelPrefixes(),
+			maxValueLength: scheduler.MaxLabelValueLengths(),
+			omitJobLabel:   scheduler.OmittedJobLabels(),
+		}
+
+		if *serveHTTPSD {
+			targets, _ := dedupTargets(scheduler.Targets())
+			if *groupOutput {
+				targets = groupTargets(targets)
+			}
+			if err := sd.Update(outputLabels(targets, info), started); err != nil {
+				return err
+			}
 		}
 
-		if force {
+		writer.minTargets = scheduler.MinTargetsByFile(outputFilenames.first())
+
+		// Without -output only jobs with their own output are written.
+		targetsByFile := scheduler.TargetsByFile(outputFilenames.first())
+		delete(targetsByFile, "")
+
+		if event.forcesWrite() {
 			log.Info("Forcing write")
-		} else if !targetsDifferent(newTargets, currentTargets) {
-			log.V(2).Info("No changes detected, skipping write")
-			return nil
 		}
+		err := writer.Write(ctx, targetsByFile, event.forcesWrite(), info)
 
-		log.V(2).Info("Writing targets")
-		resultWrite.Inc()
-		err = WriteTargets(ctx, newTargets, *outputFilename)
-		if err != nil {
-			return errors.Wrap(err, "Could not write targets")
+		if registrar != nil {
+			reconcile()
 		}
-		currentTargets = newTargets
-		return nil
+		if err == nil {
+			err = discoverErr
+		}
+		return err
+	}
+
+	if *once {
+		if err := loop(syncForce); err != nil {
+			log.Errorf("Sync failed: %v", err)
+			os.Exit(1)
+		}
+		return
 	}
 
-	for force := range tickAndListen(ctx, *discoveryInterval) {
-		err := loop(force)
+	for event := range tickAndListen(ctx, scheduler.TickInterval, reloads) {
+		if event == syncReload && !reloadConfig(*configFilename, scheduler) {
+			continue
+		}
+
+		err := loop(event)
 		if err != nil {
 			log.Errorf("Sync loop failed: %v", err)
 			syncResult.WithLabelValues("failure").Inc()
@@ -3,11 +3,26 @@ package main
 import (
 	"testing"
 
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
 	compute "google.golang.org/api/compute/v1"
+	"gopkg.in/yaml.v2"
 )
 
 func TestLoadConfigFile(t *testing.T) {
@@ -82,9 +97,315 @@ func TestLoadConfigFile(t *testing.T) {
 	}
 }
 
+func TestLoadConfigFileEntries(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		path          string
+		expected      []SearchConfig
+		expectedError bool
+	}{
+		{
+			path: "./test/config_valid.yaml",
+			expected: []SearchConfig{
+				{
+					Job:     "gce_zookeeper",
+					Tags:    []string{"zookeeper"},
+					Project: "sandbox",
+					Ports:   []int{8080, 6060},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_malformed.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid.json",
+			expected: []SearchConfig{
+				{
+					Job:     "gce_zookeeper",
+					Tags:    []string{"zookeeper"},
+					Project: "sandbox",
+					Ports:   []int{8080, 6060},
+					Zones:   []string{"europe-west1-b"},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_malformed.json",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_unknown_key.json",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_missing.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_missing_tags.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_missing_project.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_missing_ports.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_empty_tags.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_empty_ports.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid_zones.yaml",
+			expected: []SearchConfig{
+				{
+					Job:     "gce_zookeeper",
+					Tags:    []string{"zookeeper"},
+					Project: "sandbox",
+					Zones:   []string{"europe-west1-b", "us-central1-*"},
+					Ports:   []int{8080},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_malformed_zones.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_zone_as_region.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_excluded_required_tag.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_unknown_tag_match.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid_labels.yaml",
+			expected: []SearchConfig{
+				{
+					Job:     "gce_api",
+					Labels:  map[string]string{"role": "api", "team": "payments"},
+					Project: "sandbox",
+					Ports:   []int{8080},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_invalid_name_regex.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_unknown_status.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid_projects.yaml",
+			expected: []SearchConfig{
+				{
+					Job:      "gce_zookeeper",
+					Tags:     []string{"zookeeper"},
+					Projects: []string{"prod-eu", "prod-us"},
+					Ports:    []int{8080},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_project_and_projects.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid_target_labels.yaml",
+			expected: []SearchConfig{
+				{
+					Job:          "gce_zookeeper",
+					Tags:         []string{"zookeeper"},
+					Project:      "sandbox",
+					Ports:        []int{8080},
+					TargetLabels: map[string]string{"env": "prod", "team": "infra"},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_invalid_target_labels.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_reserved_target_labels.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_interface_index_and_network.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid_no_ports.yaml",
+			expected: []SearchConfig{
+				{
+					Job:          "gce_blackbox",
+					Tags:         []string{"web"},
+					Project:      "sandbox",
+					Ports:        []int{},
+					AllowNoPorts: true,
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path: "./test/config_valid_defaults.yaml",
+			expected: []SearchConfig{
+				{
+					Job:     "gce_node",
+					Tags:    []string{"node"},
+					Project: "prod",
+					Ports:   []int{9100},
+				},
+				{
+					Job:     "gce_zookeeper",
+					Tags:    []string{"zookeeper"},
+					Project: "sandbox",
+					Ports:   []int{9100, 8080},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path: "./test/config_valid_defaults_override.yaml",
+			expected: []SearchConfig{
+				{
+					Job:           "gce_node",
+					Tags:          []string{"node"},
+					Project:       "sandbox",
+					Ports:         []int{9100},
+					AllInterfaces: true,
+					AllowNoPorts:  true,
+				},
+				{
+					Job:     "gce_zookeeper",
+					Tags:    []string{"zookeeper"},
+					Project: "sandbox",
+					Ports:   []int{8080},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_defaults_unknown_key.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_invalid_address_template.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_invalid_job_template.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid_port_ranges.yaml",
+			expected: []SearchConfig{
+				{
+					Job:     "gce_cassandra",
+					Tags:    []string{"cassandra"},
+					Project: "sandbox",
+					Ports:   []int{9100, 7070, 7071, 7072, 7073, 8080},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_inverted_port_range.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid_port_entries.yaml",
+			expected: []SearchConfig{
+				{
+					Job:     "gce_app",
+					Tags:    []string{"app"},
+					Project: "sandbox",
+					Ports:   []int{9100, 8080},
+					portSpecs: []PortSpec{
+						{Port: 8080, Name: "http", Labels: map[string]string{"component": "app"}},
+					},
+				},
+			},
+			expectedError: false,
+		},
+		{
+			path:          "./test/config_duplicate_ports.yaml",
+			expectedError: true,
+		},
+		{
+			path:          "./test/config_huge_port_range.yaml",
+			expectedError: true,
+		},
+		{
+			path: "./test/config_valid_ports_from_metadata.yaml",
+			expected: []SearchConfig{
+				{
+					Job:               "gce_node",
+					Tags:              []string{"node"},
+					Project:           "sandbox",
+					PortsFromMetadata: "prometheus-ports",
+				},
+			},
+			expectedError: false,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res, err := LoadConfigFile(c.path)
+			if c.expectedError {
+				if err == nil {
+					t.Fatalf("Unexpected success\nResult: %v", prettyPrint(res))
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Unexpected error\nError: %v", err)
+				}
+
+				if !reflect.DeepEqual(res, c.expected) {
+					t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+				}
+			}
+		})
+	}
+}
+
 func TestInstanceToTargets(t *testing.T) {
 	t.Parallel()
 
+	// Each port is a separate target, sharing the instance's labels.
+	portTargets := func(labels map[string]string) []DiscoveryTarget {
+		return []DiscoveryTarget{
+			{Targets: []string{"127.0.0.1:8080"}, Labels: labels},
+			{Targets: []string{"127.0.0.1:9090"}, Labels: labels},
+		}
+	}
+
 	cases := []struct {
 		instance      *compute.Instance
 		config        SearchConfig
@@ -107,18 +428,21 @@ func TestInstanceToTargets(t *testing.T) {
 				Job:     "test-job",
 				Project: "test-project",
 			},
-			expected: []DiscoveryTarget{
-				{
-					Targets: []string{"127.0.0.1:8080", "127.0.0.1:9090"},
-					Labels: map[string]string{
-						"job": "test-job",
-						"gce_instance_tag_foo": "true",
-						"gce_instance_zone":    "us-central-1b",
-						"gce_instance_type":    "g1-small",
-						"gce_instance_project": "us-central-1b",
-					},
-				},
-			},
+			expected: portTargets(map[string]string{
+				"job":                             "test-job",
+				"__meta_gce_instance_tags":        ",foo,",
+				"__meta_gce_instance_zone":        "us-central1-b",
+				"__meta_gce_instance_region":      "us-central1",
+				"__meta_gce_instance_preemptible": "false",
+				"__meta_gce_provisioning_model":   "STANDARD",
+				"__meta_gce_automatic_restart":    "true",
+				"__meta_gce_instance_type":        "g1-small",
+				"__meta_gce_instance_project":     "test-project",
+				"__meta_gce_instance_name":        "",
+				"__meta_gce_instance_hostname":    ".c.test-project.internal",
+				"__meta_gce_instance_status":      "UNKNOWN",
+				"__meta_gce_private_ip":           "127.0.0.1",
+			}),
 			expectedError: false,
 		},
 		{ // No network interfaces
@@ -137,8 +461,9 @@ func TestInstanceToTargets(t *testing.T) {
 			},
 			expectedError: true,
 		},
-		{ // Tags to lower and - to _
+		{ // Tags keep their case
 			instance: &compute.Instance{
+				Status:      "PROVISIONING",
 				Zone:        "https://www.googleapis.com/compute/v1/projects/qubit-vcloud-us-proc-stg/zones/us-central1-b",
 				MachineType: "https://www.googleapis.com/compute/v1/projects/qubit-vcloud-us-proc-stg/zones/us-central1-b/machineTypes/g1-small",
 				Tags: &compute.Tags{
@@ -153,18 +478,63 @@ func TestInstanceToTargets(t *testing.T) {
 				Job:     "test-job",
 				Project: "test-project",
 			},
-			expected: []DiscoveryTarget{
-				{
-					Targets: []string{"127.0.0.1:8080", "127.0.0.1:9090"},
-					Labels: map[string]string{
-						"job": "test-job",
-						"gce_instance_tag_foo_bar": "true",
-						"gce_instance_zone":        "us-central-1b",
-						"gce_instance_type":        "g1-small",
-						"gce_instance_project":     "us-central-1b",
+			expected: portTargets(map[string]string{
+				"job":                             "test-job",
+				"__meta_gce_instance_tags":        ",FOO-BAR,",
+				"__meta_gce_instance_zone":        "us-central1-b",
+				"__meta_gce_instance_region":      "us-central1",
+				"__meta_gce_instance_preemptible": "false",
+				"__meta_gce_provisioning_model":   "STANDARD",
+				"__meta_gce_automatic_restart":    "true",
+				"__meta_gce_instance_type":        "g1-small",
+				"__meta_gce_instance_project":     "test-project",
+				"__meta_gce_instance_name":        "",
+				"__meta_gce_instance_hostname":    ".c.test-project.internal",
+				"__meta_gce_instance_status":      "PROVISIONING",
+				"__meta_gce_private_ip":           "127.0.0.1",
+			}),
+			expectedError: false,
+		},
+		{ // The first external IP is labelled while the internal one is targeted
+			instance: &compute.Instance{
+				Status:      "RUNNING",
+				Zone:        "https://www.googleapis.com/compute/v1/projects/qubit-vcloud-us-proc-stg/zones/us-central1-b",
+				MachineType: "https://www.googleapis.com/compute/v1/projects/qubit-vcloud-us-proc-stg/zones/us-central1-b/machineTypes/g1-small",
+				Tags: &compute.Tags{
+					Items: []string{"foo"},
+				},
+				NetworkInterfaces: []*compute.NetworkInterface{
+					{
+						NetworkIP: "127.0.0.1",
+						AccessConfigs: []*compute.AccessConfig{
+							{Name: "unassigned"},
+							{Name: "external-nat", NatIP: "35.0.0.1"},
+							{Name: "second-nat", NatIP: "35.0.0.2"},
+						},
 					},
 				},
 			},
+			config: SearchConfig{
+				Ports:   []int{8080, 9090},
+				Job:     "test-job",
+				Project: "test-project",
+			},
+			expected: portTargets(map[string]string{
+				"job":                             "test-job",
+				"__meta_gce_instance_tags":        ",foo,",
+				"__meta_gce_instance_zone":        "us-central1-b",
+				"__meta_gce_instance_region":      "us-central1",
+				"__meta_gce_instance_preemptible": "false",
+				"__meta_gce_provisioning_model":   "STANDARD",
+				"__meta_gce_automatic_restart":    "true",
+				"__meta_gce_instance_type":        "g1-small",
+				"__meta_gce_instance_project":     "test-project",
+				"__meta_gce_instance_name":        "",
+				"__meta_gce_instance_hostname":    ".c.test-project.internal",
+				"__meta_gce_instance_status":      "RUNNING",
+				"__meta_gce_private_ip":           "127.0.0.1",
+				"__meta_gce_public_ip":            "35.0.0.1",
+			}),
 			expectedError: false,
 		},
 	}
@@ -184,7 +554,7 @@ func TestInstanceToTargets(t *testing.T) {
 					t.Fatalf("Unexpected error\nError: %v", err)
 				}
 
-				if reflect.DeepEqual(res, c.expected) {
+				if !reflect.DeepEqual(res, c.expected) {
 					t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
 				}
 			}
@@ -192,10 +562,3725 @@ func TestInstanceToTargets(t *testing.T) {
 	}
 }
 
-func prettyPrint(i interface{}) string {
-	v, err := json.Marshal(i)
+func TestLoadConfigFileAllErrors(t *testing.T) {
+	_, err := LoadConfigFile("./test/config_multiple_invalid.yaml")
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+
+	expected := []string{
+		`Failed to validate config entry #0 in ./test/config_multiple_invalid.yaml (job "unknown_keys"): Unknown keys in config: alpha,zeta`,
+		`Failed to validate config entry #1 in ./test/config_multiple_invalid.yaml (job "no_project"): No tags or other selectors specified; No project specified`,
+		`Failed to validate config entry #3 in ./test/config_multiple_invalid.yaml (job "no_ports"): No ports, ports_from_metadata or port_label specified, set allow_no_ports to produce targets without ports`,
+	}
+	if lines := strings.Split(err.Error(), "\n"); !reflect.DeepEqual(lines, expected) {
+		t.Fatalf("Discrepancy in errors\nResult: %v", prettyPrint(lines))
+	}
+}
+
+func TestLoadConfigFileDuplicateJobs(t *testing.T) {
+	_, err := LoadConfigFile("./test/config_duplicate_jobs.yaml")
+	if err == nil || !strings.Contains(err.Error(), `Job "node" is defined by multiple entries: entry #0 in ./test/config_duplicate_jobs.yaml, entry #2 in ./test/config_duplicate_jobs.yaml`) {
+		t.Fatalf("Expected duplicate job error listing entries #0 and #2\nError: %v", err)
+	}
+
+	res, err := LoadConfigFile("./test/config_allowed_duplicate_jobs.yaml")
 	if err != nil {
-		return fmt.Sprintf("%v", i)
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("Expected every entry to be kept\nResult: %v", prettyPrint(res))
+	}
+
+	entries, err := loadConfigEntries("./test/config_allowed_duplicate_jobs.yaml", []string{})
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if identical := identicalEntries(entries); !reflect.DeepEqual(identical, [][]int{{0, 1}}) {
+		t.Fatalf("Expected entries #0 and #1 to be identical\nResult: %v", identical)
+	}
+}
+
+func TestLoadConfigFileDefaultsMissingProject(t *testing.T) {
+	t.Parallel()
+
+	_, err := LoadConfigFile("./test/config_defaults_missing_project.yaml")
+	if err == nil || !strings.Contains(err.Error(), "entry #1") || !strings.Contains(err.Error(), "No project specified") {
+		t.Fatalf("Expected missing project error for entry #1\nError: %v", err)
+	}
+}
+
+func TestLoadConfigFileTagGroups(t *testing.T) {
+	res, err := LoadConfigFile("./test/config_valid_tag_groups.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	tags := map[string][]string{}
+	for _, c := range res {
+		tags[c.Job] = c.Tags
+	}
+	expected := map[string][]string{
+		"node": {"gce", "managed", "prod"},
+		"api":  {"api", "prod", "gce", "managed", "node-exporter"},
+	}
+	if !reflect.DeepEqual(tags, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(tags))
+	}
+
+	_, err = LoadConfigFile("./test/config_unknown_tag_group.yaml")
+	if err == nil || !strings.Contains(err.Error(), `Unknown tag group "missing" in entry #1 (job "api")`) {
+		t.Fatalf("Expected unknown tag group error for entry #1\nError: %v", err)
+	}
+}
+
+func TestExpandEnvString(t *testing.T) {
+	os.Setenv("GCESD_TEST_PROJECT", "prod")
+	os.Setenv("GCESD_TEST_EMPTY", "")
+	defer os.Unsetenv("GCESD_TEST_PROJECT")
+	defer os.Unsetenv("GCESD_TEST_EMPTY")
+
+	cases := []struct {
+		in         string
+		expected   string
+		unresolved []string
+	}{
+		{in: "plain", expected: "plain", unresolved: []string{}},
+		{in: "${GCESD_TEST_PROJECT}", expected: "prod", unresolved: []string{}},
+		{in: "my-${GCESD_TEST_PROJECT}-project", expected: "my-prod-project", unresolved: []string{}},
+		{in: "${GCESD_TEST_UNSET:-staging}", expected: "staging", unresolved: []string{}},
+		{in: "${GCESD_TEST_EMPTY:-staging}", expected: "staging", unresolved: []string{}},
+		{in: "${GCESD_TEST_PROJECT:-staging}", expected: "prod", unresolved: []string{}},
+		{in: "${GCESD_TEST_EMPTY}", expected: "", unresolved: []string{}},
+		{in: "$${GCESD_TEST_PROJECT}", expected: "${GCESD_TEST_PROJECT}", unresolved: []string{}},
+		{in: "cost$$", expected: "cost$", unresolved: []string{}},
+		{in: "$HOME ${", expected: "$HOME ${", unresolved: []string{}},
+		{in: "web-${}", expected: "web-${}", unresolved: []string{}},
+		{in: "web-${:-api}", expected: "web-${:-api}", unresolved: []string{}},
+		{in: "${GCESD_TEST_A}-${GCESD_TEST_B}", expected: "-", unresolved: []string{"GCESD_TEST_A", "GCESD_TEST_B"}},
+	}
+
+	for _, c := range cases {
+		res, unresolved := expandEnvString(c.in)
+		if res != c.expected || !reflect.DeepEqual(unresolved, c.unresolved) {
+			t.Fatalf("Discrepancy in result for %q\nResult: %q %v", c.in, res, unresolved)
+		}
+	}
+}
+
+func TestLoadConfigFileExpandEnvDefaults(t *testing.T) {
+	t.Parallel()
+
+	// Values inherited from defaults are shared by every job, and must only
+	// be expanded once.
+	res, err := LoadConfigFile("./test/config_valid_env_defaults.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	for _, c := range res {
+		if !reflect.DeepEqual(c.Tags, []string{"${GCESD_TEST_LITERAL}"}) || c.TargetLabels["cost"] != "${GCESD_TEST_LITERAL}" {
+			t.Fatalf("Discrepancy in result for %v\nResult: %v", c.Job, prettyPrint(res))
+		}
+	}
+}
+
+func TestLoadConfigFileExpandEnv(t *testing.T) {
+	os.Setenv("GCESD_TEST_PROJECT", "prod")
+	defer os.Unsetenv("GCESD_TEST_PROJECT")
+
+	res, err := LoadConfigFile("./test/config_valid_env.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := []SearchConfig{
+		{
+			Job:          "node-prod",
+			Tags:         []string{"node", "prod"},
+			Project:      "prod",
+			Ports:        []int{9100},
+			TargetLabels: map[string]string{"env": "prod", "team": "infra"},
+		},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+
+	_, err = LoadConfigFile("./test/config_unresolved_env.yaml")
+	if err == nil || !strings.Contains(err.Error(), "entry #0") || !strings.Contains(err.Error(), "GCESD_TEST_UNSET_PROJECT,GCESD_TEST_UNSET_TAG") {
+		t.Fatalf("Expected unresolved variables error for entry #0\nError: %v", err)
+	}
+
+	*expandEnv = false
+	defer func() { *expandEnv = true }()
+	res, err = LoadConfigFile("./test/config_unresolved_env.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if res[0].Project != "${GCESD_TEST_UNSET_PROJECT}" {
+		t.Fatalf("Unexpected expansion with expansion disabled\nResult: %v", prettyPrint(res))
+	}
+}
+
+func TestLoadConfigFileIncludes(t *testing.T) {
+	res, err := LoadConfigFile("./test/include/config.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	jobs := []string{}
+	for _, c := range res {
+		jobs = append(jobs, c.Job)
+	}
+	expected := []string{"main", "a", "b", "nested"}
+	if !reflect.DeepEqual(jobs, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(jobs))
+	}
+
+	*strictIncludes = true
+	_, err = LoadConfigFile("./test/include/config.yaml")
+	*strictIncludes = false
+	if err == nil || !strings.Contains(err.Error(), "missing.d") {
+		t.Fatalf("Expected error for include matching nothing\nError: %v", err)
+	}
+
+	_, err = LoadConfigFile("./test/include/config_invalid.yaml")
+	if err == nil || !strings.Contains(err.Error(), "entry #1 in test/include/invalid.d/b.yaml") {
+		t.Fatalf("Expected error naming the fragment file and entry\nError: %v", err)
+	}
+
+	_, err = LoadConfigFile("./test/include/config_loop.yaml")
+	if err == nil || !strings.Contains(err.Error(), "Include loop") {
+		t.Fatalf("Expected include loop error\nError: %v", err)
+	}
+}
+
+func TestConfigFormat(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		path     string
+		data     string
+		expected string
+	}{
+		{path: "config.json", data: "- job: foo", expected: "JSON"},
+		{path: "config.yaml", data: `[{"job": "foo"}]`, expected: "YAML"},
+		{path: "config.yml", data: `[{"job": "foo"}]`, expected: "YAML"},
+		{path: "config", data: "\n\t [{\"job\": \"foo\"}]", expected: "JSON"},
+		{path: "config", data: `{"jobs": []}`, expected: "JSON"},
+		{path: "config", data: "[foo, bar]", expected: "YAML"},
+		{path: "config", data: "- job: foo", expected: "YAML"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			if res := configFormat(c.path, []byte(c.data)); res != c.expected {
+				t.Fatalf("Discrepancy in result\nResult: %v", res)
+			}
+		})
+	}
+
+	_, err := LoadConfigFile("./test/config_malformed.json")
+	if err == nil || !strings.Contains(err.Error(), "as JSON") {
+		t.Fatalf("Expected error naming the JSON parser\nError: %v", err)
+	}
+}
+
+func TestPortListUnmarshal(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		yaml          string
+		expected      PortList
+		expectedError bool
+		errorContains string
+	}{
+		{yaml: "[8080, 9090]", expected: PortList{8080, 9090}},
+		{yaml: `["7070-7072"]`, expected: PortList{7070, 7071, 7072}},
+		{yaml: `[9100, "7070-7071", "8080", 7079]`, expected: PortList{9100, 7070, 7071, 8080, 7079}},
+		{yaml: `["7070 - 7070"]`, expected: PortList{7070}},
+		{yaml: `["7079-7070"]`, expectedError: true},
+		{yaml: `["65530-65536"]`, expectedError: true},
+		{yaml: `["1-65535"]`, expectedError: true},
+		{yaml: `["http"]`, expectedError: true},
+		{yaml: `[8080.5]`, expectedError: true},
+		{yaml: `[0]`, expectedError: true},
+		{yaml: `[-1]`, expectedError: true},
+		{yaml: `[8080, 70000]`, expectedError: true, errorContains: "entry #1"},
+		{yaml: `[8080, 9090, "http"]`, expectedError: true, errorContains: "entry #2"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			var res PortList
+			err := yaml.Unmarshal([]byte(c.yaml), &res)
+			if c.expectedError {
+				if err == nil {
+					t.Fatalf("Unexpected success\nResult: %v", prettyPrint(res))
+				}
+				if !strings.Contains(err.Error(), c.errorContains) {
+					t.Fatalf("Expected error containing %q\nError: %v", c.errorContains, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("Unexpected error\nError: %v", err)
+				}
+
+				if !reflect.DeepEqual(res, c.expected) {
+					t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+				}
+			}
+		})
+	}
+}
+
+func TestZonesMatch(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		zones    []string
+		zone     string
+		expected bool
+	}{
+		{zones: nil, zone: "us-central1-b", expected: true},
+		{zones: []string{"us-central1-b"}, zone: "us-central1-b", expected: true},
+		{zones: []string{"us-central1-a"}, zone: "us-central1-b", expected: false},
+		{zones: []string{"us-central1-*"}, zone: "us-central1-f", expected: true},
+		{zones: []string{"us-central1-*"}, zone: "us-east1-b", expected: false},
+		{zones: []string{"europe-west1-b", "us-*"}, zone: "us-east1-b", expected: true},
+		{zones: []string{"europe-west1-[bc]"}, zone: "europe-west1-c", expected: true},
+		{zones: []string{"europe-west1-[bc]"}, zone: "europe-west1-d", expected: false},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res := zonesMatch(c.zones, c.zone)
+			if res != c.expected {
+				t.Fatalf("Discrepancy in result for %v in %v\nResult: %v", c.zone, c.zones, res)
+			}
+		})
+	}
+}
+
+func TestDiscoverTargetsZones(t *testing.T) {
+	calls := map[string]int{}
+	listInstances = fakeListInstances(calls, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("a", "us-central1-b", "10.0.0.1", "foo"),
+			testInstance("b", "us-central1-c", "10.0.0.2", "foo"),
+			testInstance("c", "europe-west1-b", "10.0.0.3", "foo"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "us", Tags: []string{"foo"}, Project: "test-project", Ports: []int{80}, Zones: []string{"us-central1-*"}},
+		{Job: "eu", Tags: []string{"foo"}, Project: "test-project", Ports: []int{80}, Zones: []string{"europe-west1-b"}},
+		{Job: "all", Tags: []string{"foo"}, Project: "test-project", Ports: []int{80}},
+	}
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	if calls["test-project"] != 1 {
+		t.Fatalf("Expected a single listing of test-project, got %v", calls["test-project"])
+	}
+
+	expected := map[string][]string{
+		"us":  {"10.0.0.1:80", "10.0.0.2:80"},
+		"eu":  {"10.0.0.3:80"},
+		"all": {"10.0.0.1:80", "10.0.0.2:80", "10.0.0.3:80"},
+	}
+	if got := targetsByJob(res); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+}
+
+func TestDiscoverTargetsRegions(t *testing.T) {
+	calls := map[string]int{}
+	listInstances = fakeListInstances(calls, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("a", "us-central1-b", "10.0.0.1", "foo"),
+			testInstance("b", "us-central1-c", "10.0.0.2", "foo"),
+			testInstance("c", "europe-west1-b", "10.0.0.3", "foo"),
+			testInstance("d", "europe-west1-c", "10.0.0.4", "foo"),
+			testInstance("e", "asia-east1-a", "10.0.0.5", "foo"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "us", Tags: []string{"foo"}, Project: "test-project", Ports: []int{80}, Regions: []string{"us-central1"}},
+		{Job: "eu-asia", Tags: []string{"foo"}, Project: "test-project", Ports: []int{80}, Regions: []string{"europe-west1", "asia-east1"}},
+		{Job: "eu-c", Tags: []string{"foo"}, Project: "test-project", Ports: []int{80}, Regions: []string{"europe-west1"}, Zones: []string{"*-c"}},
+		{Job: "none", Tags: []string{"foo"}, Project: "test-project", Ports: []int{80}, Regions: []string{"us-central1"}, Zones: []string{"europe-west1-b"}},
+	}
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := map[string][]string{
+		"us":      {"10.0.0.1:80", "10.0.0.2:80"},
+		"eu-asia": {"10.0.0.3:80", "10.0.0.4:80", "10.0.0.5:80"},
+		"eu-c":    {"10.0.0.4:80"},
+	}
+	if got := targetsByJob(res); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+}
+
+func TestValidateConfigRegions(t *testing.T) {
+	t.Parallel()
+
+	// A zone given as a region gets a single error suggesting its region.
+	config := SearchConfig{Job: "us", Tags: []string{"foo"}, Project: "test-project", Ports: []int{80}, Regions: []string{"us-central1-b", "us_central1"}}
+	err := ValidateConfig(config)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	if !strings.Contains(err.Error(), `Region "us-central1-b" looks like a zone, did you mean "us-central1"?`) || strings.Contains(err.Error(), `Malformed region "us-central1-b"`) {
+		t.Fatalf("Expected only a suggestion for us-central1-b\nError: %v", err)
+	}
+	if !strings.Contains(err.Error(), `Malformed region "us_central1"`) {
+		t.Fatalf("Expected us_central1 to be malformed\nError: %v", err)
+	}
+}
+
+func TestValidateConfigEmptyEnvRef(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		config   SearchConfig
+		expected string
+	}{
+		{
+			config:   SearchConfig{Job: "web-${}", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}},
+			expected: `Empty environment variable reference ${} in job "web-${}"`,
+		},
+		{
+			config:   SearchConfig{Job: "web-${:-api}", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}},
+			expected: `Empty environment variable reference ${:-api} in job "web-${:-api}"`,
+		},
+		{
+			config:   SearchConfig{JobTemplate: "{{.Name}}-${:-api}", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}},
+			expected: `Empty environment variable reference ${:-api} in job_template "{{.Name}}-${:-api}"`,
+		},
+	}
+
+	for _, c := range cases {
+		err := ValidateConfig(c.config)
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("Expected %q\nError: %v", c.expected, err)
+		}
+	}
+
+	config := SearchConfig{Job: "web-${ENV:-prod}", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}}
+	if err := ValidateConfig(config); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+}
+
+func TestDiscoverComputeByTagsExcludeTags(t *testing.T) {
+	t.Parallel()
+
+	instances := []*compute.Instance{
+		testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+		testInstance("web-2", "us-central1-b", "10.0.0.2", "web", "canary"),
+		testInstance("web-3", "us-central1-b", "10.0.0.3", "canary", "web", "debug"),
+		testInstance("db-1", "us-central1-b", "10.0.0.4", "db"),
+		{Name: "untagged", Zone: "us-central1-b"},
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{Job: "web", Tags: []string{"web"}},
+			expected: []string{"web-1", "web-2", "web-3"},
+		},
+		{
+			config:   SearchConfig{Job: "web", Tags: []string{"web"}, ExcludeTags: []string{"canary"}},
+			expected: []string{"web-1"},
+		},
+		{
+			config:   SearchConfig{Job: "web", Tags: []string{"web"}, ExcludeTags: []string{"debug", "other"}},
+			expected: []string{"web-1", "web-2"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+}
+
+func TestDiscoverTargetsTagMatch(t *testing.T) {
+	calls := map[string]int{}
+	listInstances = fakeListInstances(calls, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("kafka-1", "us-central1-b", "10.0.0.1", "kafka"),
+			testInstance("kafka-2", "us-central1-b", "10.0.0.2", "kafka-legacy"),
+			testInstance("kafka-3", "us-central1-b", "10.0.0.3", "kafka", "kafka-legacy"),
+			testInstance("zk-1", "us-central1-b", "10.0.0.4", "zookeeper"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "all", Tags: []string{"kafka", "kafka-legacy"}, Project: "test-project", Ports: []int{80}},
+		{Job: "explicit-all", Tags: []string{"kafka", "kafka-legacy"}, TagMatch: "all", Project: "test-project", Ports: []int{80}},
+		{Job: "any", Tags: []string{"kafka", "kafka-legacy"}, TagMatch: "any", Project: "test-project", Ports: []int{80, 81}},
+	}
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := map[string][]string{
+		"all":          {"10.0.0.3:80"},
+		"explicit-all": {"10.0.0.3:80"},
+		"any":          {"10.0.0.1:80", "10.0.0.1:81", "10.0.0.2:80", "10.0.0.2:81", "10.0.0.3:80", "10.0.0.3:81"},
+	}
+	if got := targetsByJob(res); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+}
+
+func TestDiscoverComputeByTagsLabels(t *testing.T) {
+	t.Parallel()
+
+	withLabels := func(i *compute.Instance, labels map[string]string) *compute.Instance {
+		i.Labels = labels
+		return i
+	}
+	instances := []*compute.Instance{
+		withLabels(testInstance("api-1", "us-central1-b", "10.0.0.1", "web"), map[string]string{"role": "api", "team": "payments"}),
+		withLabels(testInstance("api-2", "us-central1-b", "10.0.0.2"), map[string]string{"role": "api", "team": "search"}),
+		withLabels(testInstance("worker-1", "us-central1-b", "10.0.0.3", "web"), map[string]string{"role": "worker"}),
+		withLabels(testInstance("empty", "us-central1-b", "10.0.0.4", "web"), map[string]string{}),
+		testInstance("nil", "us-central1-b", "10.0.0.5", "web"),
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{Labels: map[string]string{"role": "api"}},
+			expected: []string{"api-1", "api-2"},
+		},
+		{
+			config:   SearchConfig{Labels: map[string]string{"role": "api", "team": "payments"}},
+			expected: []string{"api-1"},
+		},
+		{
+			config:   SearchConfig{Labels: map[string]string{"role": ""}},
+			expected: []string{},
+		},
+		{
+			config:   SearchConfig{Tags: []string{"web"}, Labels: map[string]string{"role": "api"}},
+			expected: []string{"api-1"},
+		},
+		{
+			config:   SearchConfig{Tags: []string{"web"}},
+			expected: []string{"api-1", "worker-1", "empty", "nil"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+}
+
+func TestDiscoverComputeByTagsMetadata(t *testing.T) {
+	t.Parallel()
+
+	withMetadata := func(i *compute.Instance, md *compute.Metadata) *compute.Instance {
+		i.Metadata = md
+		return i
+	}
+	instances := []*compute.Instance{
+		withMetadata(testInstance("checkout-1", "us-central1-b", "10.0.0.1", "web"), testMetadata("service", "checkout", "version", "12")),
+		withMetadata(testInstance("checkout-2", "us-central1-b", "10.0.0.2"), testMetadata("service", "checkout", "version", "13")),
+		withMetadata(testInstance("search-1", "us-central1-b", "10.0.0.3", "web"), testMetadata("service", "search")),
+		withMetadata(testInstance("nil-items", "us-central1-b", "10.0.0.4", "web"), &compute.Metadata{}),
+		withMetadata(testInstance("nil-value", "us-central1-b", "10.0.0.5", "web"), &compute.Metadata{
+			Items: []*compute.MetadataItems{nil, {Key: "service"}},
+		}),
+		testInstance("nil-metadata", "us-central1-b", "10.0.0.6", "web"),
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{Metadata: map[string]string{"service": "checkout"}},
+			expected: []string{"checkout-1", "checkout-2"},
+		},
+		{
+			config:   SearchConfig{Metadata: map[string]string{"service": "checkout", "version": "13"}},
+			expected: []string{"checkout-2"},
+		},
+		{
+			config:   SearchConfig{Metadata: map[string]string{"service": ""}},
+			expected: []string{"checkout-1", "checkout-2", "search-1", "nil-value"},
+		},
+		{
+			config:   SearchConfig{Metadata: map[string]string{"missing": ""}},
+			expected: []string{},
+		},
+		{
+			config:   SearchConfig{Tags: []string{"web"}, Metadata: map[string]string{"service": "checkout"}},
+			expected: []string{"checkout-1"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileNameRegex(t *testing.T) {
+	t.Parallel()
+
+	res, err := LoadConfigFile("./test/config_valid_name_regex.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	if len(res) != 1 || res[0].nameRegex == nil {
+		t.Fatalf("Expected a compiled name_regex\nResult: %v", prettyPrint(res))
+	}
+
+	_, err = LoadConfigFile("./test/config_invalid_name_regex.yaml")
+	if err == nil || !strings.Contains(err.Error(), "entry #1") {
+		t.Fatalf("Expected error naming entry #1\nError: %v", err)
+	}
+}
+
+func TestDiscoverComputeByTagsNameRegex(t *testing.T) {
+	t.Parallel()
+
+	instances := []*compute.Instance{
+		testInstance("es-data-1", "us-central1-b", "10.0.0.1"),
+		testInstance("es-data-12", "us-central1-b", "10.0.0.2", "legacy"),
+		testInstance("es-data-x", "us-central1-b", "10.0.0.3"),
+		testInstance("old-es-data-1", "us-central1-b", "10.0.0.4"),
+		testInstance("es-master-1", "us-central1-b", "10.0.0.5", "legacy"),
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{NameRegex: `es-data-\d+`},
+			expected: []string{"es-data-1", "es-data-12"},
+		},
+		{
+			config:   SearchConfig{NameRegex: `es-(data|master)-\d+`, Tags: []string{"legacy"}},
+			expected: []string{"es-data-12", "es-master-1"},
+		},
+		{
+			config:   SearchConfig{NameRegex: `es-data`},
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			if err := compileConfig(&c.config); err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileTagRegex(t *testing.T) {
+	t.Parallel()
+
+	_, err := LoadConfigFile("./test/config_tag_regex.yaml")
+	if err == nil || !strings.Contains(err.Error(), "entry #1") || !strings.Contains(err.Error(), `Invalid tag_regex "api-v(\\d+"`) {
+		t.Fatalf("Expected error naming entry #1 and its tag_regex\nError: %v", err)
+	}
+	if strings.Contains(err.Error(), "entry #0") {
+		t.Fatalf("Unexpected error for entry #0\nError: %v", err)
+	}
+}
+
+func TestDiscoverComputeByTagsTagRegex(t *testing.T) {
+	t.Parallel()
+
+	instances := []*compute.Instance{
+		testInstance("api-1", "us-central1-b", "10.0.0.1", "api-v12"),
+		testInstance("api-2", "us-central1-b", "10.0.0.2", "api-v13", "canary"),
+		testInstance("api-3", "us-central1-b", "10.0.0.3", "api-v13-rc"),
+		testInstance("web-1", "us-central1-b", "10.0.0.4", "web", "canary"),
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{TagRegex: []string{`api-v\d+`}},
+			expected: []string{"api-1", "api-2"},
+		},
+		{
+			config:   SearchConfig{TagRegex: []string{`api-v\d+`}, Tags: []string{"canary"}},
+			expected: []string{"api-2"},
+		},
+		{
+			config:   SearchConfig{TagRegex: []string{`api-v\d+`, `canary|web`}},
+			expected: []string{"api-2"},
+		},
+		{
+			config:   SearchConfig{TagRegex: []string{`api`}},
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			if err := compileConfig(&c.config); err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+}
+
+func TestDiscoverComputeByTagsIgnoreTagCase(t *testing.T) {
+	t.Parallel()
+
+	instances := []*compute.Instance{
+		testInstance("zk-1", "us-central1-b", "10.0.0.1", "zookeeper"),
+		testInstance("zk-2", "us-central1-b", "10.0.0.2", "Zookeeper", "Canary"),
+		testInstance("zk-3", "us-central1-b", "10.0.0.3", "ZOOKEEPER-V3"),
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{Tags: []string{"zookeeper"}},
+			expected: []string{"zk-1"},
+		},
+		{
+			config:   SearchConfig{Tags: []string{"zookeeper"}, IgnoreTagCase: true},
+			expected: []string{"zk-1", "zk-2"},
+		},
+		{
+			config:   SearchConfig{Tags: []string{"ZooKeeper"}, ExcludeTags: []string{"canary"}, IgnoreTagCase: true},
+			expected: []string{"zk-1"},
+		},
+		{
+			config:   SearchConfig{TagRegex: []string{`zookeeper(-v\d+)?`}},
+			expected: []string{"zk-1"},
+		},
+		{
+			config:   SearchConfig{TagRegex: []string{`zookeeper(-v\d+)?`}, IgnoreTagCase: true},
+			expected: []string{"zk-1", "zk-2", "zk-3"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			if err := compileConfig(&c.config); err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+
+	targets, err := InstanceToTargets(instances[1], SearchConfig{Job: "zk", Tags: []string{"zookeeper"}, IgnoreTagCase: true, Ports: []int{80}})
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if tags := targets[0].Labels["__meta_gce_instance_tags"]; tags != ",Zookeeper,Canary," {
+		t.Fatalf("Expected original tag case in labels, got %v", tags)
+	}
+}
+
+// BenchmarkDiscoverComputeByTagsTagRegex shows tag_regex patterns are
+// compiled once by compileConfig, not per instance.
+func BenchmarkDiscoverComputeByTagsTagRegex(b *testing.B) {
+	instances := []*compute.Instance{}
+	for i := 0; i < 1000; i++ {
+		instances = append(instances, testInstance(fmt.Sprintf("api-%v", i), "us-central1-b", "10.0.0.1", fmt.Sprintf("api-v%v", i%20), "prod"))
+	}
+
+	config := SearchConfig{TagRegex: []string{`api-v1\d`}}
+	if err := compileConfig(&config); err != nil {
+		b.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := DiscoverComputeByTags(context.Background(), instances, config); err != nil {
+			b.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+}
+
+func TestLoadConfigFileMachineTypes(t *testing.T) {
+	t.Parallel()
+
+	_, err := LoadConfigFile("./test/config_machine_types.yaml")
+	if err == nil || !strings.Contains(err.Error(), `(job "bad_machine_types"): Empty machine type in machine_types; Malformed machine type "n2-["`) {
+		t.Fatalf("Expected machine_types errors for entry #1\nError: %v", err)
+	}
+	if strings.Contains(err.Error(), "entry #0") {
+		t.Fatalf("Unexpected error for entry #0\nError: %v", err)
+	}
+}
+
+func TestDiscoverComputeByTagsMachineTypes(t *testing.T) {
+	t.Parallel()
+
+	withType := func(name, machineType string) *compute.Instance {
+		i := testInstance(name, "us-central1-b", "10.0.0.1", "node")
+		i.MachineType = "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-b/machineTypes/" + machineType
+		return i
+	}
+	instances := []*compute.Instance{
+		withType("n2-node", "n2-standard-8"),
+		withType("n2d-node", "n2d-standard-8"),
+		withType("legacy-node", "N2-HIGHMEM-4"),
+		withType("e2-node", "e2-standard-4"),
+		withType("bastion", "e2-micro"),
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{Tags: []string{"node"}},
+			expected: []string{"n2-node", "n2d-node", "legacy-node", "e2-node", "bastion"},
+		},
+		{
+			config:   SearchConfig{Tags: []string{"node"}, MachineTypes: []string{"n2-*"}},
+			expected: []string{"n2-node", "legacy-node"},
+		},
+		{
+			config:   SearchConfig{Tags: []string{"node"}, MachineTypes: []string{"N2-*", "e2-standard-4"}},
+			expected: []string{"n2-node", "legacy-node", "e2-node"},
+		},
+		{
+			config:   SearchConfig{Tags: []string{"node"}, MachineTypes: []string{"e2-standard"}},
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+}
+
+func TestDiscoverComputeByTagsPreemptible(t *testing.T) {
+	t.Parallel()
+
+	withScheduling := func(name string, scheduling *compute.Scheduling) *compute.Instance {
+		i := testInstance(name, "us-central1-b", "10.0.0.1", "batch")
+		i.Scheduling = scheduling
+		return i
+	}
+	instances := []*compute.Instance{
+		withScheduling("standard", &compute.Scheduling{ProvisioningModel: "STANDARD"}),
+		withScheduling("legacy-preemptible", &compute.Scheduling{Preemptible: true}),
+		withScheduling("spot", &compute.Scheduling{ProvisioningModel: "SPOT"}),
+		withScheduling("no-scheduling", nil),
+	}
+
+	cases := []struct {
+		mode     string
+		expected []string
+	}{
+		{mode: "", expected: []string{"standard", "legacy-preemptible", "spot", "no-scheduling"}},
+		{mode: preemptibleInclude, expected: []string{"standard", "legacy-preemptible", "spot", "no-scheduling"}},
+		{mode: preemptibleExclude, expected: []string{"standard", "no-scheduling"}},
+		{mode: preemptibleOnly, expected: []string{"legacy-preemptible", "spot"}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.mode, func(t *testing.T) {
+			t.Parallel()
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, SearchConfig{Tags: []string{"batch"}, Preemptible: c.mode})
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+
+	err := ValidateConfig(SearchConfig{Job: "batch", Tags: []string{"batch"}, Project: "test", Ports: []int{80}, Preemptible: "never"})
+	if err == nil || !strings.Contains(err.Error(), `Unknown preemptible "never"`) {
+		t.Fatalf("Expected unknown preemptible error\nError: %v", err)
+	}
+}
+
+func TestInstanceToTargetsLifecycleLabels(t *testing.T) {
+	t.Parallel()
+
+	config := SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}}
+	instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+	instance.LastStartTimestamp = "2017-01-01T03:59:30.123-08:00"
+	if res := lifecycleLabels(instance, config); !reflect.DeepEqual(res, map[string]string{"__meta_gce_last_start_timestamp": "2017-01-01T11:59:30Z"}) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+
+	instance.LastStopTimestamp = "2017-01-01T11:58:00Z"
+	expected := map[string]string{
+		"__meta_gce_last_start_timestamp": "2017-01-01T11:59:30Z",
+		"__meta_gce_last_stop_timestamp":  "2017-01-01T11:58:00Z",
+	}
+	if res := lifecycleLabels(instance, config); !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+
+	instance.LastStopTimestamp = "yesterday"
+	if res := lifecycleLabels(instance, config); !reflect.DeepEqual(res, map[string]string{"__meta_gce_last_start_timestamp": "2017-01-01T11:59:30Z"}) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+
+	// A restart changes the targets even though the instance is the same.
+	before, err := InstanceToTargets(instance, config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	instance.LastStartTimestamp = "2017-01-02T08:00:00Z"
+	after, err := InstanceToTargets(instance, config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if !targetsDifferent(before, after) {
+		t.Fatalf("Expected a restart to change the targets")
+	}
+}
+
+func TestInstanceToTargetsCreationLabels(t *testing.T) {
+	current := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return current }
+	defer func() { timeNow = time.Now }()
+
+	cases := []struct {
+		timestamp string
+		withAge   bool
+		expected  map[string]string
+	}{
+		{ // Normalised to UTC
+			timestamp: "2017-01-01T03:59:30.123-08:00",
+			withAge:   true,
+			expected:  map[string]string{"__meta_gce_instance_created": "2017-01-01T11:59:30Z", "__meta_gce_instance_age_seconds": "29"},
+		},
+		{
+			timestamp: "2017-01-01T03:59:30.123-08:00",
+			expected:  map[string]string{"__meta_gce_instance_created": "2017-01-01T11:59:30Z"},
+		},
+		{ // Clock skew does not produce a negative age
+			timestamp: "2017-01-01T12:00:05Z",
+			withAge:   true,
+			expected:  map[string]string{"__meta_gce_instance_created": "2017-01-01T12:00:05Z", "__meta_gce_instance_age_seconds": "0"},
+		},
+		{
+			timestamp: "yesterday",
+			withAge:   true,
+			expected:  map[string]string{},
+		},
+		{
+			timestamp: "",
+			withAge:   true,
+			expected:  map[string]string{},
+		},
+	}
+
+	config := SearchConfig{Job: "creation-labels", Project: "test-project", Ports: []int{80}}
+	errs := counterValue(createdLabelErrors.WithLabelValues(config.Job))
+	for i, c := range cases {
+		instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+		instance.CreationTimestamp = c.timestamp
+		if res := creationLabels(instance, config, c.withAge); !reflect.DeepEqual(res, c.expected) {
+			t.Fatalf("Discrepancy in result of case %v\nResult: %v", i, prettyPrint(res))
+		}
+	}
+	if got := counterValue(createdLabelErrors.WithLabelValues(config.Job)) - errs; got != 1 {
+		t.Fatalf("Expected 1 unparseable timestamp, got %v", got)
+	}
+
+	*instanceAgeLabel = true
+	defer func() { *instanceAgeLabel = false }()
+	instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+	instance.CreationTimestamp = "2017-01-01T11:00:00Z"
+	res, err := InstanceToTargets(instance, config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if age := res[0].Labels["__meta_gce_instance_age_seconds"]; age != "3600" {
+		t.Fatalf("Expected an age of 3600 seconds, got %v", prettyPrint(res))
+	}
+}
+
+func TestDiscoverComputeByTagsMinAge(t *testing.T) {
+	current := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	timeNow = func() time.Time { return current }
+	defer func() { timeNow = time.Now }()
+
+	createdAt := func(name, timestamp string) *compute.Instance {
+		i := testInstance(name, "us-central1-b", "10.0.0.1", "node")
+		i.CreationTimestamp = timestamp
+		return i
+	}
+	instances := []*compute.Instance{
+		createdAt("old", "2016-12-01T00:00:00.000-08:00"),
+		createdAt("boundary", current.Add(-90*time.Second).Format(time.RFC3339)),
+		createdAt("young", current.Add(-89*time.Second).Format(time.RFC3339)),
+		createdAt("unparseable", "yesterday"),
+	}
+	config := SearchConfig{Job: "node_min_age", Project: "test", Tags: []string{"node"}, MinAge: 90 * time.Second}
+
+	timestampErrors := counterValue(instanceTimestampErrors.WithLabelValues("node_min_age"))
+
+	res, err := DiscoverComputeByTags(context.Background(), instances, config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if names := instanceNames(res); !reflect.DeepEqual(names, []string{"old", "boundary", "unparseable"}) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+	}
+	if got := gaugeValue(instancesWarmingUp.WithLabelValues("node_min_age", "test")); got != 1 {
+		t.Fatalf("Expected one instance warming up, got %v", got)
+	}
+	if got := counterValue(instanceTimestampErrors.WithLabelValues("node_min_age")); got != timestampErrors+1 {
+		t.Fatalf("Expected the timestamp error counter to increment, got %v", got)
+	}
+
+	current = current.Add(time.Second)
+	res, err = DiscoverComputeByTags(context.Background(), instances, config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if names := instanceNames(res); !reflect.DeepEqual(names, []string{"old", "boundary", "young", "unparseable"}) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+	}
+	if got := gaugeValue(instancesWarmingUp.WithLabelValues("node_min_age", "test")); got != 0 {
+		t.Fatalf("Expected no instances warming up, got %v", got)
+	}
+}
+
+func TestDiscoverTargetsAccelerators(t *testing.T) {
+	t.Parallel()
+
+	acceleratorType := func(name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/test-project/zones/us-central1-b/acceleratorTypes/" + name
+	}
+	withAccelerators := func(name, ip string, accelerators ...*compute.AcceleratorConfig) *compute.Instance {
+		i := testInstance(name, "us-central1-b", ip, "ml")
+		i.GuestAccelerators = accelerators
+		return i
+	}
+	instances := []*compute.Instance{
+		withAccelerators("cpu-only", "10.0.0.1"),
+		withAccelerators("t4", "10.0.0.2", &compute.AcceleratorConfig{AcceleratorType: acceleratorType("nvidia-tesla-t4"), AcceleratorCount: 1}),
+		withAccelerators("mixed", "10.0.0.3",
+			&compute.AcceleratorConfig{AcceleratorType: acceleratorType("nvidia-tesla-v100"), AcceleratorCount: 4},
+			nil,
+			&compute.AcceleratorConfig{AcceleratorType: acceleratorType("nvidia-l4"), AcceleratorCount: 2},
+			&compute.AcceleratorConfig{AcceleratorType: acceleratorType("nvidia-tesla-v100"), AcceleratorCount: 2},
+		),
+		withAccelerators("nil-entry", "10.0.0.4", nil),
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected map[string][2]string
+	}{
+		{
+			config: SearchConfig{Accelerators: acceleratorsRequire},
+			expected: map[string][2]string{
+				"10.0.0.2:80": {"nvidia-tesla-t4", "1"},
+				"10.0.0.3:80": {"nvidia-l4,nvidia-tesla-v100", "8"},
+			},
+		},
+		{
+			config: SearchConfig{Accelerators: acceleratorsRequire, AcceleratorType: "nvidia-tesla-*"},
+			expected: map[string][2]string{
+				"10.0.0.2:80": {"nvidia-tesla-t4", "1"},
+				"10.0.0.3:80": {"nvidia-tesla-v100", "6"},
+			},
+		},
+		{
+			config: SearchConfig{Accelerators: acceleratorsExclude},
+			expected: map[string][2]string{
+				"10.0.0.1:80": {"", ""},
+				"10.0.0.4:80": {"", ""},
+			},
+		},
+		{
+			config: SearchConfig{Accelerators: acceleratorsExclude, AcceleratorType: "nvidia-l4"},
+			expected: map[string][2]string{
+				"10.0.0.1:80": {"", ""},
+				"10.0.0.2:80": {"", ""},
+				"10.0.0.4:80": {"", ""},
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			c.config.Job = "dcgm"
+			c.config.Tags = []string{"ml"}
+			c.config.Ports = []int{80}
+			matched, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			res := map[string][2]string{}
+			for _, i := range matched {
+				targets, err := InstanceToTargets(i, c.config)
+				if err != nil {
+					t.Fatalf("Unexpected error\nError: %v", err)
+				}
+				for _, tg := range targets {
+					res[tg.Targets[0]] = [2]string{tg.Labels["__meta_gce_accelerator_type"], tg.Labels["__meta_gce_accelerator_count"]}
+				}
+			}
+
+			if !reflect.DeepEqual(res, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+			}
+		})
+	}
+
+	err := ValidateConfig(SearchConfig{Job: "dcgm", Tags: []string{"ml"}, Project: "test", Ports: []int{80}, AcceleratorType: "nvidia-*"})
+	if err == nil || !strings.Contains(err.Error(), "accelerator_type requires accelerators") {
+		t.Fatalf("Expected accelerator_type error\nError: %v", err)
+	}
+}
+
+func TestDiscoverComputeByTagsExternalIP(t *testing.T) {
+	t.Parallel()
+
+	withInterfaces := func(name string, ifaces ...*compute.NetworkInterface) *compute.Instance {
+		i := testInstance(name, "us-central1-b", "", "web")
+		i.NetworkInterfaces = ifaces
+		return i
+	}
+	instances := []*compute.Instance{
+		withInterfaces("internal", &compute.NetworkInterface{NetworkIP: "10.0.0.1"}),
+		withInterfaces("exposed", &compute.NetworkInterface{NetworkIP: "10.0.0.2", AccessConfigs: []*compute.AccessConfig{{NatIP: "35.1.1.2"}}}),
+		withInterfaces("exposed-second-nic",
+			&compute.NetworkInterface{NetworkIP: "10.0.0.3"},
+			nil,
+			&compute.NetworkInterface{NetworkIP: "10.1.0.3", AccessConfigs: []*compute.AccessConfig{nil, {NatIP: "35.1.1.3"}}},
+		),
+		withInterfaces("access-config-without-ip", &compute.NetworkInterface{NetworkIP: "10.0.0.4", AccessConfigs: []*compute.AccessConfig{{}}}),
+		withInterfaces("no-interfaces"),
+	}
+
+	cases := []struct {
+		mode     string
+		expected []string
+	}{
+		{mode: "", expected: []string{"internal", "exposed", "exposed-second-nic", "access-config-without-ip", "no-interfaces"}},
+		{mode: externalIPAny, expected: []string{"internal", "exposed", "exposed-second-nic", "access-config-without-ip", "no-interfaces"}},
+		{mode: externalIPRequire, expected: []string{"exposed", "exposed-second-nic"}},
+		{mode: externalIPExclude, expected: []string{"internal", "access-config-without-ip", "no-interfaces"}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.mode, func(t *testing.T) {
+			t.Parallel()
+
+			// The target address comes from the first interface, which must
+			// not affect matching on the second.
+			res, err := DiscoverComputeByTags(context.Background(), instances, SearchConfig{Tags: []string{"web"}, ExternalIP: c.mode, InterfaceIndex: new(int)})
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+}
+
+func TestIsGKENode(t *testing.T) {
+	t.Parallel()
+
+	gkeNode := testInstance("gke-prod-default-pool-1a2b3c4d-xyz1", "us-central1-b", "10.0.0.1", "node", "gke-prod-1a2b3c4d-node")
+	gkeNode.Labels = map[string]string{"goog-gke-node": "", "goog-k8s-cluster-name": "prod"}
+	gkeNode.Metadata = testMetadata("kube-env", "KUBERNETES_MASTER_NAME: 10.0.0.2", "cluster-name", "prod")
+
+	kubeEnvOnly := testInstance("legacy-node", "us-central1-b", "10.0.0.2", "node")
+	kubeEnvOnly.Metadata = testMetadata("kube-env", "")
+
+	// Looks GKE-ish by name, tags and labels, but is an ordinary VM.
+	lookalike := testInstance("gke-tools", "us-central1-b", "10.0.0.3", "node", "gke-admin")
+	lookalike.Labels = map[string]string{"goog-gke-tools": "true"}
+	lookalike.Metadata = testMetadata("kube-env-backup", "", "cluster-name", "prod")
+
+	plain := testInstance("node-1", "us-central1-b", "10.0.0.4", "node")
+
+	cases := []struct {
+		instance *compute.Instance
+		expected bool
+	}{
+		{instance: gkeNode, expected: true},
+		{instance: kubeEnvOnly, expected: true},
+		{instance: lookalike, expected: false},
+		{instance: plain, expected: false},
+	}
+	for _, c := range cases {
+		if got := isGKENode(c.instance); got != c.expected {
+			t.Fatalf("Expected isGKENode of %v to be %v", c.instance.Name, c.expected)
+		}
+	}
+
+	instances := []*compute.Instance{gkeNode, kubeEnvOnly, lookalike, plain}
+
+	res, err := DiscoverComputeByTags(context.Background(), instances, SearchConfig{Job: "node_gke_off", Tags: []string{"node"}})
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if names := instanceNames(res); len(names) != 4 {
+		t.Fatalf("Expected no instances excluded with exclude_gke_nodes off\nResult: %v", prettyPrint(names))
+	}
+
+	res, err = DiscoverComputeByTags(context.Background(), instances, SearchConfig{Job: "node_gke_on", Tags: []string{"node"}, ExcludeGKENodes: true})
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if names := instanceNames(res); !reflect.DeepEqual(names, []string{"gke-tools", "node-1"}) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+	}
+	if got := counterValue(instancesSkipped.WithLabelValues("node_gke_on", "gke_node")); got != 2 {
+		t.Fatalf("Expected two GKE nodes counted, got %v", got)
+	}
+}
+
+func TestDiscoverComputeByTagsRequireMetadata(t *testing.T) {
+	t.Parallel()
+
+	optedIn := testInstance("opted-in", "us-central1-b", "10.0.0.1")
+	optedIn.Metadata = testMetadata("prometheus-port", "9100", "startup-script", "")
+
+	emptyValue := testInstance("empty-value", "us-central1-b", "10.0.0.2")
+	emptyValue.Metadata = testMetadata("prometheus-port", "")
+
+	nilValue := testInstance("nil-value", "us-central1-b", "10.0.0.3")
+	nilValue.Metadata = &compute.Metadata{Items: []*compute.MetadataItems{nil, {Key: "prometheus-port"}}}
+
+	otherKey := testInstance("other-key", "us-central1-b", "10.0.0.4")
+	otherKey.Metadata = testMetadata("startup-script", "")
+
+	nilItems := testInstance("nil-items", "us-central1-b", "10.0.0.5")
+	nilItems.Metadata = &compute.Metadata{}
+
+	nilMetadata := testInstance("nil-metadata", "us-central1-b", "10.0.0.6")
+
+	instances := []*compute.Instance{optedIn, emptyValue, nilValue, otherKey, nilItems, nilMetadata}
+
+	cases := []struct {
+		job      string
+		keys     []string
+		expected []string
+	}{
+		{job: "require_port", keys: []string{"prometheus-port"}, expected: []string{"opted-in", "empty-value", "nil-value"}},
+		{job: "require_both", keys: []string{"prometheus-port", "startup-script"}, expected: []string{"opted-in"}},
+		{job: "require_none", expected: []string{"opted-in", "empty-value", "nil-value", "other-key", "nil-items", "nil-metadata"}},
+	}
+	for _, c := range cases {
+		res, err := DiscoverComputeByTags(context.Background(), instances, SearchConfig{Job: c.job, RequireMetadata: c.keys})
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+			t.Fatalf("Discrepancy in result for %v\nResult: %v", c.job, prettyPrint(names))
+		}
+		skipped := counterValue(instancesSkipped.WithLabelValues(c.job, "missing_metadata"))
+		if expected := float64(len(instances) - len(c.expected)); skipped != expected {
+			t.Fatalf("Expected %v instances skipped for %v, got %v", expected, c.job, skipped)
+		}
+	}
+}
+
+func TestDiscoverComputeByTagsStatuses(t *testing.T) {
+	t.Parallel()
+
+	instances := []*compute.Instance{}
+	for _, st := range instanceStatuses {
+		i := testInstance(st, "us-central1-b", "10.0.0.1", "web")
+		i.Status = st
+		instances = append(instances, i)
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{Job: "default", Tags: []string{"web"}},
+			expected: []string{"RUNNING"},
+		},
+		{
+			config:   SearchConfig{Job: "running", Tags: []string{"web"}, Statuses: []string{"RUNNING"}},
+			expected: []string{"RUNNING"},
+		},
+		{
+			config:   SearchConfig{Job: "starting", Tags: []string{"web"}, Statuses: []string{"PROVISIONING", "STAGING", "RUNNING"}},
+			expected: []string{"PROVISIONING", "STAGING", "RUNNING"},
+		},
+		{
+			config:   SearchConfig{Job: "stopped", Tags: []string{"web"}, Statuses: []string{"STOPPING", "STOPPED", "SUSPENDING", "SUSPENDED", "REPAIRING", "TERMINATED"}},
+			expected: []string{"STOPPING", "STOPPED", "SUSPENDING", "SUSPENDED", "REPAIRING", "TERMINATED"},
+		},
+		{
+			config:   SearchConfig{Job: "any", Tags: []string{"web"}, Statuses: []string{"*"}},
+			expected: instanceStatuses,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			skipped := counterValue(instancesSkipped.WithLabelValues(c.config.Job, "status"))
+			res, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+			expectedSkipped := float64(len(instances) - len(c.expected))
+			if got := counterValue(instancesSkipped.WithLabelValues(c.config.Job, "status")) - skipped; got != expectedSkipped {
+				t.Fatalf("Expected %v instances skipped by status, got %v", expectedSkipped, got)
+			}
+		})
+	}
+}
+
+func TestDiscoverTargetsProjects(t *testing.T) {
+	calls := map[string]int{}
+	listInstances = fakeListInstances(calls, map[string][]*compute.Instance{
+		"prod-eu": {
+			testInstance("eu-1", "europe-west1-b", "10.0.0.1", "zookeeper"),
+		},
+		"prod-us": {
+			testInstance("us-1", "us-central1-b", "10.1.0.1", "zookeeper"),
+			testInstance("us-2", "us-central1-b", "10.1.0.2", "kafka"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "zk", Tags: []string{"zookeeper"}, Projects: []string{"prod-eu", "prod-us"}, Ports: []int{80}},
+		{Job: "kafka", Tags: []string{"kafka"}, Project: "prod-us", Ports: []int{80}},
+	}
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	if calls["prod-eu"] != 1 || calls["prod-us"] != 1 {
+		t.Fatalf("Expected a single listing of each project, got %v", calls)
+	}
+
+	projects := map[string]string{}
+	for _, t := range res {
+		projects[t.Targets[0]] = t.Labels["__meta_gce_instance_project"]
+	}
+	expected := map[string]string{
+		"10.0.0.1:80": "prod-eu",
+		"10.1.0.1:80": "prod-us",
+		"10.1.0.2:80": "prod-us",
+	}
+	if !reflect.DeepEqual(projects, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(projects))
+	}
+}
+
+func TestDiscoverTargetsProjectError(t *testing.T) {
+	listInstances = func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		if project == "broken" {
+			return nil, errors.New("permission denied")
+		}
+		return []*compute.Instance{}, nil
+	}
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "zk", Tags: []string{"zookeeper"}, Projects: []string{"working", "broken"}, Ports: []int{80}},
+	}
+
+	_, err := DiscoverTargets(context.Background(), configs)
+	if err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Fatalf("Expected error naming the broken project\nError: %v", err)
+	}
+}
+
+func TestDiscoverTargetsAPIFilter(t *testing.T) {
+	type listCall struct{ project, filter string }
+	calls := map[listCall]int{}
+	var mu sync.Mutex
+	listInstances = func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		mu.Lock()
+		calls[listCall{project, filter}]++
+		mu.Unlock()
+		switch filter {
+		case "":
+			return []*compute.Instance{
+				testInstance("zk-1", "us-central1-b", "10.0.0.1", "zookeeper"),
+				testInstance("zk-2", "us-central1-b", "10.0.0.2", "zookeeper"),
+			}, nil
+		case "labels.monitored = true":
+			return []*compute.Instance{
+				testInstance("zk-1", "us-central1-b", "10.0.0.1", "zookeeper"),
+			}, nil
+		}
+		return nil, errors.New("Invalid value for field 'filter'")
+	}
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "all", Tags: []string{"zookeeper"}, Project: "test-project", Ports: []int{80}},
+		{Job: "all_again", Tags: []string{"zookeeper"}, Project: "test-project", Ports: []int{81}},
+		{Job: "monitored", Tags: []string{"zookeeper"}, Project: "test-project", APIFilter: "labels.monitored = true", Ports: []int{80}},
+		{Job: "monitored_again", Tags: []string{"zookeeper"}, Project: "test-project", APIFilter: "labels.monitored = true", Ports: []int{81}},
+	}
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := map[string][]string{
+		"all":             {"10.0.0.1:80", "10.0.0.2:80"},
+		"all_again":       {"10.0.0.1:81", "10.0.0.2:81"},
+		"monitored":       {"10.0.0.1:80"},
+		"monitored_again": {"10.0.0.1:81"},
+	}
+	if got := targetsByJob(res); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+
+	expectedCalls := map[listCall]int{
+		{"test-project", ""}:                        1,
+		{"test-project", "labels.monitored = true"}: 1,
+	}
+	if !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("Expected each project and filter to be listed once, got %v", calls)
+	}
+
+	configs = append(configs, SearchConfig{Job: "typo", Tags: []string{"zookeeper"}, Project: "test-project", APIFilter: "labels.monitored = = true", Ports: []int{80}})
+	_, err = DiscoverTargets(context.Background(), configs)
+	if err == nil || !strings.Contains(err.Error(), `job "typo"`) {
+		t.Fatalf("Expected error naming the job with the invalid filter\nError: %v", err)
+	}
+}
+
+func TestLoadConfigFileCredentials(t *testing.T) {
+	res, err := LoadConfigFile("./test/config_valid_credentials.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if res[0].CredentialsFile != "test/credentials.json" {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+
+	_, err = LoadConfigFile("./test/config_missing_credentials.yaml")
+	if err == nil || !strings.Contains(err.Error(), "partner-project") {
+		t.Fatalf("Expected error naming the project\nError: %v", err)
+	}
+}
+
+func TestComputeServiceFor(t *testing.T) {
+	created := map[string]int{}
+	newComputeService = func(ctx context.Context, credentialsFile string) (*compute.Service, error) {
+		created[credentialsFile]++
+		return &compute.Service{BasePath: credentialsFile}, nil
+	}
+	computeServices.byFile = map[string]*compute.Service{}
+	defer func() {
+		newComputeService = NewComputeServiceFromFile
+		computeServices.byFile = map[string]*compute.Service{}
+	}()
+
+	configs := []SearchConfig{
+		{Project: "ours"},
+		{Project: "partner-a", CredentialsFile: "partner-a.json"},
+		{Project: "partner-b", CredentialsFile: "partner-b.json"},
+		{Project: "partner-a", CredentialsFile: "partner-a.json"},
+	}
+	for _, c := range configs {
+		service, err := computeServiceFor(c.CredentialsFile)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if service.BasePath != c.CredentialsFile {
+			t.Fatalf("Wrong client selected for %v: %v", c.Project, service.BasePath)
+		}
+	}
+
+	expected := map[string]int{"": 1, "partner-a.json": 1, "partner-b.json": 1}
+	if !reflect.DeepEqual(created, expected) {
+		t.Fatalf("Expected one client per credentials file, got %v", created)
+	}
+}
+
+// countingTransport answers every request with an aggregated instance list
+// holding instances, counting the requests made.
+type countingTransport struct {
+	sync.Mutex
+	requests  int
+	instances []*compute.Instance
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.Lock()
+	c.requests++
+	c.Unlock()
+
+	body, err := json.Marshal(compute.InstanceAggregatedList{
+		Items: map[string]compute.InstancesScopedList{
+			"zones/us-central1-b": {Instances: c.instances},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func TestListAllInstancesReusesClient(t *testing.T) {
+	transport := &countingTransport{
+		instances: []*compute.Instance{testInstance("web-1", "us-central1-b", "10.0.0.1", "web")},
+	}
+	created := 0
+	var createdCtx context.Context
+	newComputeService = func(ctx context.Context, credentialsFile string) (*compute.Service, error) {
+		created++
+		createdCtx = ctx
+		return compute.New(&http.Client{Transport: transport})
+	}
+	computeServices.byFile = map[string]*compute.Service{}
+	defer func() {
+		newComputeService = NewComputeServiceFromFile
+		computeServices.byFile = map[string]*compute.Service{}
+	}()
+
+	configs := []SearchConfig{{Job: "web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}}}
+	syncs := 5
+	for i := 0; i < syncs; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		targets, err := DiscoverTargets(ctx, configs)
+		cancel()
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if got := targetAddresses(targets); !reflect.DeepEqual(got, []string{"10.0.0.1:80"}) {
+			t.Fatalf("Discrepancy in result\nResult: %v", got)
+		}
+	}
+
+	if created != 1 {
+		t.Fatalf("Expected one client for %d syncs, got %d", syncs, created)
+	}
+	if transport.requests != syncs {
+		t.Fatalf("Expected %d requests through the shared transport, got %d", syncs, transport.requests)
+	}
+	if createdCtx.Err() != nil {
+		t.Fatalf("Expected the client to outlive the sync creating it\nError: %v", createdCtx.Err())
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	jobs := func(s *discoveryScheduler) []string {
+		res := []string{}
+		for _, c := range s.configs {
+			res = append(res, c.Job)
+		}
+		return res
+	}
+
+	writeConfig("- job: zk\n  tags: [zookeeper]\n  project: test\n  ports: [2181]\n")
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	scheduler := newDiscoveryScheduler(config, time.Minute)
+	scheduler.lastRun[0] = time.Now()
+
+	failures := counterValue(configReload.WithLabelValues("failure"))
+	writeConfig("- job: zk\n  tags: [zookeeper]\n")
+	if reloadConfig(path, scheduler) {
+		t.Fatalf("Expected reload of a broken config to fail")
+	}
+	if !reflect.DeepEqual(jobs(scheduler), []string{"zk"}) {
+		t.Fatalf("Expected the old config to stay active\nResult: %v", jobs(scheduler))
+	}
+	if got := counterValue(configReload.WithLabelValues("failure")); got != failures+1 {
+		t.Fatalf("Expected the failure counter to increment, got %v", got)
+	}
+
+	successes := counterValue(configReload.WithLabelValues("success"))
+	writeConfig("- job: zk\n  tags: [zookeeper]\n  project: test\n  ports: [2181]\n- job: kafka\n  tags: [kafka]\n  project: test\n  ports: [9092]\n")
+	if !reloadConfig(path, scheduler) {
+		t.Fatalf("Expected reload of a valid config to succeed")
+	}
+	if !reflect.DeepEqual(jobs(scheduler), []string{"zk", "kafka"}) {
+		t.Fatalf("Expected the new config to be active\nResult: %v", jobs(scheduler))
+	}
+	if got := counterValue(configReload.WithLabelValues("success")); got != successes+1 {
+		t.Fatalf("Expected the success counter to increment, got %v", got)
+	}
+	if due := scheduler.due(time.Now(), false); len(due) != 2 {
+		t.Fatalf("Expected every job to be due after a reload, got %v", due)
+	}
+}
+
+func TestReloadShrinkSuppressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	out := filepath.Join(dir, "targets.yaml")
+
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test": {
+			testInstance("zk-1", "us-central1-b", "10.0.0.1", "zookeeper"),
+			testInstance("kafka-1", "us-central1-b", "10.0.0.2", "kafka"),
+			testInstance("kafka-2", "us-central1-b", "10.0.0.3", "kafka"),
+			testInstance("kafka-3", "us-central1-b", "10.0.0.4", "kafka"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	writeConfig := func(config string) {
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	writer := newTargetWriter(out, false)
+	writer.maxShrinkPercent = 50
+	sync := func(scheduler *discoveryScheduler, event syncEvent) int {
+		now := time.Now()
+		if _, err := scheduler.Sync(context.Background(), now, event.forcesDiscovery()); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if err := writer.Write(context.Background(), scheduler.TargetsByFile(out), event.forcesWrite(), syncInfo{time: now}); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		return countTargets(writer.current[out])
+	}
+
+	writeConfig("- job: zk\n  tags: [zookeeper]\n  project: test\n  ports: [2181]\n- job: kafka\n  tags: [kafka]\n  project: test\n  ports: [9092]\n")
+	config, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	scheduler := newDiscoveryScheduler(config, time.Minute)
+	if n := sync(scheduler, syncTick); n != 4 {
+		t.Fatalf("Expected 4 targets written, got %v", n)
+	}
+
+	// Dropping kafka from the config shrinks the file by 75%, which a
+	// reload doesn't override, but SIGUSR1 does.
+	writeConfig("- job: zk\n  tags: [zookeeper]\n  project: test\n  ports: [2181]\n")
+	if !reloadConfig(path, scheduler) {
+		t.Fatalf("Expected reload of a valid config to succeed")
+	}
+	before := counterValue(writeSuppressed.WithLabelValues(out, "shrink"))
+	if n := sync(scheduler, syncReload); n != 4 {
+		t.Fatalf("Expected the reload's write to be suppressed, got %v targets", n)
+	}
+	if got := counterValue(writeSuppressed.WithLabelValues(out, "shrink")) - before; got != 1 {
+		t.Fatalf("Expected 1 suppressed write, got %v", got)
+	}
+	if n := sync(scheduler, syncForce); n != 1 {
+		t.Fatalf("Expected a forced write, got %v targets", n)
+	}
+}
+
+func TestValidateConfigFile(t *testing.T) {
+	out, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	if code := validateConfigFile("./test/config_valid_summary.yaml", out, errOut); code != 0 {
+		t.Fatalf("Unexpected exit status %v\nErrors: %v", code, errOut)
+	}
+	expected := `kafka project=prod-us tags=kafka ports=9092,label:metrics_port
+zookeeper project=prod-eu,prod-us tags=prod,zookeeper ports=9100,10000
+2 jobs OK
+`
+	if out.String() != expected {
+		t.Fatalf("Discrepancy in summary\nResult: %v", out)
+	}
+
+	out, errOut = &bytes.Buffer{}, &bytes.Buffer{}
+	if code := validateConfigFile("./test/config_invalid_name_regex.yaml", out, errOut); code != 1 {
+		t.Fatalf("Unexpected exit status %v", code)
+	}
+	if out.Len() != 0 || !strings.Contains(errOut.String(), "name_regex") {
+		t.Fatalf("Expected only errors to be printed\nOutput: %v\nErrors: %v", out, errOut)
+	}
+}
+
+func fakeListInstances(calls map[string]int, instances map[string][]*compute.Instance) func(context.Context, string, string, string) ([]*compute.Instance, error) {
+	var mu sync.Mutex
+	return func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[project]++
+		return instances[project], nil
+	}
+}
+
+func testInstance(name, zone, ip string, tags ...string) *compute.Instance {
+	return &compute.Instance{
+		Name:        name,
+		Status:      "RUNNING",
+		Zone:        "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + zone,
+		MachineType: "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + zone + "/machineTypes/g1-small",
+		Tags: &compute.Tags{
+			Items: tags,
+		},
+		NetworkInterfaces: []*compute.NetworkInterface{
+			{NetworkIP: ip},
+		},
+	}
+}
+
+// testMetadata builds instance metadata from alternating keys and values.
+func testMetadata(kvs ...string) *compute.Metadata {
+	md := &compute.Metadata{}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		v := kvs[i+1]
+		md.Items = append(md.Items, &compute.MetadataItems{Key: kvs[i], Value: &v})
+	}
+	return md
+}
+
+func instanceNames(instances []*compute.Instance) []string {
+	names := []string{}
+	for _, i := range instances {
+		names = append(names, i.Name)
+	}
+	return names
+}
+
+func targetAddresses(targets []DiscoveryTarget) []string {
+	addrs := []string{}
+	for _, t := range targets {
+		addrs = append(addrs, t.Targets...)
+	}
+	return addrs
+}
+
+func targetsByJob(targets []DiscoveryTarget) map[string][]string {
+	res := map[string][]string{}
+	for _, t := range targets {
+		job := t.Labels["job"]
+		res[job] = append(res[job], t.Targets...)
+	}
+	for _, ts := range res {
+		sort.Strings(ts)
+	}
+	return res
+}
+
+func TestInstanceToTargetsTargetLabels(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("zk-1", "us-central1-b", "10.0.0.1", "zookeeper")
+	config := SearchConfig{
+		Job:     "zk",
+		Project: "test-project",
+		Ports:   []int{8080},
+		TargetLabels: map[string]string{
+			"env":                      "prod",
+			"job":                      "overridden",
+			"__meta_gce_instance_zone": "overridden",
+		},
+	}
+
+	res, err := InstanceToTargets(instance, config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := []DiscoveryTarget{
+		{
+			Targets: []string{"10.0.0.1:8080"},
+			Labels: map[string]string{
+				"job":                             "zk",
+				"env":                             "prod",
+				"__meta_gce_instance_tags":        ",zookeeper,",
+				"__meta_gce_instance_zone":        "us-central1-b",
+				"__meta_gce_instance_region":      "us-central1",
+				"__meta_gce_instance_preemptible": "false",
+				"__meta_gce_provisioning_model":   "STANDARD",
+				"__meta_gce_automatic_restart":    "true",
+				"__meta_gce_instance_type":        "g1-small",
+				"__meta_gce_instance_project":     "test-project",
+				"__meta_gce_instance_name":        "zk-1",
+				"__meta_gce_instance_hostname":    "zk-1.c.test-project.internal",
+				"__meta_gce_instance_status":      "RUNNING",
+				"__meta_gce_private_ip":           "10.0.0.1",
+			},
+		},
+	}
+	if !reflect.DeepEqual(res, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+}
+
+func TestDiscoverTargetsSchemeAndMetricsPath(t *testing.T) {
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "plain", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}},
+		{Job: "probe", Tags: []string{"web"}, Project: "test-project", Ports: []int{443}, Scheme: "https", MetricsPath: "/probe/metrics"},
+		{Job: "path", Tags: []string{"web"}, Project: "test-project", Ports: []int{8080}, MetricsPath: "/stats"},
+	}
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	got := map[string][2]string{}
+	for _, target := range res {
+		got[target.Labels["job"]] = [2]string{target.Labels["__scheme__"], target.Labels["__metrics_path__"]}
+	}
+	expected := map[string][2]string{
+		"plain": {"", ""},
+		"probe": {"https", "/probe/metrics"},
+		"path":  {"", "/stats"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+	for _, target := range res {
+		_, scheme := target.Labels["__scheme__"]
+		_, path := target.Labels["__metrics_path__"]
+		if target.Labels["job"] == "plain" && (scheme || path) {
+			t.Fatalf("Unexpected labels on %v", prettyPrint(target))
+		}
+	}
+
+	for _, c := range []struct {
+		config   SearchConfig
+		expected string
+	}{
+		{config: SearchConfig{Scheme: "ftp"}, expected: `Unknown scheme "ftp"`},
+		{config: SearchConfig{Scheme: "HTTPS"}, expected: `Unknown scheme "HTTPS"`},
+		{config: SearchConfig{MetricsPath: "metrics"}, expected: `Invalid metrics_path "metrics", must start with /`},
+	} {
+		c.config.Job, c.config.Tags, c.config.Project, c.config.Ports = "web", []string{"web"}, "test-project", []int{80}
+		if err := ValidateConfig(c.config); err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("Expected %q\nError: %v", c.expected, err)
+		}
+	}
+}
+
+func TestInstanceToTargetsHostname(t *testing.T) {
+	t.Parallel()
+
+	custom := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+	custom.Hostname = "web-1.example.com"
+	tests := []struct {
+		instance *compute.Instance
+		expected string
+	}{
+		{instance: custom, expected: "web-1.example.com"},
+		{instance: testInstance("web-2", "us-central1-b", "10.0.0.2", "web"), expected: "web-2.c.test-project.internal"},
+	}
+
+	for _, test := range tests {
+		res, err := InstanceToTargets(test.instance, SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}})
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if got := res[0].Labels["__meta_gce_instance_hostname"]; got != test.expected {
+			t.Fatalf("Unexpected hostname for %v: %q", test.instance.Name, got)
+		}
+	}
+}
+
+func TestInstanceToTargetsTagsLabelFormat(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web", "Front-End", "http.server")
+	joined := map[string]string{"__meta_gce_instance_tags": ",web,Front-End,http.server,"}
+	boolean := map[string]string{
+		"__meta_gce_instance_tag_web":        "true",
+		"__meta_gce_instance_tag_front_end":  "true",
+		"__meta_gce_instance_tag_httpserver": "true",
+	}
+	both := map[string]string{}
+	for _, ls := range []map[string]string{joined, boolean} {
+		for k, v := range ls {
+			both[k] = v
+		}
+	}
+
+	cases := []struct {
+		format   string
+		expected map[string]string
+	}{
+		{format: "", expected: joined},
+		{format: tagsLabelJoined, expected: joined},
+		{format: tagsLabelBoolean, expected: boolean},
+		{format: tagsLabelBoth, expected: both},
+	}
+	for _, c := range cases {
+		res, err := InstanceToTargets(instance, SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}, TagsLabelFormat: c.format})
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		tagLabels := map[string]string{}
+		for k, v := range res[0].Labels {
+			if strings.HasPrefix(k, "__meta_gce_instance_tag") {
+				tagLabels[k] = v
+			}
+		}
+		if !reflect.DeepEqual(tagLabels, c.expected) {
+			t.Fatalf("Discrepancy in tag labels for %q\nResult: %v", c.format, prettyPrint(tagLabels))
+		}
+	}
+
+	err := ValidateConfig(SearchConfig{Job: "web", Tags: []string{"web"}, Project: "test", Ports: []int{80}, TagsLabelFormat: "split"})
+	if err == nil || !strings.Contains(err.Error(), `Unknown tags_label_format "split"`) {
+		t.Fatalf("Expected an unknown tags_label_format error\nError: %v", err)
+	}
+}
+
+func TestApplyConfigFlagsTagsLabelFormat(t *testing.T) {
+	defer func() { *tagsLabelFormat = tagsLabelJoined }()
+
+	*tagsLabelFormat = tagsLabelBoth
+	conf := SearchConfig{Job: "web"}
+	applyConfigFlags(&conf)
+	if conf.TagsLabelFormat != tagsLabelBoth {
+		t.Fatalf("Expected the flag's format, got %q", conf.TagsLabelFormat)
+	}
+
+	// Validating and compiling a config leave it alone.
+	conf = SearchConfig{Job: "web"}
+	if err := compileConfig(&conf); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if conf.TagsLabelFormat != "" {
+		t.Fatalf("Expected no format, got %q", conf.TagsLabelFormat)
+	}
+
+	conf = SearchConfig{Job: "web", TagsLabelFormat: tagsLabelJoined}
+	applyConfigFlags(&conf)
+	if conf.TagsLabelFormat != tagsLabelJoined {
+		t.Fatalf("Expected the job's format, got %q", conf.TagsLabelFormat)
+	}
+
+	for format, expected := range map[string]bool{tagsLabelJoined: true, tagsLabelBoolean: true, tagsLabelBoth: true, "": false, "split": false} {
+		if got := validTagsLabelFormat(format); got != expected {
+			t.Fatalf("Expected %q valid %v, got %v", format, expected, got)
+		}
+	}
+}
+
+func TestFormatTag(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"foo":         "foo",
+		"FOO-BAR":     "foo_bar",
+		"http.server": "httpserver",
+		"a b/c":       "abc",
+		"x_1":         "x_1",
+	}
+	for tag, expected := range cases {
+		if got := formatTag(tag); got != expected {
+			t.Fatalf("Expected %q for %q, got %q", expected, tag, got)
+		}
+	}
+}
+
+func TestInstanceToTargetsInstanceID(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		id       uint64
+		expected string
+	}{
+		{id: 1234567890123456789, expected: "1234567890123456789"},
+		// Beyond 2^53 a float64 conversion would lose the last digits.
+		{id: 18446744073709551615, expected: "18446744073709551615"},
+		{id: 9007199254740993, expected: "9007199254740993"},
+	}
+	for _, c := range cases {
+		instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+		instance.Id = c.id
+		res, err := InstanceToTargets(instance, SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}})
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if id := res[0].Labels["__meta_gce_instance_id"]; id != c.expected {
+			t.Fatalf("Expected instance id %v, got %v", c.expected, id)
+		}
+	}
+
+	res, err := InstanceToTargets(testInstance("web-1", "us-central1-b", "10.0.0.1", "web"), SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}})
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if id, ok := res[0].Labels["__meta_gce_instance_id"]; ok {
+		t.Fatalf("Expected no instance id for a zero id, got %v", id)
+	}
+}
+
+func TestInstanceToTargetsPortsFromMetadata(t *testing.T) {
+	t.Parallel()
+
+	withMetadata := func(md *compute.Metadata) *compute.Instance {
+		i := testInstance("node-1", "us-central1-b", "10.0.0.1", "node")
+		i.Metadata = md
+		return i
+	}
+	config := SearchConfig{
+		Job:               "node",
+		Project:           "test-project",
+		Ports:             []int{9100},
+		PortsFromMetadata: "prometheus-ports",
+	}
+
+	cases := []struct {
+		instance *compute.Instance
+		expected []string
+	}{
+		{
+			instance: withMetadata(testMetadata("prometheus-ports", "9100,9256")),
+			expected: []string{"10.0.0.1:9100", "10.0.0.1:9256"},
+		},
+		{
+			instance: withMetadata(testMetadata("prometheus-ports", " 9256 ")),
+			expected: []string{"10.0.0.1:9256"},
+		},
+		{
+			instance: withMetadata(testMetadata("other", "9256")),
+			expected: []string{"10.0.0.1:9100"},
+		},
+		{
+			instance: withMetadata(nil),
+			expected: []string{"10.0.0.1:9100"},
+		},
+		{
+			instance: withMetadata(testMetadata("prometheus-ports", "9100,http")),
+			expected: []string{},
+		},
+		{
+			instance: withMetadata(testMetadata("prometheus-ports", "70000")),
+			expected: []string{},
+		},
+		{
+			instance: withMetadata(testMetadata("prometheus-ports", "")),
+			expected: []string{},
+		},
+		{
+			instance: withMetadata(testMetadata("prometheus-ports", "9100,9256,9100")),
+			expected: []string{"10.0.0.1:9100", "10.0.0.1:9256"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res, err := InstanceToTargets(c.instance, config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if addrs := targetAddresses(res); !reflect.DeepEqual(addrs, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(addrs))
+			}
+		})
+	}
+}
+
+func TestInstanceToTargetsPortsFromMetadataMissing(t *testing.T) {
+	t.Parallel()
+
+	config := SearchConfig{Job: "metadata-only", Project: "test-project", PortsFromMetadata: "prometheus-ports"}
+	skipped := counterValue(instancesSkipped.WithLabelValues(config.Job, "no_ports"))
+
+	res, err := InstanceToTargets(testInstance("node-1", "us-central1-b", "10.0.0.1", "node"), config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("Expected no targets\nResult: %v", prettyPrint(res))
+	}
+	if got := counterValue(instancesSkipped.WithLabelValues(config.Job, "no_ports")) - skipped; got != 1 {
+		t.Fatalf("Expected 1 instance skipped without ports, got %v", got)
+	}
+}
+
+func TestInstanceToTargetsPortLabel(t *testing.T) {
+	t.Parallel()
+
+	withLabels := func(labels map[string]string) *compute.Instance {
+		i := testInstance("node-1", "us-central1-b", "10.0.0.1", "node")
+		i.Labels = labels
+		return i
+	}
+	config := SearchConfig{
+		Job:       "node",
+		Project:   "test-project",
+		Ports:     []int{9100, 9256},
+		PortLabel: "prometheus-port",
+	}
+
+	cases := []struct {
+		instance *compute.Instance
+		expected []string
+	}{
+		{
+			instance: withLabels(map[string]string{"prometheus-port": "8080"}),
+			expected: []string{"10.0.0.1:8080"},
+		},
+		{
+			instance: withLabels(map[string]string{"role": "api"}),
+			expected: []string{"10.0.0.1:9100", "10.0.0.1:9256"},
+		},
+		{
+			instance: withLabels(nil),
+			expected: []string{"10.0.0.1:9100", "10.0.0.1:9256"},
+		},
+		{
+			instance: withLabels(map[string]string{"prometheus-port": "garbage"}),
+			expected: []string{},
+		},
+		{
+			instance: withLabels(map[string]string{"prometheus-port": "0"}),
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res, err := InstanceToTargets(c.instance, config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if addrs := targetAddresses(res); !reflect.DeepEqual(addrs, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(addrs))
+			}
+		})
+	}
+}
+
+func TestInstanceToTargetsExternalAddress(t *testing.T) {
+	t.Parallel()
+
+	withInterfaces := func(ifaces ...*compute.NetworkInterface) *compute.Instance {
+		i := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+		i.NetworkInterfaces = ifaces
+		return i
+	}
+	config := SearchConfig{
+		Job:         "web",
+		Project:     "test-project",
+		Ports:       []int{80},
+		AddressType: "external",
+	}
+
+	cases := []struct {
+		instance *compute.Instance
+		expected []string
+	}{
+		{
+			instance: withInterfaces(&compute.NetworkInterface{
+				NetworkIP: "10.0.0.1",
+				AccessConfigs: []*compute.AccessConfig{
+					{NatIP: "35.1.1.1"},
+					{NatIP: "35.1.1.2"},
+				},
+			}),
+			expected: []string{"35.1.1.1:80"},
+		},
+		{
+			instance: withInterfaces(
+				nil,
+				&compute.NetworkInterface{NetworkIP: "10.0.0.1"},
+				&compute.NetworkInterface{
+					NetworkIP:     "10.1.0.1",
+					AccessConfigs: []*compute.AccessConfig{nil, {NatIP: ""}, {NatIP: "35.1.1.3"}},
+				},
+			),
+			expected: []string{"35.1.1.3:80"},
+		},
+		{
+			instance: withInterfaces(&compute.NetworkInterface{NetworkIP: "10.0.0.1"}),
+			expected: []string{},
+		},
+		{
+			instance: withInterfaces(&compute.NetworkInterface{
+				NetworkIP:     "10.0.0.1",
+				AccessConfigs: []*compute.AccessConfig{nil},
+			}),
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			res, err := InstanceToTargets(c.instance, config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if addrs := targetAddresses(res); !reflect.DeepEqual(addrs, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(addrs))
+			}
+		})
+	}
+}
+
+func TestDiscoverTargetsNetworks(t *testing.T) {
+	t.Parallel()
+
+	network := func(name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/test-project/global/networks/" + name
+	}
+	subnetwork := func(name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/test-project/regions/us-central1/subnetworks/" + name
+	}
+	withInterfaces := func(name string, ifaces ...*compute.NetworkInterface) *compute.Instance {
+		i := testInstance(name, "us-central1-b", "", "node")
+		i.NetworkInterfaces = ifaces
+		return i
+	}
+
+	instances := []*compute.Instance{
+		withInterfaces("default-only",
+			&compute.NetworkInterface{NetworkIP: "10.0.0.1", Network: network("default"), Subnetwork: subnetwork("default")},
+		),
+		withInterfaces("dual-homed",
+			&compute.NetworkInterface{NetworkIP: "10.0.0.2", Network: network("default"), Subnetwork: subnetwork("default")},
+			nil,
+			&compute.NetworkInterface{NetworkIP: "10.1.0.2", Network: network("monitoring-vpc"), Subnetwork: subnetwork("monitoring-central")},
+		),
+		withInterfaces("monitoring-east",
+			&compute.NetworkInterface{NetworkIP: "10.2.0.3", Network: network("monitoring-vpc"), Subnetwork: subnetwork("monitoring-east")},
+		),
+		withInterfaces("nil-interface", nil),
+		withInterfaces("no-interfaces"),
+	}
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{Networks: []string{"monitoring-vpc"}},
+			expected: []string{"10.1.0.2:80", "10.2.0.3:80"},
+		},
+		{
+			config:   SearchConfig{Subnetworks: []string{"monitoring-central"}},
+			expected: []string{"10.1.0.2:80"},
+		},
+		{
+			config:   SearchConfig{Networks: []string{"monitoring-vpc"}, Subnetworks: []string{"monitoring-east", "default"}},
+			expected: []string{"10.2.0.3:80"},
+		},
+		{
+			config:   SearchConfig{Networks: []string{"default", "monitoring-vpc"}},
+			expected: []string{"10.0.0.1:80", "10.0.0.2:80", "10.2.0.3:80"},
+		},
+		{
+			config:   SearchConfig{Networks: []string{"other"}},
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			c.config.Job = "node"
+			c.config.Ports = []int{80}
+			matched, err := DiscoverComputeByTags(context.Background(), instances, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			targets := []DiscoveryTarget{}
+			for _, i := range matched {
+				ts, err := InstanceToTargets(i, c.config)
+				if err != nil {
+					t.Fatalf("Unexpected error\nError: %v", err)
+				}
+				targets = append(targets, ts...)
+			}
+
+			if addrs := targetAddresses(targets); !reflect.DeepEqual(addrs, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(addrs))
+			}
+		})
+	}
+}
+
+func TestInstanceToTargetsInterfaceSelection(t *testing.T) {
+	t.Parallel()
+
+	network := func(name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/test-project/global/networks/" + name
+	}
+	subnetwork := func(name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/test-project/regions/us-central1/subnetworks/" + name
+	}
+	withInterfaces := func(ifaces ...*compute.NetworkInterface) *compute.Instance {
+		i := testInstance("appliance-1", "us-central1-b", "10.0.0.1", "appliance")
+		i.NetworkInterfaces = ifaces
+		return i
+	}
+	twoNICs := withInterfaces(
+		&compute.NetworkInterface{NetworkIP: "10.0.0.1", Network: network("management")},
+		&compute.NetworkInterface{NetworkIP: "10.1.0.1", Network: network("monitoring-vpc"), Subnetwork: subnetwork("monitoring-central")},
+	)
+	threeNICs := withInterfaces(
+		&compute.NetworkInterface{NetworkIP: "10.0.0.1", Network: network("management")},
+		nil,
+		&compute.NetworkInterface{
+			NetworkIP:     "10.2.0.1",
+			Network:       network("monitoring-vpc"),
+			AccessConfigs: []*compute.AccessConfig{{NatIP: "35.1.1.1"}},
+		},
+	)
+	index := func(i int) *int { return &i }
+
+	cases := []struct {
+		instance *compute.Instance
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			instance: twoNICs,
+			config:   SearchConfig{},
+			expected: []string{"10.0.0.1:80"},
+		},
+		{
+			instance: twoNICs,
+			config:   SearchConfig{InterfaceIndex: index(1)},
+			expected: []string{"10.1.0.1:80"},
+		},
+		{
+			instance: twoNICs,
+			config:   SearchConfig{InterfaceNetwork: "monitoring-vpc"},
+			expected: []string{"10.1.0.1:80"},
+		},
+		{
+			instance: twoNICs,
+			config:   SearchConfig{InterfaceNetwork: "monitoring-central"},
+			expected: []string{"10.1.0.1:80"},
+		},
+		{
+			instance: twoNICs,
+			config:   SearchConfig{InterfaceIndex: index(2)},
+			expected: []string{},
+		},
+		{
+			instance: threeNICs,
+			config:   SearchConfig{InterfaceIndex: index(1)},
+			expected: []string{},
+		},
+		{
+			instance: threeNICs,
+			config:   SearchConfig{InterfaceIndex: index(2)},
+			expected: []string{"10.2.0.1:80"},
+		},
+		{
+			instance: threeNICs,
+			config:   SearchConfig{InterfaceNetwork: "monitoring-vpc", AddressType: "external"},
+			expected: []string{"35.1.1.1:80"},
+		},
+		{
+			instance: threeNICs,
+			config:   SearchConfig{InterfaceNetwork: "other-vpc"},
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			c.config.Job = "appliance"
+			c.config.Project = "test-project"
+			c.config.Ports = []int{80}
+			res, err := InstanceToTargets(c.instance, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if addrs := targetAddresses(res); !reflect.DeepEqual(addrs, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(addrs))
+			}
+		})
+	}
+}
+
+func TestInstanceToTargetsNetworkLabels(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("appliance-1", "us-central1-b", "10.0.0.1", "appliance")
+	instance.NetworkInterfaces = []*compute.NetworkInterface{
+		{NetworkIP: "10.0.0.1", Network: "https://www.googleapis.com/compute/v1/projects/test-project/global/networks/legacy"},
+		{
+			NetworkIP:  "10.1.0.1",
+			Network:    "https://www.googleapis.com/compute/v1/projects/host-project/global/networks/shared-vpc",
+			Subnetwork: "https://www.googleapis.com/compute/v1/projects/host-project/regions/us-central1/subnetworks/monitoring",
+		},
+	}
+	index := func(i int) *int { return &i }
+
+	cases := []struct {
+		config   SearchConfig
+		expected []map[string]string
+	}{
+		{ // A legacy network has no subnetwork
+			config:   SearchConfig{},
+			expected: []map[string]string{{"__meta_gce_network": "legacy"}},
+		},
+		{
+			config:   SearchConfig{InterfaceIndex: index(1)},
+			expected: []map[string]string{{"__meta_gce_network": "shared-vpc", "__meta_gce_subnetwork": "monitoring"}},
+		},
+		{ // Each interface's target is labelled with its own network
+			config: SearchConfig{AllInterfaces: true},
+			expected: []map[string]string{
+				{"__meta_gce_network": "legacy"},
+				{"__meta_gce_network": "shared-vpc", "__meta_gce_subnetwork": "monitoring"},
+			},
+		},
+	}
+
+	for i, c := range cases {
+		c.config.Job = "appliance"
+		c.config.Project = "test-project"
+		c.config.Ports = []int{80}
+		res, err := InstanceToTargets(instance, c.config)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+
+		labels := []map[string]string{}
+		for _, target := range res {
+			ls := map[string]string{}
+			for _, k := range []string{"__meta_gce_network", "__meta_gce_subnetwork"} {
+				if v, ok := target.Labels[k]; ok {
+					ls[k] = v
+				}
+			}
+			labels = append(labels, ls)
+		}
+		if !reflect.DeepEqual(labels, c.expected) {
+			t.Fatalf("Discrepancy in result of case %v\nResult: %v", i, prettyPrint(labels))
+		}
+	}
+}
+
+func TestInstanceToTargetsRegion(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		zone     string
+		region   string
+		expected bool
+	}{
+		{zone: "us-central1-b", region: "us-central1", expected: true},
+		{zone: "europe-west10-a", region: "europe-west10", expected: true},
+		{zone: "northamerica-northeast1-c", region: "northamerica-northeast1", expected: true},
+		{zone: "", expected: false},
+		{zone: "local", expected: false},
+		{zone: "-b", expected: false},
+		{zone: "us-central1-", expected: false},
+		{zone: "us-central1-bc", expected: false},
+		{zone: "us-central1-1", expected: false},
+	}
+	for _, c := range cases {
+		instance := testInstance("web-1", c.zone, "10.0.0.1", "web")
+		instance.Zone = "https://www.googleapis.com/compute/v1/projects/test-project/zones/" + c.zone
+		job := "region-" + c.zone
+		errs := counterValue(regionParseErrors.WithLabelValues(job))
+
+		res, err := InstanceToTargets(instance, SearchConfig{Job: job, Project: "test-project", Ports: []int{80}})
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		region, ok := res[0].Labels["__meta_gce_instance_region"]
+		if ok != c.expected || region != c.region {
+			t.Fatalf("Expected region %q for zone %q, got %q", c.region, c.zone, region)
+		}
+		if zone := res[0].Labels["__meta_gce_instance_zone"]; zone != c.zone {
+			t.Fatalf("Expected zone %q to be unchanged, got %q", c.zone, zone)
+		}
+		if got := counterValue(regionParseErrors.WithLabelValues(job)) - errs; (got == 1) == c.expected {
+			t.Fatalf("Unexpected %v parse errors for zone %q", got, c.zone)
+		}
+	}
+}
+
+func TestInstanceToTargetsCPUPlatformLabels(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	withPlatform := func(name, platform, minPlatform string) *compute.Instance {
+		i := testInstance(name, "us-central1-b", "10.0.0.1", "web")
+		i.CpuPlatform = platform
+		i.MinCpuPlatform = minPlatform
+		return i
+	}
+	cases := []struct {
+		instance *compute.Instance
+		expected map[string]string
+	}{
+		{
+			instance: withPlatform("web-1", "Intel Cascade Lake", "Intel Skylake"),
+			expected: map[string]string{"__meta_gce_cpu_platform": "Intel Cascade Lake", "__meta_gce_min_cpu_platform": "Intel Skylake"},
+		},
+		{
+			instance: withPlatform("web-2", "AMD Milan", ""),
+			expected: map[string]string{"__meta_gce_cpu_platform": "AMD Milan"},
+		},
+		{
+			instance: withPlatform("web-3", "", ""),
+			expected: map[string]string{},
+		},
+	}
+
+	for i, c := range cases {
+		res, err := InstanceToTargets(c.instance, SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}})
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+
+		// The labels survive being written and read back.
+		out := filepath.Join(dir, fmt.Sprintf("targets-%v.yaml", i))
+		if err := WriteTargets(context.Background(), res, out, syncInfo{}); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		d, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		var written []DiscoveryTarget
+		if err := yaml.Unmarshal(d, &written); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+
+		got := map[string]string{}
+		for k, v := range written[0].Labels {
+			if strings.Contains(k, "cpu_platform") {
+				got[k] = v
+			}
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("Discrepancy in result of case %v\nResult: %v", i, prettyPrint(got))
+		}
+	}
+}
+
+func TestInstanceToTargetsCreatedByLabels(t *testing.T) {
+	t.Parallel()
+
+	d, err := ioutil.ReadFile("./test/instance_mig.json")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	var instance compute.Instance
+	if err := json.Unmarshal(d, &instance); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	config := SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}}
+	res, err := InstanceToTargets(&instance, config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if createdBy := res[0].Labels["__meta_gce_created_by"]; createdBy != "web-mig" {
+		t.Fatalf("Expected the instance group manager, got %v", prettyPrint(res))
+	}
+	if template := res[0].Labels["__meta_gce_instance_template"]; template != "web-template-v3" {
+		t.Fatalf("Expected the instance template, got %v", prettyPrint(res))
+	}
+
+	// Instances created manually have neither label.
+	res, err = InstanceToTargets(testInstance("web-1", "us-central1-b", "10.0.0.1", "web"), config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	for _, k := range []string{"__meta_gce_created_by", "__meta_gce_instance_template"} {
+		if v, ok := res[0].Labels[k]; ok {
+			t.Fatalf("Expected no %v label, got %v", k, v)
+		}
+	}
+}
+
+func TestInstanceToTargetsServiceAccountLabels(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		accounts []*compute.ServiceAccount
+		expected map[string]string
+	}{
+		{
+			accounts: nil,
+			expected: map[string]string{},
+		},
+		{
+			accounts: []*compute.ServiceAccount{
+				{
+					Email:  "123456789-compute@developer.gserviceaccount.com",
+					Scopes: []string{"https://www.googleapis.com/auth/cloud-platform"},
+				},
+			},
+			expected: map[string]string{
+				"__meta_gce_service_account":        "123456789-compute@developer.gserviceaccount.com",
+				"__meta_gce_service_account_scopes": ",cloud-platform,",
+			},
+		},
+		{ // Several accounts are joined, and their scopes merged
+			accounts: []*compute.ServiceAccount{
+				{
+					Email: "web@test-project.iam.gserviceaccount.com",
+					Scopes: []string{
+						"https://www.googleapis.com/auth/logging.write",
+						"https://www.googleapis.com/auth/monitoring.write",
+					},
+				},
+				nil,
+				{
+					Email: "deploy@test-project.iam.gserviceaccount.com",
+					Scopes: []string{
+						"https://www.googleapis.com/auth/devstorage.read_only",
+						"https://www.googleapis.com/auth/logging.write",
+					},
+				},
+			},
+			expected: map[string]string{
+				"__meta_gce_service_account":        "web@test-project.iam.gserviceaccount.com,deploy@test-project.iam.gserviceaccount.com",
+				"__meta_gce_service_account_scopes": ",logging.write,monitoring.write,devstorage.read_only,",
+			},
+		},
+		{ // An account without scopes
+			accounts: []*compute.ServiceAccount{{Email: "web@test-project.iam.gserviceaccount.com"}},
+			expected: map[string]string{
+				"__meta_gce_service_account":        "web@test-project.iam.gserviceaccount.com",
+				"__meta_gce_service_account_scopes": ",,",
+			},
+		},
+	}
+
+	for i, c := range cases {
+		instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+		instance.ServiceAccounts = c.accounts
+		res, err := InstanceToTargets(instance, SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}})
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		got := map[string]string{}
+		for k, v := range res[0].Labels {
+			if strings.HasPrefix(k, "__meta_gce_service_account") {
+				got[k] = v
+			}
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("Discrepancy in result of case %v\nResult: %v", i, prettyPrint(got))
+		}
+	}
+}
+
+func TestInstanceToTargetsSchedulingLabels(t *testing.T) {
+	t.Parallel()
+
+	no := false
+	cases := []struct {
+		scheduling *compute.Scheduling
+		expected   map[string]string
+	}{
+		{ // No scheduling options
+			scheduling: nil,
+			expected:   map[string]string{"preemptible": "false", "model": "STANDARD", "restart": "true"},
+		},
+		{ // Legacy preemptible VM
+			scheduling: &compute.Scheduling{Preemptible: true, AutomaticRestart: &no, OnHostMaintenance: "TERMINATE"},
+			expected:   map[string]string{"preemptible": "true", "model": "STANDARD", "restart": "false"},
+		},
+		{ // Spot VM
+			scheduling: &compute.Scheduling{ProvisioningModel: "SPOT", AutomaticRestart: &no},
+			expected:   map[string]string{"preemptible": "true", "model": "SPOT", "restart": "false"},
+		},
+		{
+			scheduling: &compute.Scheduling{ProvisioningModel: "STANDARD"},
+			expected:   map[string]string{"preemptible": "false", "model": "STANDARD", "restart": "true"},
+		},
+	}
+
+	for i, c := range cases {
+		instance := testInstance("batch-1", "us-central1-b", "10.0.0.1", "batch")
+		instance.Scheduling = c.scheduling
+		res, err := InstanceToTargets(instance, SearchConfig{Job: "batch", Project: "test-project", Ports: []int{80}})
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		labels := res[0].Labels
+		got := map[string]string{
+			"preemptible": labels["__meta_gce_instance_preemptible"],
+			"model":       labels["__meta_gce_provisioning_model"],
+			"restart":     labels["__meta_gce_automatic_restart"],
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Fatalf("Discrepancy in result of case %v\nResult: %v", i, prettyPrint(got))
+		}
+	}
+}
+
+func TestInstanceToTargetsDNSAddress(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("instance-1", "europe-west1-b", "10.0.0.1", "node")
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{AddressType: "dns"},
+			expected: []string{"instance-1.c.my-project.internal:9100"},
+		},
+		{
+			config:   SearchConfig{AddressType: "dns", DNSForm: "global"},
+			expected: []string{"instance-1.c.my-project.internal:9100"},
+		},
+		{
+			config:   SearchConfig{AddressType: "dns", DNSForm: "zonal"},
+			expected: []string{"instance-1.europe-west1-b.c.my-project.internal:9100"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			c.config.Job = "node"
+			c.config.Project = "my-project"
+			c.config.Ports = []int{9100}
+			res, err := InstanceToTargets(instance, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if addrs := targetAddresses(res); !reflect.DeepEqual(addrs, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(addrs))
+			}
+			if ip := res[0].Labels["__meta_gce_private_ip"]; ip != "10.0.0.1" {
+				t.Fatalf("Unexpected private ip label %q", ip)
+			}
+		})
+	}
+}
+
+func TestInstanceToTargetsAllInterfaces(t *testing.T) {
+	t.Parallel()
+
+	withInterfaces := func(ifaces ...*compute.NetworkInterface) *compute.Instance {
+		i := testInstance("gateway-1", "us-central1-b", "10.0.0.1", "gateway")
+		i.NetworkInterfaces = ifaces
+		return i
+	}
+	network := func(name string) string {
+		return "https://www.googleapis.com/compute/v1/projects/test-project/global/networks/" + name
+	}
+
+	cases := []struct {
+		instance *compute.Instance
+		config   SearchConfig
+		expected map[string][2]string
+	}{
+		{ // Default behaviour is unchanged
+			instance: withInterfaces(
+				&compute.NetworkInterface{Name: "nic0", NetworkIP: "10.0.0.1", Network: network("default")},
+				&compute.NetworkInterface{Name: "nic1", NetworkIP: "10.1.0.1", Network: network("monitoring")},
+			),
+			config: SearchConfig{},
+			expected: map[string][2]string{
+				"10.0.0.1:80": {"", ""},
+				"10.0.0.1:81": {"", ""},
+			},
+		},
+		{
+			instance: withInterfaces(
+				&compute.NetworkInterface{Name: "nic0", NetworkIP: "10.0.0.1", Network: network("default")},
+				nil,
+				&compute.NetworkInterface{Name: "nic2", NetworkIP: "10.1.0.1", Network: network("monitoring")},
+			),
+			config: SearchConfig{AllInterfaces: true},
+			expected: map[string][2]string{
+				"10.0.0.1:80": {"nic0", "default"},
+				"10.0.0.1:81": {"nic0", "default"},
+				"10.1.0.1:80": {"nic2", "monitoring"},
+				"10.1.0.1:81": {"nic2", "monitoring"},
+			},
+		},
+		{ // Single NIC
+			instance: withInterfaces(
+				&compute.NetworkInterface{Name: "nic0", NetworkIP: "10.0.0.1", Network: network("default")},
+			),
+			config: SearchConfig{AllInterfaces: true},
+			expected: map[string][2]string{
+				"10.0.0.1:80": {"nic0", "default"},
+				"10.0.0.1:81": {"nic0", "default"},
+			},
+		},
+		{ // Shared IPs are deduplicated
+			instance: withInterfaces(
+				&compute.NetworkInterface{Name: "nic0", NetworkIP: "10.0.0.1", Network: network("default")},
+				&compute.NetworkInterface{Name: "nic1", NetworkIP: "10.0.0.1", Network: network("other")},
+			),
+			config: SearchConfig{AllInterfaces: true},
+			expected: map[string][2]string{
+				"10.0.0.1:80": {"nic0", "default"},
+				"10.0.0.1:81": {"nic0", "default"},
+			},
+		},
+		{
+			instance: withInterfaces(
+				&compute.NetworkInterface{Name: "nic0", NetworkIP: "10.0.0.1", Network: network("default")},
+				&compute.NetworkInterface{
+					Name:          "nic1",
+					NetworkIP:     "10.1.0.1",
+					Network:       network("public"),
+					AccessConfigs: []*compute.AccessConfig{{NatIP: "35.1.1.1"}},
+				},
+			),
+			config: SearchConfig{AllInterfaces: true, AddressType: "external"},
+			expected: map[string][2]string{
+				"35.1.1.1:80": {"nic1", "public"},
+				"35.1.1.1:81": {"nic1", "public"},
+			},
+		},
+		{
+			instance: withInterfaces(nil),
+			config:   SearchConfig{AllInterfaces: true},
+			expected: map[string][2]string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			c.config.Job = "gateway"
+			c.config.Project = "test-project"
+			c.config.Ports = []int{80, 81}
+			res, err := InstanceToTargets(c.instance, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			got := map[string][2]string{}
+			for _, t := range res {
+				got[t.Targets[0]] = [2]string{t.Labels["__meta_gce_interface_name"], t.Labels["__meta_gce_interface_network"]}
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+			}
+		})
+	}
+}
+
+func TestInstanceToTargetsNoPorts(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+
+	cases := []struct {
+		config   SearchConfig
+		expected []string
+	}{
+		{
+			config:   SearchConfig{AllowNoPorts: true},
+			expected: []string{"10.0.0.1"},
+		},
+		{
+			config:   SearchConfig{AllowNoPorts: true, Ports: []int{80}},
+			expected: []string{"10.0.0.1:80"},
+		},
+		{
+			config:   SearchConfig{AllowNoPorts: true, AddressType: "dns"},
+			expected: []string{"web-1.c.test-project.internal"},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			c.config.Job = "blackbox"
+			c.config.Project = "test-project"
+			res, err := InstanceToTargets(instance, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if addrs := targetAddresses(res); !reflect.DeepEqual(addrs, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(addrs))
+			}
+			if name := res[0].Labels["__meta_gce_instance_name"]; name != "web-1" {
+				t.Fatalf("Unexpected instance name label %q", name)
+			}
+		})
+	}
+}
+
+func TestInstanceToTargetsAliasIPs(t *testing.T) {
+	t.Parallel()
+
+	withInterfaces := func(ifaces ...*compute.NetworkInterface) *compute.Instance {
+		i := testInstance("containers-1", "us-central1-b", "10.0.0.1", "containers")
+		i.NetworkInterfaces = ifaces
+		return i
+	}
+
+	cases := []struct {
+		instance *compute.Instance
+		config   SearchConfig
+		expected map[string]string
+	}{
+		{
+			instance: withInterfaces(&compute.NetworkInterface{
+				NetworkIP: "10.0.0.1",
+				AliasIpRanges: []*compute.AliasIpRange{
+					{IpCidrRange: "10.4.0.1/32", SubnetworkRangeName: "pods"},
+					{IpCidrRange: "10.4.0.2/32", SubnetworkRangeName: "pods"},
+					{IpCidrRange: "10.0.0.9/32"},
+					{IpCidrRange: "10.4.1.0/24", SubnetworkRangeName: "pods"},
+					nil,
+				},
+			}),
+			config: SearchConfig{IncludeAliasIPs: true},
+			expected: map[string]string{
+				"10.0.0.1:80": "",
+				"10.4.0.1:80": "pods",
+				"10.4.0.2:80": "pods",
+				"10.0.0.9:80": "",
+			},
+		},
+		{ // Aliases are only discovered when requested
+			instance: withInterfaces(&compute.NetworkInterface{
+				NetworkIP: "10.0.0.1",
+				AliasIpRanges: []*compute.AliasIpRange{
+					{IpCidrRange: "10.4.0.1/32", SubnetworkRangeName: "pods"},
+				},
+			}),
+			config: SearchConfig{},
+			expected: map[string]string{
+				"10.0.0.1:80": "",
+			},
+		},
+		{ // Interfaces without aliases
+			instance: withInterfaces(
+				&compute.NetworkInterface{NetworkIP: "10.0.0.1"},
+				&compute.NetworkInterface{
+					NetworkIP: "10.1.0.1",
+					AliasIpRanges: []*compute.AliasIpRange{
+						{IpCidrRange: "10.5.0.7", SubnetworkRangeName: "services"},
+						{IpCidrRange: "10.5.0.0/28", SubnetworkRangeName: "services"},
+					},
+				},
+			),
+			config: SearchConfig{IncludeAliasIPs: true},
+			expected: map[string]string{
+				"10.0.0.1:80": "",
+				"10.5.0.7:80": "services",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			c.config.Job = "containers"
+			c.config.Project = "test-project"
+			c.config.Ports = []int{80}
+			res, err := InstanceToTargets(c.instance, c.config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			got := map[string]string{}
+			for _, t := range res {
+				got[t.Targets[0]] = t.Labels["__meta_gce_alias_range_name"]
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+			}
+		})
+	}
+}
+
+func TestDiscoverySchedulerJobTemplate(t *testing.T) {
+	withLabels := func(instance *compute.Instance, labels map[string]string) *compute.Instance {
+		instance.Labels = labels
+		return instance
+	}
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			withLabels(testInstance("api-1", "us-central1-b", "10.0.0.1", "node"), map[string]string{"service": "api"}),
+			withLabels(testInstance("api-2", "us-central1-c", "10.0.0.2", "node"), map[string]string{"service": "api"}),
+			withLabels(testInstance("billing-1", "us-central1-b", "10.0.0.3", "node"), map[string]string{"service": "billing"}),
+			testInstance("unlabelled-1", "us-central1-b", "10.0.0.4", "node"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	// Instances without a service label render an empty job.
+	config := SearchConfig{JobTemplate: "{{ with .Labels.service }}{{ . }}-exporter{{ end }}", Tags: []string{"node"}, Project: "test-project", Ports: []int{9100}}
+	if err := ValidateConfig(config); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := compileConfig(&config); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	skipped := counterValue(jobTemplateSkipped.WithLabelValues("0"))
+	scheduler := newDiscoveryScheduler([]SearchConfig{config}, time.Minute)
+	if _, err := scheduler.Sync(context.Background(), time.Now(), true); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	expected := map[string][]string{
+		"api-exporter":     {"10.0.0.1:9100", "10.0.0.2:9100"},
+		"billing-exporter": {"10.0.0.3:9100"},
+	}
+	if got := targetsByJob(scheduler.Targets()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+	if got := gaugeValue(targetCount.WithLabelValues("api-exporter")); got != 2 {
+		t.Fatalf("Expected 2 api-exporter targets counted, got %v", got)
+	}
+	if got := gaugeValue(targetCount.WithLabelValues("billing-exporter")); got != 1 {
+		t.Fatalf("Expected 1 billing-exporter target counted, got %v", got)
+	}
+	if got := counterValue(jobTemplateSkipped.WithLabelValues("0")) - skipped; got != 1 {
+		t.Fatalf("Expected 1 skipped instance, got %v", got)
+	}
+
+	config = SearchConfig{Job: "web", JobTemplate: "{{ .Name }}", Tags: []string{"node"}, Project: "test-project", Ports: []int{80}}
+	if err := ValidateConfig(config); err == nil || !strings.Contains(err.Error(), "Only one of job and job_template may be specified") {
+		t.Fatalf("Expected job and job_template to be rejected\nError: %v", err)
+	}
+}
+
+func TestDiscoverySchedulerJobTemplateSettings(t *testing.T) {
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("api-1", "us-central1-b", "10.0.0.1", "node"),
+			testInstance("db-1", "us-central1-b", "10.0.0.2", "node"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	// The settings of a templated entry apply to each job it renders.
+	emit := false
+	configs := []SearchConfig{
+		{JobTemplate: "{{ .Name }}", Tags: []string{"node"}, Project: "test-project", Ports: []int{9100}, MinTargets: 2, StripMeta: true, EmitJobLabel: &emit, TargetLabels: map[string]string{"team": "infra"}},
+		{Job: "web", Tags: []string{"node"}, Project: "test-project", Ports: []int{80}},
+	}
+	for i := range configs {
+		if err := ValidateConfig(configs[i]); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if err := compileConfig(&configs[i]); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	scheduler := newDiscoveryScheduler(configs, time.Minute)
+	if _, err := scheduler.Sync(context.Background(), time.Now(), true); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	if got, expected := scheduler.MinTargetsByFile("targets.yaml"), map[string]map[string]int{"targets.yaml": {"api-1": 2, "db-1": 2}}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in min_targets\nResult: %v", prettyPrint(got))
+	}
+	if got, expected := scheduler.LabelPrefixes(), map[string]string{"api-1": stripMetaPrefix, "db-1": stripMetaPrefix}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in label prefixes\nResult: %v", prettyPrint(got))
+	}
+	if got, expected := scheduler.OmittedJobLabels(), map[string]bool{"api-1": true, "db-1": true}; !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in omitted job labels\nResult: %v", prettyPrint(got))
+	}
+}
+
+func TestDiscoverTargetsJobTemplateMetrics(t *testing.T) {
+	young := testInstance("api-1", "us-central1-b", "10.0.0.1", "node")
+	young.CreationTimestamp = time.Now().Format(time.RFC3339)
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			young,
+			testInstance("db-1", "nowhere", "10.0.0.2", "node"),
+			testInstance("cache-1", "us-central1-b", "10.0.0.3", "node", "excluded"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	// Instances of a templated entry are reported under the job they render.
+	config := SearchConfig{JobTemplate: "{{ .Name }}", Tags: []string{"node"}, ExcludeTags: []string{"excluded"}, Project: "test-project", Ports: []int{9100}, MinAge: time.Hour}
+	if err := compileConfig(&config); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if _, err := DiscoverTargets(context.Background(), []SearchConfig{config}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	metrics := scrapeMetrics()
+	for _, series := range []string{
+		`gcesd_instances_warming_up{job="api-1",project="test-project"} 1`,
+		`gcesd_instances_warming_up{job="db-1",project="test-project"} 0`,
+		`gcesd_region_parse_errors_total{job="db-1"} 1`,
+		`gcesd_instances_skipped_count{job="cache-1",reason="excluded_tag"} 1`,
+	} {
+		if !strings.Contains(metrics, series) {
+			t.Fatalf("Expected %v\nMetrics: %v", series, metrics)
+		}
+	}
+	if strings.Contains(metrics, `job=""`) {
+		t.Fatalf("Unexpected series without a job\nMetrics: %v", metrics)
+	}
+}
+
+// scrapeMetrics returns the metrics exposed by the default registry.
+func scrapeMetrics() string {
+	rec := httptest.NewRecorder()
+	prometheus.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	return rec.Body.String()
+}
+
+func TestDiscoverTargetsRemovesStaleJobs(t *testing.T) {
+	young := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+	young.CreationTimestamp = time.Now().Format(time.RFC3339)
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			young,
+			testInstance("db-1", "us-central1-b", "10.0.0.2", "db"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "stale-web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}, MinAge: time.Hour},
+		{Job: "stale-db", Tags: []string{"db"}, Project: "test-project", Ports: []int{5432}},
+	}
+	if _, err := DiscoverTargets(context.Background(), configs); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	metrics := scrapeMetrics()
+	for _, series := range []string{
+		`gcesd_targets{job="stale-web"} 0`,
+		`gcesd_targets{job="stale-db"} 1`,
+		`gcesd_instances_warming_up{job="stale-web",project="test-project"} 1`,
+	} {
+		if !strings.Contains(metrics, series) {
+			t.Fatalf("Expected %v\nMetrics: %v", series, metrics)
+		}
+	}
+
+	if _, err := DiscoverTargets(context.Background(), configs[1:]); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	metrics = scrapeMetrics()
+	if !strings.Contains(metrics, `gcesd_targets{job="stale-db"} 1`) {
+		t.Fatalf("Expected stale-db to be counted\nMetrics: %v", metrics)
+	}
+	if strings.Contains(metrics, `job="stale-web"`) {
+		t.Fatalf("Expected the stale-web series to be removed\nMetrics: %v", metrics)
+	}
+}
+
+func TestInstanceToTargetsAddressTemplate(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+	instance.NetworkInterfaces[0].AccessConfigs = []*compute.AccessConfig{{NatIP: "35.1.1.1"}}
+
+	cases := []struct {
+		template string
+		expected []string
+	}{
+		{
+			template: "{{ .InternalIP }}",
+			expected: []string{"10.0.0.1", "10.0.0.1"},
+		},
+		{
+			template: "{{ .Name }}.example.com:{{ .Port }}",
+			expected: []string{"web-1.example.com:80", "web-1.example.com:443"},
+		},
+		{
+			template: "{{ .ExternalIP }}:{{ .Port }}",
+			expected: []string{"35.1.1.1:80", "35.1.1.1:443"},
+		},
+		{
+			template: "{{ .Name }}.{{ .Zone }}.{{ .Project }}",
+			expected: []string{"web-1.us-central1-b.test-project", "web-1.us-central1-b.test-project"},
+		},
+		{
+			template: "{{ .Missing }}",
+			expected: []string{},
+		},
+		{
+			template: "{{ if false }}{{ .Name }}{{ end }}",
+			expected: []string{},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+
+			config := SearchConfig{
+				Job:             "web",
+				Project:         "test-project",
+				Ports:           []int{80, 443},
+				AddressTemplate: c.template,
+			}
+			if err := compileConfig(&config); err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			res, err := InstanceToTargets(instance, config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if addrs := targetAddresses(res); !reflect.DeepEqual(addrs, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(addrs))
+			}
+		})
+	}
+}
+
+func prettyPrint(i interface{}) string {
+	v, err := json.Marshal(i)
+	if err != nil {
+		return fmt.Sprintf("%v", i)
+	}
+	return string(v)
+}
+
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		panic(err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func gaugeValue(g prometheus.Gauge) float64 {
+	m := &dto.Metric{}
+	if err := g.Write(m); err != nil {
+		panic(err)
+	}
+	return m.GetGauge().GetValue()
+}
+
+func TestResolveOutputFormat(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		format   string
+		filename string
+		expected string
+		err      bool
+	}{
+		{format: "auto", filename: "targets.json", expected: "json"},
+		{format: "auto", filename: "targets.JSON", expected: "json"},
+		{format: "auto", filename: "targets.yaml", expected: "yaml"},
+		{format: "auto", filename: "targets.yml", expected: "yaml"},
+		{format: "auto", filename: "targets.out", expected: "yaml"},
+		{format: "auto", filename: "targets", expected: "yaml"},
+		{format: "json", filename: "targets.yaml", expected: "json"},
+		{format: "yaml", filename: "targets.json", expected: "yaml"},
+		{format: "toml", filename: "targets.toml", err: true},
+	}
+	for _, c := range cases {
+		res, err := resolveOutputFormat(c.format, c.filename)
+		if c.err {
+			if err == nil {
+				t.Fatalf("Expected an error for %v", c.format)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if res != c.expected {
+			t.Fatalf("Expected %v for %v with %v, got %v", c.expected, c.filename, c.format, res)
+		}
+	}
+}
+
+func TestWriteTargetsJSON(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	targets := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.2:80"}, Labels: map[string]string{"job": "web"}},
+		{Targets: []string{"10.0.0.1:9100", "10.0.0.3:9100"}, Labels: map[string]string{"job": "node", "__meta_gce_instance_name": "node-1"}},
+	}
+
+	out := filepath.Join(dir, "targets.json")
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	d, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	// file_sd expects a list of objects holding a list of target strings and
+	// an object of string labels.
+	var groups []map[string]interface{}
+	if err := json.Unmarshal(d, &groups); err != nil {
+		t.Fatalf("Output is not a JSON list of objects\nError: %v\nOutput: %s", err, d)
+	}
+	if len(groups) != len(targets) {
+		t.Fatalf("Expected %v target groups\nOutput: %s", len(targets), d)
+	}
+	for _, g := range groups {
+		if len(g) != 2 {
+			t.Fatalf("Expected only targets and labels keys\nOutput: %s", d)
+		}
+		ts, ok := g["targets"].([]interface{})
+		if !ok || len(ts) == 0 {
+			t.Fatalf("Expected a list of targets\nOutput: %s", d)
+		}
+		for _, target := range ts {
+			if _, ok := target.(string); !ok {
+				t.Fatalf("Expected targets to be strings\nOutput: %s", d)
+			}
+		}
+		labels, ok := g["labels"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("Expected an object of labels\nOutput: %s", d)
+		}
+		for _, v := range labels {
+			if _, ok := v.(string); !ok {
+				t.Fatalf("Expected label values to be strings\nOutput: %s", d)
+			}
+		}
+	}
+
+	var res []DiscoveryTarget
+	if err := json.Unmarshal(d, &res); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if targetsDifferent(res, targets) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+	if res[0].Labels["job"] != "node" {
+		t.Fatalf("Expected targets to be sorted\nResult: %v", prettyPrint(res))
+	}
+
+	out = filepath.Join(dir, "empty.json")
+	if err := WriteTargets(context.Background(), nil, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if d, _ := ioutil.ReadFile(out); strings.TrimSpace(string(d)) != "[]" {
+		t.Fatalf("Expected an empty list for no targets\nOutput: %s", d)
+	}
+}
+
+func TestSetFilePermissions(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := os.Create(filepath.Join(dir, "targets.yaml"))
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer f.Close()
+
+	for _, mode := range []os.FileMode{0640, 0600, 0604} {
+		if err := setFilePermissions(f, fmt.Sprintf("%#o", mode), -1, -1); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		fi, err := os.Stat(f.Name())
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if fi.Mode().Perm() != mode {
+			t.Fatalf("Expected mode %v, got %v", mode, fi.Mode().Perm())
+		}
+	}
+
+	// Giving a file to its current owner needs no privileges.
+	if err := setFilePermissions(f, "", os.Getuid(), os.Getgid()); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	for _, mode := range []string{"640x", "rw-r-----", "01777", "-1"} {
+		if err := setFilePermissions(f, mode, -1, -1); err == nil {
+			t.Fatalf("Expected an error for mode %v", mode)
+		}
+	}
+}
+
+func TestGroupTargets(t *testing.T) {
+	t.Parallel()
+
+	instances := []*compute.Instance{}
+	for i := 0; i < 50; i++ {
+		instances = append(instances, testInstance(fmt.Sprintf("node-%v", i), "us-central1-b", fmt.Sprintf("10.0.0.%v", i+1), "node"))
+	}
+	config := SearchConfig{Job: "node", Project: "test-project", Ports: []int{9100, 9101, 9102}}
+	targets := []DiscoveryTarget{}
+	for _, instance := range instances {
+		ts, err := InstanceToTargets(instance, config)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		targets = append(targets, ts...)
+	}
+	// The same address in another job keeps its own group.
+	targets = append(targets, DiscoveryTarget{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "other"}})
+
+	grouped := groupTargets(targets)
+	if len(grouped) != len(instances)+1 {
+		t.Fatalf("Expected a group per instance and job, got %v", len(grouped))
+	}
+	for _, g := range grouped {
+		if g.Labels["job"] == "node" && len(g.Targets) != 3 {
+			t.Fatalf("Expected every port of an instance in one group\nResult: %v", prettyPrint(g))
+		}
+	}
+
+	// Both forms hold the same addresses with the same labels.
+	expand := func(targets []DiscoveryTarget) map[string]bool {
+		pairs := map[string]bool{}
+		for _, t := range targets {
+			for _, a := range t.Targets {
+				pairs[a+"\x00"+labelsKey(t.Labels)] = true
+			}
+		}
+		return pairs
+	}
+	if !reflect.DeepEqual(expand(grouped), expand(targets)) {
+		t.Fatalf("Expected grouped targets to be equivalent")
+	}
+
+	groupedYAML, _ := yaml.Marshal(grouped)
+	targetsYAML, _ := yaml.Marshal(targets)
+	if len(groupedYAML)*2 > len(targetsYAML) {
+		t.Fatalf("Expected grouping to at least halve the output, %v bytes grouped, %v bytes ungrouped", len(groupedYAML), len(targetsYAML))
+	}
+
+	// Grouping is deterministic, whatever order the targets are found in.
+	reversed := make([]DiscoveryTarget, len(targets))
+	for i, t := range targets {
+		reversed[len(targets)-1-i] = t
+	}
+	if again := groupTargets(reversed); !reflect.DeepEqual(again, grouped) {
+		t.Fatalf("Expected grouping to be independent of order\nResult: %v", prettyPrint(again))
+	}
+
+	duplicated := groupTargets(append(targets, targets[0]))
+	if !reflect.DeepEqual(duplicated, grouped) {
+		t.Fatalf("Expected duplicate addresses to be merged\nResult: %v", prettyPrint(duplicated))
+	}
+}
+
+func TestTargetsDifferentGrouped(t *testing.T) {
+	t.Parallel()
+
+	web := map[string]string{"job": "web"}
+	other := map[string]string{"job": "other"}
+	old := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.1:80", "10.0.0.2:80"}, Labels: web},
+		{Targets: []string{"10.0.0.1:80"}, Labels: other},
+	}
+	same := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.1:80"}, Labels: other},
+		{Targets: []string{"10.0.0.2:80", "10.0.0.1:80"}, Labels: web},
+	}
+	if targetsDifferent(old, same) {
+		t.Fatalf("Expected reordered targets not to differ")
+	}
+	if old[0].Targets[0] != "10.0.0.1:80" || same[1].Targets[0] != "10.0.0.2:80" {
+		t.Fatalf("Expected targetsDifferent not to reorder its arguments")
+	}
+
+	changed := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.1:80"}, Labels: other},
+		{Targets: []string{"10.0.0.1:80"}, Labels: web},
+	}
+	if !targetsDifferent(old, changed) {
+		t.Fatalf("Expected a removed address to differ")
+	}
+}
+
+func TestWriteTargetsSyncsDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	synced := []string{}
+	syncOutputDir = func(dir string) error {
+		synced = append(synced, dir)
+		return syncDir(dir)
+	}
+	defer func() { syncOutputDir = syncDir }()
+
+	out := filepath.Join(dir, "targets.yaml")
+	if err := WriteTargets(context.Background(), []DiscoveryTarget{}, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	// The targets, checksum and manifest are each synced into place.
+	if len(synced) != 3 {
+		t.Fatalf("Expected the directory to be synced after each file, got %v", synced)
+	}
+	for _, d := range synced {
+		if d != dir {
+			t.Fatalf("Expected %v to be synced, got %v", dir, d)
+		}
+	}
+
+	syncOutputDir = func(string) error { return errors.New("input/output error") }
+	if err := WriteTargets(context.Background(), []DiscoveryTarget{}, out, syncInfo{}); err == nil {
+		t.Fatalf("Expected a failure to sync the directory to fail the write")
+	}
+}
+
+func TestWriteTargetsVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	*verifyWrites = true
+	defer func() { *verifyWrites = false }()
+
+	// The filesystem loses the end of the file the first time it is read.
+	reads := 0
+	readOutputFile = func(name string) ([]byte, error) {
+		d, err := ioutil.ReadFile(name)
+		reads++
+		if reads == 1 && len(d) > 0 {
+			d = d[:len(d)-1]
+		}
+		return d, err
+	}
+	defer func() { readOutputFile = ioutil.ReadFile }()
+
+	out := filepath.Join(dir, "targets.yaml")
+	targets := map[string][]DiscoveryTarget{
+		out: {{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}},
+	}
+	writer := newTargetWriter(out, false)
+	failures := counterValue(resultVerifyFailures.WithLabelValues(out))
+
+	if err := writer.Write(context.Background(), targets, false, syncInfo{}); err == nil {
+		t.Fatalf("Expected a verification failure")
+	}
+	if got := counterValue(resultVerifyFailures.WithLabelValues(out)) - failures; got != 1 {
+		t.Fatalf("Expected 1 verification failure, got %v", got)
+	}
+	if !writer.Pending(time.Time{}) {
+		t.Fatalf("Expected the failed file to be retried")
+	}
+
+	// The unchanged targets are written again, and verify this time.
+	if err := writer.Write(context.Background(), targets, false, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if reads != 2 {
+		t.Fatalf("Expected the file to be written and read back again, got %v reads", reads)
+	}
+	if writer.Pending(time.Time{}) {
+		t.Fatalf("Expected no failures after a successful write")
+	}
+
+	if err := writer.Write(context.Background(), targets, false, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if reads != 2 {
+		t.Fatalf("Expected unchanged targets not to be written, got %v reads", reads)
 	}
-	return string(v)
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// version is the version of prometheus_gce_sd, set at build time with
+// -ldflags "-X main.version=...".
+var version = "dev"
+
+// syncInfo describes the sync which discovered the targets being written.
+type syncInfo struct {
+	time       time.Time
+	configHash string
+	// labelPrefixes holds the prefix the meta labels of each job's targets
+	// are renamed to when written, for jobs setting one.
+	labelPrefixes map[string]string
+	// omitJobLabel holds the jobs whose targets are written without their
+	// job label.
+	omitJobLabel map[string]bool
+	// maxValueLength holds the length label values of each job's targets
+	// are truncated to when written, for jobs setting one.
+	maxValueLength map[string]int
+}
+
+// targetsManifest summarises a targets file, for tools which need to know
+// what it holds without parsing it.
+type targetsManifest struct {
+	Version    string         `json:"version"`
+	SyncTime   time.Time      `json:"sync_time"`
+	ConfigHash string         `json:"config_hash"`
+	Targets    int            `json:"targets"`
+	Jobs       map[string]int `json:"jobs"`
+	Projects   map[string]int `json:"projects"`
+}
+
+// manifestFile returns the path of the manifest written next to targetFile.
+func manifestFile(targetFile string) string {
+	return targetFile + ".manifest.json"
+}
+
+// newTargetsManifest counts targets by job and project.
+func newTargetsManifest(targets []DiscoveryTarget, info syncInfo) targetsManifest {
+	m := targetsManifest{
+		Version:    version,
+		SyncTime:   info.time.UTC(),
+		ConfigHash: info.configHash,
+		Jobs:       map[string]int{},
+		Projects:   map[string]int{},
+	}
+	for _, t := range targets {
+		m.Targets += len(t.Targets)
+		m.Jobs[t.Labels["job"]] += len(t.Targets)
+		if project, ok := t.Labels["__meta_gce_instance_project"]; ok {
+			m.Projects[project] += len(t.Targets)
+		}
+	}
+	return m
+}
+
+func marshalManifest(m targetsManifest) ([]byte, error) {
+	d, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal manifest")
+	}
+	return append(d, '\n'), nil
+}
+
+// configHash returns a hash identifying configs.
+func configHash(configs []SearchConfig) string {
+	d, err := yaml.Marshal(configs)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(d)
+	return hex.EncodeToString(sum[:])
+}
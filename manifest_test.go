@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestWriteTargetsManifest(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	targets := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.1:9100", "10.0.0.1:9101"}, Labels: map[string]string{"job": "node", "__meta_gce_instance_project": "prod"}},
+		{Targets: []string{"10.0.0.2:9100"}, Labels: map[string]string{"job": "node", "__meta_gce_instance_project": "staging"}},
+		{Targets: []string{"10.0.0.3:80"}, Labels: map[string]string{"job": "web", "__meta_gce_instance_project": "prod"}},
+	}
+	info := syncInfo{
+		time:       time.Date(2017, 1, 1, 12, 0, 0, 0, time.FixedZone("BST", 3600)),
+		configHash: configHash([]SearchConfig{{Job: "node"}, {Job: "web"}}),
+	}
+
+	out := filepath.Join(dir, "targets.yaml")
+	if err := WriteTargets(context.Background(), targets, out, info); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	d, err := ioutil.ReadFile(manifestFile(out))
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(d, &raw); err != nil {
+		t.Fatalf("Manifest is not a JSON object\nError: %v\nOutput: %s", err, d)
+	}
+	for _, k := range []string{"version", "sync_time", "config_hash", "targets", "jobs", "projects"} {
+		if _, ok := raw[k]; !ok {
+			t.Fatalf("Expected %v in manifest\nOutput: %s", k, d)
+		}
+	}
+
+	var m targetsManifest
+	if err := json.Unmarshal(d, &m); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	expected := targetsManifest{
+		Version:    version,
+		SyncTime:   time.Date(2017, 1, 1, 11, 0, 0, 0, time.UTC),
+		ConfigHash: info.configHash,
+		Targets:    4,
+		Jobs:       map[string]int{"node": 3, "web": 1},
+		Projects:   map[string]int{"prod": 3, "staging": 1},
+	}
+	if !reflect.DeepEqual(m, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(m))
+	}
+	if len(m.ConfigHash) != 64 || m.ConfigHash == configHash([]SearchConfig{{Job: "node"}}) {
+		t.Fatalf("Expected config hash to identify the config, got %v", m.ConfigHash)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if len(files) != 3 {
+		t.Fatalf("Expected only the targets, checksum and manifest, temporary files were left behind")
+	}
+}
+
+func TestWriteTargetsManifestFailures(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := []DiscoveryTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}}
+	targets := []DiscoveryTarget{{Targets: []string{"10.0.0.1:80", "10.0.0.2:80"}, Labels: map[string]string{"job": "web"}}}
+	readManifest := func(out string) targetsManifest {
+		var m targetsManifest
+		d, err := ioutil.ReadFile(manifestFile(out))
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if err := json.Unmarshal(d, &m); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		return m
+	}
+
+	// The targets cannot replace a directory, so the previous manifest is
+	// kept.
+	out := filepath.Join(dir, "web.yaml")
+	if err := WriteTargets(context.Background(), old, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := os.Remove(out); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Join(out, "dir"), 0755); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err == nil {
+		t.Fatalf("Expected an error writing the targets")
+	}
+	if m := readManifest(out); m.Targets != 1 {
+		t.Fatalf("Expected the previous manifest to be kept\nResult: %v", prettyPrint(m))
+	}
+
+	// The manifest cannot replace a directory, the targets are written and
+	// the error is reported so the write is retried.
+	out = filepath.Join(dir, "targets.yaml")
+	if err := os.MkdirAll(filepath.Join(manifestFile(out), "dir"), 0755); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err == nil {
+		t.Fatalf("Expected an error writing the manifest")
+	}
+	if _, err := os.Stat(out); err != nil {
+		t.Fatalf("Expected the targets to be written\nError: %v", err)
+	}
+
+	// Once the manifest can be written, both are replaced.
+	if err := os.RemoveAll(manifestFile(out)); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := WriteTargets(context.Background(), targets, out, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if m := readManifest(out); m.Targets != 2 {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(m))
+	}
+}
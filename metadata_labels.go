@@ -0,0 +1,72 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	compute "google.golang.org/api/compute/v1"
+)
+
+const metadataLabelPrefix = "__meta_gce_metadata_"
+
+// metadataKeyPattern matches the metadata keys GCE allows.
+var metadataKeyPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+var metadataLabelsTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_metadata_labels_truncated_total",
+	Help: "Number of metadata_labels values truncated to -metadata-labels.max-length, by job name",
+}, []string{"job"})
+
+func init() {
+	prometheus.MustRegister(metadataLabelsTruncated)
+}
+
+// metadataLabels returns a __meta_gce_metadata_<key> label for each of the
+// metadata_labels keys set on instance. Values longer than maxLength bytes
+// are truncated, and multi-line or binary values are left out.
+func metadataLabels(instance *compute.Instance, config SearchConfig, maxLength int) map[string]string {
+	labels := map[string]string{}
+	if len(config.MetadataLabels) == 0 {
+		return labels
+	}
+
+	md := instanceMetadata(instance)
+	for _, key := range config.MetadataLabels {
+		v, ok := md[key]
+		if !ok {
+			continue
+		}
+		if !validMetadataLabelValue(v) {
+			log.Warningf("Ignoring metadata %v of %v for %v, it is not a single line of text", key, instance.Name, config.Job)
+			continue
+		}
+		if maxLength > 0 && len(v) > maxLength {
+			v = truncateUTF8(v, maxLength)
+			metadataLabelsTruncated.WithLabelValues(config.Job).Inc()
+		}
+		labels[metadataLabelPrefix+formatTag(key)] = v
+	}
+	return labels
+}
+
+// validMetadataLabelValue reports whether v is valid UTF-8 on a single line,
+// without control characters.
+func validMetadataLabelValue(v string) bool {
+	if !utf8.ValidString(v) {
+		return false
+	}
+	return strings.IndexFunc(v, unicode.IsControl) == -1
+}
+
+// truncateUTF8 returns the longest prefix of s no longer than n bytes which
+// does not split a character.
+func truncateUTF8(s string, n int) string {
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestMetadataLabels(t *testing.T) {
+	t.Parallel()
+
+	withMetadata := func(md *compute.Metadata) *compute.Instance {
+		i := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+		i.Metadata = md
+		return i
+	}
+	config := SearchConfig{Job: "metadata-labels", MetadataLabels: []string{"version", "build-id"}}
+
+	cases := []struct {
+		instance *compute.Instance
+		expected map[string]string
+	}{
+		{ // Nil metadata
+			instance: withMetadata(nil),
+			expected: map[string]string{},
+		},
+		{ // Missing keys are left out, and other keys are not copied
+			instance: withMetadata(testMetadata("version", "1.2.3", "secret", "hunter2")),
+			expected: map[string]string{"__meta_gce_metadata_version": "1.2.3"},
+		},
+		{
+			instance: withMetadata(testMetadata("version", "1.2.3", "build-id", "abc123")),
+			expected: map[string]string{"__meta_gce_metadata_version": "1.2.3", "__meta_gce_metadata_build_id": "abc123"},
+		},
+		{ // Multi-line and binary values are left out
+			instance: withMetadata(testMetadata("version", "1.2.3\n1.2.4", "build-id", "\x00\xff")),
+			expected: map[string]string{},
+		},
+		{ // Long values are truncated without splitting characters
+			instance: withMetadata(testMetadata("version", strings.Repeat("a", 15)+"é")),
+			expected: map[string]string{"__meta_gce_metadata_version": strings.Repeat("a", 15)},
+		},
+	}
+
+	truncated := counterValue(metadataLabelsTruncated.WithLabelValues(config.Job))
+	for i, c := range cases {
+		if res := metadataLabels(c.instance, config, 16); !reflect.DeepEqual(res, c.expected) {
+			t.Fatalf("Discrepancy in result of case %v\nResult: %v", i, prettyPrint(res))
+		}
+	}
+	if got := counterValue(metadataLabelsTruncated.WithLabelValues(config.Job)) - truncated; got != 1 {
+		t.Fatalf("Expected 1 truncated value, got %v", got)
+	}
+
+	long := withMetadata(testMetadata("version", strings.Repeat("a", 600)))
+	if res := metadataLabels(long, config, 0); len(res["__meta_gce_metadata_version"]) != 600 {
+		t.Fatalf("Expected no truncation without a limit, got %v bytes", len(res["__meta_gce_metadata_version"]))
+	}
+}
+
+func TestInstanceToTargetsMetadataLabels(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+	instance.Metadata = testMetadata("version", "1.2.3")
+	res, err := InstanceToTargets(instance, SearchConfig{Job: "web", Project: "test-project", Ports: []int{80}, MetadataLabels: []string{"version"}})
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if v := res[0].Labels["__meta_gce_metadata_version"]; v != "1.2.3" {
+		t.Fatalf("Expected the version label, got %v", prettyPrint(res))
+	}
+}
+
+func TestValidateConfigMetadataLabels(t *testing.T) {
+	t.Parallel()
+
+	err := ValidateConfig(SearchConfig{Job: "web", Tags: []string{"web"}, Project: "test", Ports: []int{80}, MetadataLabels: []string{"version", "build id"}})
+	if err == nil || !strings.Contains(err.Error(), `Invalid metadata_labels key "build id"`) {
+		t.Fatalf("Expected an invalid key error\nError: %v", err)
+	}
+}
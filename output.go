@@ -0,0 +1,399 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	writeSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_write_suppressed_total",
+		Help: "Number of writes skipped as the targets shrank suspiciously, by file and reason",
+	}, []string{"file", "reason"})
+	resultRefresh = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_target_refresh_total",
+		Help: "Number of times that an output file is rewritten with unchanged targets as it is older than -write.refresh-interval, by file",
+	}, []string{"file"})
+	duplicateTargets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_duplicate_targets_total",
+		Help: "Number of targets left out of a write to an output file as an identical target, with the same address and labels, was already included, by file",
+	}, []string{"file"})
+)
+
+func init() {
+	prometheus.MustRegister(writeSuppressed)
+	prometheus.MustRegister(resultRefresh)
+	prometheus.MustRegister(duplicateTargets)
+}
+
+// stdoutOutput is the output file name meaning targets are printed to
+// stdout.
+const stdoutOutput = "-"
+
+// stdout is where targets are printed for stdoutOutput, it is replaced in
+// tests.
+var stdout io.Writer = os.Stdout
+
+// outputList is a flag listing output files, which may be repeated or
+// given as a comma separated list.
+type outputList []string
+
+func (l *outputList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *outputList) Set(v string) error {
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			*l = append(*l, f)
+		}
+	}
+	return nil
+}
+
+// first returns the first output file, or the empty string if there are
+// none.
+func (l outputList) first() string {
+	if len(l) == 0 {
+		return ""
+	}
+	return l[0]
+}
+
+// targetWriter writes discovered targets to their output files, skipping
+// files whose targets have not changed since they were last written. The
+// targets of defaultFile are also written to each of mirrors. Targets are
+// printed to stdout on every write unless stdoutChangesOnly is set, and
+// targets with identical labels are merged if groupTargets is set.
+//
+// Unless forced, a write is suppressed if it has more than maxShrinkPercent
+// fewer targets than were last written to the file, or fewer targets for a
+// job than the minTargets of the job in that file.
+//
+// Files which failed to be written are written again on the next Write, even
+// if their targets are unchanged, as are files last written refreshInterval
+// or longer ago, if it is set.
+type targetWriter struct {
+	defaultFile       string
+	mirrors           []string
+	removeStale       bool
+	stdoutChangesOnly bool
+	groupTargets      bool
+	maxShrinkPercent  float64
+	refreshInterval   time.Duration
+	minTargets        map[string]map[string]int
+	current           map[string][]DiscoveryTarget
+	failed            map[string]bool
+	lastWrite         map[string]time.Time
+}
+
+func newTargetWriter(defaultFile string, removeStale bool) *targetWriter {
+	return &targetWriter{
+		defaultFile: defaultFile,
+		removeStale: removeStale,
+		current:     map[string][]DiscoveryTarget{},
+		failed:      map[string]bool{},
+		lastWrite:   map[string]time.Time{},
+		// Targets can shrink by at most 100%, so nothing is suppressed.
+		maxShrinkPercent: 100,
+	}
+}
+
+// Write writes the targets of each file in targetsByFile, every file if
+// force is set, or only those which changed otherwise. Duplicate targets in a
+// file, with the same addresses and labels, are written once. Files previously
+// written but no longer in targetsByFile are emptied, or removed if
+// removeStale is set. A failure to write one file does not stop the others
+// being written. info.time is the time of the write, used to decide whether
+// unchanged files are due to be refreshed.
+func (w *targetWriter) Write(ctx context.Context, targetsByFile map[string][]DiscoveryTarget, force bool, info syncInfo) error {
+	errs := []string{}
+
+	for _, file := range sortedFiles(targetsByFile) {
+		targets, duplicates := dedupTargets(targetsByFile[file])
+		if duplicates != 0 {
+			log.V(1).Infof("Dropping %v duplicate targets from %v", duplicates, file)
+			duplicateTargets.WithLabelValues(file).Add(float64(duplicates))
+		}
+		if w.groupTargets {
+			targets = groupTargets(targets)
+		}
+		unchanged := !w.failed[file] && !targetsDifferent(targets, w.current[file])
+		if file == stdoutOutput && !w.stdoutChangesOnly {
+			unchanged = false
+		}
+		paths := []string{file}
+		if file == w.defaultFile {
+			paths = append(paths, w.mirrors...)
+		}
+
+		if !force && unchanged {
+			if !w.refreshDue(file, info.time) {
+				log.V(2).Infof("No changes detected for %v, skipping write", file)
+				continue
+			}
+			// The targets last written are written again, so the
+			// baseline changes are detected against stays the same. They
+			// are still checked against min_targets, which may have been
+			// raised since.
+			if reason, msg := w.suppress(file, w.current[file]); reason != "" {
+				log.Errorf("Not refreshing %v, %v, send SIGUSR1 to force the write", file, msg)
+				writeSuppressed.WithLabelValues(file, reason).Inc()
+				continue
+			}
+			log.V(1).Infof("Refreshing %v, it was last written at %v", file, w.lastWrite[file])
+			if err := writeTargetsTo(ctx, w.current[file], paths, info, resultRefresh); err != nil {
+				errs = append(errs, err.Error())
+				w.failed[file] = true
+				continue
+			}
+			w.lastWrite[file] = info.time
+			continue
+		}
+
+		if !force {
+			if reason, msg := w.suppress(file, targets); reason != "" {
+				log.Errorf("Not writing targets to %v, %v, send SIGUSR1 to force the write", file, msg)
+				writeSuppressed.WithLabelValues(file, reason).Inc()
+				continue
+			}
+		}
+
+		if err := writeTargetsTo(ctx, targets, paths, info, resultWrite); err != nil {
+			errs = append(errs, err.Error())
+			w.failed[file] = true
+			continue
+		}
+		w.current[file] = targets
+		w.lastWrite[file] = info.time
+		delete(w.failed, file)
+	}
+
+	for _, file := range sortedFiles(w.current) {
+		if _, ok := targetsByFile[file]; ok || file == w.defaultFile || file == stdoutOutput {
+			continue
+		}
+
+		// Files no job writes to are not refreshed.
+		delete(w.lastWrite, file)
+
+		// GCS objects and ConfigMap keys are emptied rather than removed.
+		if w.removeStale && !isRemoteOutput(file) {
+			log.Infof("Removing %v, no jobs write to it", file)
+			if err := removeTargets(file); err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			delete(w.current, file)
+			continue
+		}
+
+		if len(w.current[file]) == 0 {
+			continue
+		}
+		log.Infof("Emptying %v, no jobs write to it", file)
+		if err := writeTargetsTo(ctx, []DiscoveryTarget{}, []string{file}, info, resultWrite); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		w.current[file] = []DiscoveryTarget{}
+	}
+
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Pending reports whether a Write at now would write any files even if no
+// targets changed, as they failed to be written by the last Write or are due
+// to be refreshed.
+func (w *targetWriter) Pending(now time.Time) bool {
+	if len(w.failed) != 0 {
+		return true
+	}
+	for file := range w.lastWrite {
+		if w.refreshDue(file, now) {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshDue reports whether file was last written refreshInterval or longer
+// before now. Targets printed to stdout, and files never written, are never
+// refreshed.
+func (w *targetWriter) refreshDue(file string, now time.Time) bool {
+	if w.refreshInterval <= 0 || file == stdoutOutput {
+		return false
+	}
+	last, ok := w.lastWrite[file]
+	if !ok {
+		return false
+	}
+	return !now.Before(last.Add(w.refreshInterval))
+}
+
+// suppress returns the reason, and an explanation, for refusing to write
+// targets to file, or the empty string if they can be written.
+func (w *targetWriter) suppress(file string, targets []DiscoveryTarget) (string, string) {
+	byJob := map[string]int{}
+	for _, t := range liveTargets(targets) {
+		byJob[t.Labels["job"]] += len(t.Targets)
+	}
+	minTargets := w.minTargets[file]
+	jobs := make([]string, 0, len(minTargets))
+	for job := range minTargets {
+		jobs = append(jobs, job)
+	}
+	sort.Strings(jobs)
+	for _, job := range jobs {
+		if n := byJob[job]; n < minTargets[job] {
+			return "min_targets", fmt.Sprintf("job %v has %v targets, fewer than its min_targets of %v", job, n, minTargets[job])
+		}
+	}
+
+	old, ok := w.current[file]
+	if !ok {
+		return "", ""
+	}
+	oldCount, newCount := countTargets(old), countTargets(targets)
+	if shrink := shrinkPercent(oldCount, newCount); shrink > w.maxShrinkPercent {
+		return "shrink", fmt.Sprintf("targets would shrink by %.1f%% from %v to %v, more than the %v%% allowed", shrink, oldCount, newCount, w.maxShrinkPercent)
+	}
+	return "", ""
+}
+
+// countTargets returns the number of addresses in targets, ignoring removed
+// targets.
+func countTargets(targets []DiscoveryTarget) int {
+	n := 0
+	for _, t := range liveTargets(targets) {
+		n += len(t.Targets)
+	}
+	return n
+}
+
+// shrinkPercent returns by what percentage a count of targets falling from
+// old to new shrank, which is 0 if it grew or there were no targets before.
+func shrinkPercent(old, new int) float64 {
+	if old == 0 || new >= old {
+		return 0
+	}
+	return float64(old-new) * 100 / float64(old)
+}
+
+// writeTargetsTo writes targets to each of paths, counting each write in
+// writes. A failure to write one path does not stop the others being
+// written, the error names every path which failed.
+func writeTargetsTo(ctx context.Context, targets []DiscoveryTarget, paths []string, info syncInfo, writes *prometheus.CounterVec) error {
+	errs := []string{}
+	for _, path := range paths {
+		log.V(2).Infof("Writing targets to %v", path)
+		writes.WithLabelValues(path).Inc()
+		if err := WriteTargets(ctx, targets, path, info); err != nil {
+			resultWriteFailures.WithLabelValues(path).Inc()
+			errs = append(errs, errors.Wrapf(err, "Could not write targets to %v", path).Error())
+		}
+	}
+	if len(errs) != 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// isRemoteOutput reports whether file is uploaded rather than written to
+// the local filesystem.
+func isRemoteOutput(file string) bool {
+	return strings.HasPrefix(file, gcsScheme) || strings.HasPrefix(file, configMapScheme)
+}
+
+// removeTargets removes a targets file, its backup, checksum, manifest and
+// gzipped copy.
+func removeTargets(file string) error {
+	for _, f := range []string{file, backupFile(file), checksumFile(file), manifestFile(file), compressedFile(file)} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "Could not remove %v", f)
+		}
+	}
+	return nil
+}
+
+// outputAttempts is how many times a write to a remote output is tried
+// before giving up.
+const outputAttempts = 4
+
+// outputRetryBackoff is how long to wait before retrying a failed write to a
+// remote output, doubling with each attempt. It is replaced in tests.
+var outputRetryBackoff = time.Second
+
+// outputStatusError is returned for requests to remote outputs which fail
+// with an HTTP error.
+type outputStatusError struct {
+	uri    string
+	status string
+	code   int
+}
+
+func (e outputStatusError) Error() string {
+	return fmt.Sprintf("Unable to write %v: %v", e.uri, e.status)
+}
+
+// retryableStatus reports whether a request failing with err may succeed if
+// tried again, which is the case for network errors, server errors and the
+// given statuses.
+func retryableStatus(err error, codes ...int) bool {
+	switch e := errors.Cause(err).(type) {
+	case net.Error:
+		return true
+	case outputStatusError:
+		if e.code >= 500 {
+			return true
+		}
+		for _, c := range codes {
+			if e.code == c {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// retryWithBackoff calls write until it succeeds, fails with an error which
+// is not retryable, or has been tried outputAttempts times.
+func retryWithBackoff(ctx context.Context, uri string, retryable func(error) bool, write func() error) error {
+	backoff := outputRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := write()
+		if err == nil || attempt == outputAttempts || !retryable(err) {
+			return err
+		}
+
+		log.Warningf("Writing %v failed, retrying in %v: %v", uri, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "Unable to write %v", uri)
+		}
+		backoff *= 2
+	}
+}
+
+func sortedFiles(targetsByFile map[string][]DiscoveryTarget) []string {
+	files := make([]string, 0, len(targetsByFile))
+	for f := range targetsByFile {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+// configMapScheme prefixes outputs which are keys of a Kubernetes ConfigMap,
+// such as configmap://monitoring/gcesd/targets.yaml.
+const configMapScheme = "configmap://"
+
+// configMapLimit is the largest ConfigMap Kubernetes accepts.
+const configMapLimit = 1024 * 1024
+
+// serviceAccountDir holds the credentials of the pod's service account.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// configMapKeyPattern matches valid ConfigMap keys.
+var configMapKeyPattern = regexp.MustCompile(`^[-._a-zA-Z0-9]+$`)
+
+var configMapErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_configmap_update_errors_total",
+	Help: "Number of failed updates of targets in a ConfigMap, after retries, by output",
+}, []string{"output"})
+
+func init() {
+	prometheus.MustRegister(configMapErrors)
+}
+
+// kubernetesClient returns the base URL of the Kubernetes API, a client for
+// it and the bearer token to authenticate with. It uses the pod's service
+// account, or -kubernetes.api-url without authentication, such as for a
+// kubectl proxy. It is replaced in tests.
+var kubernetesClient = func() (string, *http.Client, string, error) {
+	if *kubernetesAPIURL != "" {
+		return strings.TrimSuffix(*kubernetesAPIURL, "/"), http.DefaultClient, "", nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return "", nil, "", errors.New("Not running in a Kubernetes cluster, set -kubernetes.api-url to reach the Kubernetes API")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return "", nil, "", errors.Wrap(err, "Unable to read service account token")
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return "", nil, "", errors.Wrap(err, "Unable to read service account CA certificate")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return "", nil, "", errors.New("Invalid service account CA certificate")
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	return "https://" + net.JoinHostPort(host, port), client, strings.TrimSpace(string(token)), nil
+}
+
+// parseConfigMapURL splits a configmap://namespace/name/key URL into its
+// namespace, name and key.
+func parseConfigMapURL(uri string) (string, string, string, error) {
+	parts := strings.Split(strings.TrimPrefix(uri, configMapScheme), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || !configMapKeyPattern.MatchString(parts[2]) {
+		return "", "", "", errors.Errorf("Invalid ConfigMap URL %v, must be configmap://namespace/name/key", uri)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// configMapRetryable reports whether an update failing with err may succeed
+// if tried again: conflicts, throttling, server errors and network errors.
+func configMapRetryable(err error) bool {
+	return retryableStatus(err, http.StatusConflict, http.StatusTooManyRequests)
+}
+
+// updateConfigMap sets the key of the ConfigMap at uri to data, retrying
+// failures with backoff. The ConfigMap must already exist.
+func updateConfigMap(ctx context.Context, uri string, data []byte) error {
+	err := updateConfigMapKey(ctx, uri, data)
+	if err != nil {
+		configMapErrors.WithLabelValues(uri).Inc()
+	}
+	return err
+}
+
+func updateConfigMapKey(ctx context.Context, uri string, data []byte) error {
+	namespace, name, key, err := parseConfigMapURL(uri)
+	if err != nil {
+		return err
+	}
+
+	patch, err := json.Marshal(map[string]map[string]string{"data": {key: string(data)}})
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal patch")
+	}
+	// The patch is a little larger than the ConfigMap's data, so this
+	// rejects ConfigMaps very close to the limit which the API would accept.
+	if len(patch) > configMapLimit {
+		return errors.Errorf("Targets for %v are %v bytes, larger than the %v byte ConfigMap limit", uri, len(data), configMapLimit)
+	}
+
+	baseURL, client, token, err := kubernetesClient()
+	if err != nil {
+		return err
+	}
+	patchURL := fmt.Sprintf("%s/api/v1/namespaces/%s/configmaps/%s", baseURL, url.PathEscape(namespace), url.PathEscape(name))
+
+	return retryWithBackoff(ctx, uri, configMapRetryable, func() error {
+		req, err := http.NewRequest("PATCH", patchURL, bytes.NewReader(patch))
+		if err != nil {
+			return errors.Wrapf(err, "Unable to update %v", uri)
+		}
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return errors.Wrapf(err, "Unable to update %v", uri)
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusNotFound:
+			return errors.Errorf("Unable to update %v, ConfigMap %v/%v does not exist", uri, namespace, name)
+		default:
+			return outputStatusError{uri: uri, status: resp.Status, code: resp.StatusCode}
+		}
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+// fakeConfigMaps is a Kubernetes API serving merge patches of ConfigMaps.
+type fakeConfigMaps struct {
+	sync.Mutex
+	data    map[string]map[string]string
+	patches int
+	// conflicts is how many patches fail with a conflict.
+	conflicts int
+}
+
+func (k *fakeConfigMaps) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.Lock()
+	defer k.Unlock()
+
+	if r.Method != "PATCH" || r.Header.Get("Content-Type") != "application/merge-patch+json" {
+		http.Error(w, "Unsupported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	k.patches++
+
+	data, ok := k.data[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if k.conflicts > 0 {
+		k.conflicts--
+		http.Error(w, "Conflict", http.StatusConflict)
+		return
+	}
+
+	var patch struct {
+		Data map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for key, value := range patch.Data {
+		data[key] = value
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data})
+}
+
+func TestWriteTargetsConfigMap(t *testing.T) {
+	api := &fakeConfigMaps{data: map[string]map[string]string{
+		"/api/v1/namespaces/monitoring/configmaps/gcesd": {"other.yaml": "- targets: []\n"},
+	}}
+	server := httptest.NewServer(api)
+	origClient, origBackoff := kubernetesClient, outputRetryBackoff
+	kubernetesClient = func() (string, *http.Client, string, error) {
+		return server.URL, server.Client(), "token", nil
+	}
+	outputRetryBackoff = time.Millisecond
+	defer func() {
+		server.Close()
+		kubernetesClient, outputRetryBackoff = origClient, origBackoff
+	}()
+
+	const uri = "configmap://monitoring/gcesd/targets.yaml"
+	targets := []DiscoveryTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}}
+	write := func(uri string, targets []DiscoveryTarget) error {
+		return WriteTargets(context.Background(), targets, uri, syncInfo{})
+	}
+	configMap := func() map[string]string {
+		return api.data["/api/v1/namespaces/monitoring/configmaps/gcesd"]
+	}
+
+	// Conflicts are retried, and other keys are left alone.
+	api.conflicts = 2
+	if err := write(uri, targets); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	var res []DiscoveryTarget
+	if err := yaml.Unmarshal([]byte(configMap()["targets.yaml"]), &res); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if targetsDifferent(res, targets) || configMap()["other.yaml"] == "" || api.patches != 3 {
+		t.Fatalf("Discrepancy in ConfigMap after %v patches\nResult: %v", api.patches, prettyPrint(configMap()))
+	}
+
+	// The format follows the key's extension.
+	if err := write("configmap://monitoring/gcesd/targets.json", targets); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := json.Unmarshal([]byte(configMap()["targets.json"]), &res); err != nil || targetsDifferent(res, targets) {
+		t.Fatalf("Discrepancy in ConfigMap\nResult: %v", prettyPrint(configMap()))
+	}
+
+	errorsBefore := counterValue(configMapErrors.WithLabelValues("configmap://monitoring/missing/targets.yaml"))
+	api.patches = 0
+	err := write("configmap://monitoring/missing/targets.yaml", targets)
+	if err == nil || !strings.Contains(err.Error(), "monitoring/missing does not exist") || api.patches != 1 {
+		t.Fatalf("Expected a single failed patch of the missing ConfigMap\nError: %v", err)
+	}
+	if got := counterValue(configMapErrors.WithLabelValues("configmap://monitoring/missing/targets.yaml")) - errorsBefore; got != 1 {
+		t.Fatalf("Expected 1 ConfigMap error, got %v", got)
+	}
+
+	// Targets too large for a ConfigMap are not sent.
+	large := []DiscoveryTarget{}
+	for i := 0; i < 10000; i++ {
+		large = append(large, DiscoveryTarget{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": strings.Repeat("x", 100) + string(rune('a'+i%26))}})
+	}
+	api.patches = 0
+	if err := write(uri, large); err == nil || !strings.Contains(err.Error(), "ConfigMap limit") || api.patches != 0 {
+		t.Fatalf("Expected an error for targets over the size limit\nError: %v", err)
+	}
+
+	for _, invalid := range []string{"configmap://monitoring/gcesd", "configmap://monitoring/gcesd/dir/targets.yaml", "configmap:///gcesd/targets.yaml"} {
+		if err := write(invalid, targets); err == nil || !strings.Contains(err.Error(), "Invalid ConfigMap URL") {
+			t.Fatalf("Expected an error for %v\nError: %v", invalid, err)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+)
+
+// gcsWriteScope is the OAuth scope needed to write GCS objects.
+const gcsWriteScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+var uploadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_gcs_upload_errors_total",
+	Help: "Number of failed uploads of targets to GCS, after retries, by output",
+}, []string{"output"})
+
+func init() {
+	prometheus.MustRegister(uploadErrors)
+}
+
+// gcsUploadBaseURL is the base URL of the GCS JSON upload API, it is
+// replaced in tests.
+var gcsUploadBaseURL = "https://storage.googleapis.com/upload/storage/v1"
+
+// gcsWriteClient returns the HTTP client used to upload targets to GCS,
+// using application default credentials as for the compute API. It is
+// replaced in tests.
+var gcsWriteClient = func(ctx context.Context) (*http.Client, error) {
+	return google.DefaultClient(ctx, gcsWriteScope)
+}
+
+// gcsRetryable reports whether a GCS request failing with err may succeed if
+// tried again: failed preconditions, as another writer won the race,
+// throttling, server errors and any error other than an HTTP error, such as
+// a network error.
+func gcsRetryable(err error) bool {
+	if _, ok := errors.Cause(err).(outputStatusError); !ok {
+		return true
+	}
+	return retryableStatus(err, http.StatusPreconditionFailed, http.StatusTooManyRequests)
+}
+
+// uploadGCSObject replaces the GCS object at uri with data, retrying
+// failures with backoff.
+func uploadGCSObject(ctx context.Context, uri string, data []byte, contentType string) error {
+	bucket, object, err := parseGCSURL(uri)
+	if err != nil {
+		return err
+	}
+
+	client, err := gcsWriteClient(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Unable to get client")
+	}
+
+	err = retryWithBackoff(ctx, uri, gcsRetryable, func() error {
+		return uploadGCSObjectOnce(ctx, client, uri, bucket, object, data, contentType)
+	})
+	if err != nil {
+		uploadErrors.WithLabelValues(uri).Inc()
+	}
+	return err
+}
+
+// uploadGCSObjectOnce uploads data over the current generation of the
+// object, so that if another writer replaces it first the upload fails
+// rather than interleaving with theirs.
+func uploadGCSObjectOnce(ctx context.Context, client *http.Client, uri, bucket, object string, data []byte, contentType string) error {
+	generation, err := gcsObjectGeneration(ctx, client, uri, bucket, object)
+	if err != nil {
+		return err
+	}
+
+	uploadURL := fmt.Sprintf("%s/b/%s/o?uploadType=media&name=%s&ifGenerationMatch=%d",
+		gcsUploadBaseURL, url.PathEscape(bucket), url.QueryEscape(object), generation)
+	req, err := http.NewRequest("POST", uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return errors.Wrapf(err, "Unable to upload %v", uri)
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "Unable to upload %v", uri)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return outputStatusError{uri: uri, status: resp.Status, code: resp.StatusCode}
+	}
+	return nil
+}
+
+// gcsObjectGeneration returns the generation of the object, or 0 if it
+// does not exist.
+func gcsObjectGeneration(ctx context.Context, client *http.Client, uri, bucket, object string) (int64, error) {
+	objectURL := fmt.Sprintf("%s/b/%s/o/%s?fields=generation", gcsBaseURL, url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequest("GET", objectURL, nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to fetch %v", uri)
+	}
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to fetch %v", uri)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return 0, nil
+	default:
+		return 0, outputStatusError{uri: uri, status: resp.Status, code: resp.StatusCode}
+	}
+
+	var attrs struct {
+		Generation string `json:"generation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&attrs); err != nil {
+		return 0, errors.Wrapf(err, "Unable to read the generation of %v", uri)
+	}
+	generation, err := strconv.ParseInt(attrs.Generation, 10, 64)
+	if err != nil {
+		return 0, errors.Wrapf(err, "Unable to read the generation of %v", uri)
+	}
+	return generation, nil
+}
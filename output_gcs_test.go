@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	"gopkg.in/yaml.v2"
+)
+
+// fakeGCSBucket is a single GCS object supporting generation preconditions.
+type fakeGCSBucket struct {
+	sync.Mutex
+	generation  int64
+	body        []byte
+	contentType string
+	uploads     int
+	// failures are the statuses returned by the next uploads.
+	failures []int
+	// races is how many uploads find another writer replaced the object
+	// between reading its generation and uploading.
+	races int
+}
+
+func (b *fakeGCSBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.Lock()
+	defer b.Unlock()
+
+	switch {
+	case r.Method == "GET" && r.URL.EscapedPath() == "/storage/b/bucket/o/sd%2Ftargets.yaml":
+		if b.generation == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"generation": "%d"}`, b.generation)
+	case r.Method == "POST" && r.URL.Path == "/upload/b/bucket/o":
+		b.uploads++
+		if r.URL.Query().Get("name") != "sd/targets.yaml" || r.URL.Query().Get("uploadType") != "media" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if len(b.failures) != 0 {
+			code := b.failures[0]
+			b.failures = b.failures[1:]
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+		if b.races > 0 {
+			b.races--
+			b.generation++
+		}
+		if r.URL.Query().Get("ifGenerationMatch") != strconv.FormatInt(b.generation, 10) {
+			http.Error(w, "Precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		b.body, _ = ioutil.ReadAll(r.Body)
+		b.contentType = r.Header.Get("Content-Type")
+		b.generation++
+		fmt.Fprintf(w, `{"generation": "%d"}`, b.generation)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestWriteTargetsGCS(t *testing.T) {
+	bucket := &fakeGCSBucket{}
+	server := httptest.NewServer(bucket)
+	origBase, origUpload, origClient, origBackoff := gcsBaseURL, gcsUploadBaseURL, gcsWriteClient, outputRetryBackoff
+	gcsBaseURL, gcsUploadBaseURL = server.URL+"/storage", server.URL+"/upload"
+	gcsWriteClient = func(ctx context.Context) (*http.Client, error) {
+		return server.Client(), nil
+	}
+	outputRetryBackoff = time.Millisecond
+	defer func() {
+		server.Close()
+		gcsBaseURL, gcsUploadBaseURL, gcsWriteClient, outputRetryBackoff = origBase, origUpload, origClient, origBackoff
+	}()
+
+	const uri = "gs://bucket/sd/targets.yaml"
+	targets := []DiscoveryTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}}
+	write := func(targets []DiscoveryTarget) error {
+		return WriteTargets(context.Background(), targets, uri, syncInfo{})
+	}
+	uploaded := func() []DiscoveryTarget {
+		var res []DiscoveryTarget
+		if err := yaml.Unmarshal(bucket.body, &res); err != nil {
+			t.Fatalf("Uploaded targets are not YAML\nError: %v", err)
+		}
+		return res
+	}
+
+	if err := write(targets); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if targetsDifferent(uploaded(), targets) || bucket.contentType != "application/x-yaml" || bucket.generation != 1 {
+		t.Fatalf("Discrepancy in upload %v of %s", bucket.generation, bucket.body)
+	}
+
+	// Server errors and another writer winning the race are retried.
+	targets = append(targets, DiscoveryTarget{Targets: []string{"10.0.0.2:80"}, Labels: map[string]string{"job": "web"}})
+	bucket.uploads, bucket.failures, bucket.races = 0, []int{http.StatusServiceUnavailable}, 1
+	if err := write(targets); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if targetsDifferent(uploaded(), targets) || bucket.uploads != 3 {
+		t.Fatalf("Expected the upload to succeed on the third attempt, after %v\nResult: %s", bucket.uploads, bucket.body)
+	}
+
+	// Client errors are not retried.
+	errorsBefore := counterValue(uploadErrors.WithLabelValues(uri))
+	bucket.uploads, bucket.failures = 0, []int{http.StatusForbidden}
+	if err := write(targets[:1]); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Expected a permission error\nError: %v", err)
+	}
+	if bucket.uploads != 1 {
+		t.Fatalf("Expected a single upload attempt, got %v", bucket.uploads)
+	}
+
+	// Persistent server errors give up after outputAttempts.
+	bucket.uploads, bucket.failures = 0, []int{500, 500, 500, 500, 500}
+	if err := write(targets[:1]); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if bucket.uploads != outputAttempts {
+		t.Fatalf("Expected %v upload attempts, got %v", outputAttempts, bucket.uploads)
+	}
+	if got := counterValue(uploadErrors.WithLabelValues(uri)) - errorsBefore; got != 2 {
+		t.Fatalf("Expected 2 upload errors, got %v", got)
+	}
+	if targetsDifferent(uploaded(), targets) {
+		t.Fatalf("Expected failed uploads to leave the object unchanged\nResult: %s", bucket.body)
+	}
+
+	// Unchanged targets are not uploaded again.
+	bucket.uploads, bucket.failures = 0, nil
+	writer := newTargetWriter(uri, false)
+	for i := 0; i < 2; i++ {
+		if err := writer.Write(context.Background(), map[string][]DiscoveryTarget{uri: targets}, false, syncInfo{}); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	if bucket.uploads != 1 {
+		t.Fatalf("Expected unchanged targets not to be uploaded, got %v uploads", bucket.uploads)
+	}
+}
+
+func TestGCSRetryable(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		err      error
+		expected bool
+	}{
+		{err: errors.New("unexpected EOF"), expected: true},
+		{err: errors.Wrap(errors.New("connection reset by peer"), "Unable to upload"), expected: true},
+		{err: outputStatusError{code: http.StatusPreconditionFailed}, expected: true},
+		{err: outputStatusError{code: http.StatusTooManyRequests}, expected: true},
+		{err: outputStatusError{code: http.StatusServiceUnavailable}, expected: true},
+		{err: outputStatusError{code: http.StatusForbidden}, expected: false},
+		{err: outputStatusError{code: http.StatusConflict}, expected: false},
+	} {
+		if got := gcsRetryable(tc.err); got != tc.expected {
+			t.Errorf("Expected retryable %v for %v, got %v", tc.expected, tc.err, got)
+		}
+	}
+}
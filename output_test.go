@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+	"gopkg.in/yaml.v2"
+)
+
+func TestTargetWriterOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	defaultFile := filepath.Join(dir, "targets.yaml")
+	webFile := filepath.Join(dir, "web.yaml")
+	dbFile := filepath.Join(dir, "db.yaml")
+
+	instances := map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+			testInstance("db-1", "us-central1-b", "10.0.0.2", "db"),
+			testInstance("cache-1", "us-central1-b", "10.0.0.3", "cache"),
+		},
+	}
+	listInstances = fakeListInstances(map[string]int{}, instances)
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}, Output: webFile},
+		{Job: "db", Tags: []string{"db"}, Project: "test-project", Ports: []int{5432}, Output: dbFile},
+		{Job: "cache", Tags: []string{"cache"}, Project: "test-project", Ports: []int{6379}},
+	}
+	scheduler := newDiscoveryScheduler(configs, time.Minute)
+	writer := newTargetWriter(defaultFile, false)
+
+	writes := func() map[string]float64 {
+		res := map[string]float64{}
+		for _, f := range []string{defaultFile, webFile, dbFile} {
+			res[f] = counterValue(resultWrite.WithLabelValues(f))
+		}
+		return res
+	}
+	sync := func(now time.Time) map[string]float64 {
+		before := writes()
+		if _, err := scheduler.Sync(context.Background(), now, true); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if err := writer.Write(context.Background(), scheduler.TargetsByFile(defaultFile), false, syncInfo{time: now}); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		after := writes()
+		for f := range after {
+			after[f] -= before[f]
+		}
+		return after
+	}
+	readJobs := func(file string) map[string][]string {
+		d, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		var targets []DiscoveryTarget
+		if err := yaml.Unmarshal(d, &targets); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		return targetsByJob(targets)
+	}
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := sync(start); !reflect.DeepEqual(got, map[string]float64{defaultFile: 1, webFile: 1, dbFile: 1}) {
+		t.Fatalf("Expected every file to be written\nResult: %v", got)
+	}
+	expected := map[string]map[string][]string{
+		defaultFile: {"cache": {"10.0.0.3:6379"}},
+		webFile:     {"web": {"10.0.0.1:80"}},
+		dbFile:      {"db": {"10.0.0.2:5432"}},
+	}
+	for f, e := range expected {
+		if got := readJobs(f); !reflect.DeepEqual(got, e) {
+			t.Fatalf("Discrepancy in %v\nResult: %v", f, prettyPrint(got))
+		}
+	}
+
+	// Only the web file changes.
+	instances["test-project"] = append(instances["test-project"], testInstance("web-2", "us-central1-b", "10.0.0.4", "web"))
+	if got := sync(start.Add(time.Minute)); !reflect.DeepEqual(got, map[string]float64{defaultFile: 0, webFile: 1, dbFile: 0}) {
+		t.Fatalf("Expected only the web file to be written\nResult: %v", got)
+	}
+	if got := readJobs(webFile); !reflect.DeepEqual(got, map[string][]string{"web": {"10.0.0.1:80", "10.0.0.4:80"}}) {
+		t.Fatalf("Discrepancy in %v\nResult: %v", webFile, prettyPrint(got))
+	}
+
+	// Nothing changes.
+	if got := sync(start.Add(2 * time.Minute)); !reflect.DeepEqual(got, map[string]float64{defaultFile: 0, webFile: 0, dbFile: 0}) {
+		t.Fatalf("Expected no files to be written\nResult: %v", got)
+	}
+
+	// Removing the db job empties its file, and rewrites the default file as
+	// the cache entry moves up in the config and so changes its index.
+	scheduler.SetConfigs([]SearchConfig{configs[0], configs[2]})
+	if got := sync(start.Add(3 * time.Minute)); !reflect.DeepEqual(got, map[string]float64{defaultFile: 1, webFile: 0, dbFile: 1}) {
+		t.Fatalf("Expected the db file to be emptied\nResult: %v", got)
+	}
+	if got := readJobs(dbFile); len(got) != 0 {
+		t.Fatalf("Expected %v to be empty\nResult: %v", dbFile, prettyPrint(got))
+	}
+	if got := sync(start.Add(4 * time.Minute)); !reflect.DeepEqual(got, map[string]float64{defaultFile: 0, webFile: 0, dbFile: 0}) {
+		t.Fatalf("Expected the emptied db file not to be rewritten\nResult: %v", got)
+	}
+
+	// Removing the web job removes its file with removeStale.
+	writer.removeStale = true
+	scheduler.SetConfigs([]SearchConfig{configs[2]})
+	sync(start.Add(5 * time.Minute))
+	if _, err := os.Stat(webFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected %v to be removed\nError: %v", webFile, err)
+	}
+	if _, err := os.Stat(defaultFile); err != nil {
+		t.Fatalf("Expected %v to be kept\nError: %v", defaultFile, err)
+	}
+}
+
+func TestTargetWriterDuplicates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+			testInstance("web-2", "us-central1-b", "10.0.0.2", "web", "canary"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	// The canary is found by both web entries, with identical labels other
+	// than those of the entry, and by the canary job, with a different job
+	// label.
+	configs := []SearchConfig{
+		{Job: "web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}},
+		{Job: "web", Tags: []string{"web", "canary"}, Project: "test-project", Ports: []int{80}},
+		{Job: "canary", Tags: []string{"canary"}, Project: "test-project", Ports: []int{80}},
+	}
+	out := filepath.Join(dir, "targets.yaml")
+	scheduler := newDiscoveryScheduler(configs, time.Minute)
+	writer := newTargetWriter(out, false)
+
+	before := counterValue(duplicateTargets.WithLabelValues(out))
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := scheduler.Sync(context.Background(), now, true); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := writer.Write(context.Background(), scheduler.TargetsByFile(out), false, syncInfo{time: now}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	d, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	var targets []DiscoveryTarget
+	if err := yaml.Unmarshal(d, &targets); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	addresses := []string{}
+	for _, target := range targets {
+		addresses = append(addresses, target.Labels["job"]+" "+strings.Join(target.Targets, ","))
+	}
+	expected := []string{"web 10.0.0.1:80", "web 10.0.0.2:80", "canary 10.0.0.2:80"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %s", d)
+	}
+
+	if got := counterValue(duplicateTargets.WithLabelValues(out)) - before; got != 1 {
+		t.Fatalf("Expected 1 duplicate target, got %v", got)
+	}
+	if got := gaugeValue(targetCount.WithLabelValues("web")); got != 2 {
+		t.Fatalf("Expected the duplicate to be counted once, got %v", got)
+	}
+}
+
+func TestTargetWriterStdout(t *testing.T) {
+	out := &bytes.Buffer{}
+	stdout = out
+	defer func() { stdout = os.Stdout }()
+
+	targets := []DiscoveryTarget{
+		{Targets: []string{"10.0.0.2:80"}, Labels: map[string]string{"job": "web"}},
+		{Targets: []string{"10.0.0.1:9100"}, Labels: map[string]string{"job": "node"}},
+	}
+	printed := func() []DiscoveryTarget {
+		defer out.Reset()
+		if out.Len() == 0 {
+			return nil
+		}
+		var res []DiscoveryTarget
+		if err := yaml.Unmarshal(out.Bytes(), &res); err != nil {
+			t.Fatalf("Output is not YAML\nError: %v\nOutput: %s", err, out)
+		}
+		return res
+	}
+
+	writer := newTargetWriter(stdoutOutput, false)
+	for i := 0; i < 2; i++ {
+		if err := writer.Write(context.Background(), map[string][]DiscoveryTarget{stdoutOutput: targets}, false, syncInfo{}); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		res := printed()
+		if targetsDifferent(res, targets) {
+			t.Fatalf("Expected targets to be printed on every sync\nResult: %v", prettyPrint(res))
+		}
+		if res[0].Labels["job"] != "node" {
+			t.Fatalf("Expected printed targets to be sorted\nResult: %v", prettyPrint(res))
+		}
+	}
+	if _, err := os.Stat(manifestFile(stdoutOutput)); !os.IsNotExist(err) {
+		t.Fatalf("Expected no manifest to be written for stdout")
+	}
+
+	writer = newTargetWriter(stdoutOutput, false)
+	writer.stdoutChangesOnly = true
+	for i, expected := range []bool{true, false} {
+		if err := writer.Write(context.Background(), map[string][]DiscoveryTarget{stdoutOutput: targets}, false, syncInfo{}); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if res := printed(); (res != nil) != expected {
+			t.Fatalf("Expected targets printed on sync %v to be %v\nResult: %v", i, expected, prettyPrint(res))
+		}
+	}
+}
+
+func TestOutputList(t *testing.T) {
+	t.Parallel()
+
+	var l outputList
+	for _, v := range []string{"a.yaml", "b.yaml, c.json", ""} {
+		if err := l.Set(v); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	if !reflect.DeepEqual([]string(l), []string{"a.yaml", "b.yaml", "c.json"}) || l.first() != "a.yaml" {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(l))
+	}
+	if (outputList{}).first() != "" {
+		t.Fatalf("Expected no first output of an empty list")
+	}
+}
+
+func TestTargetWriterMirrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	primary := filepath.Join(dir, "a", "targets.yaml")
+	mirror := filepath.Join(dir, "b", "targets.yaml")
+	if err := os.Mkdir(filepath.Dir(primary), 0755); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	writer := newTargetWriter(primary, false)
+	writer.mirrors = []string{mirror}
+	targets := map[string][]DiscoveryTarget{
+		primary: {{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}},
+	}
+
+	// The mirror's directory is missing, the primary is still written.
+	failuresBefore := counterValue(resultWriteFailures.WithLabelValues(mirror))
+	err = writer.Write(context.Background(), targets, false, syncInfo{})
+	if err == nil || !strings.Contains(err.Error(), mirror) || strings.Contains(err.Error(), primary+":") {
+		t.Fatalf("Expected an error naming only the mirror\nError: %v", err)
+	}
+	if got := counterValue(resultWriteFailures.WithLabelValues(mirror)) - failuresBefore; got != 1 {
+		t.Fatalf("Expected 1 write failure for the mirror, got %v", got)
+	}
+	primaryContent, err := ioutil.ReadFile(primary)
+	if err != nil {
+		t.Fatalf("Expected the primary to be written\nError: %v", err)
+	}
+
+	// Once the mirror is writable, the unchanged targets are written to it
+	// as the last write failed.
+	if err := os.Mkdir(filepath.Dir(mirror), 0755); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := writer.Write(context.Background(), targets, false, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	mirrorContent, err := ioutil.ReadFile(mirror)
+	if err != nil {
+		t.Fatalf("Expected the mirror to be written\nError: %v", err)
+	}
+	if !bytes.Equal(primaryContent, mirrorContent) {
+		t.Fatalf("Expected identical content\nPrimary: %s\nMirror: %s", primaryContent, mirrorContent)
+	}
+
+	writesBefore := counterValue(resultWrite.WithLabelValues(mirror))
+	if err := writer.Write(context.Background(), targets, false, syncInfo{}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if got := counterValue(resultWrite.WithLabelValues(mirror)) - writesBefore; got != 0 {
+		t.Fatalf("Expected unchanged targets not to be written, got %v writes", got)
+	}
+}
+
+func TestShrinkPercent(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		old, new int
+		expected float64
+	}{
+		{old: 0, new: 0, expected: 0},
+		{old: 0, new: 10, expected: 0},
+		{old: 10, new: 10, expected: 0},
+		{old: 10, new: 20, expected: 0},
+		{old: 10, new: 5, expected: 50},
+		{old: 3, new: 2, expected: 100.0 / 3},
+		{old: 10, new: 0, expected: 100},
+	}
+	for _, c := range cases {
+		if got := shrinkPercent(c.old, c.new); got != c.expected {
+			t.Fatalf("Expected shrink from %v to %v of %v, got %v", c.old, c.new, c.expected, got)
+		}
+	}
+}
+
+func TestTargetWriterSuppress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "targets.yaml")
+	writer := newTargetWriter(out, false)
+	writer.maxShrinkPercent = 50
+
+	targetsOf := func(job string, n int) []DiscoveryTarget {
+		targets := []DiscoveryTarget{}
+		for i := 0; i < n; i++ {
+			targets = append(targets, DiscoveryTarget{Targets: []string{fmt.Sprintf("10.0.0.%v:80", i+1)}, Labels: map[string]string{"job": job, "i": strconv.Itoa(i)}})
+		}
+		return targets
+	}
+	write := func(targets []DiscoveryTarget, force bool) int {
+		if err := writer.Write(context.Background(), map[string][]DiscoveryTarget{out: targets}, force, syncInfo{}); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		d, err := ioutil.ReadFile(out)
+		if err != nil {
+			return -1
+		}
+		var written []DiscoveryTarget
+		if err := yaml.Unmarshal(d, &written); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		return countTargets(written)
+	}
+	suppressed := func(reason string) float64 {
+		return counterValue(writeSuppressed.WithLabelValues(out, reason))
+	}
+
+	// The first write has no baseline to shrink from.
+	if n := write(targetsOf("web", 10), false); n != 10 {
+		t.Fatalf("Expected the first write, got %v targets", n)
+	}
+	if n := write(targetsOf("web", 5), false); n != 5 {
+		t.Fatalf("Expected shrinking by the threshold to be written, got %v targets", n)
+	}
+
+	before := suppressed("shrink")
+	if n := write(targetsOf("web", 2), false); n != 5 {
+		t.Fatalf("Expected shrinking past the threshold to be suppressed, got %v targets", n)
+	}
+	if got := suppressed("shrink") - before; got != 1 {
+		t.Fatalf("Expected 1 suppressed write, got %v", got)
+	}
+	if n := write(targetsOf("web", 2), true); n != 2 {
+		t.Fatalf("Expected a forced write, got %v targets", n)
+	}
+
+	writer.minTargets = map[string]map[string]int{out: {"web": 2, "db": 1}}
+	before = suppressed("min_targets")
+	if n := write(targetsOf("web", 2), false); n != 2 {
+		t.Fatalf("Unexpected targets %v", n)
+	}
+	if n := write(append(targetsOf("web", 2), targetsOf("db", 1)...), true); n != 3 {
+		t.Fatalf("Unexpected targets %v", n)
+	}
+	if n := write(targetsOf("web", 3), false); n != 3 {
+		t.Fatalf("Expected a job below min_targets to be suppressed, got %v targets", n)
+	}
+	if got := suppressed("min_targets") - before; got != 1 {
+		t.Fatalf("Expected 1 suppressed write, got %v", got)
+	}
+}
+
+func TestTargetWriterRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := filepath.Join(dir, "targets.yaml")
+	writer := newTargetWriter(out, false)
+	writer.refreshInterval = time.Minute
+
+	web := []DiscoveryTarget{{Targets: []string{"10.0.0.1:80"}, Labels: map[string]string{"job": "web"}}}
+	both := append([]DiscoveryTarget{{Targets: []string{"10.0.0.2:5432"}, Labels: map[string]string{"job": "db"}}}, web...)
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	writes, refreshes := resultWrite.WithLabelValues(out), resultRefresh.WithLabelValues(out)
+	steps := []struct {
+		offset    time.Duration
+		targets   []DiscoveryTarget
+		force     bool
+		pending   bool
+		writes    float64
+		refreshes float64
+	}{
+		{ // The first write is a change
+			offset: 0, targets: web, pending: false, writes: 1,
+		},
+		{ // Unchanged and not due for a refresh
+			offset: 30 * time.Second, targets: web, pending: false, writes: 1,
+		},
+		{ // Unchanged and due for a refresh
+			offset: time.Minute, targets: web, pending: true, writes: 1, refreshes: 1,
+		},
+		{ // The refresh kept the baseline, so changes are still written
+			offset: time.Minute + 10*time.Second, targets: both, pending: false, writes: 2, refreshes: 1,
+		},
+		{ // A forced write counts as a write and restarts the interval
+			offset: 2*time.Minute + 5*time.Second, targets: both, force: true, pending: false, writes: 3, refreshes: 1,
+		},
+		{
+			offset: 3 * time.Minute, targets: both, pending: false, writes: 3, refreshes: 1,
+		},
+		{
+			offset: 3*time.Minute + 5*time.Second, targets: both, pending: true, writes: 3, refreshes: 2,
+		},
+	}
+
+	baseWrites, baseRefreshes := counterValue(writes), counterValue(refreshes)
+	for i, s := range steps {
+		now := start.Add(s.offset)
+		if pending := writer.Pending(now); pending != s.pending {
+			t.Fatalf("Unexpected pending in step %v: %v", i, pending)
+		}
+		if err := writer.Write(context.Background(), map[string][]DiscoveryTarget{out: s.targets}, s.force, syncInfo{time: now}); err != nil {
+			t.Fatalf("Unexpected error in step %v\nError: %v", i, err)
+		}
+		if got := counterValue(writes) - baseWrites; got != s.writes {
+			t.Fatalf("Expected %v writes in step %v, got %v", s.writes, i, got)
+		}
+		if got := counterValue(refreshes) - baseRefreshes; got != s.refreshes {
+			t.Fatalf("Expected %v refreshes in step %v, got %v", s.refreshes, i, got)
+		}
+
+		d, err := ioutil.ReadFile(out)
+		if err != nil {
+			t.Fatalf("Unexpected error in step %v\nError: %v", i, err)
+		}
+		var written []DiscoveryTarget
+		if err := yaml.Unmarshal(d, &written); err != nil {
+			t.Fatalf("Unexpected error in step %v\nError: %v", i, err)
+		}
+		if targetsDifferent(written, s.targets) {
+			t.Fatalf("Unexpected targets in step %v\nResult: %s", i, d)
+		}
+	}
+
+	// Refreshes are subject to min_targets like any other write.
+	writer.minTargets = map[string]map[string]int{out: {"web": 5}}
+	before := counterValue(writeSuppressed.WithLabelValues(out, "min_targets"))
+	now := start.Add(5 * time.Minute)
+	if err := writer.Write(context.Background(), map[string][]DiscoveryTarget{out: steps[len(steps)-1].targets}, false, syncInfo{time: now}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if got := counterValue(refreshes) - baseRefreshes; got != 2 {
+		t.Fatalf("Expected the refresh to be suppressed, got %v refreshes", got)
+	}
+	if got := counterValue(writeSuppressed.WithLabelValues(out, "min_targets")) - before; got != 1 {
+		t.Fatalf("Expected 1 suppressed write, got %v", got)
+	}
+
+	// A file never written is not refreshed, so min_targets stops it being
+	// created empty.
+	other := filepath.Join(dir, "other.yaml")
+	writer.minTargets = map[string]map[string]int{other: {"web": 5}}
+	if err := writer.Write(context.Background(), map[string][]DiscoveryTarget{out: steps[len(steps)-1].targets, other: {}}, false, syncInfo{time: now}); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if _, err := os.Stat(other); !os.IsNotExist(err) {
+		t.Fatalf("Expected %v not to be written\nError: %v", other, err)
+	}
+	if writer.refreshDue(other, now.Add(time.Hour)) {
+		t.Fatalf("Expected %v not to be due a refresh", other)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// portNameLabel holds the name given to a port in a structured ports entry.
+const portNameLabel = "__meta_gce_port_name"
+
+// PortSpec is a structured ports entry, naming a port and giving labels for
+// its targets, such as {port: 8080, name: app, labels: {component: app}}.
+type PortSpec struct {
+	Port   int
+	Name   string
+	Labels map[string]string
+}
+
+// parsePortSpec parses a structured ports entry.
+func parsePortSpec(m map[interface{}]interface{}) (PortSpec, error) {
+	spec := PortSpec{}
+	for k, v := range m {
+		key := fmt.Sprint(k)
+		switch key {
+		case "port":
+			port, ok := v.(int)
+			if !ok {
+				return PortSpec{}, errors.Errorf("Invalid port %v in ports entry, must be a number", v)
+			}
+			if port < 1 || port > 65535 {
+				return PortSpec{}, errors.Errorf("Invalid port %v in ports entry, out of range", port)
+			}
+			spec.Port = port
+		case "name":
+			name, ok := v.(string)
+			if !ok {
+				return PortSpec{}, errors.Errorf("Invalid name %v in ports entry, must be a string", v)
+			}
+			spec.Name = name
+		case "labels":
+			labels, ok := v.(map[interface{}]interface{})
+			if !ok {
+				return PortSpec{}, errors.Errorf("Invalid labels %v in ports entry, must be a map", v)
+			}
+			spec.Labels = map[string]string{}
+			for lk, lv := range labels {
+				spec.Labels[fmt.Sprint(lk)] = fmt.Sprint(lv)
+			}
+		default:
+			return PortSpec{}, errors.Errorf("Unknown key %q in ports entry", key)
+		}
+	}
+	if spec.Port == 0 {
+		return PortSpec{}, errors.New("No port in ports entry")
+	}
+	return spec, nil
+}
+
+// UnmarshalYAML reads a SearchConfig. Its ports are read here rather than
+// through the Ports field, so that each entry is parsed once into both Ports
+// and the structured entries among them.
+func (c *SearchConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SearchConfig
+	var raw struct {
+		plain `yaml:",inline"`
+		Ports []interface{}          `yaml:"ports"`
+		XXX   map[string]interface{} `yaml:",inline"`
+	}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	ports, specs, err := parsePortEntries(raw.Ports)
+	if err != nil {
+		return err
+	}
+	*c = SearchConfig(raw.plain)
+	if raw.Ports != nil {
+		c.Ports = ports
+	}
+	c.portSpecs = specs
+	c.XXX = raw.XXX
+	return nil
+}
+
+// MarshalYAML writes a SearchConfig with its ports, as UnmarshalYAML reads
+// them, so that configs differing only in their ports marshal differently.
+func (c SearchConfig) MarshalYAML() (interface{}, error) {
+	type plain SearchConfig
+	ports := []interface{}{}
+	for _, p := range c.Ports {
+		if spec, ok := portSpec(c, p); ok {
+			ports = append(ports, map[string]interface{}{"port": spec.Port, "name": spec.Name, "labels": spec.Labels})
+			continue
+		}
+		ports = append(ports, p)
+	}
+	return struct {
+		plain `yaml:",inline"`
+		Ports []interface{} `yaml:"ports"`
+	}{plain(c), ports}, nil
+}
+
+// portSpec returns the structured ports entry of conf for port, if any.
+func portSpec(conf SearchConfig, port int) (PortSpec, bool) {
+	for _, s := range conf.portSpecs {
+		if s.Port == port {
+			return s, true
+		}
+	}
+	return PortSpec{}, false
+}
+
+// validatePorts checks that no port of conf is listed twice, and the labels
+// of its structured entries.
+func validatePorts(conf SearchConfig) []error {
+	errs := []error{}
+	seen := map[int]bool{}
+	for _, p := range conf.Ports {
+		if seen[p] {
+			errs = append(errs, errors.Errorf("Port %v is listed more than once", p))
+		}
+		seen[p] = true
+	}
+	for _, s := range conf.portSpecs {
+		for k := range s.Labels {
+			if !labelNamePattern.MatchString(k) {
+				errs = append(errs, errors.Errorf("Invalid label name %q for port %v", k, s.Port))
+			} else if reservedLabelName(k) {
+				errs = append(errs, errors.Errorf("Label %q of port %v conflicts with a built in label", k, s.Port))
+			}
+		}
+	}
+	return errs
+}
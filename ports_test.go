@@ -0,0 +1,164 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestPortListUnmarshalEntries(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input         string
+		expected      []int
+		expectedSpecs []PortSpec
+		expectedError bool
+	}{
+		{
+			input:    "ports: [9100, \"7070-7071\"]",
+			expected: []int{9100, 7070, 7071},
+		},
+		{
+			input:    "ports: [9100, {port: 8080, name: http, labels: {component: app}}]",
+			expected: []int{9100, 8080},
+			expectedSpecs: []PortSpec{
+				{Port: 8080, Name: "http", Labels: map[string]string{"component": "app"}},
+			},
+		},
+		{input: "ports: [{name: http}]", expectedError: true},
+		{input: "ports: [{port: http}]", expectedError: true},
+		{input: "ports: [{port: 8080, scheme: https}]", expectedError: true},
+		{input: "ports: [{port: 8080, labels: [a]}]", expectedError: true},
+		{input: "ports: [{port: 70000}]", expectedError: true},
+		{input: "ports: [{port: 0, name: http}]", expectedError: true},
+	}
+
+	for _, tt := range tests {
+		var conf SearchConfig
+		err := yaml.Unmarshal([]byte(tt.input), &conf)
+		if tt.expectedError {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", tt.input, conf.Ports)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.input, err)
+			continue
+		}
+		if !reflect.DeepEqual([]int(conf.Ports), tt.expected) {
+			t.Errorf("%q: expected ports %v, got %v", tt.input, tt.expected, conf.Ports)
+		}
+		if !reflect.DeepEqual(conf.portSpecs, tt.expectedSpecs) {
+			t.Errorf("%q: expected port entries %v, got %v", tt.input, tt.expectedSpecs, conf.portSpecs)
+		}
+	}
+}
+
+func TestInstanceToTargetsPortEntries(t *testing.T) {
+	t.Parallel()
+
+	config := SearchConfig{
+		Job:     "app",
+		Project: "test-project",
+		Ports:   []int{9100, 8080},
+		portSpecs: []PortSpec{
+			{Port: 8080, Name: "http", Labels: map[string]string{"component": "app"}},
+		},
+	}
+	targets, err := InstanceToTargets(testInstance("app-1", "us-central1-b", "10.0.0.1", "app"), config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("Expected 2 targets, got %v", prettyPrint(targets))
+	}
+
+	for _, target := range targets {
+		switch target.Targets[0] {
+		case "10.0.0.1:9100":
+			if _, ok := target.Labels[portNameLabel]; ok {
+				t.Errorf("Unexpected port name on %v", prettyPrint(target))
+			}
+			if _, ok := target.Labels["component"]; ok {
+				t.Errorf("Unexpected port label on %v", prettyPrint(target))
+			}
+		case "10.0.0.1:8080":
+			if target.Labels[portNameLabel] != "http" || target.Labels["component"] != "app" {
+				t.Errorf("Missing port name or labels on %v", prettyPrint(target))
+			}
+		default:
+			t.Errorf("Unexpected target %v", prettyPrint(target))
+		}
+	}
+}
+
+func TestValidatePorts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		config   SearchConfig
+		expected int
+	}{
+		{config: SearchConfig{Ports: []int{8080, 9100}}, expected: 0},
+		{config: SearchConfig{Ports: []int{8080, 8080}}, expected: 1},
+		{
+			config: SearchConfig{
+				Ports:     []int{8080},
+				portSpecs: []PortSpec{{Port: 8080, Labels: map[string]string{"job": "x", "bad-name": "y"}}},
+			},
+			expected: 2,
+		},
+		{
+			config: SearchConfig{
+				Ports:     []int{8080},
+				portSpecs: []PortSpec{{Port: 8080, Labels: map[string]string{"__scheme__": "https", "__meta_gce_instance_zone": "x", "component": "app"}}},
+			},
+			expected: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		if errs := validatePorts(tt.config); len(errs) != tt.expected {
+			t.Errorf("Expected %d errors for %v, got %v", tt.expected, prettyPrint(tt.config), errs)
+		}
+	}
+}
+
+func TestSearchConfigMarshalPorts(t *testing.T) {
+	t.Parallel()
+
+	var conf SearchConfig
+	input := "job: app\nports: [9100, \"7070-7071\", {port: 8080, name: http, labels: {component: app}}]\nunknown: true\n"
+	if err := yaml.Unmarshal([]byte(input), &conf); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(mapKeys(conf.XXX), []string{"unknown"}) {
+		t.Fatalf("Expected unknown keys to be kept, got %v", conf.XXX)
+	}
+
+	d, err := yaml.Marshal(conf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var res SearchConfig
+	if err := yaml.Unmarshal(d, &res); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(res.Ports, conf.Ports) || !reflect.DeepEqual(res.portSpecs, conf.portSpecs) {
+		t.Fatalf("Discrepancy in ports after marshalling\nResult: %s", d)
+	}
+
+	// Configs differing only in their port entries marshal differently.
+	other := conf
+	other.portSpecs = nil
+	o, err := yaml.Marshal(other)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(o) == string(d) {
+		t.Fatalf("Expected the port entries to be marshalled\nResult: %s", d)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"sync"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// listKey identifies an instance listing. Instances are listed once per
+// project, API filter and credentials, as different credentials may not see
+// the same instances.
+type listKey struct{ project, filter, credentialsFile string }
+
+// listProjectInstances lists the instances of each of keys, running up to
+// -discovery.concurrency listings at once. Listings not started when ctx is
+// done fail with its error.
+func listProjectInstances(ctx context.Context, keys []listKey) (map[listKey][]*compute.Instance, map[listKey]error) {
+	concurrency := *listConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var (
+		mu        sync.Mutex
+		wg        sync.WaitGroup
+		instances = map[listKey][]*compute.Instance{}
+		errs      = map[listKey]error{}
+		sem       = make(chan struct{}, concurrency)
+	)
+	for _, key := range keys {
+		if ctx.Err() == nil {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			mu.Lock()
+			errs[key] = err
+			mu.Unlock()
+			continue
+		}
+
+		wg.Add(1)
+		go func(key listKey) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			res, err := listSharedInstances(ctx, key)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[key] = err
+				return
+			}
+			instances[key] = res
+		}(key)
+	}
+	wg.Wait()
+
+	return instances, errs
+}
+
+// listGroup shares each instance listing between the discoveries which run
+// it concurrently, such as a forced sync overlapping a periodic one.
+var listGroup singleflight.Group
+
+// listSharedInstances lists the instances of key, sharing one listing with
+// any concurrent caller listing the same key. The listing is not cancelled
+// with the ctx of the caller which started it, as other callers may still be
+// waiting for it, but times out after -discovery.timeout; each caller stops
+// waiting when its own ctx is done. The instances returned may be shared and
+// must not be modified.
+func listSharedInstances(ctx context.Context, key listKey) ([]*compute.Instance, error) {
+	// The listing may outlive this call, so it must not read listInstances
+	// or the timeout after it returns.
+	list, timeout := listInstances, *discoveryTimeout
+	ch := listGroup.DoChan(key.project+"\x00"+key.filter+"\x00"+key.credentialsFile, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return list(ctx, key.project, key.filter, key.credentialsFile)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Err != nil {
+			return nil, res.Err
+		}
+		if res.Shared {
+			log.V(2).Infof("Shared the listing of %v with a concurrent discovery", key.project)
+		}
+		return res.Val.([]*compute.Instance), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// slowListInstances returns a listInstances taking latency per project, and
+// failing for the projects in broken. It records the most listings running
+// at once in peak.
+func slowListInstances(latency time.Duration, broken map[string]bool, peak *int) func(context.Context, string, string, string) ([]*compute.Instance, error) {
+	var mu sync.Mutex
+	running := 0
+	return func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		mu.Lock()
+		running++
+		if running > *peak {
+			*peak = running
+		}
+		mu.Unlock()
+		defer func() {
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+
+		select {
+		case <-time.After(latency):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if broken[project] {
+			return nil, errors.New("permission denied")
+		}
+		return []*compute.Instance{
+			testInstance(project+"-1", "us-central1-b", "10.0.0.1", "node"),
+		}, nil
+	}
+}
+
+func TestDiscoverTargetsConcurrentProjects(t *testing.T) {
+	projects := []string{}
+	for i := 0; i < 8; i++ {
+		projects = append(projects, fmt.Sprintf("project-%d", i))
+	}
+	configs := []SearchConfig{{Job: "node", Tags: []string{"node"}, Projects: projects, Ports: []int{9100}}}
+
+	peak := 0
+	latency := 50 * time.Millisecond
+	listInstances = slowListInstances(latency, nil, &peak)
+	concurrency := *listConcurrency
+	*listConcurrency = 4
+	defer func() {
+		listInstances = listAllInstances
+		*listConcurrency = concurrency
+	}()
+
+	start := time.Now()
+	targets, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed >= time.Duration(len(projects))*latency {
+		t.Fatalf("Expected projects to be listed concurrently, took %v", elapsed)
+	}
+	if peak != 4 {
+		t.Fatalf("Expected 4 listings at once, got %v", peak)
+	}
+
+	// Targets are in the order of the projects, however long each took.
+	got := []string{}
+	for _, target := range targets {
+		got = append(got, target.Labels["__meta_gce_instance_project"])
+	}
+	if !reflect.DeepEqual(got, projects) {
+		t.Fatalf("Discrepancy in result\nResult: %v", got)
+	}
+}
+
+func TestDiscoverTargetsConcurrentProjectErrors(t *testing.T) {
+	peak := 0
+	listInstances = slowListInstances(time.Millisecond, map[string]bool{"broken-a": true, "broken-b": true}, &peak)
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "node", Tags: []string{"node"}, Projects: []string{"broken-a", "working", "broken-b"}, Ports: []int{9100}},
+		{Job: "exporter", Tags: []string{"node"}, Projects: []string{"broken-a"}, Ports: []int{9101}},
+	}
+	_, err := DiscoverTargets(context.Background(), configs)
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	expected := "Failed to list instances in broken-a: permission denied; Failed to list instances in broken-b: permission denied"
+	if err.Error() != expected {
+		t.Fatalf("Expected every broken project to be named once\nError: %v", err)
+	}
+}
+
+func TestListProjectInstancesCancelled(t *testing.T) {
+	peak := 0
+	listInstances = slowListInstances(time.Hour, nil, &peak)
+	concurrency, timeout := *listConcurrency, *discoveryTimeout
+	*listConcurrency = 1
+	// The listing started outlives ctx until -discovery.timeout.
+	*discoveryTimeout = 50 * time.Millisecond
+	defer func() {
+		listInstances = listAllInstances
+		*listConcurrency, *discoveryTimeout = concurrency, timeout
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	keys := []listKey{{project: "a"}, {project: "b"}, {project: "c"}}
+	instances, errs := listProjectInstances(ctx, keys)
+	if len(instances) != 0 || len(errs) != len(keys) {
+		t.Fatalf("Expected every listing to fail\nResult: %v %v", instances, errs)
+	}
+	for _, k := range keys {
+		if !strings.Contains(errs[k].Error(), "deadline") {
+			t.Fatalf("Expected %v to fail with the context's error\nError: %v", k.project, errs[k])
+		}
+	}
+}
+
+// waitingContext is a context which calls waiting when a caller first waits
+// on it, as listSharedInstances does once it has joined a listing.
+type waitingContext struct {
+	context.Context
+	once    sync.Once
+	waiting func()
+}
+
+func (c *waitingContext) Done() <-chan struct{} {
+	c.once.Do(c.waiting)
+	return c.Context.Done()
+}
+
+func TestListSharedInstances(t *testing.T) {
+	calls := map[string]int{}
+	var mu sync.Mutex
+	release := make(chan struct{})
+	listInstances = func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		mu.Lock()
+		calls[project]++
+		mu.Unlock()
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return []*compute.Instance{
+			testInstance(project+"-1", "us-central1-b", "10.0.0.1", "node"),
+		}, nil
+	}
+	defer func() { listInstances = listAllInstances }()
+
+	// The first caller of each project gives up before the listing finishes,
+	// which must not fail the listing for the others.
+	keys := []listKey{{project: "prod-eu"}, {project: "prod-us"}}
+	callers := 10
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var waiting, first, rest sync.WaitGroup
+	errs := make(chan error, len(keys)*callers)
+	for _, key := range keys {
+		for i := 0; i < callers; i++ {
+			waiting.Add(1)
+			wg, callerCtx := &rest, context.Background()
+			if i == 0 {
+				wg, callerCtx = &first, ctx
+			}
+			wg.Add(1)
+			go func(wg *sync.WaitGroup, ctx context.Context, key listKey, first bool) {
+				defer wg.Done()
+				instances, err := listSharedInstances(&waitingContext{Context: ctx, waiting: waiting.Done}, key)
+				switch {
+				case first && err != context.Canceled:
+					err = errors.Errorf("Expected the first caller of %v to be cancelled, got %v", key.project, err)
+				case first:
+					err = nil
+				case err == nil && len(instances) != 1:
+					err = errors.Errorf("Expected 1 instance, got %v", prettyPrint(instances))
+				}
+				errs <- err
+			}(wg, callerCtx, key, i == 0)
+		}
+	}
+	waiting.Wait()
+	cancel()
+	first.Wait()
+	close(release)
+	rest.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	if expected := map[string]int{"prod-eu": 1, "prod-us": 1}; !reflect.DeepEqual(calls, expected) {
+		t.Fatalf("Expected one listing per project, got %v", calls)
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	folders "google.golang.org/api/cloudresourcemanager/v2"
+	"google.golang.org/api/googleapi"
+)
+
+// ProjectDiscoveryConfig configures searching every active project under a
+// folder or organisation, rather than a fixed list of projects.
+type ProjectDiscoveryConfig struct {
+	Parent string `yaml:"parent"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// projectParentPattern matches the parents accepted by project_discovery.
+var projectParentPattern = regexp.MustCompile(`^(folders|organizations)/[0-9]+$`)
+
+var (
+	discoveredProjectsGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gcesd_discovered_projects",
+		Help: "Projects found under each project_discovery parent, by parent and project",
+	}, []string{"parent", "project"})
+	projectErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_project_errors_total",
+		Help: "Number of discovered projects skipped due to errors listing their instances, by job name and project",
+	}, []string{"job", "project"})
+)
+
+func init() {
+	prometheus.MustRegister(discoveredProjectsGauge)
+	prometheus.MustRegister(projectErrors)
+}
+
+// listParentProjects is the function used to find the active projects under
+// a parent, it is replaced in tests.
+var listParentProjects = listActiveProjects
+
+// discoveredProjects holds the projects last found under each parent, so
+// that changes can be logged and removed projects dropped from the gauge.
+var discoveredProjects = struct {
+	sync.Mutex
+	byParent map[string][]string
+}{byParent: map[string][]string{}}
+
+// validateProjectDiscovery checks the project_discovery settings of conf.
+func validateProjectDiscovery(conf SearchConfig) error {
+	pd := conf.ProjectDiscovery
+	if len(pd.XXX) != 0 {
+		return errors.Errorf("Unknown keys in project_discovery: %v", strings.Join(mapKeys(pd.XXX), ","))
+	}
+	if !projectParentPattern.MatchString(pd.Parent) {
+		return errors.Errorf("Invalid project_discovery parent %q, must be folders/ID or organizations/ID", pd.Parent)
+	}
+	if len(configProjects(conf)) != 0 {
+		return errors.New("Only one of project, projects and project_discovery may be specified")
+	}
+	return nil
+}
+
+// ResourceManager holds the resource manager clients used to find the
+// projects and folders under a project_discovery parent.
+type ResourceManager struct {
+	Projects *cloudresourcemanager.Service
+	Folders  *folders.Service
+}
+
+// NewResourceManager creates resource manager clients using the service
+// account key in credentialsFile, or application default credentials if it
+// is empty.
+func NewResourceManager(ctx context.Context, credentialsFile string) (*ResourceManager, error) {
+	var client *http.Client
+	if credentialsFile == "" {
+		var err error
+		client, err = google.DefaultClient(ctx, cloudresourcemanager.CloudPlatformReadOnlyScope)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to get client")
+		}
+	} else {
+		jwtConfig, err := readCredentialsFile(credentialsFile, cloudresourcemanager.CloudPlatformReadOnlyScope)
+		if err != nil {
+			return nil, err
+		}
+		client = jwtConfig.Client(ctx)
+	}
+
+	projects, err := cloudresourcemanager.New(client)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create resource manager service")
+	}
+	folders, err := folders.New(client)
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create resource manager folders service")
+	}
+
+	return &ResourceManager{Projects: projects, Folders: folders}, nil
+}
+
+// newResourceManager is the function used to create resource manager
+// clients, it is replaced in tests.
+var newResourceManager = NewResourceManager
+
+// resourceManagers caches one set of resource manager clients per
+// credentials file.
+var resourceManagers = struct {
+	sync.Mutex
+	byFile map[string]*ResourceManager
+}{byFile: map[string]*ResourceManager{}}
+
+// resourceManagerFor returns the cached resource manager clients for
+// credentialsFile, creating them on first use with a background context, as
+// computeServiceFor does.
+func resourceManagerFor(credentialsFile string) (*ResourceManager, error) {
+	resourceManagers.Lock()
+	defer resourceManagers.Unlock()
+
+	if rm, ok := resourceManagers.byFile[credentialsFile]; ok {
+		return rm, nil
+	}
+
+	rm, err := newResourceManager(context.Background(), credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	resourceManagers.byFile[credentialsFile] = rm
+
+	return rm, nil
+}
+
+// listActiveProjects returns the IDs of the active projects under parent,
+// including those in its sub-folders at any depth, sorted.
+func listActiveProjects(ctx context.Context, parent, credentialsFile string) ([]string, error) {
+	rm, err := resourceManagerFor(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	projects := []string{}
+	pending := []string{parent}
+	for len(pending) != 0 {
+		p := pending[0]
+		pending = pending[1:]
+
+		parts := strings.SplitN(p, "/", 2)
+		filter := fmt.Sprintf("parent.type:%v parent.id:%v lifecycleState:ACTIVE", strings.TrimSuffix(parts[0], "s"), parts[1])
+		err = rm.Projects.Projects.List().Filter(filter).Pages(ctx, func(resp *cloudresourcemanager.ListProjectsResponse) error {
+			for _, project := range resp.Projects {
+				projects = append(projects, project.ProjectId)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list projects in %v", p)
+		}
+
+		err = rm.Folders.Folders.List().Parent(p).Pages(ctx, func(resp *folders.ListFoldersResponse) error {
+			for _, folder := range resp.Folders {
+				if folder.LifecycleState == "ACTIVE" {
+					pending = append(pending, folder.Name)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to list folders in %v", p)
+		}
+	}
+
+	sort.Strings(projects)
+	return projects, nil
+}
+
+// skipProjectError reports whether err, from listing the instances of a
+// discovered project, means the project should be skipped rather than the
+// sync failed. Only permission denied and not found are skipped, as returned
+// for projects without the compute API enabled or that we can't access.
+func skipProjectError(err error) bool {
+	apiErr, ok := errors.Cause(err).(*googleapi.Error)
+	return ok && (apiErr.Code == http.StatusForbidden || apiErr.Code == http.StatusNotFound)
+}
+
+// searchProjects returns the projects conf should search, enumerating those
+// under its project_discovery parent if set. Parents are listed at most once
+// per sync, using cache.
+func searchProjects(ctx context.Context, conf SearchConfig, cache map[string][]string) ([]string, error) {
+	if conf.ProjectDiscovery == nil {
+		return configProjects(conf), nil
+	}
+
+	parent := conf.ProjectDiscovery.Parent
+	key := parent + "\x00" + conf.CredentialsFile
+	projects, ok := cache[key]
+	if !ok {
+		var err error
+		projects, err = listParentProjects(ctx, parent, conf.CredentialsFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to discover projects for %v", entryJob(conf))
+		}
+		cache[key] = projects
+		recordDiscoveredProjects(parent, projects)
+	}
+
+	excluded := map[string]bool{}
+	for _, p := range conf.ExcludeProjects {
+		excluded[p] = true
+	}
+
+	res := []string{}
+	for _, p := range projects {
+		if !excluded[p] {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+// recordDiscoveredProjects updates the discovered projects gauge for parent,
+// logging when its projects have changed.
+func recordDiscoveredProjects(parent string, projects []string) {
+	discoveredProjects.Lock()
+	defer discoveredProjects.Unlock()
+
+	previous, seen := discoveredProjects.byParent[parent]
+	current := map[string]bool{}
+	for _, p := range projects {
+		current[p] = true
+		discoveredProjectsGauge.WithLabelValues(parent, p).Set(1)
+	}
+
+	changed := !seen || len(previous) != len(projects)
+	for _, p := range previous {
+		if !current[p] {
+			changed = true
+			discoveredProjectsGauge.DeleteLabelValues(parent, p)
+		}
+	}
+
+	if changed {
+		log.Infof("Discovered projects under %v: %v", parent, strings.Join(projects, ", "))
+	}
+	discoveredProjects.byParent[parent] = projects
+}
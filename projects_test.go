@@ -0,0 +1,196 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	cloudresourcemanager "google.golang.org/api/cloudresourcemanager/v1"
+	folders "google.golang.org/api/cloudresourcemanager/v2"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+func TestLoadConfigFileProjectDiscovery(t *testing.T) {
+	res, err := LoadConfigFile("./test/config_valid_project_discovery.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if len(res) != 1 || res[0].ProjectDiscovery == nil || res[0].ProjectDiscovery.Parent != "folders/123456789" {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+
+	_, err = LoadConfigFile("./test/config_invalid_project_discovery.yaml")
+	if err == nil {
+		t.Fatalf("Expected an error")
+	}
+	for _, expected := range []string{
+		`entry #0 in ./test/config_invalid_project_discovery.yaml (job "bad_parent"): Invalid project_discovery parent "projects/123"`,
+		`entry #1 in ./test/config_invalid_project_discovery.yaml (job "with_project"): Only one of project, projects and project_discovery may be specified`,
+		`entry #2 in ./test/config_invalid_project_discovery.yaml (job "unknown_key"): Unknown keys in project_discovery: recursive`,
+		`entry #3 in ./test/config_invalid_project_discovery.yaml (job "exclude_without_discovery"): exclude_projects requires project_discovery`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected error containing %q\nError: %v", expected, err)
+		}
+	}
+}
+
+func TestDiscoverTargetsProjectDiscovery(t *testing.T) {
+	parents := map[string][]string{
+		"folders/123": {"env-dev", "env-prod", "env-sandbox", "no-compute"},
+	}
+	parentCalls := 0
+	listParentProjects = func(ctx context.Context, parent, credentialsFile string) ([]string, error) {
+		parentCalls++
+		return parents[parent], nil
+	}
+	listInstances = func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		if project == "no-compute" {
+			return nil, &googleapi.Error{Code: http.StatusForbidden, Message: "Access Not Configured"}
+		}
+		return []*compute.Instance{
+			testInstance("node-1", "us-central1-b", "10.0.0.1", "node"),
+		}, nil
+	}
+	defer func() {
+		listParentProjects = listActiveProjects
+		listInstances = listAllInstances
+	}()
+
+	configs := []SearchConfig{
+		{
+			Job:              "node",
+			Tags:             []string{"node"},
+			ProjectDiscovery: &ProjectDiscoveryConfig{Parent: "folders/123"},
+			ExcludeProjects:  []string{"env-sandbox"},
+			Ports:            []int{9100},
+		},
+		{
+			Job:              "node_all",
+			Tags:             []string{"node"},
+			ProjectDiscovery: &ProjectDiscoveryConfig{Parent: "folders/123"},
+			Ports:            []int{9100},
+		},
+	}
+
+	errorsBefore := counterValue(projectErrors.WithLabelValues("node", "no-compute"))
+
+	res, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if parentCalls != 1 {
+		t.Fatalf("Expected the folder to be listed once, got %v", parentCalls)
+	}
+
+	projects := map[string][]string{}
+	for _, tg := range res {
+		job := tg.Labels["job"]
+		projects[job] = append(projects[job], tg.Labels["__meta_gce_instance_project"])
+	}
+	expected := map[string][]string{
+		"node":     {"env-dev", "env-prod"},
+		"node_all": {"env-dev", "env-prod", "env-sandbox"},
+	}
+	if !reflect.DeepEqual(projects, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(projects))
+	}
+
+	if got := counterValue(projectErrors.WithLabelValues("node", "no-compute")); got != errorsBefore+1 {
+		t.Fatalf("Expected the project error counter to increment, got %v", got)
+	}
+
+	parents["folders/123"] = []string{"env-dev"}
+	if _, err := DiscoverTargets(context.Background(), configs); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	discoveredProjects.Lock()
+	current := discoveredProjects.byParent["folders/123"]
+	discoveredProjects.Unlock()
+	if !reflect.DeepEqual(current, []string{"env-dev"}) {
+		t.Fatalf("Expected discovered projects to be updated\nResult: %v", current)
+	}
+
+	parents["folders/123"] = []string{"env-dev", "env-broken"}
+	listInstances = func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		if project == "env-broken" {
+			return nil, errors.New("connection reset by peer")
+		}
+		return []*compute.Instance{
+			testInstance("node-1", "us-central1-b", "10.0.0.1", "node"),
+		}, nil
+	}
+	_, err = DiscoverTargets(context.Background(), configs)
+	if err == nil || !strings.Contains(err.Error(), "env-broken") {
+		t.Fatalf("Expected errors other than permission denied to fail the sync\nError: %v", err)
+	}
+}
+
+func TestListActiveProjectsRecursesFolders(t *testing.T) {
+	projects := map[string]string{
+		"folder:123": `{"projects": [{"projectId": "top"}]}`,
+		"folder:456": `{"projects": [{"projectId": "nested-b"}, {"projectId": "nested-a"}]}`,
+		"folder:789": `{"projects": [{"projectId": "deep"}]}`,
+	}
+	folderList := map[string]string{
+		"folders/123": `{"folders": [{"name": "folders/456", "lifecycleState": "ACTIVE"}, {"name": "folders/999", "lifecycleState": "DELETE_REQUESTED"}]}`,
+		"folders/456": `{"folders": [{"name": "folders/789", "lifecycleState": "ACTIVE"}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body string
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/projects"):
+			filter := r.URL.Query().Get("filter")
+			fields := strings.Fields(filter)
+			if len(fields) != 3 || fields[2] != "lifecycleState:ACTIVE" {
+				t.Errorf("Unexpected filter %q", filter)
+			}
+			parent := strings.TrimPrefix(fields[0], "parent.type:") + ":" + strings.TrimPrefix(fields[1], "parent.id:")
+			body = projects[parent]
+		case strings.HasSuffix(r.URL.Path, "/folders"):
+			body = folderList[r.URL.Query().Get("parent")]
+		default:
+			t.Errorf("Unexpected request %v", r.URL)
+		}
+		if body == "" {
+			body = "{}"
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	created := 0
+	newResourceManager = func(ctx context.Context, credentialsFile string) (*ResourceManager, error) {
+		created++
+		projects, _ := cloudresourcemanager.New(http.DefaultClient)
+		projects.BasePath = server.URL + "/v1/"
+		folders, _ := folders.New(http.DefaultClient)
+		folders.BasePath = server.URL + "/v2/"
+		return &ResourceManager{Projects: projects, Folders: folders}, nil
+	}
+	resourceManagers.byFile = map[string]*ResourceManager{}
+	defer func() {
+		newResourceManager = NewResourceManager
+		resourceManagers.byFile = map[string]*ResourceManager{}
+	}()
+
+	for i := 0; i < 2; i++ {
+		res, err := listActiveProjects(context.Background(), "folders/123", "")
+		if err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		expected := []string{"deep", "nested-a", "nested-b", "top"}
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatalf("Discrepancy in result\nResult: %v", res)
+		}
+	}
+	if created != 1 {
+		t.Fatalf("Expected the resource manager clients to be created once, got %v", created)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Labels recording the config entry which produced a target.
+const (
+	matchedTagsLabel = "__meta_gce_matched_tags"
+	configIndexLabel = "__meta_gce_config_index"
+	configNameLabel  = "__meta_gce_config_name"
+)
+
+// provenanceLabels returns the labels recording that targets were produced
+// by conf, the entry at index in the config: its search tags, its index and
+// its name. Entries have no name of their own yet, so the name is the index;
+// once they do, it should be preferred.
+func provenanceLabels(index int, conf SearchConfig) map[string]string {
+	tags := "," + strings.Join(conf.Tags, ",") + ","
+	if len(conf.Tags) == 0 {
+		tags = ",,"
+	}
+	return map[string]string{
+		matchedTagsLabel: tags,
+		configIndexLabel: strconv.Itoa(index),
+		configNameLabel:  strconv.Itoa(index),
+	}
+}
+
+// labelProvenance sets labels, from provenanceLabels, on each of targets.
+func labelProvenance(targets []DiscoveryTarget, labels map[string]string) {
+	for _, t := range targets {
+		for k, v := range labels {
+			t.Labels[k] = v
+		}
+	}
+}
+
+// withoutProvenance returns a copy of labels without the labels set by
+// labelProvenance.
+func withoutProvenance(labels map[string]string) map[string]string {
+	res := copyLabels(labels)
+	for _, l := range []string{matchedTagsLabel, configIndexLabel, configNameLabel} {
+		delete(res, l)
+	}
+	return res
+}
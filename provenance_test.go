@@ -0,0 +1,63 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestDiscoverTargetsProvenance(t *testing.T) {
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web", "canary"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}},
+		{Job: "canary", Tags: []string{"web", "canary"}, Project: "test-project", Ports: []int{80}},
+	}
+	targets, err := DiscoverTargets(context.Background(), configs)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	got := map[string][]string{}
+	for _, target := range targets {
+		got[target.Labels["job"]] = []string{
+			target.Labels[matchedTagsLabel],
+			target.Labels[configIndexLabel],
+			target.Labels[configNameLabel],
+		}
+	}
+	expected := map[string][]string{
+		"web":    {",web,", "0", "0"},
+		"canary": {",web,canary,", "1", "1"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+
+	// Entries discovered on their own keep their position in the config.
+	configs[0].Interval = time.Hour
+	scheduler := newDiscoveryScheduler(configs, time.Minute)
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := scheduler.Sync(context.Background(), now, false); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if due := scheduler.due(now.Add(2*time.Minute), false); !reflect.DeepEqual(due, []int{1}) {
+		t.Fatalf("Expected only the canary entry to be due, got %v", due)
+	}
+	if _, err := scheduler.Sync(context.Background(), now.Add(2*time.Minute), false); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	for _, target := range scheduler.Targets() {
+		if target.Labels["job"] == "canary" && target.Labels[configIndexLabel] != "1" {
+			t.Fatalf("Expected the canary entry to keep index 1\nResult: %v", prettyPrint(target))
+		}
+	}
+}
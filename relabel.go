@@ -0,0 +1,194 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Actions of a RelabelConfig, a subset of those Prometheus supports, with the
+// same meaning.
+const (
+	relabelReplace   = "replace"
+	relabelKeep      = "keep"
+	relabelDrop      = "drop"
+	relabelLabelMap  = "labelmap"
+	relabelLabelDrop = "labeldrop"
+)
+
+// addressLabel holds the address of a target while it is relabelled.
+const addressLabel = "__address__"
+
+// RelabelConfig is a relabelling rule applied to the targets of a job before
+// they are written, as in the relabel_configs of a Prometheus scrape config.
+// Unset fields have the same defaults as in Prometheus.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels"`
+	Separator    *string  `yaml:"separator"`
+	Regex        *string  `yaml:"regex"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  *string  `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// relabelRule is a RelabelConfig with its defaults applied and its regex
+// compiled.
+type relabelRule struct {
+	sourceLabels []string
+	separator    string
+	regex        *regexp.Regexp
+	targetLabel  string
+	replacement  string
+	action       string
+}
+
+var relabelDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcesd_relabel_dropped_targets_total",
+	Help: "Number of targets dropped by relabel_configs, by job name",
+}, []string{"job"})
+
+func init() {
+	prometheus.MustRegister(relabelDropped)
+}
+
+// compileRelabelConfig checks rc and returns the rule it describes.
+func compileRelabelConfig(rc RelabelConfig) (relabelRule, error) {
+	if len(rc.XXX) != 0 {
+		return relabelRule{}, errors.Errorf("Unknown keys in relabel_configs: %v", strings.Join(mapKeys(rc.XXX), ","))
+	}
+
+	r := relabelRule{
+		sourceLabels: rc.SourceLabels,
+		separator:    ";",
+		targetLabel:  rc.TargetLabel,
+		replacement:  "$1",
+		action:       rc.Action,
+	}
+	if rc.Separator != nil {
+		r.separator = *rc.Separator
+	}
+	if rc.Replacement != nil {
+		r.replacement = *rc.Replacement
+	}
+	if r.action == "" {
+		r.action = relabelReplace
+	}
+
+	expr := "(.*)"
+	if rc.Regex != nil {
+		expr = *rc.Regex
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return relabelRule{}, errors.Wrapf(err, "Invalid relabel_configs regex %q", expr)
+	}
+	r.regex = re
+
+	switch r.action {
+	case relabelReplace:
+		if r.targetLabel == "" {
+			return relabelRule{}, errors.Errorf("Relabel action %q requires a target_label", r.action)
+		}
+	case relabelKeep, relabelDrop:
+		if len(r.sourceLabels) == 0 {
+			return relabelRule{}, errors.Errorf("Relabel action %q requires source_labels", r.action)
+		}
+	case relabelLabelMap, relabelLabelDrop:
+	default:
+		return relabelRule{}, errors.Errorf("Unknown relabel action %q, must be one of %v", r.action, strings.Join([]string{relabelReplace, relabelKeep, relabelDrop, relabelLabelMap, relabelLabelDrop}, ", "))
+	}
+	for _, l := range r.sourceLabels {
+		if !labelNamePattern.MatchString(l) {
+			return relabelRule{}, errors.Errorf("Invalid relabel_configs source label %q", l)
+		}
+	}
+	return r, nil
+}
+
+// relabel applies rules to labels in order, returning the resulting labels,
+// or false if a rule dropped the target. labels is not modified.
+func relabel(labels map[string]string, rules []relabelRule) (map[string]string, bool) {
+	labels = copyLabels(labels)
+	for _, r := range rules {
+		values := make([]string, 0, len(r.sourceLabels))
+		for _, l := range r.sourceLabels {
+			values = append(values, labels[l])
+		}
+		val := strings.Join(values, r.separator)
+
+		switch r.action {
+		case relabelKeep:
+			if !r.regex.MatchString(val) {
+				return nil, false
+			}
+		case relabelDrop:
+			if r.regex.MatchString(val) {
+				return nil, false
+			}
+		case relabelReplace:
+			indexes := r.regex.FindStringSubmatchIndex(val)
+			if indexes == nil {
+				continue
+			}
+			target := string(r.regex.ExpandString(nil, r.targetLabel, val, indexes))
+			if !labelNamePattern.MatchString(target) {
+				continue
+			}
+			res := string(r.regex.ExpandString(nil, r.replacement, val, indexes))
+			if res == "" {
+				delete(labels, target)
+				continue
+			}
+			labels[target] = res
+		case relabelLabelMap:
+			mapped := map[string]string{}
+			for k, v := range labels {
+				if r.regex.MatchString(k) {
+					if name := r.regex.ReplaceAllString(k, r.replacement); labelNamePattern.MatchString(name) {
+						mapped[name] = v
+					}
+				}
+			}
+			for k, v := range mapped {
+				labels[k] = v
+			}
+		case relabelLabelDrop:
+			for k := range labels {
+				if r.regex.MatchString(k) {
+					delete(labels, k)
+				}
+			}
+		}
+	}
+	return labels, true
+}
+
+// relabelTargets applies the relabel_configs of config to targets, each of
+// which has a single address, available to rules as __address__. Targets
+// dropped by a rule, or left without an address, are left out.
+func relabelTargets(targets []DiscoveryTarget, config SearchConfig) []DiscoveryTarget {
+	if len(config.relabelRules) == 0 {
+		return targets
+	}
+
+	res := []DiscoveryTarget{}
+	for _, t := range targets {
+		labels := copyLabels(t.Labels)
+		if len(t.Targets) != 0 {
+			labels[addressLabel] = t.Targets[0]
+		}
+		labels, keep := relabel(labels, config.relabelRules)
+		if !keep || labels[addressLabel] == "" {
+			relabelDropped.WithLabelValues(t.Labels["job"]).Inc()
+			continue
+		}
+		address := labels[addressLabel]
+		delete(labels, addressLabel)
+		res = append(res, DiscoveryTarget{Targets: []string{address}, Labels: labels})
+	}
+	return res
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestRelabel(t *testing.T) {
+	t.Parallel()
+
+	str := func(s string) *string { return &s }
+	input := map[string]string{
+		"__address__":                 "10.0.0.1:9100",
+		"job":                         "node",
+		"__meta_gce_instance_name":    "web-1",
+		"__meta_gce_instance_zone":    "us-central1-b",
+		"__meta_gce_instance_tags":    ",web,canary,",
+		"__meta_gce_metadata_team":    "infra",
+		"__meta_gce_metadata_service": "api",
+	}
+
+	cases := []struct {
+		name     string
+		configs  []RelabelConfig
+		expected map[string]string
+	}{
+		{
+			name: "replace with defaults copies the source value",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__meta_gce_instance_name"}, TargetLabel: "instance"},
+			},
+			expected: map[string]string{"instance": "web-1"},
+		},
+		{
+			name: "replace joins source labels and expands groups",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__meta_gce_instance_zone", "__meta_gce_instance_name"}, Separator: str("/"), Regex: str("([a-z]+)-.*/(.*)"), TargetLabel: "site", Replacement: str("$1:$2")},
+			},
+			expected: map[string]string{"site": "us:web-1"},
+		},
+		{
+			name: "replace copies a tag into the job",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__meta_gce_instance_tags"}, Regex: str(".*,(canary),.*"), TargetLabel: "job", Replacement: str("node-$1")},
+			},
+			expected: map[string]string{"job": "node-canary"},
+		},
+		{
+			name: "replace rewrites the address",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__address__"}, Regex: str("(.*):9100"), TargetLabel: "__address__", Replacement: str("${1}:9200")},
+			},
+			expected: map[string]string{"__address__": "10.0.0.1:9200"},
+		},
+		{
+			name: "replace without a match leaves labels alone",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__meta_gce_instance_name"}, Regex: str("db-.*"), TargetLabel: "instance"},
+			},
+			expected: map[string]string{},
+		},
+		{
+			name: "replace with an empty result deletes the target label",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__meta_gce_missing"}, TargetLabel: "job"},
+			},
+			expected: map[string]string{"job": ""},
+		},
+		{
+			name: "replace expands the target label",
+			configs: []RelabelConfig{
+				{SourceLabels: []string{"__meta_gce_metadata_service"}, TargetLabel: "svc_${1}", Replacement: str("true")},
+			},
+			expected: map[string]string{"svc_api": "true"},
+		},
+		{
+			name: "labelmap copies matching labels",
+			configs: []RelabelConfig{
+				{Action: "labelmap", Regex: str("__meta_gce_metadata_(.+)")},
+			},
+			expected: map[string]string{"team": "infra", "service": "api"},
+		},
+		{
+			name: "labeldrop removes matching labels",
+			configs: []RelabelConfig{
+				{Action: "labeldrop", Regex: str("__meta_gce_metadata_.*")},
+			},
+			expected: map[string]string{"__meta_gce_metadata_team": "", "__meta_gce_metadata_service": ""},
+		},
+		{
+			name: "rules apply in order",
+			configs: []RelabelConfig{
+				{Action: "labelmap", Regex: str("__meta_gce_(instance_name)")},
+				{Action: "labeldrop", Regex: str("__meta_.*")},
+			},
+			expected: map[string]string{
+				"instance_name":               "web-1",
+				"__meta_gce_instance_name":    "",
+				"__meta_gce_instance_zone":    "",
+				"__meta_gce_instance_tags":    "",
+				"__meta_gce_metadata_team":    "",
+				"__meta_gce_metadata_service": "",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		rules := []relabelRule{}
+		for _, rc := range c.configs {
+			rule, err := compileRelabelConfig(rc)
+			if err != nil {
+				t.Fatalf("Unexpected error in %v\nError: %v", c.name, err)
+			}
+			rules = append(rules, rule)
+		}
+
+		// Expected labels are changes to the input, empty values are
+		// deleted labels.
+		expected := copyLabels(input)
+		for k, v := range c.expected {
+			if v == "" {
+				delete(expected, k)
+				continue
+			}
+			expected[k] = v
+		}
+
+		res, keep := relabel(input, rules)
+		if !keep || !reflect.DeepEqual(res, expected) {
+			t.Fatalf("Discrepancy in result of %v\nResult: %v", c.name, prettyPrint(res))
+		}
+	}
+	if input["job"] != "node" {
+		t.Fatalf("Expected the input labels to be left unchanged")
+	}
+}
+
+func TestRelabelKeepDrop(t *testing.T) {
+	t.Parallel()
+
+	str := func(s string) *string { return &s }
+	labels := map[string]string{"__meta_gce_instance_tags": ",web,canary,", "__meta_gce_instance_zone": "us-central1-b"}
+	cases := []struct {
+		config   RelabelConfig
+		expected bool
+	}{
+		{config: RelabelConfig{Action: "keep", SourceLabels: []string{"__meta_gce_instance_tags"}, Regex: str(".*,canary,.*")}, expected: true},
+		{config: RelabelConfig{Action: "keep", SourceLabels: []string{"__meta_gce_instance_tags"}, Regex: str("canary")}, expected: false},
+		{config: RelabelConfig{Action: "keep", SourceLabels: []string{"__meta_gce_missing"}, Regex: str("")}, expected: true},
+		{config: RelabelConfig{Action: "drop", SourceLabels: []string{"__meta_gce_instance_zone"}, Regex: str("us-.*")}, expected: false},
+		{config: RelabelConfig{Action: "drop", SourceLabels: []string{"__meta_gce_instance_zone"}, Regex: str("europe-.*")}, expected: true},
+	}
+	for i, c := range cases {
+		rule, err := compileRelabelConfig(c.config)
+		if err != nil {
+			t.Fatalf("Unexpected error in case %v\nError: %v", i, err)
+		}
+		if _, keep := relabel(labels, []relabelRule{rule}); keep != c.expected {
+			t.Fatalf("Expected keep %v in case %v", c.expected, i)
+		}
+	}
+}
+
+func TestCompileRelabelConfigErrors(t *testing.T) {
+	t.Parallel()
+
+	str := func(s string) *string { return &s }
+	cases := []struct {
+		config   RelabelConfig
+		expected string
+	}{
+		{config: RelabelConfig{SourceLabels: []string{"a"}, TargetLabel: "b", Regex: str("(")}, expected: `Invalid relabel_configs regex "("`},
+		{config: RelabelConfig{SourceLabels: []string{"a"}}, expected: `Relabel action "replace" requires a target_label`},
+		{config: RelabelConfig{Action: "keep"}, expected: `Relabel action "keep" requires source_labels`},
+		{config: RelabelConfig{Action: "hashmod", SourceLabels: []string{"a"}}, expected: `Unknown relabel action "hashmod"`},
+		{config: RelabelConfig{Action: "drop", SourceLabels: []string{"a.b"}}, expected: `Invalid relabel_configs source label "a.b"`},
+		{config: RelabelConfig{Action: "labeldrop", XXX: map[string]interface{}{"modulus": 2}}, expected: "Unknown keys in relabel_configs: modulus"},
+	}
+	for i, c := range cases {
+		err := ValidateConfig(SearchConfig{Job: "web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}, RelabelConfigs: []RelabelConfig{c.config}})
+		if err == nil || !strings.Contains(err.Error(), c.expected) {
+			t.Fatalf("Expected %q in case %v\nError: %v", c.expected, i, err)
+		}
+	}
+}
+
+func TestDiscoverySchedulerRelabel(t *testing.T) {
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+			testInstance("web-2", "us-central1-b", "10.0.0.2", "web", "canary"),
+			testInstance("web-3", "us-central1-b", "10.0.0.3", "web"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	str := func(s string) *string { return &s }
+	config := SearchConfig{
+		Job:     "relabelled",
+		Tags:    []string{"web"},
+		Project: "test-project",
+		Ports:   []int{80},
+		RelabelConfigs: []RelabelConfig{
+			{Action: "drop", SourceLabels: []string{"__meta_gce_instance_tags"}, Regex: str(".*,canary,.*")},
+			{SourceLabels: []string{"__address__"}, Regex: str("(.*):80"), TargetLabel: "__address__", Replacement: str("${1}:8080")},
+			{SourceLabels: []string{"__meta_gce_instance_name"}, TargetLabel: "instance"},
+		},
+	}
+	if err := compileConfig(&config); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	dropped := counterValue(relabelDropped.WithLabelValues("relabelled"))
+	scheduler := newDiscoveryScheduler([]SearchConfig{config}, time.Minute)
+	if _, err := scheduler.Sync(context.Background(), time.Now(), true); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	res := scheduler.Targets()
+	if got := targetsByJob(res); !reflect.DeepEqual(got, map[string][]string{"relabelled": {"10.0.0.1:8080", "10.0.0.3:8080"}}) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(res))
+	}
+	for _, target := range res {
+		if _, ok := target.Labels[addressLabel]; ok || target.Labels["instance"] == "" {
+			t.Fatalf("Unexpected labels %v", prettyPrint(target))
+		}
+	}
+	if got := gaugeValue(targetCount.WithLabelValues("relabelled")); got != 2 {
+		t.Fatalf("Expected 2 targets counted, got %v", got)
+	}
+	if got := counterValue(relabelDropped.WithLabelValues("relabelled")) - dropped; got != 1 {
+		t.Fatalf("Expected 1 dropped target, got %v", got)
+	}
+}
+
+func TestDiscoverySchedulerRelabelJob(t *testing.T) {
+	listInstances = fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+		},
+	})
+	defer func() { listInstances = listAllInstances }()
+
+	// Settings applying to a job by name follow the job rewritten by
+	// relabel_configs.
+	str := func(s string) *string { return &s }
+	maxLength := 8
+	config := SearchConfig{
+		Job:              "web",
+		Tags:             []string{"web"},
+		Project:          "test-project",
+		Ports:            []int{80},
+		MinTargets:       1,
+		StripMeta:        true,
+		MaxLabelValueLen: &maxLength,
+		RelabelConfigs: []RelabelConfig{
+			{SourceLabels: []string{"__meta_gce_instance_name"}, TargetLabel: "job", Replacement: str("job-${1}")},
+		},
+	}
+	if err := compileConfig(&config); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	scheduler := newDiscoveryScheduler([]SearchConfig{config}, time.Minute)
+	if _, err := scheduler.Sync(context.Background(), time.Now(), true); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	job := "job-web-1"
+	if got := targetsByJob(scheduler.Targets()); !reflect.DeepEqual(got, map[string][]string{job: {"10.0.0.1:80"}}) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+	if got := scheduler.MinTargetsByFile("targets.yaml")["targets.yaml"][job]; got != 1 {
+		t.Fatalf("Expected min_targets to apply to %v, got %v", job, got)
+	}
+	if got := scheduler.LabelPrefixes()[job]; got != stripMetaPrefix {
+		t.Fatalf("Expected strip_meta to apply to %v, got %q", job, got)
+	}
+	if got, ok := scheduler.MaxLabelValueLengths()[job]; !ok || got != maxLength {
+		t.Fatalf("Expected max_label_value_length to apply to %v, got %v", job, got)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// invalidLabelNameChars matches the characters not allowed in Prometheus
+// label names. Unlike invalidLabelChars, used by formatTag, upper case
+// letters are allowed.
+var invalidLabelNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+var (
+	labelsSanitized = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_labels_sanitized_total",
+		Help: "Number of labels whose name or value was rewritten to be valid for Prometheus, by job name",
+	}, []string{"job"})
+	labelsTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcesd_labels_truncated_total",
+		Help: "Number of label values truncated to max_label_value_length, by label name",
+	}, []string{"label"})
+)
+
+func init() {
+	prometheus.MustRegister(labelsSanitized)
+	prometheus.MustRegister(labelsTruncated)
+}
+
+// truncationMarker ends label values cut short by truncateLabelValues.
+const truncationMarker = "…"
+
+// sanitizeLabelName returns name with each character not allowed in a
+// Prometheus label name replaced by _, prefixed by _ if it would start with
+// a digit.
+func sanitizeLabelName(name string) string {
+	name = invalidLabelNameChars.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// sanitizeLabelValue returns v without control characters, such as
+// newlines, or invalid UTF-8.
+func sanitizeLabelValue(v string) string {
+	if validMetadataLabelValue(v) {
+		return v
+	}
+	return strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, v)
+}
+
+// sanitizeLabels returns labels with names and values valid for Prometheus,
+// counting those rewritten against job. Valid names are kept. Invalid names
+// are sanitised in sorted order, and one which then clashes with a label
+// already present is suffixed with _2, _3 and so on, so the same labels are
+// always given the same names.
+func sanitizeLabels(labels map[string]string, job string) map[string]string {
+	res := make(map[string]string, len(labels))
+	invalid := []string{}
+	for k, v := range labels {
+		if !labelNamePattern.MatchString(k) {
+			invalid = append(invalid, k)
+			continue
+		}
+		res[k] = sanitizeLabelValue(v)
+		if res[k] != v {
+			labelsSanitized.WithLabelValues(job).Inc()
+		}
+	}
+
+	sort.Strings(invalid)
+	for _, k := range invalid {
+		name := sanitizeLabelName(k)
+		for i := 2; ; i++ {
+			if _, ok := res[name]; !ok {
+				break
+			}
+			name = fmt.Sprintf("%v_%v", sanitizeLabelName(k), i)
+		}
+		res[name] = sanitizeLabelValue(labels[k])
+		labelsSanitized.WithLabelValues(job).Inc()
+	}
+	return res
+}
+
+// truncateTargets returns targets with their label values truncated to the
+// length in maxLengths of their job, or -labels.max-value-length for jobs
+// not in it. Targets with labels to truncate are copied.
+func truncateTargets(targets []DiscoveryTarget, maxLengths map[string]int) []DiscoveryTarget {
+	res := make([]DiscoveryTarget, 0, len(targets))
+	for _, t := range targets {
+		maxLength, ok := maxLengths[t.Labels["job"]]
+		if !ok {
+			maxLength = *labelValueMax
+		}
+		if maxLength <= 0 || !hasLongValue(t.Labels, maxLength) {
+			res = append(res, t)
+			continue
+		}
+		labels := copyLabels(t.Labels)
+		truncateLabelValues(labels, maxLength)
+		res = append(res, DiscoveryTarget{Targets: t.Targets, Labels: labels})
+	}
+	return res
+}
+
+// hasLongValue reports whether any value of labels is longer than maxLength
+// bytes.
+func hasLongValue(labels map[string]string, maxLength int) bool {
+	for _, v := range labels {
+		if len(v) > maxLength {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateLabelValues truncates the values of labels longer than maxLength
+// bytes, without splitting a character, ending them with truncationMarker
+// so the result is at most maxLength bytes. labels is modified in place. A
+// maxLength of 0 or less disables truncation.
+func truncateLabelValues(labels map[string]string, maxLength int) {
+	if maxLength <= 0 {
+		return
+	}
+	for k, v := range labels {
+		if len(v) <= maxLength {
+			continue
+		}
+		if maxLength > len(truncationMarker) {
+			labels[k] = truncateUTF8(v, maxLength-len(truncationMarker)) + truncationMarker
+		} else {
+			labels[k] = truncateUTF8(v, maxLength)
+		}
+		labelsTruncated.WithLabelValues(k).Inc()
+	}
+}
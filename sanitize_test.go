@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSanitizeLabels(t *testing.T) {
+	t.Parallel()
+
+	labels := map[string]string{
+		"job":                     "sanitize",
+		"team_name":               "infra",
+		"team.name":               "dots",
+		"team-name":               "hyphens",
+		"owner🚀":                  "rocket 🚀",
+		"9lives":                  "cat",
+		"":                        "empty",
+		"__meta_gce_instance_tag": "line one\nline two\r\t",
+		"binary":                  "a\x00b\xffc",
+	}
+	expected := map[string]string{
+		"job":                     "sanitize",
+		"team_name":               "infra",
+		"team_name_2":             "hyphens",
+		"team_name_3":             "dots",
+		"owner_":                  "rocket 🚀",
+		"_9lives":                 "cat",
+		"_":                       "empty",
+		"__meta_gce_instance_tag": "line oneline two",
+		"binary":                  "abc",
+	}
+
+	before := counterValue(labelsSanitized.WithLabelValues("sanitize"))
+	for i := 0; i < 3; i++ {
+		if res := sanitizeLabels(labels, "sanitize"); !reflect.DeepEqual(res, expected) {
+			t.Fatalf("Discrepancy in result of run %v\nResult: %v", i, prettyPrint(res))
+		}
+	}
+	if got := counterValue(labelsSanitized.WithLabelValues("sanitize")) - before; got != 3*7 {
+		t.Fatalf("Expected 21 rewritten labels, got %v", got)
+	}
+}
+
+func TestInstanceToTargetsSanitizesLabels(t *testing.T) {
+	t.Parallel()
+
+	instance := testInstance("web-1", "us-central1-b", "10.0.0.1", "web")
+	config := SearchConfig{
+		Job:          "web",
+		Project:      "test-project",
+		Ports:        []int{80},
+		TargetLabels: map[string]string{"app.kubernetes.io/name": "web\n", "env": "prod"},
+	}
+	res, err := InstanceToTargets(instance, config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	for k, v := range res[0].Labels {
+		if !labelNamePattern.MatchString(k) || !validMetadataLabelValue(v) {
+			t.Fatalf("Invalid label %q=%q in %v", k, v, prettyPrint(res))
+		}
+	}
+	if v := res[0].Labels["app_kubernetes_io_name"]; v != "web" {
+		t.Fatalf("Expected a sanitised label, got %v", prettyPrint(res))
+	}
+	if v := res[0].Labels["env"]; v != "prod" {
+		t.Fatalf("Expected a valid label to be kept, got %v", prettyPrint(res))
+	}
+}
+
+func TestTruncateLabelValues(t *testing.T) {
+	t.Parallel()
+
+	labels := map[string]string{
+		"short":    "abc",
+		"ascii":    "abcdefghij",
+		"accented": "ééééé",
+		"emoji":    "🚀🚀🚀",
+	}
+	// The marker takes 3 bytes, so 5 bytes of each value can be kept, which
+	// would split the second é and the second rocket.
+	expected := map[string]string{
+		"short":    "abc",
+		"ascii":    "abcde…",
+		"accented": "éé…",
+		"emoji":    "🚀…",
+	}
+
+	before := counterValue(labelsTruncated.WithLabelValues("emoji"))
+	for i := 0; i < 2; i++ {
+		res := copyLabels(labels)
+		truncateLabelValues(res, 8)
+		if !reflect.DeepEqual(res, expected) {
+			t.Fatalf("Discrepancy in result of run %v\nResult: %v", i, prettyPrint(res))
+		}
+		for k, v := range res {
+			if len(v) > 8 || !utf8.ValidString(v) {
+				t.Fatalf("Invalid truncation of %v: %q", k, v)
+			}
+		}
+	}
+	if got := counterValue(labelsTruncated.WithLabelValues("emoji")) - before; got != 2 {
+		t.Fatalf("Expected 2 truncations of emoji, got %v", got)
+	}
+
+	// Limits too short for the marker cut without it.
+	res := map[string]string{"ascii": "abcdef"}
+	truncateLabelValues(res, 3)
+	if res["ascii"] != "abc" {
+		t.Fatalf("Unexpected truncation %q", res["ascii"])
+	}
+
+	res = copyLabels(labels)
+	truncateLabelValues(res, 0)
+	if !reflect.DeepEqual(res, labels) {
+		t.Fatalf("Expected no truncation without a limit, got %v", prettyPrint(res))
+	}
+}
+
+func TestOutputLabelsMaxLabelValueLength(t *testing.T) {
+	t.Parallel()
+
+	blob := strings.Repeat("x", 9*1024)
+	targetsOf := func(job string) []DiscoveryTarget {
+		// Labels added after discovery, such as by relabel_configs, are
+		// truncated too.
+		return []DiscoveryTarget{{
+			Targets: []string{"10.0.0.1:80"},
+			Labels:  map[string]string{"job": job, "blob": blob, "__meta_gce_source_image": blob},
+		}}
+	}
+	info := syncInfo{maxValueLength: map[string]int{"short": 16, "unlimited": 0}}
+	cases := []struct {
+		job      string
+		expected int
+	}{
+		{job: "default", expected: 1024},
+		{job: "short", expected: 16},
+		{job: "unlimited", expected: len(blob)},
+	}
+	for _, c := range cases {
+		targets := targetsOf(c.job)
+		res := outputLabels(targets, info)
+		for _, k := range []string{"blob", "__meta_gce_source_image"} {
+			v := res[0].Labels[k]
+			if len(v) != c.expected || (c.expected != len(blob) && !strings.HasSuffix(v, truncationMarker)) {
+				t.Fatalf("Expected %v of %v to be truncated to %v bytes, got %v", k, c.job, c.expected, len(v))
+			}
+		}
+		if targets[0].Labels["blob"] != blob {
+			t.Fatalf("Expected the discovered labels of %v to be left alone", c.job)
+		}
+	}
+}
+
+func TestParseConfigMaxLabelValueLength(t *testing.T) {
+	t.Parallel()
+
+	config := []byte(`defaults:
+  project: sandbox
+  ports: [9100]
+  max_label_value_length: 64
+jobs:
+  - job: default
+    tags: [node]
+  - job: unlimited
+    tags: [node]
+    max_label_value_length: 0
+`)
+	res, _, err := parseConfig(config)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	lengths := newDiscoveryScheduler(res, time.Minute).MaxLabelValueLengths()
+	if expected := map[string]int{"default": 64, "unlimited": 0}; !reflect.DeepEqual(lengths, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(lengths))
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// discoveryScheduler tracks when each search entry was last discovered, so
+// that entries with their own interval are only discovered when due, along
+// with the targets each entry produced and those it recently stopped
+// producing. The config may be replaced by SetConfigs while the scheduler is
+// in use.
+type discoveryScheduler struct {
+	sync.Mutex
+	configs    []SearchConfig
+	interval   time.Duration
+	lastRun    []time.Time
+	targets    [][]DiscoveryTarget
+	tombstones [][]tombstone
+	hash       string
+	// generation is incremented by SetConfigs, so a Sync which started
+	// discovering before can tell its results are of the replaced config.
+	generation int
+}
+
+// newDiscoveryScheduler creates a scheduler for configs, with interval used
+// for entries which do not set their own.
+func newDiscoveryScheduler(configs []SearchConfig, interval time.Duration) *discoveryScheduler {
+	return &discoveryScheduler{
+		configs:    configs,
+		interval:   interval,
+		lastRun:    make([]time.Time, len(configs)),
+		targets:    make([][]DiscoveryTarget, len(configs)),
+		tombstones: make([][]tombstone, len(configs)),
+		hash:       configHash(configs),
+	}
+}
+
+func (s *discoveryScheduler) configInterval(conf SearchConfig) time.Duration {
+	if conf.Interval > 0 {
+		return conf.Interval
+	}
+	return s.interval
+}
+
+// TickInterval returns how often the scheduler needs to be synced to
+// discover every entry on time.
+func (s *discoveryScheduler) TickInterval() time.Duration {
+	s.Lock()
+	defer s.Unlock()
+
+	tick := s.interval
+	for _, c := range s.configs {
+		if i := s.configInterval(c); i < tick {
+			tick = i
+		}
+	}
+	return tick
+}
+
+// due returns the indexes of the entries due for discovery at now, which is
+// every entry when force is set.
+func (s *discoveryScheduler) due(now time.Time, force bool) []int {
+	due := []int{}
+	for i, c := range s.configs {
+		if force || s.lastRun[i].IsZero() || !now.Before(s.lastRun[i].Add(s.configInterval(c))) {
+			due = append(due, i)
+		}
+	}
+	return due
+}
+
+// Sync discovers the targets of every entry due at now, reporting whether
+// any entries were discovered or any removed targets expired. Projects are
+// only listed if an entry searching them is due. Entries which fail keep
+// their previously discovered targets, and stay due, while those of the
+// others are updated; the error names every failure. The scheduler is not
+// locked while discovering, and the results are dropped if the config is
+// replaced meanwhile.
+func (s *discoveryScheduler) Sync(ctx context.Context, now time.Time, force bool) (bool, error) {
+	s.Lock()
+	expired := s.expireTombstones(now)
+	due := s.due(now, force)
+	configs := make([]SearchConfig, len(due))
+	for j, i := range due {
+		configs[j] = s.configs[i]
+	}
+	generation := s.generation
+	s.Unlock()
+
+	if len(due) == 0 {
+		return expired, nil
+	}
+
+	results, errs := discoverTargetsByConfig(ctx, configs, due)
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.generation != generation {
+		log.V(1).Info("Dropping discovered targets, the config was replaced while discovering")
+		return expired, nil
+	}
+
+	discovered := expired
+	for j, i := range due {
+		// A sync which started later may have finished first.
+		if errs[j] != nil || now.Before(s.lastRun[i]) {
+			continue
+		}
+		if ttl := s.configs[i].RemovedTargetTTL; ttl > 0 {
+			s.tombstones[i] = updateTombstones(s.tombstones[i], s.targets[i], results[j], now, ttl)
+		}
+		s.targets[i] = results[j]
+		s.lastRun[i] = now
+		discovered = true
+	}
+	if discovered {
+		updateTargetCounts(liveTargets(s.targetList()), configJobs(s.configs))
+	}
+
+	return discovered, combineDiscoveryErrors(errs)
+}
+
+// SetConfigs replaces the entries being discovered, discarding all previously
+// discovered targets so every entry is due on the next sync.
+func (s *discoveryScheduler) SetConfigs(configs []SearchConfig) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.configs = configs
+	s.lastRun = make([]time.Time, len(configs))
+	s.targets = make([][]DiscoveryTarget, len(configs))
+	s.tombstones = make([][]tombstone, len(configs))
+	s.hash = configHash(configs)
+	s.generation++
+}
+
+// expireTombstones drops the removed targets older than their entry's
+// removed_target_ttl at now, reporting whether any were dropped.
+func (s *discoveryScheduler) expireTombstones(now time.Time) bool {
+	expired := false
+	for i, c := range s.configs {
+		kept := expireTombstones(s.tombstones[i], now, c.RemovedTargetTTL)
+		if len(kept) != len(s.tombstones[i]) {
+			expired = true
+		}
+		s.tombstones[i] = kept
+	}
+	return expired
+}
+
+// ConfigHash returns a hash of the entries being discovered.
+func (s *discoveryScheduler) ConfigHash() string {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.hash
+}
+
+// Targets returns the most recently discovered targets of every entry,
+// including removed targets still within their removed_target_ttl.
+func (s *discoveryScheduler) Targets() []DiscoveryTarget {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.targetList()
+}
+
+// TargetsMatching returns the most recently discovered targets of the
+// entries for which keep returns true, without removed targets.
+func (s *discoveryScheduler) TargetsMatching(keep func(SearchConfig) bool) []DiscoveryTarget {
+	s.Lock()
+	defer s.Unlock()
+
+	targets := []DiscoveryTarget{}
+	for i, c := range s.configs {
+		if keep(c) {
+			targets = append(targets, s.targets[i]...)
+		}
+	}
+	return targets
+}
+
+// entryJobs returns the jobs of entry i, which the settings of the entry
+// applying to a job by name apply to: its job, if it has a fixed one, and the
+// job of each of its most recently discovered and removed targets, which
+// differs for an entry with a job_template, or relabel_configs rewriting the
+// job.
+func (s *discoveryScheduler) entryJobs(i int) []string {
+	jobs := []string{}
+	seen := map[string]bool{}
+	if job := s.configs[i].Job; job != "" {
+		seen[job] = true
+		jobs = append(jobs, job)
+	}
+	for _, targets := range [][]DiscoveryTarget{s.targets[i], tombstoneTargets(s.tombstones[i])} {
+		for _, t := range targets {
+			if job := t.Labels["job"]; !seen[job] {
+				seen[job] = true
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	return jobs
+}
+
+// MinTargetsByFile returns the min_targets of each job which sets it,
+// grouped by the file the job is written to as for TargetsByFile.
+func (s *discoveryScheduler) MinTargetsByFile(defaultFile string) map[string]map[string]int {
+	s.Lock()
+	defer s.Unlock()
+
+	byFile := map[string]map[string]int{}
+	for i, c := range s.configs {
+		if c.MinTargets == 0 {
+			continue
+		}
+		file := c.Output
+		if file == "" {
+			file = defaultFile
+		}
+		if byFile[file] == nil {
+			byFile[file] = map[string]int{}
+		}
+		for _, job := range s.entryJobs(i) {
+			if c.MinTargets > byFile[file][job] {
+				byFile[file][job] = c.MinTargets
+			}
+		}
+	}
+	return byFile
+}
+
+// LabelPrefixes returns the prefix meta labels are renamed to on output for
+// each job which sets label_prefix or strip_meta, taken from the first entry
+// of the job which sets one.
+func (s *discoveryScheduler) LabelPrefixes() map[string]string {
+	s.Lock()
+	defer s.Unlock()
+
+	prefixes := map[string]string{}
+	for i, c := range s.configs {
+		prefix := labelPrefix(c)
+		if prefix == "" {
+			continue
+		}
+		for _, job := range s.entryJobs(i) {
+			if _, ok := prefixes[job]; !ok {
+				prefixes[job] = prefix
+			}
+		}
+	}
+	return prefixes
+}
+
+// MaxLabelValueLengths returns the max_label_value_length of each job with
+// an entry setting one, taken from its first such entry.
+func (s *discoveryScheduler) MaxLabelValueLengths() map[string]int {
+	s.Lock()
+	defer s.Unlock()
+
+	lengths := map[string]int{}
+	for i, c := range s.configs {
+		if c.MaxLabelValueLen == nil {
+			continue
+		}
+		for _, job := range s.entryJobs(i) {
+			if _, ok := lengths[job]; !ok {
+				lengths[job] = *c.MaxLabelValueLen
+			}
+		}
+	}
+	return lengths
+}
+
+// OmittedJobLabels returns the jobs with an entry setting emit_job_label to
+// false, whose targets are written without their job label.
+func (s *discoveryScheduler) OmittedJobLabels() map[string]bool {
+	s.Lock()
+	defer s.Unlock()
+
+	omit := map[string]bool{}
+	for i, c := range s.configs {
+		if emitJobLabel(c) {
+			continue
+		}
+		for _, job := range s.entryJobs(i) {
+			omit[job] = true
+		}
+	}
+	return omit
+}
+
+func (s *discoveryScheduler) targetList() []DiscoveryTarget {
+	targets := []DiscoveryTarget{}
+	for i, ts := range s.targets {
+		targets = append(targets, ts...)
+		targets = append(targets, tombstoneTargets(s.tombstones[i])...)
+	}
+	return targets
+}
+
+// TargetsByFile returns the most recently discovered targets grouped by the
+// file they are written to, which is defaultFile for entries which do not
+// set an output. defaultFile is always included, even with no targets.
+// Removed targets within their removed_target_ttl are included.
+func (s *discoveryScheduler) TargetsByFile(defaultFile string) map[string][]DiscoveryTarget {
+	s.Lock()
+	defer s.Unlock()
+
+	byFile := map[string][]DiscoveryTarget{defaultFile: {}}
+	for i, c := range s.configs {
+		file := c.Output
+		if file == "" {
+			file = defaultFile
+		}
+		byFile[file] = append(byFile[file], s.targets[i]...)
+		byFile[file] = append(byFile[file], tombstoneTargets(s.tombstones[i])...)
+	}
+	return byFile
+}
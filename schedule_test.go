@@ -0,0 +1,171 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestDiscoverySchedulerIntervals(t *testing.T) {
+	instances := map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+			testInstance("db-1", "us-central1-b", "10.0.0.2", "db"),
+		},
+	}
+	calls := map[string]int{}
+	listInstances = fakeListInstances(calls, instances)
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}, Interval: time.Minute},
+		{Job: "db", Tags: []string{"db"}, Project: "test-project", Ports: []int{5432}, Interval: 5 * time.Minute},
+	}
+	scheduler := newDiscoveryScheduler(configs, 30*time.Second)
+
+	if tick := scheduler.TickInterval(); tick != 30*time.Second {
+		t.Fatalf("Unexpected tick interval %v", tick)
+	}
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	steps := []struct {
+		offset     time.Duration
+		force      bool
+		discovered bool
+		calls      int
+		expected   map[string][]string
+	}{
+		{ // Everything is due on the first sync
+			offset:     0,
+			discovered: true,
+			calls:      1,
+			expected:   map[string][]string{"web": {"10.0.0.1:80"}, "db": {"10.0.0.2:5432"}},
+		},
+		{ // Nothing is due, the project is not listed
+			offset:     30 * time.Second,
+			discovered: false,
+			calls:      1,
+			expected:   map[string][]string{"web": {"10.0.0.1:80"}, "db": {"10.0.0.2:5432"}},
+		},
+		{ // Only web is due, db keeps its last targets
+			offset:     time.Minute,
+			discovered: true,
+			calls:      2,
+			expected:   map[string][]string{"web": {"10.0.0.1:80", "10.0.0.3:80"}, "db": {"10.0.0.2:5432"}},
+		},
+		{ // Both are due, sharing a single listing
+			offset:     5 * time.Minute,
+			discovered: true,
+			calls:      3,
+			expected:   map[string][]string{"web": {"10.0.0.1:80", "10.0.0.3:80"}, "db": {"10.0.0.2:5432", "10.0.0.4:5432"}},
+		},
+		{ // Forcing discovers everything immediately
+			offset:     5*time.Minute + time.Second,
+			force:      true,
+			discovered: true,
+			calls:      4,
+			expected:   map[string][]string{"web": {"10.0.0.1:80", "10.0.0.3:80"}, "db": {"10.0.0.2:5432", "10.0.0.4:5432"}},
+		},
+	}
+
+	for i, s := range steps {
+		if i == 2 {
+			instances["test-project"] = append(instances["test-project"],
+				testInstance("web-2", "us-central1-b", "10.0.0.3", "web"),
+				testInstance("db-2", "us-central1-b", "10.0.0.4", "db"),
+			)
+		}
+
+		discovered, err := scheduler.Sync(context.Background(), start.Add(s.offset), s.force)
+		if err != nil {
+			t.Fatalf("Unexpected error in step %v\nError: %v", i, err)
+		}
+		if discovered != s.discovered {
+			t.Fatalf("Unexpected discovery in step %v: %v", i, discovered)
+		}
+		if calls["test-project"] != s.calls {
+			t.Fatalf("Unexpected listing count in step %v: %v", i, calls["test-project"])
+		}
+		if got := targetsByJob(scheduler.Targets()); !reflect.DeepEqual(got, s.expected) {
+			t.Fatalf("Discrepancy in result in step %v\nResult: %v", i, prettyPrint(got))
+		}
+	}
+}
+
+func TestDiscoverySchedulerPartialFailure(t *testing.T) {
+	list := fakeListInstances(map[string]int{}, map[string][]*compute.Instance{
+		"web-project": {testInstance("web-1", "us-central1-b", "10.0.0.1", "web")},
+		"db-project":  {testInstance("db-1", "us-central1-b", "10.0.0.2", "db")},
+	})
+	var scheduler *discoveryScheduler
+	listInstances = func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		// The scheduler is not locked while listing.
+		done := make(chan struct{})
+		go func() {
+			scheduler.Targets()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			return nil, errors.New("scheduler locked while listing")
+		}
+		return list(ctx, project, filter, credentialsFile)
+	}
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "web", Tags: []string{"web"}, Project: "web-project", Ports: []int{80}},
+		{Job: "db", Tags: []string{"db"}, Project: "db-project", Ports: []int{5432}},
+	}
+	scheduler = newDiscoveryScheduler(configs, time.Minute)
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	if _, err := scheduler.Sync(context.Background(), start, true); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	// The failing entry keeps its targets while the other is updated.
+	listInstances = func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		if project == "db-project" {
+			return nil, errors.New("permission denied")
+		}
+		return []*compute.Instance{testInstance("web-2", "us-central1-b", "10.0.0.3", "web")}, nil
+	}
+	discovered, err := scheduler.Sync(context.Background(), start.Add(time.Minute), false)
+	if err == nil || err.Error() != "Failed to list instances in db-project: permission denied" {
+		t.Fatalf("Expected db-project to fail\nError: %v", err)
+	}
+	if !discovered {
+		t.Fatal("Expected the web entry to be discovered")
+	}
+	expected := map[string][]string{"web": {"10.0.0.3:80"}, "db": {"10.0.0.2:5432"}}
+	if got := targetsByJob(scheduler.Targets()); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(got))
+	}
+	if due := scheduler.due(start.Add(time.Minute+time.Second), false); !reflect.DeepEqual(due, []int{1}) {
+		t.Fatalf("Expected only the failed entry to stay due, got %v", due)
+	}
+}
+
+func TestDiscoverySchedulerReplacedWhileDiscovering(t *testing.T) {
+	var scheduler *discoveryScheduler
+	listInstances = func(ctx context.Context, project, filter, credentialsFile string) ([]*compute.Instance, error) {
+		scheduler.SetConfigs([]SearchConfig{})
+		return []*compute.Instance{testInstance("web-1", "us-central1-b", "10.0.0.1", "web")}, nil
+	}
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{{Job: "web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}}}
+	scheduler = newDiscoveryScheduler(configs, time.Minute)
+	discovered, err := scheduler.Sync(context.Background(), time.Now(), true)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if discovered || len(scheduler.Targets()) != 0 {
+		t.Fatalf("Expected the targets of the replaced config to be dropped\nResult: %v", prettyPrint(scheduler.Targets()))
+	}
+}
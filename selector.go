@@ -0,0 +1,105 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Operators of a labelRequirement.
+const (
+	labelOpExists    = "exists"
+	labelOpNotExists = "!"
+	labelOpEquals    = "="
+	labelOpNotEquals = "!="
+	labelOpIn        = "in"
+	labelOpNotIn     = "notin"
+)
+
+var (
+	labelKeyExpr   = `[\p{Ll}\p{Lo}][\p{Ll}\p{Lo}\p{N}_-]*`
+	labelValueExpr = `[\p{Ll}\p{Lo}\p{N}_-]*`
+
+	labelExistsPattern   = regexp.MustCompile(`^(!?)\s*(` + labelKeyExpr + `)$`)
+	labelEqualityPattern = regexp.MustCompile(`^(` + labelKeyExpr + `)\s*(==|=|!=)\s*(` + labelValueExpr + `)$`)
+	labelSetPattern      = regexp.MustCompile(`^(` + labelKeyExpr + `)\s+(in|notin)\s*\(([^()]*)\)$`)
+	labelValuePattern    = regexp.MustCompile(`^` + labelValueExpr + `$`)
+)
+
+// labelRequirement is a single parsed label selector expression, such as
+// "env in (prod,canary)" or "!quarantine".
+type labelRequirement struct {
+	key    string
+	op     string
+	values []string
+}
+
+// parseLabelSelector parses a label selector expression. The accepted forms
+// are "key", "!key", "key=value", "key!=value", "key in (v1,v2)" and
+// "key notin (v1,v2)".
+func parseLabelSelector(expr string) (labelRequirement, error) {
+	expr = strings.TrimSpace(expr)
+
+	if m := labelExistsPattern.FindStringSubmatch(expr); m != nil {
+		if m[1] == "!" {
+			return labelRequirement{key: m[2], op: labelOpNotExists}, nil
+		}
+		return labelRequirement{key: m[2], op: labelOpExists}, nil
+	}
+
+	if m := labelEqualityPattern.FindStringSubmatch(expr); m != nil {
+		op := labelOpEquals
+		if m[2] == "!=" {
+			op = labelOpNotEquals
+		}
+		return labelRequirement{key: m[1], op: op, values: []string{m[3]}}, nil
+	}
+
+	if m := labelSetPattern.FindStringSubmatch(expr); m != nil {
+		values := []string{}
+		for _, v := range strings.Split(m[3], ",") {
+			v = strings.TrimSpace(v)
+			if !labelValuePattern.MatchString(v) {
+				return labelRequirement{}, errors.Errorf("Invalid label selector %q, bad value %q", expr, v)
+			}
+			values = append(values, v)
+		}
+		if len(values) == 1 && values[0] == "" {
+			return labelRequirement{}, errors.Errorf("Invalid label selector %q, no values given", expr)
+		}
+		return labelRequirement{key: m[1], op: m[2], values: values}, nil
+	}
+
+	return labelRequirement{}, errors.Errorf("Invalid label selector %q", expr)
+}
+
+// matches reports whether labels satisfy r.
+func (r labelRequirement) matches(labels map[string]string) bool {
+	v, ok := labels[r.key]
+	switch r.op {
+	case labelOpExists:
+		return ok
+	case labelOpNotExists:
+		return !ok
+	case labelOpEquals:
+		return ok && v == r.values[0]
+	case labelOpNotEquals:
+		return !ok || v != r.values[0]
+	case labelOpIn:
+		return ok && stringInSlice(v, r.values)
+	case labelOpNotIn:
+		return !ok || !stringInSlice(v, r.values)
+	}
+	return false
+}
+
+// labelRequirementsMatch reports whether labels satisfy every one of reqs.
+func labelRequirementsMatch(reqs []labelRequirement, labels map[string]string) bool {
+	for _, r := range reqs {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		expr     string
+		expected labelRequirement
+		err      bool
+	}{
+		{expr: "env", expected: labelRequirement{key: "env", op: labelOpExists}},
+		{expr: "!quarantine", expected: labelRequirement{key: "quarantine", op: labelOpNotExists}},
+		{expr: "env=prod", expected: labelRequirement{key: "env", op: labelOpEquals, values: []string{"prod"}}},
+		{expr: "env == prod", expected: labelRequirement{key: "env", op: labelOpEquals, values: []string{"prod"}}},
+		{expr: "env!=prod", expected: labelRequirement{key: "env", op: labelOpNotEquals, values: []string{"prod"}}},
+		{expr: "env in (prod, canary)", expected: labelRequirement{key: "env", op: labelOpIn, values: []string{"prod", "canary"}}},
+		{expr: " env notin (dev) ", expected: labelRequirement{key: "env", op: labelOpNotIn, values: []string{"dev"}}},
+		{expr: "env in ()", err: true},
+		{expr: "env in prod", err: true},
+		{expr: "env in (Prod)", err: true},
+		{expr: "Env", err: true},
+		{expr: "env ~ prod", err: true},
+		{expr: "", err: true},
+	}
+
+	for _, c := range cases {
+		req, err := parseLabelSelector(c.expr)
+		if c.err {
+			if err == nil || !strings.Contains(err.Error(), c.expr) {
+				t.Fatalf("Expected an error naming %q\nError: %v", c.expr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %q\nError: %v", c.expr, err)
+		}
+		if !reflect.DeepEqual(req, c.expected) {
+			t.Fatalf("Discrepancy in result for %q\nResult: %+v", c.expr, req)
+		}
+	}
+}
+
+func TestLoadConfigFileLabelSelectors(t *testing.T) {
+	t.Parallel()
+
+	_, err := LoadConfigFile("./test/config_label_selectors.yaml")
+	if err == nil || !strings.Contains(err.Error(), `(job "api_broken"): Invalid label selector "env in prod"`) {
+		t.Fatalf("Expected error naming the job and expression\nError: %v", err)
+	}
+	if strings.Contains(err.Error(), `job "api"`) {
+		t.Fatalf("Unexpected error for the valid job\nError: %v", err)
+	}
+}
+
+func TestDiscoverComputeByTagsLabelSelectors(t *testing.T) {
+	t.Parallel()
+
+	withLabels := func(name string, labels map[string]string) *compute.Instance {
+		i := testInstance(name, "us-central1-b", "10.0.0.1", "api")
+		i.Labels = labels
+		return i
+	}
+	instances := []*compute.Instance{
+		withLabels("prod", map[string]string{"env": "prod"}),
+		withLabels("canary", map[string]string{"env": "canary"}),
+		withLabels("prod-quarantined", map[string]string{"env": "prod", "quarantine": ""}),
+		withLabels("dev", map[string]string{"env": "dev"}),
+		withLabels("unlabelled", nil),
+	}
+
+	cases := []struct {
+		selectors []string
+		expected  []string
+	}{
+		{selectors: []string{"env in (prod,canary)"}, expected: []string{"prod", "canary", "prod-quarantined"}},
+		{selectors: []string{"env in (prod,canary)", "!quarantine"}, expected: []string{"prod", "canary"}},
+		{selectors: []string{"env notin (prod)"}, expected: []string{"canary", "dev", "unlabelled"}},
+		{selectors: []string{"quarantine"}, expected: []string{"prod-quarantined"}},
+		{selectors: []string{"env"}, expected: []string{"prod", "canary", "prod-quarantined", "dev"}},
+		{selectors: []string{"env!=dev", "env"}, expected: []string{"prod", "canary", "prod-quarantined"}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(strings.Join(c.selectors, ","), func(t *testing.T) {
+			t.Parallel()
+
+			config := SearchConfig{Tags: []string{"api"}, LabelSelectors: c.selectors}
+			if err := compileConfig(&config); err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			res, err := DiscoverComputeByTags(context.Background(), instances, config)
+			if err != nil {
+				t.Fatalf("Unexpected error\nError: %v", err)
+			}
+
+			if names := instanceNames(res); !reflect.DeepEqual(names, c.expected) {
+				t.Fatalf("Discrepancy in result\nResult: %v", prettyPrint(names))
+			}
+		})
+	}
+}
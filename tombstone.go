@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Labels marking targets kept in the output after they stopped being
+// discovered, for the removed_target_ttl of their job.
+const (
+	tombstoneLabel        = "__meta_gce_tombstone"
+	removedTimestampLabel = "__meta_gce_removed_timestamp"
+)
+
+// tombstone is a target which stopped being discovered at removed.
+type tombstone struct {
+	target  DiscoveryTarget
+	removed time.Time
+}
+
+// isTombstone reports whether t was removed from discovery and is only kept
+// for its job's removed_target_ttl.
+func isTombstone(t DiscoveryTarget) bool {
+	return t.Labels[tombstoneLabel] == "true"
+}
+
+// liveTargets returns the targets which are not tombstones.
+func liveTargets(targets []DiscoveryTarget) []DiscoveryTarget {
+	live := []DiscoveryTarget{}
+	for _, t := range targets {
+		if !isTombstone(t) {
+			live = append(live, t)
+		}
+	}
+	return live
+}
+
+// tombstoneKey identifies t by its addresses and labels, so a target whose
+// labels change is tombstoned with its old labels. The instance age, which
+// changes on every discovery, is left out.
+func tombstoneKey(t DiscoveryTarget) string {
+	labels := t.Labels
+	if _, ok := labels["__meta_gce_instance_age_seconds"]; ok {
+		labels = copyLabels(labels)
+		delete(labels, "__meta_gce_instance_age_seconds")
+	}
+	return strings.Join(t.Targets, ",") + "\x00" + labelsKey(labels)
+}
+
+// updateTombstones returns the tombstones to keep after discovering current
+// at now, when previous were the targets discovered before. Targets missing
+// from current are tombstoned, and tombstones whose targets were discovered
+// again or which are older than ttl are dropped.
+func updateTombstones(tombstones []tombstone, previous, current []DiscoveryTarget, now time.Time, ttl time.Duration) []tombstone {
+	discovered := map[string]bool{}
+	for _, t := range current {
+		discovered[tombstoneKey(t)] = true
+	}
+
+	kept := []tombstone{}
+	for _, t := range tombstones {
+		if !discovered[tombstoneKey(t.target)] {
+			kept = append(kept, t)
+		}
+	}
+	for _, t := range previous {
+		if !discovered[tombstoneKey(t)] {
+			kept = append(kept, tombstone{target: t, removed: now})
+		}
+	}
+	return expireTombstones(kept, now, ttl)
+}
+
+// expireTombstones returns the tombstones removed less than ttl before now.
+func expireTombstones(tombstones []tombstone, now time.Time, ttl time.Duration) []tombstone {
+	kept := []tombstone{}
+	for _, t := range tombstones {
+		if now.Before(t.removed.Add(ttl)) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
+
+// tombstoneTargets returns the targets of tombstones labelled as removed.
+func tombstoneTargets(tombstones []tombstone) []DiscoveryTarget {
+	targets := []DiscoveryTarget{}
+	for _, t := range tombstones {
+		labels := make(map[string]string, len(t.target.Labels)+2)
+		for k, v := range t.target.Labels {
+			labels[k] = v
+		}
+		labels[tombstoneLabel] = "true"
+		labels[removedTimestampLabel] = strconv.FormatInt(t.removed.Unix(), 10)
+		targets = append(targets, DiscoveryTarget{Targets: t.target.Targets, Labels: labels})
+	}
+	return targets
+}
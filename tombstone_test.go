@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	compute "google.golang.org/api/compute/v1"
+)
+
+func TestDiscoverySchedulerTombstones(t *testing.T) {
+	instances := map[string][]*compute.Instance{
+		"test-project": {
+			testInstance("web-1", "us-central1-b", "10.0.0.1", "web"),
+		},
+	}
+	calls := map[string]int{}
+	listInstances = fakeListInstances(calls, instances)
+	defer func() { listInstances = listAllInstances }()
+
+	configs := []SearchConfig{
+		{Job: "web", Tags: []string{"web"}, Project: "test-project", Ports: []int{80}, RemovedTargetTTL: 10 * time.Minute},
+	}
+	scheduler := newDiscoveryScheduler(configs, time.Minute)
+
+	start := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	removed := start.Add(time.Minute)
+	steps := []struct {
+		offset     time.Duration
+		instances  []*compute.Instance
+		discovered bool
+		live       []string
+		tombstoned []string
+		count      float64
+	}{
+		{ // The instance appears
+			offset:     0,
+			instances:  []*compute.Instance{testInstance("web-1", "us-central1-b", "10.0.0.1", "web")},
+			discovered: true,
+			live:       []string{"10.0.0.1:80"},
+			count:      1,
+		},
+		{ // It disappears and is tombstoned
+			offset:     time.Minute,
+			instances:  []*compute.Instance{},
+			discovered: true,
+			tombstoned: []string{"10.0.0.1:80"},
+			count:      0,
+		},
+		{ // Nothing is due, the tombstone is kept
+			offset:     time.Minute + 30*time.Second,
+			instances:  []*compute.Instance{},
+			discovered: false,
+			tombstoned: []string{"10.0.0.1:80"},
+			count:      0,
+		},
+		{ // Discovery keeps the tombstone until its TTL passes
+			offset:     10*time.Minute + 30*time.Second,
+			instances:  []*compute.Instance{},
+			discovered: true,
+			tombstoned: []string{"10.0.0.1:80"},
+			count:      0,
+		},
+		{ // It expires even though nothing is due
+			offset:     11 * time.Minute,
+			instances:  []*compute.Instance{},
+			discovered: true,
+			count:      0,
+		},
+	}
+
+	for i, s := range steps {
+		instances["test-project"] = s.instances
+
+		discovered, err := scheduler.Sync(context.Background(), start.Add(s.offset), false)
+		if err != nil {
+			t.Fatalf("Unexpected error in step %v\nError: %v", i, err)
+		}
+		if discovered != s.discovered {
+			t.Fatalf("Unexpected discovery in step %v: %v", i, discovered)
+		}
+
+		live, tombstoned := []string{}, []string{}
+		for _, target := range scheduler.Targets() {
+			if !isTombstone(target) {
+				live = append(live, target.Targets...)
+				continue
+			}
+			if ts := target.Labels[removedTimestampLabel]; ts != strconv.FormatInt(removed.Unix(), 10) {
+				t.Fatalf("Unexpected removal timestamp in step %v: %v", i, ts)
+			}
+			tombstoned = append(tombstoned, target.Targets...)
+		}
+		if len(s.live) == 0 {
+			s.live = []string{}
+		}
+		if len(s.tombstoned) == 0 {
+			s.tombstoned = []string{}
+		}
+		if !reflect.DeepEqual(live, s.live) || !reflect.DeepEqual(tombstoned, s.tombstoned) {
+			t.Fatalf("Discrepancy in result in step %v\nLive: %v\nTombstoned: %v", i, live, tombstoned)
+		}
+		if got := gaugeValue(targetCount.WithLabelValues("web")); got != s.count {
+			t.Fatalf("Unexpected target count in step %v: %v", i, got)
+		}
+		if consul := scheduler.TargetsMatching(func(SearchConfig) bool { return true }); len(consul) != len(s.live) {
+			t.Fatalf("Expected only live targets to match in step %v, got %v", i, prettyPrint(consul))
+		}
+	}
+}
+
+func TestUpdateTombstones(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	target := func(addr string) DiscoveryTarget {
+		return DiscoveryTarget{Targets: []string{addr}, Labels: map[string]string{"job": "web"}}
+	}
+
+	tombstones := updateTombstones(nil, []DiscoveryTarget{target("10.0.0.1:80"), target("10.0.0.2:80")}, []DiscoveryTarget{target("10.0.0.2:80")}, now, time.Minute)
+	if len(tombstones) != 1 || tombstones[0].target.Targets[0] != "10.0.0.1:80" {
+		t.Fatalf("Unexpected tombstones %v", tombstones)
+	}
+
+	// A target which is discovered again is no longer a tombstone.
+	tombstones = updateTombstones(tombstones, []DiscoveryTarget{target("10.0.0.2:80")}, []DiscoveryTarget{target("10.0.0.1:80"), target("10.0.0.2:80")}, now.Add(time.Second), time.Minute)
+	if len(tombstones) != 0 {
+		t.Fatalf("Unexpected tombstones %v", tombstones)
+	}
+
+	// A target whose labels change is tombstoned with its old labels, as is
+	// each of two targets sharing an address.
+	moved := target("10.0.0.1:80")
+	moved.Labels = map[string]string{"job": "web", "__meta_gce_instance_zone": "us-central1-c"}
+	tombstones = updateTombstones(nil, []DiscoveryTarget{target("10.0.0.1:80")}, []DiscoveryTarget{moved}, now, time.Minute)
+	if len(tombstones) != 1 || !reflect.DeepEqual(tombstones[0].target.Labels, map[string]string{"job": "web"}) {
+		t.Fatalf("Unexpected tombstones %v", tombstones)
+	}
+	tombstones = updateTombstones(nil, []DiscoveryTarget{target("10.0.0.1:80"), moved}, []DiscoveryTarget{}, now, time.Minute)
+	if len(tombstones) != 2 {
+		t.Fatalf("Expected a tombstone per label set, got %v", tombstones)
+	}
+
+	// The instance age changing alone does not tombstone a target.
+	aged := func(age string) DiscoveryTarget {
+		t := target("10.0.0.1:80")
+		t.Labels["__meta_gce_instance_age_seconds"] = age
+		return t
+	}
+	if tombstones = updateTombstones(nil, []DiscoveryTarget{aged("60")}, []DiscoveryTarget{aged("120")}, now, time.Minute); len(tombstones) != 0 {
+		t.Fatalf("Unexpected tombstones %v", tombstones)
+	}
+
+	targets := tombstoneTargets([]tombstone{{target: target("10.0.0.1:80"), removed: now}})
+	if !isTombstone(targets[0]) || len(liveTargets(targets)) != 0 {
+		t.Fatalf("Expected a tombstone, got %v", prettyPrint(targets))
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/net/context"
+)
+
+// watchConfig watches the config file at path, sending on the returned
+// channel once changes have settled for debounce. The containing directory
+// is watched rather than the file, so that replacing the file by rename, or
+// by swapping a symlink as Kubernetes does for ConfigMap mounts, is noticed.
+// Notifications are coalesced, so a file which keeps changing results in at
+// most one pending reload.
+func watchConfig(ctx context.Context, path string, debounce time.Duration) (<-chan struct{}, error) {
+	if isRemoteConfig(path) {
+		return nil, errors.Errorf("Unable to watch remote config %v", path)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unable to create config watcher")
+	}
+
+	path = filepath.Clean(path)
+	dir := filepath.Dir(path)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, errors.Wrapf(err, "Unable to watch %v", dir)
+	}
+
+	changes := make(chan struct{}, 1)
+	target, _ := filepath.EvalSymlinks(path)
+
+	go func() {
+		defer watcher.Close()
+
+		var settled <-chan time.Time
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-watcher.Events:
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+
+				newTarget, _ := filepath.EvalSymlinks(path)
+				if filepath.Clean(event.Name) != path && newTarget == target {
+					continue
+				}
+				target = newTarget
+
+				log.V(2).Infof("Config %v changed: %v", path, event)
+				settled = time.After(debounce)
+			case err := <-watcher.Errors:
+				log.Warningf("Error watching config %v: %v", path, err)
+			case <-settled:
+				settled = nil
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+
+	return changes, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const testDebounce = 50 * time.Millisecond
+
+func expectReload(t *testing.T, changes <-chan struct{}, expected bool, step string) {
+	select {
+	case <-changes:
+		if !expected {
+			t.Fatalf("Unexpected reload after %v", step)
+		}
+	case <-time.After(10 * testDebounce):
+		if expected {
+			t.Fatalf("Expected reload after %v", step)
+		}
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte("[]\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := watchConfig(ctx, path, testDebounce)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.yaml"), []byte("[]\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	expectReload(t, changes, false, "writing another file")
+
+	// A burst of in place edits is coalesced into a single reload.
+	for i := 0; i < 5; i++ {
+		if err := ioutil.WriteFile(path, []byte("[]\n"), 0644); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	expectReload(t, changes, true, "in place edits")
+	expectReload(t, changes, false, "coalesced in place edits")
+
+	tmp := filepath.Join(dir, "config.yaml.tmp")
+	if err := ioutil.WriteFile(tmp, []byte("[]\n"), 0644); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	expectReload(t, changes, true, "rename replacement")
+}
+
+func TestWatchConfigSymlinkSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcesd")
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Lay the directory out as a Kubernetes ConfigMap mount, where
+	// config.yaml links through ..data to a timestamped directory.
+	for _, d := range []string{"..v1", "..v2"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, d, "config.yaml"), []byte("[]\n"), 0644); err != nil {
+			t.Fatalf("Unexpected error\nError: %v", err)
+		}
+	}
+	if err := os.Symlink("..v1", filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := os.Symlink(filepath.Join("..data", "config.yaml"), path); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes, err := watchConfig(ctx, path, testDebounce)
+	if err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+
+	if err := os.Symlink("..v2", filepath.Join(dir, "..data_tmp")); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	if err := os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, "..data")); err != nil {
+		t.Fatalf("Unexpected error\nError: %v", err)
+	}
+	expectReload(t, changes, true, "swapping the ..data symlink")
+}
+
+func TestWatchConfigRemote(t *testing.T) {
+	if _, err := watchConfig(context.Background(), "gs://bucket/config.yaml", testDebounce); err == nil {
+		t.Fatalf("Expected an error watching a remote config")
+	}
+}